@@ -0,0 +1,8 @@
+-- the size of a repeated string is checked before it overflows.
+local ok, err = pcall(string.rep, "abc", 2^62)
+assert(not ok and err:find("resulting string too large"), err)
+ok, err = pcall(string.rep, ("x"):rep(1024), 2^53)
+assert(not ok and err:find("resulting string too large"), err)
+assert(string.rep("ab", 3) == "ababab")
+
+print("OK")
@@ -0,0 +1,20 @@
+-- a running script is aborted when its context is done.
+local err = timeout(50, [[while true do end]])
+assert(err and err:find("context deadline exceeded"), err)
+err = timeout(50, [[local x = 0 for i = 1, math.huge do x = x + i end]])
+assert(err and err:find("context deadline exceeded"), err)
+err = timeout(50, [[coroutine.wrap(function() while true do end end)()]])
+assert(err and err:find("context deadline exceeded"), err)
+assert(timeout(1000, [[x = 1]]) == nil and x == 1)
+
+-- a coroutine created with a context keeps it after the context is replaced.
+err = timeout(50, [[
+  co = coroutine.create(function() while true do coroutine.yield() end end)
+  coroutine.resume(co)
+  while true do end
+]])
+assert(err and err:find("context deadline exceeded"), err)
+local ok, err = coroutine.resume(co)
+assert(not ok and err:find("context deadline exceeded"), err)
+
+print("OK")
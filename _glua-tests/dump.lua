@@ -0,0 +1,22 @@
+-- functions dumped by string.dump are loaded back, including functions whose
+-- final RETURN can not be reached.
+local function roundtrip(f, ...)
+  local g = assert(load(string.dump(f)))
+  return g(...)
+end
+
+assert(roundtrip(function(a, b) return a + b end, 1, 2) == 3)
+assert(roundtrip(function() while true do return "loop" end end) == "loop")
+assert(roundtrip(function() repeat return "repeat" until false end) == "repeat")
+assert(roundtrip(function(n)
+  for i = 1, 10 do
+    if i == n then
+      return i
+    end
+  end
+end, 3) == 3)
+
+-- the loops never end, so the functions are only loaded.
+assert(load(string.dump(function() while true do end end)))
+assert(load(string.dump(function() repeat until false end)))
+assert(load(string.dump(function(x) while true do x = x + 1 end end)))
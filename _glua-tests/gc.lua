@@ -0,0 +1,21 @@
+-- collectgarbage("collect") calls __gc metamethods even while the collector is
+-- stopped.
+local finalized = 0
+local function garbage()
+  setmetatable({}, {__gc = function() finalized = finalized + 1 end})
+end
+
+collectgarbage("stop")
+assert(collectgarbage("isrunning") == false)
+for i = 1, 100 do garbage() end
+collectgarbage("collect")
+assert(finalized > 0, "not finalized")
+collectgarbage("restart")
+assert(collectgarbage("isrunning") == true)
+
+local pause = collectgarbage("setpause", 150)
+assert(collectgarbage("setpause", pause) == 150)
+local stepmul = collectgarbage("setstepmul", 400)
+assert(collectgarbage("setstepmul", stepmul) == 400)
+
+print("OK")
@@ -0,0 +1,17 @@
+-- the call hook is called once per call, not at backward jumps to the first
+-- instruction.
+local calls = 0
+function count() repeat n = n + 1 until n >= 3 end
+n = 0
+debug.sethook(function() calls = calls + 1 end, "c")
+count()
+debug.sethook()
+assert(calls == 2, tostring(calls)) -- count and debug.sethook
+
+-- errors in the call hook of a starting coroutine are returned by resume.
+local co = coroutine.create(function() end)
+debug.sethook(co, function() error("hook") end, "c")
+local ok, err = coroutine.resume(co)
+assert(not ok and err:find("hook"), err)
+
+print("OK")
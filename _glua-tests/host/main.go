@@ -0,0 +1,99 @@
+// Command host runs the regression scripts given as arguments. Each script
+// runs in a new state that has the functions below, which scripts use to call
+// the Go API of the state:
+//
+//	reload(name, patch) calls LState.ReloadModule and returns the module.
+//	pooled(code) runs code in a state of a StatePool that keeps one idle state
+//	and returns the first result as a string.
+//	timeout(ms, code) runs code with a context that is cancelled after ms
+//	milliseconds and returns the error message or nil.
+//	syntaxerrors(code) returns the messages of the errors that
+//	parse.ParseTolerant finds in code as an array.
+//	sandboxed(code) runs code in a new state that has only the libraries of
+//	LState.OpenSafeLibs and returns the first result as a string.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var pool = lua.NewStatePool(lua.StatePoolOptions{MaxIdle: 1})
+
+func main() {
+	status := 0
+	for _, script := range os.Args[1:] {
+		if err := run(script); err != nil {
+			fmt.Printf("%s: %v\n", script, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func run(script string) error {
+	L := lua.NewState()
+	defer L.Close()
+	L.Register("reload", func(L *lua.LState) int {
+		mod, err := L.ReloadModule(L.CheckString(1), lua.ReloadOptions{Patch: L.ToBool(2)})
+		if err != nil {
+			L.RaiseError("%v", err.Object)
+		}
+		L.Push(mod)
+		return 1
+	})
+	L.Register("pooled", func(L *lua.LState) int {
+		PL, err := pool.Get()
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		defer pool.Put(PL)
+		if err := PL.DoString(L.CheckString(1)); err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(lua.LString(PL.Get(1).String()))
+		return 1
+	})
+	L.Register("timeout", func(L *lua.LState) int {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(L.CheckInt(1))*time.Millisecond)
+		defer cancel()
+		oldctx := L.Context()
+		L.SetContext(ctx)
+		err := L.DoString(L.CheckString(2))
+		L.SetContext(oldctx)
+		if err != nil {
+			L.Push(lua.LString(err.Error()))
+			return 1
+		}
+		return 0
+	})
+	L.Register("syntaxerrors", func(L *lua.LState) int {
+		_, errs := parse.ParseTolerant(strings.NewReader(L.CheckString(1)), "<string>")
+		tb := L.NewTable()
+		for _, err := range errs {
+			tb.Append(lua.LString(err.Error()))
+		}
+		L.Push(tb)
+		return 1
+	})
+	L.Register("sandboxed", func(L *lua.LState) int {
+		SL := lua.NewState(lua.Options{SkipOpenLibs: true})
+		defer SL.Close()
+		SL.OpenSafeLibs()
+		if err := SL.DoString(L.CheckString(1)); err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(lua.LString(SL.Get(1).String()))
+		return 1
+	})
+	if err := L.DoFile(script); err != nil {
+		return err
+	}
+	return nil
+}
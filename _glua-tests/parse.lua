@@ -0,0 +1,21 @@
+-- parse.ParseTolerant reports the errors after the one it recovers from.
+local errs = syntaxerrors("local function() end\nlocal t = {1,2,,3}")
+assert(#errs == 2, tostring(#errs))
+assert(errs[1]:find("line:1") and errs[2]:find("line:2"), errs[2])
+for _, err in ipairs(errs) do
+  assert(not err:find("\n"), err)
+end
+
+errs = syntaxerrors("function f()\n  x = = 1\nend\nlocal a = {,}\nb = = 2")
+assert(#errs == 3, tostring(#errs))
+
+errs = syntaxerrors("x = 1 end\ny = 2")
+assert(#errs == 1 and errs[1]:find("near 'end'"), errs[1])
+assert(#syntaxerrors("local t = {1, 2; 3,}") == 0)
+
+-- empty fields are not allowed.
+assert(not loadstring("return {1,,2}"))
+assert(not loadstring("return {,}"))
+assert(#loadstring("return {1,2,}")() == 2)
+
+print("OK")
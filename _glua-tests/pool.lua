@@ -0,0 +1,16 @@
+-- changes made by a borrower of a pooled state must not be seen by the next
+-- borrower.
+pooled([[
+  x = 1
+  string.upper = nil
+  getmetatable("").__index = {}
+  package.preload.leak = function() return {} end
+  package.loaded.leak = {}
+  debug.sethook(function() end, "l")
+]])
+assert(pooled([[return x == nil]]) == "true")
+assert(pooled([[return string.upper ~= nil and ("a"):upper()]]) == "A")
+assert(pooled([[return package.preload.leak == nil and package.loaded.leak == nil]]) == "true")
+assert(pooled([[return debug.gethook() == nil]]) == "true")
+
+print("OK")
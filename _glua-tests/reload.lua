@@ -0,0 +1,54 @@
+-- functions that are running when their module is patched finish with their
+-- old code, and later calls run the new code.
+local version = 0
+package.preload.m = function()
+  version = version + 1
+  local M = {}
+  local calls = 0
+  if version == 1 then
+    function M.run()
+      calls = calls + 1
+      local a, b, c = 1, 2, 3
+      reload("m", true)
+      local s = 0
+      for i = 1, 10 do
+        s = s + i
+      end
+      return a + b + c + s
+    end
+    function M.gen()
+      coroutine.yield(1)
+      local x, y = 2, 3
+      coroutine.yield(x + y)
+      return "old"
+    end
+  else
+    function M.run()
+      calls = calls + 1
+      return "new", calls
+    end
+    function M.gen()
+      return "new"
+    end
+  end
+  return M
+end
+
+local m = require("m")
+local co = coroutine.wrap(m.gen)
+assert(co() == 1)
+local run = m.run
+assert(run() == 61)
+assert(co() == 5)
+assert(co() == "old")
+-- the new functions share the upvalues of the old ones.
+local v, calls = m.run()
+assert(v == "new" and calls == 2)
+assert(m.gen() == "new")
+
+-- functions that are not running are patched in place.
+local run2 = m.run
+reload("m", true)
+assert(m.run == run2)
+local r, n = run2()
+assert(r == "new" and n == 3)
@@ -0,0 +1,19 @@
+-- OpenSafeLibs does not load binary chunks, which are not verified.
+local bin = string.dump(function() return 1 end)
+
+assert(sandboxed([[return string.dump == nil]]) == "true")
+assert(sandboxed([[return load("return 1")()]]) == "1")
+assert(sandboxed([[return loadstring("return 2")()]]) == "2")
+
+local ok, err = pcall(sandboxed, string.format([[
+  local f, err = load(%q, "b", "b")
+  assert(f == nil and err:find("binary"), err)
+  f, err = load(%q)
+  assert(f == nil and err:find("binary"), err)
+  f, err = loadstring(%q)
+  assert(f == nil and err:find("binary"), err)
+  return "ok"
+]], bin, bin, bin))
+assert(ok, err)
+
+print("OK")
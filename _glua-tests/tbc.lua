@@ -0,0 +1,81 @@
+-- every pending to-be-closed variable gets the error object when an error
+-- unwinds them.
+local log = {}
+local function closer(name, fail)
+  return setmetatable({}, {__close = function(_, err)
+    log[#log + 1] = name .. "=" .. tostring(err)
+    if fail then
+      error(fail, 0)
+    end
+  end})
+end
+local function check(expected)
+  assert(table.concat(log, " ") == expected, table.concat(log, " "))
+  log = {}
+end
+
+local ok, err = pcall(function()
+  local a <close> = closer("a")
+  local b <close> = closer("b")
+  local c <close> = closer("c")
+  error("oops", 0)
+end)
+assert(not ok and err == "oops")
+check("c=oops b=oops a=oops")
+
+ok, err = pcall(function()
+  local a <close> = closer("a")
+  do
+    local b <close> = closer("b")
+    do
+      local c <close> = closer("c")
+      error("oops", 0)
+    end
+  end
+end)
+assert(not ok and err == "oops")
+check("c=oops b=oops a=oops")
+
+local function inner()
+  local c <close> = closer("c")
+  error("oops", 0)
+end
+ok, err = pcall(function()
+  local a <close> = closer("a")
+  local b <close> = closer("b")
+  inner()
+end)
+assert(not ok and err == "oops")
+check("c=oops b=oops a=oops")
+
+-- an error raised by __close replaces the error for the remaining variables.
+ok, err = pcall(function()
+  local a <close> = closer("a")
+  local b <close> = closer("b", "fail")
+  local c <close> = closer("c")
+  error("oops", 0)
+end)
+assert(not ok and err == "fail")
+check("c=oops b=oops a=fail")
+
+-- variables of a coroutine that dies with an error are closed by
+-- coroutine.close.
+local co = coroutine.create(function()
+  local a <close> = closer("a")
+  local b <close> = closer("b")
+  coroutine.yield()
+  error("oops", 0)
+end)
+coroutine.resume(co)
+ok, err = coroutine.resume(co)
+assert(not ok and err == "oops")
+ok, err = coroutine.close(co)
+assert(not ok and err == "oops")
+check("b=oops a=oops")
+
+-- variables closed normally get nil.
+do
+  local a <close> = closer("a")
+  local b <close> = closer("b")
+end
+check("b=nil a=nil")
@@ -0,0 +1,259 @@
+package lua
+
+import (
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+)
+
+// approximate sizes(in bytes) of objects allocated by the VM.
+const (
+	memTableSize     = 80
+	memArraySlotSize = 16
+	memHashSlotSize  = 48
+	memStringSize    = 16
+	memUserDataSize  = 56
+	memFunctionSize  = 72
+	memUpvalueSize   = 40
+	memProtoSize     = 160
+	memCallFrameSize = 96
+	memThreadSize    = 160
+)
+
+type AllocStats struct {
+	// number of objects created
+	Tables    int64
+	Strings   int64
+	UserData  int64
+	Functions int64
+	Threads   int64
+	// estimated amount of memory(in bytes) allocated
+	Bytes int64
+}
+
+// Allocator is notified of allocations of the VM. An allocation fails with a
+// Lua error if Allocate returns an error.
+type Allocator interface {
+	Allocate(L *LState, typ LValueType, size int) error
+}
+
+func (ls *LState) allocateObject(typ LValueType, size int) {
+	// collectgarbage("stop") stops running __gc metamethods at allocations,
+	// the Go garbage collector is shared with the program and keeps running.
+	if !ls.G.gcStopped && atomic.LoadInt32(&ls.G.finalizers.pending) != 0 {
+		ls.runFinalizers()
+	}
+	stats := &ls.G.allocStats
+	switch typ {
+	case LTTable:
+		stats.Tables++
+	case LTString:
+		stats.Strings++
+	case LTUserData:
+		stats.UserData++
+	case LTFunction:
+		stats.Functions++
+	case LTThread:
+		stats.Threads++
+	}
+	ls.allocate(typ, size)
+}
+
+func (ls *LState) allocate(typ LValueType, size int) {
+	g := ls.G
+	g.allocStats.Bytes += int64(size)
+	if allocator := g.options.Allocator; allocator != nil {
+		if err := allocator.Allocate(ls, typ, size); err != nil {
+			ls.raiseError(0, "%v", err)
+		}
+	}
+	if g.memLimit <= 0 {
+		return
+	}
+	g.memEstimate += size
+	// the estimate includes garbage, measure the memory that is actually
+	// reachable from the state. The measurement walks all the objects, so it
+	// is repeated only after memRemeasureRatio of the limit is allocated,
+	// and the usage may exceed the limit by the amount until then.
+	if g.memEstimate > g.memLimit && g.memEstimate-g.memMeasured >= g.memLimit/memRemeasureRatio {
+		g.memEstimate = g.memoryUsage()
+		g.memMeasured = g.memEstimate
+		if g.memEstimate+size > g.memLimit {
+			ls.raiseError(0, "not enough memory")
+		}
+		g.memEstimate += size
+	}
+}
+
+// memRemeasureRatio is the ratio of the memory limit to the amount of memory
+// allocated between measurements of the memory usage.
+const memRemeasureRatio = 16
+
+func (ls *LState) allocateTable(acap, hcap int) *LTable {
+	ls.allocateObject(LTTable, memTableSize+intMax(acap, 0)*memArraySlotSize+intMax(hcap, 0)*memHashSlotSize)
+	if ls.G.options.OrderedTables {
+		return newOrderedLTable(acap, hcap)
+	}
+	return newLTable(acap, hcap)
+}
+
+func (ls *LState) allocateString(s string) LString {
+	ls.allocateObject(LTString, memStringSize+len(s))
+	return ls.G.strings.intern(s)
+}
+
+func threadMemorySize(th *LState) int {
+	return memThreadSize + len(th.reg.array)*memArraySlotSize + th.stack.Cap()*memCallFrameSize
+}
+
+type memoryCounter struct {
+	total   int
+	visited map[interface{}]bool
+	strings map[*byte]bool
+	stack   []LValue
+}
+
+func (mc *memoryCounter) markString(s string) {
+	if len(s) == 0 {
+		return
+	}
+	// strings that share the same memory are counted once
+	p := unsafe.StringData(s)
+	if mc.strings[p] {
+		return
+	}
+	mc.strings[p] = true
+	mc.total += len(s)
+}
+
+func (mc *memoryCounter) mark(lv LValue) {
+	switch v := lv.(type) {
+	case LString:
+		mc.markString(string(v))
+	case *LTable:
+		if v == nil || mc.visited[v] {
+			return
+		}
+		mc.visited[v] = true
+		mc.stack = append(mc.stack, v)
+	case *LFunction:
+		if v == nil || mc.visited[v] {
+			return
+		}
+		mc.visited[v] = true
+		mc.stack = append(mc.stack, v)
+	case *LUserData:
+		if v == nil || mc.visited[v] {
+			return
+		}
+		mc.visited[v] = true
+		mc.stack = append(mc.stack, v)
+	case *LState:
+		if v == nil || mc.visited[v] {
+			return
+		}
+		mc.visited[v] = true
+		mc.stack = append(mc.stack, v)
+	}
+}
+
+func (mc *memoryCounter) markProto(proto *FunctionProto) {
+	if proto == nil || mc.visited[proto] {
+		return
+	}
+	mc.visited[proto] = true
+	mc.total += memProtoSize + len(proto.Code)*4 + len(proto.Constants)*memArraySlotSize
+	for _, c := range proto.Constants {
+		mc.mark(c)
+	}
+	for _, p := range proto.FunctionPrototypes {
+		mc.markProto(p)
+	}
+}
+
+func (mc *memoryCounter) run() {
+	for len(mc.stack) > 0 {
+		lv := mc.stack[len(mc.stack)-1]
+		mc.stack = mc.stack[:len(mc.stack)-1]
+		switch v := lv.(type) {
+		case *LTable:
+			mc.total += memTableSize + cap(v.array)*memArraySlotSize + len(v.dict)*memHashSlotSize
+			mc.mark(v.Metatable)
+			for _, value := range v.array {
+				mc.mark(value)
+			}
+			for key, value := range v.dict {
+				mc.mark(key)
+				mc.mark(value)
+			}
+		case *LFunction:
+			mc.total += memFunctionSize + len(v.Upvalues)*memUpvalueSize
+			mc.mark(v.Env)
+			for _, uv := range v.Upvalues {
+				if uv != nil {
+					mc.mark(uv.Value())
+				}
+			}
+			mc.markProto(v.Proto)
+		case *LUserData:
+			mc.total += memUserDataSize
+			mc.mark(v.Env)
+			mc.mark(v.Metatable)
+		case *LState:
+			mc.total += threadMemorySize(v)
+			mc.mark(v.Env)
+			if v.Parent != nil {
+				mc.mark(v.Parent)
+			}
+			for i := 0; i < v.reg.Top(); i++ {
+				mc.mark(v.reg.array[i])
+			}
+			for i := 0; i < v.stack.Sp(); i++ {
+				mc.mark(v.stack.At(i).Fn)
+			}
+		}
+	}
+}
+
+// default values of collectgarbage("setpause") and collectgarbage("setstepmul").
+const (
+	gcDefaultPause   = 200
+	gcDefaultStepMul = 200
+)
+
+// collectGarbage runs the Go garbage collector and updates the memory estimate
+// of the state.
+func (ls *LState) collectGarbage() {
+	if ls.G.fieldCache != nil {
+		ls.G.fieldCache.reset()
+	}
+	runtime.GC()
+	waitFinalizers()
+	ls.runFinalizers()
+	if ls.G.memLimit > 0 {
+		ls.G.memEstimate = ls.G.memoryUsage()
+		ls.G.memMeasured = ls.G.memEstimate
+	}
+}
+
+// memoryUsage returns an estimated size of objects reachable from the state.
+func (g *Global) memoryUsage() int {
+	mc := &memoryCounter{
+		visited: make(map[interface{}]bool),
+		strings: make(map[*byte]bool),
+		stack:   make([]LValue, 0, 64),
+	}
+	mc.mark(g.Registry)
+	mc.mark(g.Global)
+	for _, mt := range g.builtinMts {
+		mc.mark(mt)
+	}
+	if g.MainThread != nil {
+		mc.mark(g.MainThread)
+	}
+	if g.CurrentThread != nil {
+		mc.mark(g.CurrentThread)
+	}
+	mc.run()
+	return mc.total
+}
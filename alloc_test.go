@@ -0,0 +1,96 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 1024 * 1024})
+	defer L.Close()
+	err := L.DoString(`
+	local t = {}
+	for i = 1, 1e7 do t[i] = {} end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Fatalf("got %v, want a memory error", err)
+	}
+	// the garbage of the failed script does not count.
+	if err := L.DoString(`local t = {} for i = 1, 1000 do t[i] = {} end`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryLimitOverwrite(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 256 * 1024})
+	defer L.Close()
+	// overwriting existing fields does not allocate.
+	err := L.DoString(`
+	local t = {x = 0}
+	for i = 1, 1e6 do t.x = i end
+	`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryLimitStringRep(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 1024 * 1024})
+	defer L.Close()
+	if err := L.DoString(`string.rep("x", 1e8)`); err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Errorf("got %v, want a memory error", err)
+	}
+	if err := L.DoString(`string.rep("abc", 2^62)`); err == nil || !strings.Contains(err.Error(), "resulting string too large") {
+		t.Errorf("got %v, want a size error", err)
+	}
+}
+
+func TestAllocStats(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	before := L.AllocStats()
+	err := L.DoString(`
+	local t = {}
+	for i = 1, 10 do t[i] = {} end
+	local f = function() end
+	local co = coroutine.create(f)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := L.AllocStats()
+	if n := after.Tables - before.Tables; n < 11 {
+		t.Errorf("got %v tables, want at least 11", n)
+	}
+	if after.Functions <= before.Functions || after.Threads <= before.Threads {
+		t.Errorf("got %+v, before %+v", after, before)
+	}
+	if after.Bytes <= before.Bytes {
+		t.Errorf("got %v bytes, before %v", after.Bytes, before.Bytes)
+	}
+}
+
+type tableQuota struct{ tables int }
+
+func (tq *tableQuota) Allocate(L *LState, typ LValueType, size int) error {
+	if typ != LTTable {
+		return nil
+	}
+	tq.tables++
+	if tq.tables > 100 {
+		return errors.New("too many tables")
+	}
+	return nil
+}
+
+func TestAllocator(t *testing.T) {
+	quota := &tableQuota{}
+	L := NewState(Options{Allocator: quota})
+	defer L.Close()
+	quota.tables = 0
+	err := L.DoString(`for i = 1, 1000 do local t = {} end`)
+	if err == nil || !strings.Contains(err.Error(), "too many tables") {
+		t.Errorf("got %v, want the error of the allocator", err)
+	}
+}
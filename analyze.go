@@ -0,0 +1,135 @@
+package lua
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GlobalAccess is a read or a write of a global variable in a compiled chunk.
+// Name is empty if the name is not a constant, for example _ENV[k].
+type GlobalAccess struct {
+	Name   string
+	Write  bool
+	Source string
+	Line   int
+	Column int
+}
+
+func (ga GlobalAccess) String() string {
+	kind := "read"
+	if ga.Write {
+		kind = "write"
+	}
+	name := "(dynamic)"
+	if len(ga.Name) > 0 {
+		name = fmt.Sprintf("'%v'", ga.Name)
+	}
+	return fmt.Sprintf("%v:%v:%v: %v of global %v", ga.Source, ga.Line, ga.Column, kind, name)
+}
+
+// FindGlobals returns the accesses of global variables in the function
+// prototype and its nested prototypes, ordered by their positions. When
+// Lua52Env is enabled, reading _ENV itself is reported as a read of the global
+// "_ENV".
+func FindGlobals(proto *FunctionProto) []GlobalAccess {
+	env := make([]bool, len(proto.DbgUpvalues))
+	for i, name := range proto.DbgUpvalues {
+		env[i] = name == envName
+	}
+	accesses := findGlobals(nil, proto, env)
+	sort.SliceStable(accesses, func(i, j int) bool {
+		if accesses[i].Line != accesses[j].Line {
+			return accesses[i].Line < accesses[j].Line
+		}
+		return accesses[i].Column < accesses[j].Column
+	})
+	return accesses
+}
+
+// CheckGlobals returns the accesses of global variables that are not in the
+// allowed names. Accesses with dynamic names are always returned.
+func CheckGlobals(proto *FunctionProto, allowed []string) []GlobalAccess {
+	names := make(map[string]bool, len(allowed))
+	for _, name := range allowed {
+		names[name] = true
+	}
+	var result []GlobalAccess
+	for _, access := range FindGlobals(proto) {
+		if len(access.Name) == 0 || !names[access.Name] {
+			result = append(result, access)
+		}
+	}
+	return result
+}
+
+// findGlobals appends the accesses in the prototype. env reports whether each
+// upvalue of the prototype is the global environment.
+func findGlobals(accesses []GlobalAccess, proto *FunctionProto, env []bool) []GlobalAccess {
+	isEnv := func(idx int) bool {
+		return idx < len(env) && env[idx]
+	}
+	constant := func(pc, rk int) string {
+		if opIsK(rk) {
+			if s, ok := proto.Constants[opIndexK(rk)].(LString); ok {
+				return string(s)
+			}
+			return ""
+		}
+		// envKey loads names that do not fit in an RK operand just before.
+		if pc > 0 {
+			prev := proto.Code[pc-1]
+			if opGetOpCode(prev) == OP_LOADK && opGetArgA(prev) == rk {
+				if s, ok := proto.Constants[opGetArgBx(prev)].(LString); ok {
+					return string(s)
+				}
+			}
+		}
+		return ""
+	}
+	add := func(pc int, name string, write bool) {
+		access := GlobalAccess{Name: name, Write: write, Source: proto.SourceName}
+		if pc < len(proto.DbgSourcePositions) {
+			access.Line = proto.DbgSourcePositions[pc]
+		}
+		if pc < len(proto.DbgSourceColumns) {
+			access.Column = proto.DbgSourceColumns[pc]
+		}
+		accesses = append(accesses, access)
+	}
+	for pc := 0; pc < len(proto.Code); pc++ {
+		inst := proto.Code[pc]
+		switch opGetOpCode(inst) {
+		case OP_GETGLOBAL, OP_SETGLOBAL:
+			name := ""
+			if s, ok := proto.Constants[opGetArgBx(inst)].(LString); ok {
+				name = string(s)
+			}
+			add(pc, name, opGetOpCode(inst) == OP_SETGLOBAL)
+		case OP_GETTABUP:
+			if isEnv(opGetArgB(inst)) {
+				add(pc, constant(pc, opGetArgC(inst)), false)
+			}
+		case OP_SETTABUP:
+			if isEnv(opGetArgA(inst)) {
+				add(pc, constant(pc, opGetArgB(inst)), true)
+			}
+		case OP_GETUPVAL:
+			if isEnv(opGetArgB(inst)) {
+				add(pc, envName, false)
+			}
+		case OP_CLOSURE:
+			child := proto.FunctionPrototypes[opGetArgBx(inst)]
+			childEnv := make([]bool, int(child.NumUpvalues))
+			// the upvalues of the closure are given by the pseudo instructions
+			// following OP_CLOSURE.
+			for i := range childEnv {
+				pc++
+				if pc < len(proto.Code) && opGetOpCode(proto.Code[pc]) == OP_GETUPVAL {
+					childEnv[i] = isEnv(opGetArgB(proto.Code[pc]))
+				}
+			}
+			accesses = findGlobals(accesses, child, childEnv)
+		}
+	}
+	return accesses
+}
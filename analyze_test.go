@@ -0,0 +1,38 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestFindGlobals(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	fn, err := L.LoadString(`local x = y
+z = 1
+local function f() return print(x) end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, access := range FindGlobals(fn.Proto) {
+		got = append(got, access.String())
+	}
+	want := []string{
+		"<string>:1:11: read of global 'y'",
+		"<string>:2:1: write of global 'z'",
+		"<string>:3:27: read of global 'print'",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got[i], want[i])
+		}
+	}
+
+	unknown := CheckGlobals(fn.Proto, []string{"print", "z"})
+	if len(unknown) != 1 || unknown[0].Name != "y" || unknown[0].Write {
+		t.Errorf("got %v, want the read of y", unknown)
+	}
+}
@@ -5,11 +5,14 @@ type PositionHolder interface {
   SetLine(int)
   LastLine() int
   SetLastLine(int)
+  Column() int
+  SetColumn(int)
 }
 
 type Node struct {
   line int
   lastline int
+  column int
 }
 
 func (self *Node) Line() int {
@@ -27,3 +30,11 @@ func (self *Node) LastLine() int {
 func (self *Node) SetLastLine(line int) {
   self.lastline = line
 }
+
+func (self *Node) Column() int {
+  return self.column
+}
+
+func (self *Node) SetColumn(column int) {
+  self.column = column
+}
@@ -0,0 +1,8 @@
+package ast
+
+// Comment is a comment in a chunk. Text includes the leading "--". Line and
+// LastLine are the first and the last line of the comment.
+type Comment struct {
+	Node
+	Text string
+}
@@ -129,6 +129,11 @@ type UnaryLenOpExpr struct {
 	Expr Expr
 }
 
+type UnaryBNotOpExpr struct {
+	ExprBase
+	Expr Expr
+}
+
 type FunctionExpr struct {
 	ExprBase
 
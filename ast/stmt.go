@@ -21,8 +21,9 @@ type AssignStmt struct {
 type LocalAssignStmt struct {
 	StmtBase
 
-	Names []string
-	Exprs []Expr
+	Names   []string
+	Attribs []string
+	Exprs   []Expr
 }
 
 type FuncCallStmt struct {
@@ -93,3 +94,15 @@ type ReturnStmt struct {
 type BreakStmt struct {
 	StmtBase
 }
+
+type GotoStmt struct {
+	StmtBase
+
+	Label string
+}
+
+type LabelStmt struct {
+	StmtBase
+
+	Name string
+}
@@ -0,0 +1,137 @@
+package ast
+
+// A Visitor's Visit method is invoked for each node encountered by Walk. If
+// the result visitor w is not nil, Walk visits each of the children of node
+// with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node PositionHolder) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order. Fields, parameter lists and
+// function names are not nodes, their expressions are visited as children of
+// the nodes holding them.
+func Walk(v Visitor, node PositionHolder) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *AttrGetExpr:
+		Walk(v, n.Object)
+		Walk(v, n.Key)
+	case *TableExpr:
+		for _, field := range n.Fields {
+			if field.Key != nil {
+				Walk(v, field.Key)
+			}
+			Walk(v, field.Value)
+		}
+	case *FuncCallExpr:
+		if n.Func != nil {
+			Walk(v, n.Func)
+		}
+		if n.Receiver != nil {
+			Walk(v, n.Receiver)
+		}
+		walkExprs(v, n.Args)
+	case *LogicalOpExpr:
+		Walk(v, n.Lhs)
+		Walk(v, n.Rhs)
+	case *RelationalOpExpr:
+		Walk(v, n.Lhs)
+		Walk(v, n.Rhs)
+	case *StringConcatOpExpr:
+		Walk(v, n.Lhs)
+		Walk(v, n.Rhs)
+	case *ArithmeticOpExpr:
+		Walk(v, n.Lhs)
+		Walk(v, n.Rhs)
+	case *UnaryMinusOpExpr:
+		Walk(v, n.Expr)
+	case *UnaryNotOpExpr:
+		Walk(v, n.Expr)
+	case *UnaryLenOpExpr:
+		Walk(v, n.Expr)
+	case *UnaryBNotOpExpr:
+		Walk(v, n.Expr)
+	case *FunctionExpr:
+		walkStmts(v, n.Stmts)
+
+	case *AssignStmt:
+		walkExprs(v, n.Lhs)
+		walkExprs(v, n.Rhs)
+	case *LocalAssignStmt:
+		walkExprs(v, n.Exprs)
+	case *FuncCallStmt:
+		Walk(v, n.Expr)
+	case *DoBlockStmt:
+		walkStmts(v, n.Stmts)
+	case *WhileStmt:
+		Walk(v, n.Condition)
+		walkStmts(v, n.Stmts)
+	case *RepeatStmt:
+		walkStmts(v, n.Stmts)
+		Walk(v, n.Condition)
+	case *IfStmt:
+		Walk(v, n.Condition)
+		walkStmts(v, n.Then)
+		walkStmts(v, n.Else)
+	case *NumberForStmt:
+		Walk(v, n.Init)
+		Walk(v, n.Limit)
+		if n.Step != nil {
+			Walk(v, n.Step)
+		}
+		walkStmts(v, n.Stmts)
+	case *GenericForStmt:
+		walkExprs(v, n.Exprs)
+		walkStmts(v, n.Stmts)
+	case *FuncDefStmt:
+		if n.Name != nil {
+			if n.Name.Func != nil {
+				Walk(v, n.Name.Func)
+			}
+			if n.Name.Receiver != nil {
+				Walk(v, n.Name.Receiver)
+			}
+		}
+		Walk(v, n.Func)
+	case *ReturnStmt:
+		walkExprs(v, n.Exprs)
+	}
+	v.Visit(nil)
+}
+
+func walkExprs(v Visitor, exprs []Expr) {
+	for _, expr := range exprs {
+		Walk(v, expr)
+	}
+}
+
+func walkStmts(v Visitor, stmts []Stmt) {
+	for _, stmt := range stmts {
+		Walk(v, stmt)
+	}
+}
+
+type inspector func(PositionHolder) bool
+
+func (f inspector) Visit(node PositionHolder) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order by calling f(node) for each
+// node. If f returns true, Inspect invokes f for the children of node,
+// followed by a call of f(nil).
+func Inspect(node PositionHolder, f func(PositionHolder) bool) {
+	Walk(inspector(f), node)
+}
+
+// InspectChunk calls Inspect for each statement of the chunk.
+func InspectChunk(chunk []Stmt, f func(PositionHolder) bool) {
+	for _, stmt := range chunk {
+		Inspect(stmt, f)
+	}
+}
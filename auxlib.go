@@ -22,6 +22,9 @@ func (ls *LState) CheckInt(n int) int {
 	if intv, ok := v.(LNumber); ok {
 		return int(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -31,6 +34,9 @@ func (ls *LState) CheckInt64(n int) int64 {
 	if intv, ok := v.(LNumber); ok {
 		return int64(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int64(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -40,6 +46,9 @@ func (ls *LState) CheckNumber(n int) LNumber {
 	if lv, ok := v.(LNumber); ok {
 		return lv
 	}
+	if lv, ok := v.(LInteger); ok {
+		return LNumber(lv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -142,6 +151,9 @@ func (ls *LState) OptInt(n int, d int) int {
 	if intv, ok := v.(LNumber); ok {
 		return int(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -154,6 +166,9 @@ func (ls *LState) OptInt64(n int, d int64) int64 {
 	if intv, ok := v.(LNumber); ok {
 		return int64(intv)
 	}
+	if intv, ok := v.(LInteger); ok {
+		return int64(intv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -166,6 +181,9 @@ func (ls *LState) OptNumber(n int, d LNumber) LNumber {
 	if lv, ok := v.(LNumber); ok {
 		return lv
 	}
+	if lv, ok := v.(LInteger); ok {
+		return LNumber(lv)
+	}
 	ls.TypeError(n, LTNumber)
 	return 0
 }
@@ -260,6 +278,9 @@ func (ls *LState) Where(level int) string {
 	line := ""
 	if proto != nil {
 		line = fmt.Sprintf("%v:", proto.DbgSourcePositions[cf.Pc-1])
+		if ls.G.options.IncludeColumnInErrors {
+			line += fmt.Sprintf("%v:", proto.DbgSourceColumns[cf.Pc-1])
+		}
 	}
 	return fmt.Sprintf("%v:%v", sourcename, line)
 }
@@ -322,6 +343,17 @@ func (ls *LState) RegisterModuleToTable(tbl LValue, funcs map[string]LGFunction)
 	return tb
 }
 
+// PreloadModule sets the loader to package.preload[name], so the module is
+// created when a script requires it for the first time. The loader is called
+// with the module name and returns the module.
+func (ls *LState) PreloadModule(name string, loader LGFunction) {
+	preload := ls.GetField(ls.GetField(ls.Get(EnvironIndex), "package"), "preload")
+	if _, ok := preload.(*LTable); !ok {
+		ls.RaiseError("package.preload must be a table")
+	}
+	ls.SetField(preload, name, ls.NewFunction(loader))
+}
+
 /* }}} */
 
 /* metatable operations {{{ */
@@ -361,17 +393,15 @@ func (ls *LState) CallMeta(obj LValue, event string) LValue {
 /* load and function call operations {{{ */
 
 func (ls *LState) LoadFile(path string) (*LFunction, *ApiError) {
-	var file *os.File
 	var reader io.Reader
-	var err error
 	if len(path) == 0 {
-		reader = os.Stdin
+		reader = ls.G.stdinReader()
 	} else {
-		file, err = os.Open(path)
-		defer file.Close()
+		file, err := ls.fileSystem().OpenFile(path, os.O_RDONLY, 0)
 		if err != nil {
-			return nil, newApiError(ApiErrorFile, fmt.Sprintf("can not read %v", path), LNil)
+			return nil, newApiErrorE(ApiErrorFile, fmt.Sprintf("can not read %v", path), err)
 		}
+		defer file.Close()
 		reader = file
 	}
 	return ls.Load(reader, filepath.Base(path))
@@ -399,6 +429,41 @@ func (ls *LState) DoString(source string) *ApiError {
 	}
 }
 
+// LoadEnv loads the chunk like Load, and sets the environment of the chunk to
+// env like load(chunk, name, mode, env) of Lua 5.2. Global variables of the
+// chunk and of the functions defined in the chunk are fields of env, so scripts
+// loaded with different environments do not share their globals.
+func (ls *LState) LoadEnv(reader io.Reader, name string, env *LTable) (*LFunction, *ApiError) {
+	fn, err := ls.Load(reader, name)
+	if err != nil {
+		return nil, err
+	}
+	setChunkEnv(fn, env)
+	return fn, nil
+}
+
+// DoStringEnv runs the source like DoString with env as its environment. See
+// LoadEnv.
+func (ls *LState) DoStringEnv(source string, env *LTable) *ApiError {
+	if fn, err := ls.LoadEnv(strings.NewReader(source), "<string>", env); err != nil {
+		return err
+	} else {
+		ls.Push(fn)
+		return ls.PCall(0, MultRet, nil)
+	}
+}
+
+// DoFileEnv runs the file like DoFile with env as its environment. See LoadEnv.
+func (ls *LState) DoFileEnv(path string, env *LTable) *ApiError {
+	if fn, err := ls.LoadFile(path); err != nil {
+		return err
+	} else {
+		setChunkEnv(fn, env)
+		ls.Push(fn)
+		return ls.PCall(0, MultRet, nil)
+	}
+}
+
 func (ls *LState) OpenLibs() {
 	// loadlib must be loaded 1st
 	loadOpen(ls)
@@ -410,6 +475,48 @@ func (ls *LState) OpenLibs() {
 	mathOpen(ls)
 	osOpen(ls)
 	debugOpen(ls)
+	bit32Open(ls)
+}
+
+// safeOsFuncs are the functions of the os library opened by OpenSafeLibs.
+var safeOsFuncs = []string{"clock", "date", "difftime", "time"}
+
+// OpenSafeLibs opens the standard libraries for sandboxed scripts. The io and
+// debug libraries, dofile, loadfile and string.dump are not opened, load and
+// loadstring load only text chunks, and the os library has only clock, date,
+// difftime and time. require finds only modules in package.preload, see
+// LState.PreloadModule.
+func (ls *LState) OpenSafeLibs() {
+	loadOpen(ls)
+	baseOpen(ls)
+	coroutineOpen(ls)
+	stringOpen(ls)
+	tableOpen(ls)
+	mathOpen(ls)
+	bit32Open(ls)
+
+	global := ls.Get(GlobalsIndex).(*LTable)
+	global.RawSetH(LString("dofile"), LNil)
+	global.RawSetH(LString("loadfile"), LNil)
+	// binary chunks are not verified enough to be loaded from untrusted
+	// scripts.
+	global.RawSetH(LString("load"), ls.NewFunction(safeLoad))
+	global.RawSetH(LString("loadstring"), ls.NewFunction(safeLoadString))
+	ls.SetField(ls.GetGlobal("string"), "dump", LNil)
+
+	funcs := make(map[string]LGFunction, len(safeOsFuncs))
+	for _, name := range safeOsFuncs {
+		funcs[name] = osFuncs[name]
+	}
+	ls.RegisterModule("os", funcs)
+
+	loaders := ls.GetField(ls.Get(RegistryIndex), "_LOADERS").(*LTable)
+	for i := loaders.Len(); i > 1; i-- {
+		loaders.Remove(i)
+	}
+	packagemod := ls.GetGlobal("package")
+	ls.SetField(packagemod, "path", LString(""))
+	ls.SetField(packagemod, "loadlib", LNil)
 }
 
 /* }}} */
@@ -0,0 +1,119 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreloadModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	calls := 0
+	L.PreloadModule("mymodule", func(L *LState) int {
+		calls++
+		mod := L.NewTable()
+		mod.RawSetH(LString("name"), L.Get(1))
+		L.Push(mod)
+		return 1
+	})
+	if calls != 0 {
+		t.Errorf("the loader was called %v times before require", calls)
+	}
+	err := L.DoString(`
+	local m = require("mymodule")
+	assert(m.name == "mymodule")
+	assert(require("mymodule") == m)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %v calls, want 1", calls)
+	}
+}
+
+func TestOpenSafeLibs(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	L.OpenSafeLibs()
+	L.PreloadModule("config", func(L *LState) int {
+		L.Push(LString("config"))
+		return 1
+	})
+	err := L.DoString(`
+	assert(io == nil and debug == nil and dofile == nil and loadfile == nil)
+	assert(string.dump == nil and package.loadlib == nil)
+	assert(os.time and os.clock and os.date and os.difftime)
+	assert(os.execute == nil and os.remove == nil and os.getenv == nil)
+	assert(string.upper("a") == "A" and math.max(1, 2) == 2 and table.concat({1, 2}) == "12")
+	assert(coroutine.wrap(function() return 1 end)() == 1)
+	assert(load("return 1")() == 1)
+
+	assert(require("config") == "config")
+	local ok, err = pcall(require, "string_ext")
+	assert(not ok, "only package.preload is searched")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// binary chunks are rejected.
+	L2 := NewState()
+	defer L2.Close()
+	if err := L2.DoString(`bin = string.dump(function() return 1 end)`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("bin", L2.GetGlobal("bin"))
+	err = L.DoString(`
+	local f, err = load(bin, "b", "b")
+	assert(f == nil and err:find("binary"), err)
+	f, err = loadstring(bin)
+	assert(f == nil and err:find("binary"), err)
+	`)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoStringEnv(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	env := L.NewTable()
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.Get(GlobalsIndex))
+	L.SetMetatable(env, mt)
+	err := L.DoStringEnv(`
+	x = 1
+	function get() return x end
+	assert(tostring(1) == "1")
+	`, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if L.GetGlobal("x") != LNil || L.GetGlobal("get") != LNil {
+		t.Error("globals of the chunk must not be set to _G")
+	}
+	if v := L.GetField(env, "x"); v != LNumber(1) {
+		t.Errorf("got %v, want 1", v)
+	}
+	// functions defined by the chunk use the environment.
+	L.SetField(env, "x", LNumber(2))
+	L.Push(L.GetField(env, "get"))
+	L.Call(0, 1)
+	if v := L.Get(-1); v != LNumber(2) {
+		t.Errorf("got %v, want 2", v)
+	}
+	L.Pop(1)
+
+	path := filepath.Join(t.TempDir(), "tenant.lua")
+	if err := os.WriteFile(path, []byte(`y = x + 1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoFileEnv(path, env); err != nil {
+		t.Fatal(err)
+	}
+	if v := L.GetField(env, "y"); v != LNumber(3) {
+		t.Errorf("got %v, want 3", v)
+	}
+}
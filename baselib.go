@@ -1,10 +1,10 @@
 package lua
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
-	"runtime"
 	"strconv"
 	"strings"
 )
@@ -59,8 +59,36 @@ func baseAssert(L *LState) int {
 }
 
 func baseCollectGarbage(L *LState) int {
-	runtime.GC()
-	return 0
+	g := L.G
+	switch opt := L.OptString(1, "collect"); opt {
+	case "collect":
+		L.collectGarbage()
+		L.Push(LNumber(0))
+	case "step":
+		L.collectGarbage()
+		L.Push(LTrue)
+	case "count":
+		L.Push(LNumber(float64(g.memoryUsage()) / 1024))
+	case "stop":
+		g.gcStopped = true
+		L.Push(LNumber(0))
+	case "restart":
+		g.gcStopped = false
+		L.Push(LNumber(0))
+	case "isrunning":
+		L.Push(LBool(!g.gcStopped))
+	case "setpause":
+		// the pause and the step multiplier are kept only to be returned,
+		// the Go garbage collector is not tuned per state.
+		L.Push(LNumber(g.gcPause))
+		g.gcPause = L.OptInt(2, gcDefaultPause)
+	case "setstepmul":
+		L.Push(LNumber(g.gcStepMul))
+		g.gcStepMul = L.OptInt(2, gcDefaultStepMul)
+	default:
+		L.ArgError(1, "invalid option '"+opt+"'")
+	}
+	return 1
 }
 
 func baseDoFile(L *LState) int {
@@ -71,7 +99,7 @@ func baseDoFile(L *LState) int {
 }
 
 func baseError(L *LState) int {
-	obj := L.CheckAny(1)
+	obj := L.Get(1)
 	level := L.OptInt(2, 1)
 	L.Error(obj, level)
 	return 0
@@ -94,7 +122,7 @@ func baseGetFEnv(L *LState) int {
 		return 1
 	}
 
-	if number, ok := value.(LNumber); ok {
+	if number, ok := toFloatValue(value); ok {
 		level := int(float64(number))
 		if level <= 0 {
 			L.Push(L.Env)
@@ -130,35 +158,61 @@ func ipairsaux(L *LState) int {
 		return 0
 	} else {
 		L.Pop(1)
-		L.Push(LNumber(i))
-		L.Push(LNumber(i))
+		L.Push(integerValue(int64(i)))
+		L.Push(integerValue(int64(i)))
 		L.Push(v)
 		return 2
 	}
 }
 
 func baseIpairs(L *LState) int {
+	if mm := L.metaOp1(L.CheckAny(1), "__ipairs"); mm != LNil {
+		L.Push(mm)
+		L.Push(L.Get(1))
+		L.Call(1, 3)
+		return 3
+	}
 	tb := L.CheckTable(1)
 	L.Push(L.Get(UpvalueIndex(1)))
 	L.Push(tb)
-	L.Push(LNumber(0))
+	L.Push(integerValue(0))
 	return 3
 }
 
-func loadaux(L *LState, reader io.Reader, chunkname string) int {
+func loadaux(L *LState, reader io.Reader, chunkname string, mode string, env *LTable) int {
+	var header [1]byte
+	n, _ := io.ReadFull(reader, header[:])
+	kind := "text"
+	if n == 1 && header[0] == dumpSignature[0] {
+		kind = "binary"
+	}
+	if !strings.Contains(mode, kind[:1]) {
+		L.Push(LNil)
+		L.Push(LString(fmt.Sprintf("attempt to load a %v chunk (mode is '%v')", kind, mode)))
+		return 2
+	}
+	reader = io.MultiReader(bytes.NewReader(header[:n]), reader)
 	if fn, err := L.Load(reader, chunkname); err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
 		return 2
 	} else {
+		if env != nil {
+			setChunkEnv(fn, env)
+		}
 		L.Push(fn)
 		return 1
 	}
 }
 
 func baseLoad(L *LState) int {
+	if str, ok := L.Get(1).(LString); ok {
+		return loadaux(L, strings.NewReader(string(str)), L.OptString(2, "<string>"), L.OptString(3, "bt"), L.OptTable(4, nil))
+	}
 	fn := L.CheckFunction(1)
 	chunkname := L.OptString(2, "?")
+	mode := L.OptString(3, "bt")
+	env := L.OptTable(4, nil)
 	top := L.GetTop()
 	buf := []string{}
 	for {
@@ -178,31 +232,49 @@ func baseLoad(L *LState) int {
 			L.RaiseError("loader function must return a string or nil object.")
 		}
 	}
-	return loadaux(L, strings.NewReader(strings.Join(buf, "")), chunkname)
+	L.SetTop(top)
+	return loadaux(L, strings.NewReader(strings.Join(buf, "")), chunkname, mode, env)
 }
 
 func baseLoadFile(L *LState) int {
 	var reader io.Reader
 	var chunkname string
-	var err error
-	if L.GetTop() < 1 {
-		reader = os.Stdin
+	mode := L.OptString(2, "bt")
+	env := L.OptTable(3, nil)
+	if L.GetTop() < 1 || L.Get(1) == LNil {
+		reader = L.G.stdinReader()
 		chunkname = "<stdin>"
 	} else {
 		chunkname = L.CheckString(1)
-		reader, err = os.Open(chunkname)
+		file, err := L.fileSystem().OpenFile(chunkname, os.O_RDONLY, 0)
 		if err != nil {
 			L.Push(LNil)
 			L.Push(LString(fmt.Sprint("can not open file: %v", chunkname)))
 			return 2
 		}
-		defer reader.(*os.File).Close()
+		defer file.Close()
+		reader = file
 	}
-	return loadaux(L, reader, chunkname)
+	return loadaux(L, reader, chunkname, mode, env)
 }
 
 func baseLoadString(L *LState) int {
-	return loadaux(L, strings.NewReader(L.CheckString(1)), L.OptString(2, "<string>"))
+	return loadaux(L, strings.NewReader(L.CheckString(1)), L.OptString(2, "<string>"), "bt", nil)
+}
+
+// safeLoad is load of OpenSafeLibs, which loads only text chunks whatever the
+// mode argument is.
+func safeLoad(L *LState) int {
+	if L.GetTop() < 3 {
+		L.SetTop(3)
+	}
+	L.Replace(3, LString("t"))
+	return baseLoad(L)
+}
+
+// safeLoadString is loadstring of OpenSafeLibs, which loads only text chunks.
+func safeLoadString(L *LState) int {
+	return loadaux(L, strings.NewReader(L.CheckString(1)), L.OptString(2, "<string>"), "t", nil)
 }
 
 func baseNext(L *LState) int {
@@ -211,7 +283,7 @@ func baseNext(L *LState) int {
 	if L.GetTop() >= 2 {
 		index = L.Get(2)
 	}
-	key, value := tb.Next(index)
+	key, value := L.tableNext(tb, index)
 	if key == LNil {
 		L.Push(LNil)
 		return 1
@@ -223,7 +295,7 @@ func baseNext(L *LState) int {
 
 func pairsaux(L *LState) int {
 	tb := L.CheckTable(1)
-	key, value := tb.Next(L.Get(2))
+	key, value := L.tableNext(tb, L.Get(2))
 	if key == LNil {
 		return 0
 	} else {
@@ -236,6 +308,12 @@ func pairsaux(L *LState) int {
 }
 
 func basePairs(L *LState) int {
+	if mm := L.metaOp1(L.CheckAny(1), "__pairs"); mm != LNil {
+		L.Push(mm)
+		L.Push(L.Get(1))
+		L.Call(1, 3)
+		return 3
+	}
 	tb := L.CheckTable(1)
 	L.Push(L.Get(UpvalueIndex(1)))
 	L.Push(tb)
@@ -257,14 +335,15 @@ func basePCall(L *LState) int {
 }
 
 func basePrint(L *LState) int {
+	w := L.G.stdoutWriter()
 	top := L.GetTop()
 	for i := 1; i <= top; i++ {
-		fmt.Print(L.Get(i).String())
+		fmt.Fprint(w, L.Get(i).String())
 		if i != top {
-			fmt.Print("\t")
+			fmt.Fprint(w, "\t")
 		}
 	}
-	fmt.Println("")
+	fmt.Fprintln(w, "")
 	return 0
 }
 
@@ -296,16 +375,18 @@ func baseRawSet(L *LState) int {
 	if key == LNil {
 		L.ArgError(2, "index must not be nil")
 	}
-	L.CheckTable(1).RawSet(key, L.CheckAny(3))
+	tb := L.CheckTable(1)
+	L.checkFrozen(tb)
+	tb.RawSet(key, L.CheckAny(3))
 	return 0
 }
 
 func baseSelect(L *LState) int {
 	L.CheckTypes(1, LTNumber, LTString)
 	switch lv := L.Get(1).(type) {
-	case LNumber:
-		idx := int(lv)
-		num := L.reg.Top() - L.indexToReg(int(lv)) - 1
+	case LNumber, LInteger:
+		idx := L.CheckInt(1)
+		num := L.reg.Top() - L.indexToReg(idx) - 1
 		if idx < 0 {
 			num++
 		}
@@ -314,7 +395,7 @@ func baseSelect(L *LState) int {
 		if string(lv) != "#" {
 			L.ArgError(1, "invalid string '"+string(lv)+"'")
 		}
-		L.Push(LNumber(L.GetTop() - 1))
+		L.Push(integerValue(int64(L.GetTop() - 1)))
 		return 1
 	}
 	return 0
@@ -339,7 +420,7 @@ func baseSetFEnv(L *LState) int {
 		}
 	}
 
-	if number, ok := value.(LNumber); ok {
+	if number, ok := toFloatValue(value); ok {
 		level := int(float64(number))
 		if level <= 0 {
 			L.Env = env
@@ -370,6 +451,9 @@ func baseSetMetatable(L *LState) int {
 		L.RaiseError("cannot set metatable to a nil object.")
 	}
 	mt := L.Get(2)
+	if tb, ok := obj.(*LTable); ok {
+		L.checkFrozen(tb)
+	}
 	if m := L.metatable(obj, true); m != LNil {
 		if tb, ok := m.(*LTable); ok && tb.RawGetH(LString("__metatable")) != LNil {
 			L.RaiseError("cannot change a protected metatable")
@@ -383,7 +467,7 @@ func baseSetMetatable(L *LState) int {
 func baseToNumber(L *LState) int {
 	base := L.OptInt(2, 10)
 	switch lv := L.CheckAny(1).(type) {
-	case LNumber:
+	case LNumber, LInteger:
 		L.Push(lv)
 	case LString:
 		str := strings.Trim(string(lv), " \n\t")
@@ -397,7 +481,7 @@ func baseToNumber(L *LState) int {
 			if v, err := strconv.ParseInt(str, base, LNumberBit); err != nil {
 				L.Push(LNil)
 			} else {
-				L.Push(LNumber(v))
+				L.Push(integerValue(v))
 			}
 		}
 	default:
@@ -427,7 +511,7 @@ func baseType(L *LState) int {
 func baseUnpack(L *LState) int {
 	tb := L.CheckTable(1)
 	start := L.OptInt(2, 1)
-	end := L.OptInt(3, tb.Len())
+	end := L.OptInt(3, L.ObjLen(tb))
 	for i := start; i <= end; i++ {
 		L.Push(tb.RawGetInt(i))
 	}
@@ -444,13 +528,16 @@ func baseXPCall(L *LState) int {
 
 	top := L.GetTop()
 	L.Push(fn)
-	if err := L.PCall(0, MultRet, errfunc); err != nil {
+	for i := 3; i <= top; i++ {
+		L.Push(L.Get(i))
+	}
+	if err := L.PCall(top-2, MultRet, errfunc); err != nil {
 		L.Push(LFalse)
 		L.Push(err.Object)
 		return 2
 	} else {
-		L.Insert(LTrue, 1)
-		return L.GetTop() - top - 1
+		L.Insert(LTrue, top+1)
+		return L.GetTop() - top
 	}
 }
 
@@ -511,12 +598,19 @@ func loRequire(L *LState) int {
 		L.Push(lv)
 		return 1
 	}
+	L.Push(loLoadModule(L, loaded, name))
+	return 1
+}
+
+// loLoadModule finds the module with package.loaders, runs it and stores the
+// module into package.loaded.
+func loLoadModule(L *LState, loaded LValue, name string) LValue {
 	loaders := L.GetField(L.Get(RegistryIndex), "_LOADERS")
 	if _, ok := loaders.(*LTable); !ok {
 		L.RaiseError("package.loaders must be a table")
 	}
 	messages := []string{}
-	var modasfunc LValue
+	var modasfunc, extra LValue
 	for i := 1; ; i++ {
 		loader := L.RawGetInt(loaders, i)
 		if loader == LNil {
@@ -524,7 +618,8 @@ func loRequire(L *LState) int {
 		}
 		L.Push(loader)
 		L.Push(LString(name))
-		L.Call(1, 1)
+		L.Call(1, 2)
+		extra = L.reg.Pop()
 		ret := L.reg.Pop()
 		switch retv := ret.(type) {
 		case *LFunction:
@@ -535,22 +630,28 @@ func loRequire(L *LState) int {
 		}
 	}
 loopbreak:
+	if sources, ok := L.GetField(L.Get(RegistryIndex), "_SOURCES").(*LTable); ok {
+		if source, ok := extra.(LString); ok {
+			sources.RawSetH(LString(name), source)
+		} else {
+			sources.RawSetH(LString(name), LNil)
+		}
+	}
 	L.SetField(loaded, name, loopdetection)
 	L.Push(modasfunc)
 	L.Push(LString(name))
-	L.Call(1, 1)
+	L.Push(extra)
+	L.Call(2, 1)
 	ret := L.reg.Pop()
 	modv := L.GetField(loaded, name)
 	if ret != LNil && modv == loopdetection {
 		L.SetField(loaded, name, ret)
-		L.Push(ret)
+		return ret
 	} else if modv == loopdetection {
 		L.SetField(loaded, name, LTrue)
-		L.Push(LTrue)
-	} else {
-		L.Push(modv)
+		return LTrue
 	}
-	return 1
+	return modv
 }
 
 /* }}} */
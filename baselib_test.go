@@ -0,0 +1,152 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(collectgarbage() == 0)
+	assert(collectgarbage("step") == true)
+
+	local before = collectgarbage("count")
+	big = {}
+	for i = 1, 10000 do big[i] = {i} end
+	assert(collectgarbage("count") > before)
+	big = nil
+	collectgarbage()
+	assert(collectgarbage("count") < before + 100)
+
+	assert(collectgarbage("isrunning") == true)
+	collectgarbage("stop")
+	assert(collectgarbage("isrunning") == false)
+	collectgarbage("restart")
+	assert(collectgarbage("isrunning") == true)
+
+	assert(collectgarbage("setpause", 150) == 200)
+	assert(collectgarbage("setpause") == 150)
+	assert(collectgarbage("setstepmul", 300) == 200)
+	assert(collectgarbage("setstepmul") == 300)
+
+	local ok, err = pcall(collectgarbage, "bogus")
+	assert(not ok and err:find("invalid option 'bogus'"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairsMetamethods(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local proxy = setmetatable({}, {
+	  __pairs = function(t)
+	    return function(_, k) if not k then return "key", "value" end end, t, nil
+	  end,
+	  __ipairs = function(t)
+	    return function(_, i) if i < 2 then return i + 1, i * 10 end end, t, 0
+	  end,
+	})
+	local got = {}
+	for k, v in pairs(proxy) do got[#got + 1] = k .. "=" .. v end
+	assert(table.concat(got, ",") == "key=value")
+	got = {}
+	for i, v in ipairs(proxy) do got[#got + 1] = i .. "=" .. v end
+	assert(table.concat(got, ",") == "1=0,2=10")
+
+	-- tables without the metamethods are iterated as usual.
+	got = {}
+	for i, v in ipairs({"a", "b"}) do got[#got + 1] = v end
+	assert(table.concat(got) == "ab")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXPCallArguments(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local ok, a, b = xpcall(function(x, y) return x + y, x * y end, print, 2, 3)
+	assert(ok and a == 5 and b == 6)
+
+	local ok, msg = xpcall(function(x) error({code = x}) end, function(e) return e.code end, 42)
+	assert(not ok and msg == 42)
+
+	local ok, msg = xpcall(function() error("plain", 0) end, function(e) return "handled: " .. e end)
+	assert(not ok and msg == "handled: plain", msg)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorValues(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local e = {code = 1}
+	local ok, got = pcall(error, e)
+	assert(not ok and got == e)
+	ok, got = pcall(error, 42)
+	assert(not ok and got == 42)
+	ok, got = pcall(error)
+	assert(not ok and got == nil)
+
+	local co = coroutine.create(function() error(e) end)
+	ok, got = coroutine.resume(co)
+	assert(not ok and got == e)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = L.DoString(`error({code = 7})`)
+	if err == nil {
+		t.Fatal("error must be returned")
+	}
+	if tb, ok := err.Object.(*LTable); !ok || tb.RawGetH(LString("code")) != LNumber(7) {
+		t.Errorf("got %v, want the error table", err.Object)
+	}
+
+	co := L.NewThread()
+	fn := L.NewFunction(func(L *LState) int {
+		L.Error(LNumber(3), 0)
+		return 0
+	})
+	if _, err, _ := L.Resume(co, fn); err == nil || err.Object != LNumber(3) {
+		t.Errorf("got %v, want the error value 3", err)
+	}
+}
+
+func TestNumberToString(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function check(n, want)
+	  assert(tostring(n) == want, tostring(n))
+	end
+	check(0.1 + 0.2, "0.3")
+	check(1e15, "1e+15")
+	check(12345678901234, "12345678901234")
+	check(123456789012345, "1.2345678901234e+14")
+	check(3.0, "3")
+	check(-0.5, "-0.5")
+	check(1/3, "0.33333333333333")
+	check(1e100, "1e+100")
+	check(math.huge, "inf")
+	check(-math.huge, "-inf")
+	assert(tostring(0/0):find("nan"))
+	assert(1 .. "" == "1" and 2.5 .. "" == "2.5")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := LNumber(0.1).String(); s != "0.1" {
+		t.Errorf("got %v, want 0.1", s)
+	}
+}
@@ -0,0 +1,147 @@
+package lua
+
+import (
+	"math"
+)
+
+func bit32Open(L *LState) {
+	L.RegisterModule("bit32", bit32Funcs)
+}
+
+var bit32Funcs = map[string]LGFunction{
+	"arshift": bit32Arshift,
+	"band":    bit32Band,
+	"bnot":    bit32Bnot,
+	"bor":     bit32Bor,
+	"btest":   bit32Btest,
+	"bxor":    bit32Bxor,
+	"extract": bit32Extract,
+	"lrotate": bit32Lrotate,
+	"lshift":  bit32Lshift,
+	"replace": bit32Replace,
+	"rrotate": bit32Rrotate,
+	"rshift":  bit32Rshift,
+}
+
+// bit32CheckUnsigned converts the given argument to an unsigned 32-bit
+// integer modulo 2^32.
+func bit32CheckUnsigned(L *LState, n int) uint32 {
+	if v, ok := L.Get(n).(LInteger); ok {
+		return uint32(v)
+	}
+	f := math.Mod(math.Floor(float64(L.CheckNumber(n))), 1<<32)
+	if f < 0 {
+		f += 1 << 32
+	}
+	return uint32(f)
+}
+
+func bit32Push(L *LState, v uint32) int {
+	L.Push(integerValue(int64(v)))
+	return 1
+}
+
+func bit32Shift(v uint32, disp int) uint32 {
+	switch {
+	case disp <= -32 || disp >= 32:
+		return 0
+	case disp < 0:
+		return v >> uint(-disp)
+	}
+	return v << uint(disp)
+}
+
+func bit32Rotate(v uint32, disp int) uint32 {
+	d := uint(disp & 31)
+	return v<<d | v>>(32-d)
+}
+
+func bit32Fold(L *LState, init uint32, op func(uint32, uint32) uint32) uint32 {
+	r := init
+	top := L.GetTop()
+	for i := 1; i <= top; i++ {
+		r = op(r, bit32CheckUnsigned(L, i))
+	}
+	return r
+}
+
+func bit32And(L *LState) uint32 {
+	return bit32Fold(L, math.MaxUint32, func(a, b uint32) uint32 { return a & b })
+}
+
+func bit32Arshift(L *LState) int {
+	v := bit32CheckUnsigned(L, 1)
+	disp := L.CheckInt(2)
+	if disp < 0 || v&(1<<31) == 0 {
+		return bit32Push(L, bit32Shift(v, -disp))
+	}
+	if disp >= 32 {
+		return bit32Push(L, math.MaxUint32)
+	}
+	return bit32Push(L, v>>uint(disp)|^(math.MaxUint32>>uint(disp)))
+}
+
+func bit32Band(L *LState) int {
+	return bit32Push(L, bit32And(L))
+}
+
+func bit32Bnot(L *LState) int {
+	return bit32Push(L, ^bit32CheckUnsigned(L, 1))
+}
+
+func bit32Bor(L *LState) int {
+	return bit32Push(L, bit32Fold(L, 0, func(a, b uint32) uint32 { return a | b }))
+}
+
+func bit32Btest(L *LState) int {
+	L.Push(LBool(bit32And(L) != 0))
+	return 1
+}
+
+func bit32Bxor(L *LState) int {
+	return bit32Push(L, bit32Fold(L, 0, func(a, b uint32) uint32 { return a ^ b }))
+}
+
+func bit32CheckField(L *LState, fieldn, widthn int) (uint, uint32) {
+	field := L.CheckInt(fieldn)
+	width := L.OptInt(widthn, 1)
+	if field < 0 {
+		L.ArgError(fieldn, "field cannot be negative")
+	}
+	if width <= 0 {
+		L.ArgError(widthn, "width must be positive")
+	}
+	if field+width > 32 {
+		L.ArgError(fieldn, "trying to access non-existent bits")
+	}
+	return uint(field), uint32(math.MaxUint32 >> uint(32-width))
+}
+
+func bit32Extract(L *LState) int {
+	v := bit32CheckUnsigned(L, 1)
+	field, mask := bit32CheckField(L, 2, 3)
+	return bit32Push(L, v>>field&mask)
+}
+
+func bit32Lrotate(L *LState) int {
+	return bit32Push(L, bit32Rotate(bit32CheckUnsigned(L, 1), L.CheckInt(2)))
+}
+
+func bit32Lshift(L *LState) int {
+	return bit32Push(L, bit32Shift(bit32CheckUnsigned(L, 1), L.CheckInt(2)))
+}
+
+func bit32Replace(L *LState) int {
+	v := bit32CheckUnsigned(L, 1)
+	repl := bit32CheckUnsigned(L, 2)
+	field, mask := bit32CheckField(L, 3, 4)
+	return bit32Push(L, v&^(mask<<field)|(repl&mask)<<field)
+}
+
+func bit32Rrotate(L *LState) int {
+	return bit32Push(L, bit32Rotate(bit32CheckUnsigned(L, 1), -L.CheckInt(2)))
+}
+
+func bit32Rshift(L *LState) int {
+	return bit32Push(L, bit32Shift(bit32CheckUnsigned(L, 1), -L.CheckInt(2)))
+}
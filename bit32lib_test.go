@@ -0,0 +1,31 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestBit32(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(bit32.band(5, 3) == 1 and bit32.band() == 0xFFFFFFFF)
+	assert(bit32.bor(5, 3) == 7 and bit32.bxor(5, 3) == 6)
+	assert(bit32.bnot(0) == 0xFFFFFFFF and bit32.bnot(-1) == 0)
+	assert(bit32.btest(5, 2) == false and bit32.btest(5, 4) == true)
+	assert(bit32.lshift(1, 4) == 16 and bit32.lshift(1, 32) == 0 and bit32.lshift(16, -4) == 1)
+	assert(bit32.rshift(0x80000000, 31) == 1 and bit32.rshift(-1, 0) == 0xFFFFFFFF)
+	assert(bit32.arshift(0x80000000, 31) == 0xFFFFFFFF and bit32.arshift(16, 4) == 1)
+	assert(bit32.lrotate(0x80000001, 1) == 3 and bit32.rrotate(3, 1) == 0x80000001)
+	assert(bit32.extract(0xF0, 4, 4) == 0xF and bit32.extract(0xF0, 4) == 1)
+	assert(bit32.replace(0, 0xF, 4, 4) == 0xF0)
+	assert(bit32.band(2^32 + 1, 3) == 1)
+
+	local ok, err = pcall(bit32.extract, 1, 30, 4)
+	assert(not ok and err:find("trying to access non%-existent bits"), err)
+	ok, err = pcall(bit32.extract, 1, -1)
+	assert(not ok and err:find("field cannot be negative"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,142 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+const stringBufferClass = "BUFFER*"
+
+var stringBufferType = reflect.TypeOf((*StringBuffer)(nil))
+
+// StringBuffer is a mutable string buffer. Scripts append strings to it with
+// the methods put and putf instead of concatenating strings repeatedly, and Go
+// code can read the result with the methods of bytes.Buffer without creating a
+// Lua string. The zero value is an empty buffer.
+type StringBuffer struct {
+	bytes.Buffer
+}
+
+// OpenBuffer opens the buffer module, which is not opened by OpenLibs.
+// OpenBuffer can be given to LState.PreloadModule as a loader.
+func OpenBuffer(L *LState) int {
+	mod := L.RegisterModule("buffer", bufferFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var bufferFuncs = map[string]LGFunction{
+	"new": bufferNew,
+}
+
+// NewStringBufferValue returns userdata that exposes the StringBuffer to
+// scripts with the methods put, putf, tostring, reset and len. put, putf and
+// reset return the buffer, so calls can be chained.
+func (ls *LState) NewStringBufferValue(sb *StringBuffer) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = sb
+	ud.Metatable = ls.stringBufferMetatable()
+	return ud
+}
+
+func (ls *LState) stringBufferMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, stringBufferClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(stringBufferClass)
+	ls.SetField(mt, "__index", ls.RegisterModuleToTable(ls.NewTable(), map[string]LGFunction{
+		"put":      bufferPut,
+		"putf":     bufferPutf,
+		"tostring": bufferToString,
+		"reset":    bufferReset,
+		"len":      bufferLen,
+	}))
+	ls.RegisterModuleToTable(mt, map[string]LGFunction{
+		"__len":      bufferLen,
+		"__tostring": bufferToString,
+	})
+	ls.SetField(mt, "__metatable", LString(stringBufferClass))
+	return mt
+}
+
+func checkStringBuffer(L *LState, n int) *StringBuffer {
+	return CheckUserDataValue[*StringBuffer](L, n)
+}
+
+// bufferNew returns a new buffer. The optional argument is the initial
+// capacity in bytes.
+func bufferNew(L *LState) int {
+	sb := &StringBuffer{}
+	if size := L.OptInt(1, 0); size > 0 {
+		L.allocate(LTUserData, size)
+		sb.Grow(size)
+	}
+	L.Push(L.NewStringBufferValue(sb))
+	return 1
+}
+
+// bufferPut appends the strings and the numbers to the buffer. Other values
+// are converted by their __tostring metamethods.
+func bufferPut(L *LState) int {
+	sb := checkStringBuffer(L, 1)
+	oldcap := sb.Cap()
+	top := L.GetTop()
+	for i := 2; i <= top; i++ {
+		switch v := L.Get(i).(type) {
+		case LString:
+			sb.WriteString(string(v))
+		case LNumber, LInteger:
+			sb.WriteString(v.String())
+		default:
+			metatostring := L.metaOp1(v, "__tostring")
+			if metatostring.Type() != LTFunction {
+				L.ArgError(i, fmt.Sprintf("string expected, got %v", v.Type()))
+			}
+			L.Push(metatostring)
+			L.Push(v)
+			L.Call(1, 1)
+			sb.WriteString(LVAsString(L.Get(-1)))
+			L.Pop(1)
+		}
+	}
+	accountBufferGrowth(L, sb, oldcap)
+	L.SetTop(1)
+	return 1
+}
+
+// bufferPutf appends the arguments formatted like string.format.
+func bufferPutf(L *LState) int {
+	sb := checkStringBuffer(L, 1)
+	oldcap := sb.Cap()
+	sb.WriteString(strFormatAux(L, 2))
+	accountBufferGrowth(L, sb, oldcap)
+	L.SetTop(1)
+	return 1
+}
+
+// accountBufferGrowth counts the memory the buffer allocated since its capacity
+// was oldcap toward the memory limit of the state.
+func accountBufferGrowth(L *LState, sb *StringBuffer, oldcap int) {
+	if n := sb.Cap() - oldcap; n > 0 {
+		L.allocate(LTUserData, n)
+	}
+}
+
+func bufferToString(L *LState) int {
+	L.Push(L.allocateString(checkStringBuffer(L, 1).String()))
+	return 1
+}
+
+// bufferReset empties the buffer. The memory of the buffer is reused.
+func bufferReset(L *LState) int {
+	checkStringBuffer(L, 1).Reset()
+	L.SetTop(1)
+	return 1
+}
+
+func bufferLen(L *LState) int {
+	L.Push(integerValue(int64(checkStringBuffer(L, 1).Len())))
+	return 1
+}
@@ -0,0 +1,54 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBufferModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("buffer", OpenBuffer)
+	err := L.DoString(`
+	local buffer = require("buffer")
+	local b = buffer.new(16)
+	local obj = setmetatable({}, {__tostring = function() return "obj" end})
+	assert(b:put("a", 1, " ", obj):putf("%03d|%s", 7, "x") == b)
+	assert(b:tostring() == "a1 obj007|x" and b:len() == 11)
+	assert(b:reset():len() == 0 and b:tostring() == "")
+	for i = 1, 100 do b:put(i % 10) end
+	assert(b:len() == 100)
+	assert(not pcall(b.put, b, {}), "tables without __tostring can not be put")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringBuffer(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	out := &StringBuffer{}
+	L.SetGlobal("out", L.NewStringBufferValue(out))
+	L.SetGlobal("get", L.NewFunctionFromGo(func() *StringBuffer { return out }))
+	if err := L.DoString(`for i = 1, 3 do out:put("line ", i, "\n") end assert(get():tostring() == out:tostring())`); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "line 1\nline 2\nline 3\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBufferMemoryLimit(t *testing.T) {
+	L := NewState(Options{MemoryLimit: 1024 * 1024})
+	defer L.Close()
+	L.PreloadModule("buffer", OpenBuffer)
+	err := L.DoString(`
+	local b = require("buffer").new()
+	local s = string.rep("x", 1024)
+	for i = 1, 10000 do b:put(s) end
+	`)
+	if err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Errorf("got %v, want a memory error", err)
+	}
+}
@@ -0,0 +1,231 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const channelClass = "CHANNEL*"
+
+// OpenChannel opens the channel module, which is not opened by OpenLibs.
+// OpenChannel can be given to LState.PreloadModule as a loader.
+//
+// Channels created by channel.make carry nil, booleans, numbers, strings,
+// channels and values held by userdata, so they can be shared by states
+// running in different goroutines. Tables and functions can not be sent.
+func OpenChannel(L *LState) int {
+	mod := L.RegisterModule("channel", channelFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var channelFuncs = map[string]LGFunction{
+	"make":   channelMake,
+	"select": channelSelect,
+	"after":  channelAfter,
+}
+
+// NewChannel returns userdata that exposes the Go channel to scripts with the
+// methods of the channel module. Values are converted between Lua and Go values
+// of the element type of the channel.
+func (ls *LState) NewChannel(ch interface{}) *LUserData {
+	rv := reflect.ValueOf(ch)
+	if rv.Kind() != reflect.Chan || rv.IsNil() {
+		ls.RaiseError("NewChannel: non-nil channel expected, got %T", ch)
+	}
+	return ls.newChannel(rv)
+}
+
+func (ls *LState) newChannel(rv reflect.Value) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = rv.Interface()
+	ud.Metatable = ls.channelMetatable()
+	return ud
+}
+
+func (ls *LState) channelMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, channelClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(channelClass)
+	ls.SetField(mt, "__index", ls.RegisterModuleToTable(ls.NewTable(), map[string]LGFunction{
+		"send":    channelSend,
+		"receive": channelReceive,
+		"close":   channelClose,
+		"len":     channelLen,
+	}))
+	ls.SetField(mt, "__tostring", ls.NewFunction(channelToString))
+	ls.SetField(mt, "__metatable", LString(channelClass))
+	return mt
+}
+
+func checkChannel(L *LState, n int) reflect.Value {
+	ud := L.CheckUserData(n)
+	rv := reflect.ValueOf(ud.Value)
+	if rv.Kind() != reflect.Chan {
+		L.ArgError(n, "channel expected")
+	}
+	return rv
+}
+
+// channelValue converts the Lua value to a value sent through the channel.
+// Tables are copied like the interface{} parameters of NewFunctionFromGo.
+func (ls *LState) channelValue(ch reflect.Value, n int) reflect.Value {
+	lv := ls.Get(n)
+	typ := ch.Type().Elem()
+	if typ == interfaceType {
+		switch lv.(type) {
+		case *LFunction, *LState:
+			ls.ArgError(n, fmt.Sprintf("can not send a %v through a channel", lv.Type()))
+		}
+	}
+	value, err := toGoValue(lv, typ)
+	if err != nil {
+		ls.ArgError(n, err.Error())
+	}
+	return value
+}
+
+func (ls *LState) selectChannels(cases []reflect.SelectCase) (int, reflect.Value, bool) {
+	if ls.ctx != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ls.ctx.Done())})
+	}
+	chosen, recv, ok, err := selectCases(cases)
+	if err != nil {
+		ls.RaiseError("%v", err)
+	}
+	if ls.ctx != nil && chosen == len(cases)-1 {
+		ls.RaiseError("%v", ls.ctx.Err())
+	}
+	return chosen, recv, ok
+}
+
+// selectCases runs reflect.Select and returns an error instead of panicking
+// when a value is sent to a closed channel.
+func selectCases(cases []reflect.SelectCase) (chosen int, recv reflect.Value, ok bool, err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("%v", rcv)
+		}
+	}()
+	chosen, recv, ok = reflect.Select(cases)
+	return chosen, recv, ok, nil
+}
+
+func channelMake(L *LState) int {
+	L.Push(L.newChannel(reflect.ValueOf(make(chan interface{}, L.OptInt(1, 0)))))
+	return 1
+}
+
+// channelAfter returns a channel that receives the time after the given
+// seconds, like time.After.
+func channelAfter(L *LState) int {
+	d := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+	L.Push(L.newChannel(reflect.ValueOf(time.After(d))))
+	return 1
+}
+
+// channelSelect waits until one of the cases can proceed like the select
+// statement of Go. The cases are {"|<-", ch} to receive a value from ch,
+// {"<-|", ch, value} to send the value to ch and {"default"}. It returns the
+// index of the chosen case, the received value and whether the value was
+// received(false if the channel was closed).
+func channelSelect(L *LState) int {
+	top := L.GetTop()
+	cases := make([]reflect.SelectCase, top)
+	for i := 1; i <= top; i++ {
+		tb := L.CheckTable(i)
+		switch op := LVAsString(tb.RawGetInt(1)); op {
+		case "|<-", "<-|":
+			ch, ok := tb.RawGetInt(2).(*LUserData)
+			rv := reflect.ValueOf(nil)
+			if ok {
+				rv = reflect.ValueOf(ch.Value)
+			}
+			if rv.Kind() != reflect.Chan {
+				L.ArgError(i, "channel expected")
+			}
+			if op == "|<-" {
+				cases[i-1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: rv}
+				break
+			}
+			L.Push(tb.RawGetInt(3))
+			value := L.channelValue(rv, L.GetTop())
+			L.Pop(1)
+			cases[i-1] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: rv, Send: value}
+		case "default":
+			cases[i-1] = reflect.SelectCase{Dir: reflect.SelectDefault}
+		default:
+			L.ArgError(i, fmt.Sprintf("invalid select case: %v", op))
+		}
+	}
+	chosen, recv, ok := L.selectChannels(cases)
+	L.Push(integerValue(int64(chosen + 1)))
+	if cases[chosen].Dir == reflect.SelectRecv {
+		L.Push(L.fromGoValue(recv))
+		L.Push(LBool(ok))
+	} else {
+		L.Push(LNil)
+		L.Push(LTrue)
+	}
+	return 3
+}
+
+func channelSend(L *LState) int {
+	ch := checkChannel(L, 1)
+	if ch.Type().ChanDir()&reflect.SendDir == 0 {
+		L.ArgError(1, "receive-only channel")
+	}
+	value := L.channelValue(ch, 2)
+	L.selectChannels([]reflect.SelectCase{{Dir: reflect.SelectSend, Chan: ch, Send: value}})
+	return 0
+}
+
+// channelReceive receives a value from the channel. It returns false if the
+// channel is closed, and true and the value otherwise.
+func channelReceive(L *LState) int {
+	ch := checkChannel(L, 1)
+	if ch.Type().ChanDir()&reflect.RecvDir == 0 {
+		L.ArgError(1, "send-only channel")
+	}
+	_, recv, ok := L.selectChannels([]reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}})
+	L.Push(LBool(ok))
+	if !ok {
+		return 1
+	}
+	L.Push(L.fromGoValue(recv))
+	return 2
+}
+
+func channelClose(L *LState) int {
+	ch := checkChannel(L, 1)
+	if ch.Type().ChanDir()&reflect.SendDir == 0 {
+		L.ArgError(1, "receive-only channel")
+	}
+	if err := closeChannel(ch); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+func closeChannel(ch reflect.Value) (err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("%v", rcv)
+		}
+	}()
+	ch.Close()
+	return nil
+}
+
+func channelLen(L *LState) int {
+	L.Push(integerValue(int64(checkChannel(L, 1).Len())))
+	return 1
+}
+
+func channelToString(L *LState) int {
+	L.Push(LString(fmt.Sprintf("channel: %p", L.CheckUserData(1).Value)))
+	return 1
+}
@@ -0,0 +1,130 @@
+package lua
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannelSendTable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ch := make(chan interface{}, 1)
+	L.SetGlobal("ch", L.NewChannel(ch))
+	if err := L.DoString(`ch:send({name = "x", list = {1, 2}})`); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "x", "list": []interface{}{float64(1), float64(2)}}
+	if got := <-ch; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if err := L.DoString(`assert(not pcall(ch.send, ch, print))`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChannel(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("channel", OpenChannel)
+	err := L.DoString(`
+	local channel = require("channel")
+	local ch = channel.make(2)
+	ch:send(1)
+	ch:send("two")
+	assert(ch:len() == 2)
+	local ok, v = ch:receive()
+	assert(ok and v == 1)
+	assert(select(2, ch:receive()) == "two")
+
+	-- select chooses a case that can proceed.
+	local i, v, ok = channel.select({"|<-", ch}, {"default"})
+	assert(i == 2 and v == nil)
+	i, v, ok = channel.select({"<-|", ch, true}, {"|<-", channel.make()})
+	assert(i == 1 and ok)
+	i, v, ok = channel.select({"|<-", ch})
+	assert(i == 1 and v == true and ok)
+	i = channel.select({"|<-", ch}, {"|<-", channel.after(0.01)})
+	assert(i == 2)
+
+	ch:close()
+	assert(ch:receive() == false)
+	i, v, ok = channel.select({"|<-", ch})
+	assert(i == 1 and v == nil and ok == false)
+	assert(not pcall(ch.send, ch, 1), "send to a closed channel")
+	assert(not pcall(ch.close, ch), "close a closed channel")
+	assert(not pcall(channel.select, {"x", ch}))
+	assert(tostring(ch):find("^channel: "))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChannelTyped(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ch := make(chan int, 1)
+	L.SetGlobal("ch", L.NewChannel(ch))
+	L.SetGlobal("recvonly", L.NewChannel((<-chan int)(ch)))
+	err := L.DoString(`
+	ch:send(42)
+	assert(not pcall(ch.send, ch, "x"), "values of other types can not be sent")
+	assert(not pcall(recvonly.send, recvonly, 1), "receive-only channel")
+	assert(not pcall(recvonly.close, recvonly), "receive-only channel")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-ch; v != 42 {
+		t.Errorf("got %v, want 42", v)
+	}
+	ch <- 7
+	if err := L.DoString(`local ok, v = recvonly:receive() assert(ok and v == 7)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChannelGoroutines(t *testing.T) {
+	ch := make(chan interface{})
+	done := make(chan *ApiError)
+	go func() {
+		L := NewState()
+		defer L.Close()
+		L.SetGlobal("ch", L.NewChannel(ch))
+		done <- L.DoString(`for i = 1, 10 do ch:send(i) end ch:close()`)
+	}()
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("ch", L.NewChannel(ch))
+	err := L.DoString(`
+	local sum = 0
+	while true do
+	  local ok, v = ch:receive()
+	  if not ok then break end
+	  sum = sum + v
+	end
+	assert(sum == 55, tostring(sum))
+	`)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChannelContext(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	L.SetGlobal("ch", L.NewChannel(make(chan interface{})))
+	// blocking operations stop when the context is done.
+	if err := L.DoString(`ch:receive()`); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+}
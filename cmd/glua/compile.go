@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	exitSyntaxError = 1
+	exitUsageError  = 2
+)
+
+// compileScripts compiles the scripts without executing them. The dumped
+// function is written to output unless parseOnly is true. This returns the
+// exit status: 1 if a script has an error, 2 for usage and I/O errors.
+func compileScripts(scripts []string, output string, parseOnly bool) int {
+	if len(scripts) == 0 {
+		fmt.Fprintln(os.Stderr, "glua: no input files given")
+		return exitUsageError
+	}
+	if !parseOnly && len(scripts) > 1 {
+		fmt.Fprintln(os.Stderr, "glua: only one script can be compiled into an output file, use -p to check multiple scripts")
+		return exitUsageError
+	}
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	status := 0
+	for _, script := range scripts {
+		fn, code := loadScript(L, script)
+		if code != 0 {
+			status = code
+			continue
+		}
+		if parseOnly {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := L.DumpFunction(fn, &buf); err != nil {
+			fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+			return exitUsageError
+		}
+		if err := writeOutput(output, buf.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+			return exitUsageError
+		}
+	}
+	return status
+}
+
+func loadScript(L *lua.LState, script string) (*lua.LFunction, int) {
+	var reader io.Reader = os.Stdin
+	name := "stdin"
+	if script != "-" {
+		file, err := os.Open(script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+			return nil, exitUsageError
+		}
+		defer file.Close()
+		reader = file
+		name = script
+	}
+	fn, err := L.Load(reader, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return nil, exitSyntaxError
+	}
+	return fn, 0
+}
+
+func writeOutput(output string, data []byte) error {
+	if output == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(output, data, 0644)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestCompileScripts(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.lua")
+	bad := filepath.Join(dir, "bad.lua")
+	out := filepath.Join(dir, "good.luac")
+	if err := os.WriteFile(good, []byte(`return "compiled"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, []byte(`return = 1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := compileScripts([]string{good}, out, false); code != 0 {
+		t.Fatalf("got the status %v, want 0", code)
+	}
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoFile(out); err != nil {
+		t.Fatal(err)
+	}
+	if got := L.Get(-1); got != lua.LString("compiled") {
+		t.Errorf("got %v, want \"compiled\"", got)
+	}
+
+	if code := compileScripts([]string{good, bad}, "", true); code != exitSyntaxError {
+		t.Errorf("got the status %v, want %v", code, exitSyntaxError)
+	}
+	if code := compileScripts([]string{good, bad}, out, false); code != exitUsageError {
+		t.Errorf("got the status %v, want %v", code, exitUsageError)
+	}
+	if code := compileScripts(nil, out, false); code != exitUsageError {
+		t.Errorf("got the status %v, want %v", code, exitUsageError)
+	}
+	if code := compileScripts([]string{filepath.Join(dir, "missing.lua")}, "", true); code != exitUsageError {
+		t.Errorf("got the status %v, want %v", code, exitUsageError)
+	}
+}
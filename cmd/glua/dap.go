@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/dap"
+)
+
+// runDebugServer waits for a launch request from a Debug Adapter Protocol
+// client and runs the program under the debugger.
+func runDebugServer(L *lua.LState, addr string) int {
+	type program struct {
+		path string
+		args []string
+	}
+	d := dap.Attach(L)
+	programs := make(chan program, 1)
+	d.Launch = func(path string, args []string) error {
+		select {
+		case programs <- program{path, args}:
+			return nil
+		default:
+			return errors.New("a program has already been launched")
+		}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.ListenAndServe(addr)
+	}()
+	fmt.Fprintf(os.Stderr, "glua: waiting for a debugger on %v\n", addr)
+
+	select {
+	case err := <-errs:
+		fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+		return exitUsageError
+	case p := <-programs:
+		argtb := L.NewTable()
+		for i, arg := range p.args {
+			L.RawSet(argtb, lua.LNumber(i+1), lua.LString(arg))
+		}
+		L.SetGlobal("arg", argtb)
+		status := 0
+		if err := L.DoFile(p.path); err != nil {
+			fmt.Println(err.Error())
+			d.Output("stderr", err.Error()+"\n")
+			status = 1
+		}
+		d.Exited(status)
+		return status
+	}
+}
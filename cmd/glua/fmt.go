@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yuin/gopher-lua/format"
+)
+
+// formatScripts formats the scripts. The formatted source is written back to
+// the scripts if write is true, and to the standard output otherwise. "-"
+// formats the standard input.
+func formatScripts(scripts []string, write bool) int {
+	if len(scripts) == 0 {
+		fmt.Fprintln(os.Stderr, "glua: no input files given")
+		return exitUsageError
+	}
+	status := 0
+	for _, script := range scripts {
+		var src []byte
+		var err error
+		name := script
+		if script == "-" {
+			name = "stdin"
+			src, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			src, err = ioutil.ReadFile(script)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+			status = exitUsageError
+			continue
+		}
+		out, err := format.Source(src, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = exitSyntaxError
+			continue
+		}
+		if !write || script == "-" {
+			os.Stdout.Write(out)
+			continue
+		}
+		if bytes.Equal(src, out) {
+			continue
+		}
+		info, err := os.Stat(script)
+		if err == nil {
+			err = ioutil.WriteFile(script, out, info.Mode().Perm())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+			status = exitUsageError
+		}
+	}
+	return status
+}
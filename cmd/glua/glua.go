@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"github.com/yuin/gopher-lua"
@@ -9,17 +8,37 @@ import (
 	"os"
 )
 
+type option struct {
+	name  string
+	value string
+}
+
 func main() {
-	var opt_e, opt_l string
-	var opt_i, opt_v, opt_dt, opt_dc bool
+	// -e and -l are executed in the order given.
+	var opts []option
+	var opt_i, opt_v, opt_dt, opt_dc, opt_c, opt_p, opt_fmt, opt_w bool
 	var opt_m int
-	flag.StringVar(&opt_e, "e", "", "")
-	flag.StringVar(&opt_l, "l", "", "")
+	var opt_o, opt_dap, opt_go string
+	flag.Func("e", "", func(s string) error {
+		opts = append(opts, option{"e", s})
+		return nil
+	})
+	flag.Func("l", "", func(s string) error {
+		opts = append(opts, option{"l", s})
+		return nil
+	})
 	flag.IntVar(&opt_m, "mx", 0, "")
 	flag.BoolVar(&opt_i, "i", false, "")
 	flag.BoolVar(&opt_v, "v", false, "")
 	flag.BoolVar(&opt_dt, "dt", false, "")
 	flag.BoolVar(&opt_dc, "dc", false, "")
+	flag.BoolVar(&opt_c, "c", false, "")
+	flag.BoolVar(&opt_p, "p", false, "")
+	flag.StringVar(&opt_o, "o", "luac.out", "")
+	flag.BoolVar(&opt_fmt, "fmt", false, "")
+	flag.BoolVar(&opt_w, "w", false, "")
+	flag.StringVar(&opt_dap, "dap", "", "")
+	flag.StringVar(&opt_go, "go", "", "")
 	flag.Usage = func() {
 		fmt.Println(`usage: glua.exe [options] [script [args]].
 Available options are:
@@ -30,11 +49,35 @@ Available options are:
   -dc      dump VM codes
   -i       enter interactive mode after executing 'script'
   -v       show version information
-`)
+  -c       compile 'script' to byte code without executing it
+  -o file  output file for -c(default: luac.out, '-' for stdout)
+  -p       check syntax of scripts without executing them
+  -fmt     print formatted scripts without executing them
+  -w       write the result of -fmt to the scripts instead of stdout
+  -go pkg.Func  print 'script' translated into Go source of the function
+                'Func' in the package 'pkg'(a subset of Lua is supported)
+  -dap addr   wait for a debugger(Debug Adapter Protocol) on 'addr' and
+              run the program given by its launch request
+With no arguments, glua enters interactive mode if the standard input is a
+terminal, and executes the standard input otherwise.`)
 	}
 	flag.Parse()
-	if len(opt_e) == 0 && !opt_i && !opt_v && flag.NArg() == 0 {
-		opt_i = true
+	if opt_fmt {
+		os.Exit(formatScripts(flag.Args(), opt_w))
+	}
+	if len(opt_go) > 0 {
+		os.Exit(transpileScript(flag.Args(), opt_go))
+	}
+	if opt_c || opt_p {
+		os.Exit(compileScripts(flag.Args(), opt_o, opt_p))
+	}
+	stdin := false
+	if len(opts) == 0 && !opt_i && !opt_v && len(opt_dap) == 0 && flag.NArg() == 0 {
+		if isTerminal(int(os.Stdin.Fd())) {
+			opt_i = true
+		} else {
+			stdin = true
+		}
 	}
 
 	status := 0
@@ -49,12 +92,27 @@ Available options are:
 		fmt.Println(lua.PackageCopyRight)
 	}
 
-	if len(opt_l) > 0 {
-		if err := L.DoFile(opt_l); err != nil {
+	for _, opt := range opts {
+		var err *lua.ApiError
+		if opt.name == "l" {
+			err = L.CallByParam(lua.P{Fn: L.GetGlobal("require"), NRet: 1, Protect: true}, lua.LString(opt.value))
+			if err == nil {
+				L.SetGlobal(opt.value, L.Get(-1))
+				L.Pop(1)
+			}
+		} else {
+			err = L.DoString(opt.value)
+		}
+		if err != nil {
 			fmt.Println(err.Error())
+			os.Exit(1)
 		}
 	}
 
+	if len(opt_dap) > 0 {
+		os.Exit(runDebugServer(L, opt_dap))
+	}
+
 	if nargs := flag.NArg(); nargs > 0 {
 		script := flag.Arg(0)
 		argtb := L.NewTable()
@@ -91,24 +149,21 @@ Available options are:
 		}
 	}
 
-	if len(opt_e) > 0 {
-		if err := L.DoString(opt_e); err != nil {
+	if stdin {
+		if fn, err := L.Load(os.Stdin, "stdin"); err != nil {
 			fmt.Println(err.Error())
 			status = 1
+		} else {
+			L.Push(fn)
+			if err := L.PCall(0, lua.MultRet, nil); err != nil {
+				fmt.Println(err.Error())
+				status = 1
+			}
 		}
 	}
 
 	if opt_i {
-		reader := bufio.NewReader(os.Stdin)
-		for {
-			fmt.Print("> ")
-			if buf, err := reader.ReadString('\n'); err != nil {
-			} else {
-				if err2 := L.DoString(buf); err2 != nil {
-					fmt.Println(err2.Error())
-				}
-			}
-		}
+		runREPL(L)
 	}
 	os.Exit(status)
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+const maxHistory = 1000
+
+// lineEditor reads lines with emacs-like key bindings and history when the
+// input is a terminal, and reads plain lines otherwise.
+type lineEditor struct {
+	fd       int
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+	history  []string
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	fd := int(in.Fd())
+	return &lineEditor{
+		fd:       fd,
+		in:       bufio.NewReader(in),
+		out:      out,
+		terminal: isTerminal(fd),
+	}
+}
+
+// LoadHistory reads the history from the file, one entry per line.
+func (ed *lineEditor) LoadHistory(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) > 0 {
+			ed.history = append(ed.history, line)
+		}
+	}
+	if len(ed.history) > maxHistory {
+		ed.history = ed.history[len(ed.history)-maxHistory:]
+	}
+}
+
+// SaveHistory writes the history to the file.
+func (ed *lineEditor) SaveHistory(path string) error {
+	if len(ed.history) == 0 {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(ed.history, "\n")+"\n"), 0600)
+}
+
+// AddHistory adds the entry to the history. Multi-line entries are joined into
+// one line.
+func (ed *lineEditor) AddHistory(entry string) {
+	entry = strings.TrimSpace(strings.Replace(entry, "\n", " ", -1))
+	if len(entry) == 0 || (len(ed.history) > 0 && ed.history[len(ed.history)-1] == entry) {
+		return
+	}
+	ed.history = append(ed.history, entry)
+	if len(ed.history) > maxHistory {
+		ed.history = ed.history[1:]
+	}
+}
+
+// ReadLine reads a line without the trailing newline. This returns io.EOF at
+// the end of the input(or Ctrl-D on an empty line) and errInterrupted when
+// Ctrl-C is pressed.
+func (ed *lineEditor) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(ed.out, prompt)
+	if !ed.terminal {
+		return ed.readPlainLine()
+	}
+	state, err := makeRaw(ed.fd)
+	if err != nil {
+		return ed.readPlainLine()
+	}
+	defer restoreTerminal(ed.fd, state)
+	line, err := ed.edit(prompt)
+	fmt.Fprint(ed.out, "\r\n")
+	return line, err
+}
+
+func (ed *lineEditor) readPlainLine() (string, error) {
+	line, err := ed.in.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (ed *lineEditor) refresh(prompt string, buf []rune, pos int) {
+	fmt.Fprintf(ed.out, "\r%s%s\x1b[K", prompt, string(buf))
+	if n := len(buf) - pos; n > 0 {
+		fmt.Fprintf(ed.out, "\x1b[%dD", n)
+	}
+}
+
+func (ed *lineEditor) edit(prompt string) (string, error) {
+	buf := []rune{}
+	pos := 0
+	// history index, len(ed.history) is the line being edited.
+	hpos := len(ed.history)
+	saved := ""
+	setLine := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+	}
+	for {
+		r, _, err := ed.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			return string(buf), nil
+		case 3: // Ctrl-C
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(buf) {
+				pos++
+			}
+		case 8, 127: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = append([]rune{}, buf[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 16, 14: // Ctrl-P, Ctrl-N
+			hpos, saved = ed.moveHistory(hpos, r == 16, string(buf), saved, setLine)
+		case 27: // escape sequences
+			key := ed.readEscape()
+			switch key {
+			case "[A", "OA":
+				hpos, saved = ed.moveHistory(hpos, true, string(buf), saved, setLine)
+			case "[B", "OB":
+				hpos, saved = ed.moveHistory(hpos, false, string(buf), saved, setLine)
+			case "[C", "OC":
+				if pos < len(buf) {
+					pos++
+				}
+			case "[D", "OD":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~", "[7~":
+				pos = 0
+			case "[F", "OF", "[4~", "[8~":
+				pos = len(buf)
+			case "[3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r == '\t' {
+				r = ' '
+			}
+			if r < ' ' || r == utf8.RuneError {
+				continue
+			}
+			buf = append(buf, 0)
+			copy(buf[pos+1:], buf[pos:])
+			buf[pos] = r
+			pos++
+		}
+		ed.refresh(prompt, buf, pos)
+	}
+}
+
+// readEscape reads the rest of an escape sequence, for example "[A" for the
+// up arrow key.
+func (ed *lineEditor) readEscape() string {
+	b, err := ed.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return ""
+	}
+	seq := []byte{b}
+	for {
+		c, err := ed.in.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+func (ed *lineEditor) moveHistory(hpos int, prev bool, current, saved string, setLine func(string)) (int, string) {
+	if hpos == len(ed.history) {
+		saved = current
+	}
+	switch {
+	case prev && hpos > 0:
+		hpos--
+	case !prev && hpos < len(ed.history):
+		hpos++
+	default:
+		return hpos, saved
+	}
+	if hpos == len(ed.history) {
+		setLine(saved)
+	} else {
+		setLine(ed.history[hpos])
+	}
+	return hpos, saved
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	replPrompt         = "> "
+	replContinuePrompt = ">> "
+	replMaxDepth       = 4
+	replLineWidth      = 72
+)
+
+func historyPath() string {
+	if path := os.Getenv("GLUA_HISTORY"); len(path) > 0 {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".glua_history")
+}
+
+// runREPL reads statements from the standard input and executes them. Lines
+// are accumulated while the input is incomplete. An expression is evaluated
+// and its values are printed.
+func runREPL(L *lua.LState) {
+	ed := newLineEditor(os.Stdin, os.Stdout)
+	history := historyPath()
+	if len(history) > 0 && ed.terminal {
+		ed.LoadHistory(history)
+		defer ed.SaveHistory(history)
+	}
+	input := ""
+	for {
+		prompt := replPrompt
+		if len(input) > 0 {
+			prompt = replContinuePrompt
+		}
+		line, err := ed.ReadLine(prompt)
+		if err == errInterrupted {
+			input = ""
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if len(input) > 0 {
+			input += "\n"
+		}
+		input += line
+		fn, lerr := replLoad(L, input)
+		if lerr != nil && lerr.IsIncomplete() {
+			continue
+		}
+		ed.AddHistory(input)
+		input = ""
+		if lerr != nil {
+			fmt.Println(lerr.Error())
+			continue
+		}
+		replCall(L, fn)
+	}
+}
+
+// replLoad compiles the input as an expression first, and as statements if
+// the input is not an expression. The error of the expression is returned if
+// the expression is incomplete, for example "1 +".
+func replLoad(L *lua.LState, input string) (*lua.LFunction, *lua.ApiError) {
+	fn, err := L.Load(strings.NewReader("return "+input), "stdin")
+	if err == nil {
+		return fn, nil
+	}
+	fn, err2 := L.Load(strings.NewReader(input), "stdin")
+	if err2 != nil && err.IsIncomplete() {
+		return nil, err
+	}
+	return fn, err2
+}
+
+// replCall calls the function and prints the returned values. Ctrl-C
+// interrupts the execution.
+func replCall(L *lua.LState, fn *lua.LFunction) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+	go func() {
+		select {
+		case <-sigch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	defer func() {
+		signal.Stop(sigch)
+		cancel()
+		L.RemoveContext()
+	}()
+	L.SetContext(ctx)
+
+	top := L.GetTop()
+	L.Push(fn)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		if ctx.Err() != nil {
+			fmt.Println("interrupted!")
+		} else {
+			fmt.Println(err.Error())
+		}
+		L.SetTop(top)
+		return
+	}
+	values := []string{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, replFormat(L, L.Get(i), 0, map[lua.LValue]bool{}))
+	}
+	L.SetTop(top)
+	if len(values) > 0 {
+		fmt.Println(strings.Join(values, "\t"))
+	}
+}
+
+func replToString(L *lua.LState, lv lua.LValue) string {
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("tostring"), NRet: 1, Protect: true}, lv); err != nil {
+		return lv.String()
+	}
+	s := L.Get(-1).String()
+	L.Pop(1)
+	return s
+}
+
+// replFormat formats the value for printing. Strings are quoted and tables
+// are printed with their contents unless they have a __tostring metamethod.
+func replFormat(L *lua.LState, lv lua.LValue, depth int, seen map[lua.LValue]bool) string {
+	switch v := lv.(type) {
+	case lua.LString:
+		return fmt.Sprintf("%q", string(v))
+	case *lua.LTable:
+		if L.GetMetaField(v, "__tostring") != lua.LNil {
+			return replToString(L, v)
+		}
+		if seen[v] || depth >= replMaxDepth {
+			return fmt.Sprintf("{...} --[[%v]]", v.String())
+		}
+		seen[v] = true
+		defer delete(seen, v)
+		return replFormatTable(L, v, depth, seen)
+	}
+	return replToString(L, lv)
+}
+
+func replFormatKey(L *lua.LState, key lua.LValue, depth int, seen map[lua.LValue]bool) string {
+	if s, ok := key.(lua.LString); ok && isIdentifier(string(s)) {
+		return string(s)
+	}
+	return "[" + replFormat(L, key, depth, seen) + "]"
+}
+
+func replFormatTable(L *lua.LState, tb *lua.LTable, depth int, seen map[lua.LValue]bool) string {
+	items := []string{}
+	n := 0
+	for v := tb.RawGetInt(1); v != lua.LNil; v = tb.RawGetInt(n + 1) {
+		items = append(items, replFormat(L, v, depth+1, seen))
+		n++
+	}
+	fields := []string{}
+	tb.ForEach(func(key, value lua.LValue) {
+		if i, ok := arrayIndex(key); ok && i >= 1 && i <= n {
+			return
+		}
+		fields = append(fields, replFormatKey(L, key, depth+1, seen)+" = "+replFormat(L, value, depth+1, seen))
+	})
+	sort.Strings(fields)
+	items = append(items, fields...)
+	if len(items) == 0 {
+		return "{}"
+	}
+	oneline := "{" + strings.Join(items, ", ") + "}"
+	if len(oneline) <= replLineWidth && !strings.Contains(oneline, "\n") {
+		return oneline
+	}
+	indent := strings.Repeat("  ", depth+1)
+	return "{\n" + indent + strings.Join(items, ",\n"+indent) + "\n" + strings.Repeat("  ", depth) + "}"
+}
+
+func arrayIndex(key lua.LValue) (int, bool) {
+	switch v := key.(type) {
+	case lua.LNumber:
+		return int(v), float64(v) == float64(int(v))
+	case lua.LInteger:
+		return int(v), true
+	}
+	return 0, false
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+func isIdentifier(s string) bool {
+	if len(s) == 0 || luaKeywords[s] {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func TestREPLLoad(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	for _, input := range []string{"1 + 2", "x = 1", "for i = 1, 2 do end"} {
+		if _, err := replLoad(L, input); err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+	for _, input := range []string{"1 +", "function f()", "if x then"} {
+		if _, err := replLoad(L, input); err == nil || !err.IsIncomplete() {
+			t.Errorf("%q: got %v, want an incomplete input error", input, err)
+		}
+	}
+	if _, err := replLoad(L, "x = = 1"); err == nil || err.IsIncomplete() {
+		t.Errorf("got %v, want a syntax error", err)
+	}
+}
+
+func TestREPLFormat(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`
+	cycle = {}
+	cycle.self = cycle
+	return "s", {1, 2, x = true, ["a b"] = 3}, setmetatable({}, {__tostring = function() return "obj" end}), cycle
+	`); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`"s"`,
+		`{1, 2, ["a b"] = 3, x = true}`,
+		`obj`,
+		`{self = {...} --[[` + L.GetGlobal("cycle").String() + `]]}`,
+	}
+	for i, w := range want {
+		if got := replFormat(L, L.Get(i+1), 0, map[lua.LValue]bool{}); got != w {
+			t.Errorf("got %v, want %v", got, w)
+		}
+	}
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	ed := &lineEditor{}
+	ed.AddHistory("print(1)")
+	ed.AddHistory("print(1)")
+	ed.AddHistory("  ")
+	ed.AddHistory("if x then\nprint(2)\nend")
+	want := []string{"print(1)", "if x then print(2) end"}
+	if !reflect.DeepEqual(ed.history, want) {
+		t.Errorf("got %q, want %q", ed.history, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "history")
+	if err := ed.SaveHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	ed2 := &lineEditor{}
+	ed2.LoadHistory(path)
+	if !reflect.DeepEqual(ed2.history, want) {
+		t.Errorf("got %q, want %q", ed2.history, want)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return nil
+}
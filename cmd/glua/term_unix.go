@@ -0,0 +1,56 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+type terminalState struct {
+	termios syscall.Termios
+}
+
+func getTermios(fd int, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(ioctlGetTermios), uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setTermios(fd int, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(ioctlSetTermios), uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func isTerminal(fd int) bool {
+	var t syscall.Termios
+	return getTermios(fd, &t) == nil
+}
+
+// makeRaw puts the terminal into the raw mode for the line editor and returns
+// the previous state.
+func makeRaw(fd int) (*terminalState, error) {
+	old := &terminalState{}
+	if err := getTermios(fd, &old.termios); err != nil {
+		return nil, err
+	}
+	t := old.termios
+	t.Iflag &^= syscall.ICRNL | syscall.IXON | syscall.ISTRIP | syscall.INPCK | syscall.BRKINT
+	t.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &t); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return setTermios(fd, &state.termios)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/yuin/gopher-lua/transpile"
+)
+
+// transpileScript prints the Go source of the script translated into the
+// function given by target, which is of the form package.Func.
+func transpileScript(scripts []string, target string) int {
+	if len(scripts) != 1 {
+		fmt.Fprintln(os.Stderr, "glua: -go takes one script")
+		return exitUsageError
+	}
+	pkg, fn, ok := strings.Cut(target, ".")
+	if !ok || pkg == "" || fn == "" {
+		fmt.Fprintf(os.Stderr, "glua: -go %v: the target must be package.Func\n", target)
+		return exitUsageError
+	}
+	src, err := ioutil.ReadFile(scripts[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "glua: %v\n", err)
+		return exitUsageError
+	}
+	out, err := transpile.Source(src, scripts[0], transpile.Options{Package: pkg, Func: fn})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitSyntaxError
+	}
+	os.Stdout.Write(out)
+	return 0
+}
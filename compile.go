@@ -97,8 +97,24 @@ func savereg(ec *expcontext, reg int) int {
 }
 
 func raiseCompileError(context *funcContext, line int, format string, args ...interface{}) {
+	raiseCompileErrorAt(context, line, context.Code.column, format, args...)
+}
+
+// raiseCompileErrorAt raises a compile error at the column, for errors found
+// after the code of the statement is compiled.
+func raiseCompileErrorAt(context *funcContext, line, column int, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	panic(&CompileError{Context: context, Line: line, Message: msg})
+	panic(&CompileError{Context: context, Line: line, Column: column, Message: msg})
+}
+
+const envName = "_ENV"
+
+var bitwiseOpCodes = map[string]int{
+	"&":  OP_BAND,
+	"|":  OP_BOR,
+	"~":  OP_BXOR,
+	"<<": OP_SHL,
+	">>": OP_SHR,
 }
 
 func isConstFoldableExpr(ex ast.Expr) bool {
@@ -119,17 +135,12 @@ func isVarArgReturnExpr(expr ast.Expr) bool {
 	return false
 }
 
-func lnumberValue(expr ast.Expr) (LNumber, bool) {
-	if ex, ok := expr.(*ast.NumberExpr); ok {
-		lv, err := parseNumber(ex.Value)
-		if err != nil {
-			lv = LNumber(math.NaN())
-		}
-		return lv, true
-	} else if ex, ok := expr.(*constLValueExpr); ok {
-		return ex.Value.(LNumber), true
+func numberExprValue(ex *ast.NumberExpr) LValue {
+	lv, err := parseNumberValue(ex.Value)
+	if err != nil {
+		lv = LNumber(math.NaN())
 	}
-	return 0, false
+	return lv
 }
 
 /* utilities }}} */
@@ -137,30 +148,51 @@ func lnumberValue(expr ast.Expr) (LNumber, bool) {
 type CompileError struct { // {{{
 	Context *funcContext
 	Line    int
+	Column  int
 	Message string
 }
 
 func (e *CompileError) Error() string {
-	return fmt.Sprintf("compile error near line(%v) %v: %v", e.Line, e.Context.Proto.SourceName, e.Message)
+	return fmt.Sprintf("compile error near line(%v) column(%v) %v: %v", e.Line, e.Column, e.Context.Proto.SourceName, e.Message)
 } // }}}
 
 type codeStore struct { // {{{
-	codes []uint32
-	lines []int
-	pc    int
+	codes   []uint32
+	lines   []int
+	columns []int
+	pc      int
+	// column is the column of instructions being added.
+	column int
 }
 
 func (cd *codeStore) Add(inst uint32, line int) {
 	if l := len(cd.codes); l <= 0 || cd.pc == l {
 		cd.codes = append(cd.codes, inst)
 		cd.lines = append(cd.lines, line)
+		cd.columns = append(cd.columns, cd.column)
 	} else {
 		cd.codes[cd.pc] = inst
 		cd.lines[cd.pc] = line
+		cd.columns[cd.pc] = cd.column
 	}
 	cd.pc++
 }
 
+// PushColumn makes instructions added after this have the column of the node
+// and returns the previous column for PopColumn. Nodes created by the compiler
+// do not have columns and keep the current column.
+func (cd *codeStore) PushColumn(pos ast.PositionHolder) int {
+	column := cd.column
+	if c := pos.Column(); c > 0 {
+		cd.column = c
+	}
+	return column
+}
+
+func (cd *codeStore) PopColumn(column int) {
+	cd.column = column
+}
+
 func (cd *codeStore) AddABC(op int, a int, b int, c int, line int) {
 	cd.Add(opCreateABC(op, a, b, c), line)
 }
@@ -244,6 +276,10 @@ func (cd *codeStore) PosList() []int {
 	return cd.lines[:cd.pc]
 }
 
+func (cd *codeStore) ColumnList() []int {
+	return cd.columns[:cd.pc]
+}
+
 func (cd *codeStore) LastPC() int {
 	return cd.pc - 1
 }
@@ -269,10 +305,11 @@ type varNamePoolValue struct {
 type varNamePool struct {
 	names  []string
 	offset int
+	consts map[int]bool
 }
 
 func newVarNamePool(offset int) *varNamePool {
-	return &varNamePool{make([]string, 0, 16), offset}
+	return &varNamePool{make([]string, 0, 16), offset, nil}
 }
 
 func (vp *varNamePool) Names() []string {
@@ -314,6 +351,17 @@ func (vp *varNamePool) Register(name string) int {
 	return len(vp.names) - 1 + vp.offset
 }
 
+func (vp *varNamePool) SetConst(index int) {
+	if vp.consts == nil {
+		vp.consts = make(map[int]bool)
+	}
+	vp.consts[index] = true
+}
+
+func (vp *varNamePool) IsConst(index int) bool {
+	return vp.consts[index]
+}
+
 /* }}} VarNamePool */
 
 /* FuncContext {{{ */
@@ -323,12 +371,40 @@ type codeBlock struct {
 	BreakLabel int
 	Parent     *codeBlock
 	RefUpvalue bool
+	ToBeClosed bool
+	// RepeatBody is set if the block is the body of a repeat statement, whose
+	// local variables are visible in the condition after the block.
+	RepeatBody bool
 	LineStart  int
 	LastLine   int
+	Labels     []*gotoLabel
+	Gotos      []*pendingGoto
+}
+
+// gotoLabel is a label defined by a label statement.
+type gotoLabel struct {
+	Name    string
+	Label   int
+	NActVar int
+	Line    int
+}
+
+// pendingGoto is a goto statement that jumps to a label not defined yet.
+type pendingGoto struct {
+	Name    string
+	Pc      int
+	Label   int
+	NActVar int
+	Close   int
+	Line    int
+	Column  int
+	// Discarded is set if the goto is in code discarded by discardCode. The
+	// label of the goto is still checked, but the goto is not patched.
+	Discarded bool
 }
 
 func newCodeBlock(localvars *varNamePool, blabel int, parent *codeBlock, pos ast.PositionHolder) *codeBlock {
-	bl := &codeBlock{localvars, blabel, parent, false, 0, 0}
+	bl := &codeBlock{localvars, blabel, parent, false, false, false, 0, 0, nil, nil}
 	if pos != nil {
 		bl.LineStart = pos.Line()
 		bl.LastLine = pos.LastLine()
@@ -346,12 +422,15 @@ type funcContext struct {
 	regTop   int
 	labelId  int
 	labelPc  map[int]int
+	// strings interns the string constants of the chunk, so that the
+	// functions of the chunk share them.
+	strings *stringInterner
 }
 
 func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 	fc := &funcContext{
 		Proto:    newFunctionProto(sourcename),
-		Code:     &codeStore{make([]uint32, 0, 1024), make([]int, 0, 1024), 0},
+		Code:     &codeStore{codes: make([]uint32, 0, 1024), lines: make([]int, 0, 1024), columns: make([]int, 0, 1024)},
 		Parent:   parent,
 		Upvalues: newVarNamePool(0),
 		Block:    newCodeBlock(newVarNamePool(0), labelNoJump, nil, nil),
@@ -360,6 +439,11 @@ func newFuncContext(sourcename string, parent *funcContext) *funcContext {
 		labelPc:  map[int]int{},
 	}
 	fc.Blocks = []*codeBlock{fc.Block}
+	if parent != nil {
+		fc.strings = parent.strings
+	} else {
+		fc.strings = &stringInterner{}
+	}
 	return fc
 }
 
@@ -378,9 +462,16 @@ func (fc *funcContext) GetLabelPc(label int) int {
 }
 
 func (fc *funcContext) ConstIndex(value LValue) int {
+	if str, ok := value.(LString); ok {
+		value = fc.strings.intern(string(str))
+	}
 	ctype := value.Type()
 	for i, lv := range fc.Proto.Constants {
 		if lv.Type() == ctype && lv == value {
+			// 0 and -0 are equal but different constants.
+			if f, ok := value.(LNumber); ok && math.Signbit(float64(f)) != math.Signbit(float64(lv.(LNumber))) {
+				continue
+			}
 			return i
 		}
 	}
@@ -394,7 +485,7 @@ func (fc *funcContext) ConstIndex(value LValue) int {
 
 func (fc *funcContext) RegisterLocalVar(name string) int {
 	ret := fc.Block.LocalVars.Register(name)
-	fc.Proto.DbgLocals = append(fc.Proto.DbgLocals, &DbgLocalInfo{Name: name, StartPc: fc.Code.LastPC() + 1})
+	fc.Proto.DbgLocals = append(fc.Proto.DbgLocals, &DbgLocalInfo{Name: name, StartPc: fc.Code.LastPC() + 1, EndPc: -1})
 	fc.SetRegTop(fc.RegTop() + 1)
 	return ret
 }
@@ -413,6 +504,24 @@ func (fc *funcContext) FindLocalVar(name string) int {
 	return idx
 }
 
+func (fc *funcContext) IsConstVar(name string) bool {
+	for ctx := fc; ctx != nil; ctx = ctx.Parent {
+		if idx, block := ctx.FindLocalVarAndBlock(name); idx > -1 {
+			return block.LocalVars.IsConst(idx)
+		}
+	}
+	return false
+}
+
+func (fc *funcContext) HasToBeClosed() bool {
+	for block := fc.Block; block != nil; block = block.Parent {
+		if block.ToBeClosed {
+			return true
+		}
+	}
+	return false
+}
+
 func (fc *funcContext) LocalVars() []varNamePoolValue {
 	result := make([]varNamePoolValue, 0, 32)
 	for _, block := range fc.Blocks {
@@ -438,14 +547,46 @@ func (fc *funcContext) CloseUpvalues() int {
 func (fc *funcContext) LeaveBlock() int {
 	closed := fc.CloseUpvalues()
 	fc.EndScope()
+	fc.leaveGotos()
 	fc.Block = fc.Block.Parent
 	fc.SetRegTop(fc.Block.LocalVars.LastIndex())
 	return closed
 }
 
+// leaveGotos moves pending gotos of the current block to the parent block.
+// Gotos that leave a block with captured variables close them.
+func (fc *funcContext) leaveGotos() {
+	level := fc.Block.LocalVars.offset
+	for _, g := range fc.Block.Gotos {
+		if fc.Block.RefUpvalue && (g.Close < 0 || level < g.Close) {
+			g.Close = level
+		}
+		if g.NActVar > level {
+			g.NActVar = level
+		}
+		fc.Block.Parent.Gotos = append(fc.Block.Parent.Gotos, g)
+	}
+}
+
+func (fc *funcContext) FindGotoLabel(name string) *gotoLabel {
+	for block := fc.Block; block != nil; block = block.Parent {
+		for _, label := range block.Labels {
+			if label.Name == name {
+				return label
+			}
+		}
+	}
+	return nil
+}
+
 func (fc *funcContext) EndScope() {
-	for _, vr := range fc.Block.LocalVars.List() {
-		fc.Proto.DbgLocals[vr.Index].EndPc = fc.Code.LastPC()
+	// variables of the block are the last ones whose scopes are not ended yet
+	n := len(fc.Block.LocalVars.Names())
+	for i := len(fc.Proto.DbgLocals) - 1; i >= 0 && n > 0; i-- {
+		if local := fc.Proto.DbgLocals[i]; local.EndPc < 0 {
+			local.EndPc = fc.Code.LastPC()
+			n--
+		}
 	}
 }
 
@@ -463,11 +604,31 @@ func (fc *funcContext) RegTop() int {
 /* FuncContext }}} */
 
 func compileChunk(context *funcContext, chunk []ast.Stmt) { // {{{
-	for _, stmt := range chunk {
+	for i, stmt := range chunk {
+		if st, ok := stmt.(*ast.LabelStmt); ok {
+			compileLabelStmt(context, st, isBlockEnd(chunk[i+1:]))
+			continue
+		}
 		compileStmt(context, stmt)
 	}
+	if context.Block.Parent == nil {
+		for _, g := range context.Block.Gotos {
+			raiseCompileErrorAt(context, g.Line, g.Column, "no visible label '%v' for goto", g.Name)
+		}
+	}
 } // }}}
 
+// isBlockEnd reports whether the statements are only labels, a label followed
+// by them is at the end of the block.
+func isBlockEnd(chunk []ast.Stmt) bool {
+	for _, stmt := range chunk {
+		if _, ok := stmt.(*ast.LabelStmt); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func compileBlock(context *funcContext, chunk []ast.Stmt) { // {{{
 	if len(chunk) == 0 {
 		return
@@ -476,13 +637,12 @@ func compileBlock(context *funcContext, chunk []ast.Stmt) { // {{{
 	ph.SetLine(sline(chunk[0]))
 	ph.SetLastLine(eline(chunk[len(chunk)-1]))
 	context.EnterBlock(labelNoJump, ph)
-	for _, stmt := range chunk {
-		compileStmt(context, stmt)
-	}
+	compileChunk(context, chunk)
 	context.LeaveBlock()
 } // }}}
 
 func compileStmt(context *funcContext, stmt ast.Stmt) { // {{{
+	defer context.Code.PopColumn(context.Code.PushColumn(stmt))
 	switch st := stmt.(type) {
 	case *ast.AssignStmt:
 		compileAssignStmt(context, st)
@@ -506,6 +666,8 @@ func compileStmt(context *funcContext, stmt ast.Stmt) { // {{{
 		compileIfStmt(context, st)
 	case *ast.BreakStmt:
 		compileBreakStmt(context, st)
+	case *ast.GotoStmt:
+		compileGotoStmt(context, st)
 	case *ast.NumberForStmt:
 		compileNumberForStmt(context, st)
 	case *ast.GenericForStmt:
@@ -521,6 +683,9 @@ func compileAssignStmtLeft(context *funcContext, stmt *ast.AssignStmt) (int, []*
 		switch st := lhs.(type) {
 		case *ast.IdentExpr:
 			identtype := getIdentRefType(context, context, st)
+			if identtype != ecGlobal && context.IsConstVar(st.Value) {
+				raiseCompileError(context, sline(st), "attempt to assign to const variable '%v'", st.Value)
+			}
 			ec := &expcontext{identtype, regNotDefined, 0}
 			switch identtype {
 			case ecGlobal:
@@ -621,7 +786,11 @@ func compileAssignStmt(context *funcContext, stmt *ast.AssignStmt) { // {{{
 				reg -= 1
 			}
 		case ecGlobal:
-			code.AddABx(OP_SETGLOBAL, reg, context.ConstIndex(LString(ex.(*ast.IdentExpr).Value)), sline(ex))
+			if Lua52Env {
+				compileEnvSet(context, reg, ex.(*ast.IdentExpr).Value, sline(ex))
+			} else {
+				code.AddABx(OP_SETGLOBAL, reg, context.ConstIndex(LString(ex.(*ast.IdentExpr).Value)), sline(ex))
+			}
 			reg -= 1
 		case ecUpvalue:
 			code.AddABC(OP_SETUPVAL, reg, context.Upvalues.RegisterUnique(ex.(*ast.IdentExpr).Value), 0, sline(ex))
@@ -677,20 +846,52 @@ func compileRegAssignment(context *funcContext, names []string, exprs []ast.Expr
 
 func compileLocalAssignStmt(context *funcContext, stmt *ast.LocalAssignStmt) { // {{{
 	reg := context.RegTop()
+	isfunc := false
 	if len(stmt.Names) == 1 && len(stmt.Exprs) == 1 {
-		if _, ok := stmt.Exprs[0].(*ast.FunctionExpr); ok {
-			context.RegisterLocalVar(stmt.Names[0])
-			compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
-			return
-		}
+		_, isfunc = stmt.Exprs[0].(*ast.FunctionExpr)
 	}
 
-	compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
-	for _, name := range stmt.Names {
-		context.RegisterLocalVar(name)
+	var tbc int
+	if isfunc {
+		tbc = registerLocalVars(context, stmt)
+		compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
+	} else {
+		compileRegAssignment(context, stmt.Names, stmt.Exprs, reg, len(stmt.Names), sline(stmt))
+		tbc = registerLocalVars(context, stmt)
+	}
+	if tbc > -1 {
+		// to-be-closed variables are closed like upvalues when the block ends.
+		context.Block.RefUpvalue = true
+		context.Block.ToBeClosed = true
+		context.Code.AddABC(OP_TBC, tbc, 0, 0, sline(stmt))
 	}
 } // }}}
 
+func registerLocalVars(context *funcContext, stmt *ast.LocalAssignStmt) int { // {{{
+	tbc := -1
+	for i, name := range stmt.Names {
+		idx := context.RegisterLocalVar(name)
+		attrib := ""
+		if i < len(stmt.Attribs) {
+			attrib = stmt.Attribs[i]
+		}
+		switch attrib {
+		case "":
+		case "const":
+			context.Block.LocalVars.SetConst(idx)
+		case "close":
+			if tbc > -1 {
+				raiseCompileError(context, sline(stmt), "multiple to-be-closed variables in local list")
+			}
+			context.Block.LocalVars.SetConst(idx)
+			tbc = idx
+		default:
+			raiseCompileError(context, sline(stmt), "unknown attribute '%v'", attrib)
+		}
+	}
+	return tbc
+} // }}}
+
 func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 	lenexprs := len(stmt.Exprs)
 	code := context.Code
@@ -706,6 +907,10 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 				return
 			}
 		case *ast.FuncCallExpr:
+			if context.HasToBeClosed() {
+				// variables must be closed after the call returns
+				break
+			}
 			reg += compileExpr(context, reg, ex, ecnone(-2))
 			code.SetOpCode(code.LastPC(), OP_TAILCALL)
 			code.AddABC(OP_RETURN, a, 0, 0, sline(stmt))
@@ -728,6 +933,15 @@ func compileReturnStmt(context *funcContext, stmt *ast.ReturnStmt) { // {{{
 } // }}}
 
 func compileIfStmt(context *funcContext, stmt *ast.IfStmt) { // {{{
+	if value, ok := constValue(constFold(stmt.Condition)); ok {
+		live, dead := stmt.Then, stmt.Else
+		if !LVAsBool(value) {
+			live, dead = dead, live
+		}
+		discardCode(context, func() { compileBlock(context, dead) })
+		compileBlock(context, live)
+		return
+	}
 	thenlabel := context.NewLabel()
 	elselabel := context.NewLabel()
 	endlabel := context.NewLabel()
@@ -747,7 +961,7 @@ func compileIfStmt(context *funcContext, stmt *ast.IfStmt) { // {{{
 } // }}}
 
 func compileBranchCondition(context *funcContext, reg int, expr ast.Expr, thenlabel, elselabel int, hasnextcond bool) { // {{{
-	// TODO folding constants?
+	expr = constFold(expr)
 	code := context.Code
 	flip := 0
 	jumplabel := elselabel
@@ -762,7 +976,7 @@ func compileBranchCondition(context *funcContext, reg int, expr ast.Expr, thenla
 			code.AddASbx(OP_JMP, 0, elselabel, sline(expr))
 			return
 		}
-	case *ast.TrueExpr, *ast.NumberExpr, *ast.StringExpr:
+	case *ast.TrueExpr, *ast.NumberExpr, *ast.StringExpr, *constLValueExpr:
 		if !hasnextcond {
 			return
 		}
@@ -794,7 +1008,35 @@ func compileBranchCondition(context *funcContext, reg int, expr ast.Expr, thenla
 	code.AddASbx(OP_JMP, 0, jumplabel, sline(expr))
 } // }}}
 
+// discardCode runs the function, which compiles code that is never run, and
+// discards the code. The code is compiled to report its errors.
+func discardCode(context *funcContext, compile func()) { // {{{
+	code := context.Code
+	pc := code.LastPC()
+	nlocals := len(context.Proto.DbgLocals)
+	nprotos := len(context.Proto.FunctionPrototypes)
+	compile()
+	for code.LastPC() > pc {
+		code.Pop()
+	}
+	context.Proto.DbgLocals = context.Proto.DbgLocals[:nlocals]
+	context.Proto.FunctionPrototypes = context.Proto.FunctionPrototypes[:nprotos]
+	for _, g := range context.Block.Gotos {
+		if g.Pc > pc {
+			g.Discarded = true
+		}
+	}
+} // }}}
+
 func compileWhileStmt(context *funcContext, stmt *ast.WhileStmt) { // {{{
+	if value, ok := constValue(constFold(stmt.Condition)); ok && !LVAsBool(value) {
+		discardCode(context, func() { compileWhileLoop(context, stmt) })
+		return
+	}
+	compileWhileLoop(context, stmt)
+} // }}}
+
+func compileWhileLoop(context *funcContext, stmt *ast.WhileStmt) { // {{{
 	thenlabel := context.NewLabel()
 	elselabel := context.NewLabel()
 	condlabel := context.NewLabel()
@@ -818,6 +1060,7 @@ func compileRepeatStmt(context *funcContext, stmt *ast.RepeatStmt) { // {{{
 	context.SetLabelPc(initlabel, context.Code.LastPC())
 	context.SetLabelPc(elselabel, context.Code.LastPC())
 	context.EnterBlock(thenlabel, stmt)
+	context.Block.RepeatBody = true
 	compileChunk(context, stmt.Stmts)
 	compileBranchCondition(context, context.RegTop(), stmt.Condition, thenlabel, elselabel, false)
 
@@ -836,9 +1079,11 @@ func compileRepeatStmt(context *funcContext, stmt *ast.RepeatStmt) { // {{{
 } // }}}
 
 func compileBreakStmt(context *funcContext, stmt *ast.BreakStmt) { // {{{
+	refupvalue := false
 	for block := context.Block; block != nil; block = block.Parent {
+		refupvalue = refupvalue || block.RefUpvalue
 		if label := block.BreakLabel; label != labelNoJump {
-			if block.RefUpvalue {
+			if refupvalue {
 				context.Code.AddABC(OP_CLOSE, block.Parent.LocalVars.LastIndex(), 0, 0, sline(stmt))
 			}
 			context.Code.AddASbx(OP_JMP, 0, label, sline(stmt))
@@ -848,6 +1093,59 @@ func compileBreakStmt(context *funcContext, stmt *ast.BreakStmt) { // {{{
 	raiseCompileError(context, sline(stmt), "no loop to break")
 } // }}}
 
+func compileGotoStmt(context *funcContext, stmt *ast.GotoStmt) { // {{{
+	code := context.Code
+	if label := context.FindGotoLabel(stmt.Label); label != nil {
+		a := 0
+		if context.RegTop() > label.NActVar {
+			a = label.NActVar + 1
+		}
+		code.AddASbx(OP_JMP, a, label.Label, sline(stmt))
+		return
+	}
+	label := context.NewLabel()
+	code.AddASbx(OP_JMP, 0, label, sline(stmt))
+	context.Block.Gotos = append(context.Block.Gotos, &pendingGoto{
+		Name: stmt.Label, Pc: code.LastPC(), Label: label, NActVar: context.RegTop(), Close: -1, Line: sline(stmt),
+		Column: stmt.Column()})
+} // }}}
+
+func compileLabelStmt(context *funcContext, stmt *ast.LabelStmt, atend bool) { // {{{
+	code := context.Code
+	block := context.Block
+	if label := context.FindGotoLabel(stmt.Name); label != nil {
+		raiseCompileError(context, sline(stmt), "label '%v' already defined on line %v", stmt.Name, label.Line)
+	}
+	nactvar := context.RegTop()
+	if atend && !block.RepeatBody {
+		// local variables of the block are already out of scope.
+		nactvar = block.LocalVars.offset
+	}
+	label := &gotoLabel{Name: stmt.Name, Label: context.NewLabel(), NActVar: nactvar, Line: sline(stmt)}
+	context.SetLabelPc(label.Label, code.LastPC())
+	block.Labels = append(block.Labels, label)
+
+	gotos := block.Gotos[:0]
+	for _, g := range block.Gotos {
+		if g.Name != stmt.Name {
+			gotos = append(gotos, g)
+			continue
+		}
+		if g.NActVar < nactvar {
+			raiseCompileErrorAt(context, g.Line, g.Column, "<goto %v> at line %v jumps into the scope of local '%v'",
+				g.Name, g.Line, block.LocalVars.names[g.NActVar-block.LocalVars.offset])
+		}
+		if g.Discarded {
+			continue
+		}
+		context.SetLabelPc(g.Label, code.LastPC())
+		if g.Close > -1 {
+			code.SetA(g.Pc, g.Close+1)
+		}
+	}
+	block.Gotos = gotos
+} // }}}
+
 func compileFuncDefStmt(context *funcContext, stmt *ast.FuncDefStmt) { // {{{
 	if stmt.Name.Func == nil {
 		reg := context.RegTop()
@@ -882,12 +1180,14 @@ func compileNumberForStmt(context *funcContext, stmt *ast.NumberForStmt) { // {{
 
 	reg = context.RegTop()
 	rstep := context.RegisterLocalVar("(for step)")
-	if stmt.Step == nil {
-		stmt.Step = &ast.NumberExpr{Value: "1"}
-		stmt.Step.SetLine(sline(stmt.Init))
+	step := stmt.Step
+	if step == nil {
+		step = &ast.NumberExpr{Value: "1"}
+		step.SetLine(sline(stmt.Init))
+		step.SetColumn(stmt.Init.Column())
 	}
 	ecupdate(ec, ecLocal, rstep, 0)
-	compileExpr(context, reg, stmt.Step, ec)
+	compileExpr(context, reg, step, ec)
 
 	code.AddASbx(OP_FORPREP, rindex, 0, sline(stmt))
 
@@ -906,6 +1206,10 @@ func compileNumberForStmt(context *funcContext, stmt *ast.NumberForStmt) { // {{
 
 } // }}}
 
+// genericForValues are the values that the expressions of a generic for
+// statement are adjusted to.
+var genericForValues = []string{"(for generator)", "(for state)", "(for control)", "(for closing)"}
+
 func compileGenericForStmt(context *funcContext, stmt *ast.GenericForStmt) { // {{{
 	code := context.Code
 	endlabel := context.NewLabel()
@@ -914,14 +1218,24 @@ func compileGenericForStmt(context *funcContext, stmt *ast.GenericForStmt) { //
 	nnames := len(stmt.Names)
 
 	context.EnterBlock(endlabel, stmt)
+	// the closing value of Lua 5.4 is kept below the generator, so that
+	// OP_TFORLOOP stores the values at RA+3 as before.
+	rclose := context.RegisterLocalVar("(for closing)")
 	rgen := context.RegisterLocalVar("(for generator)")
 	context.RegisterLocalVar("(for state)")
 	context.RegisterLocalVar("(for control)")
 
-	compileRegAssignment(context, stmt.Names, stmt.Exprs, context.RegTop()-3, 3, sline(stmt))
+	compileRegAssignment(context, genericForValues, stmt.Exprs, rgen, len(genericForValues), sline(stmt))
+	code.AddABC(OP_MOVE, rclose, rgen+3, 0, sline(stmt))
+	// the closing value is closed when the loop ends, like a to-be-closed
+	// variable.
+	context.Block.RefUpvalue = true
+	context.Block.ToBeClosed = true
+	code.AddABC(OP_TBC, rclose, 0, 0, sline(stmt))
 
 	code.AddASbx(OP_JMP, 0, fllabel, sline(stmt))
 
+	context.EnterBlock(labelNoJump, stmt)
 	for _, name := range stmt.Names {
 		context.RegisterLocalVar(name)
 	}
@@ -935,11 +1249,19 @@ func compileGenericForStmt(context *funcContext, stmt *ast.GenericForStmt) { //
 	code.AddABC(OP_TFORLOOP, rgen, 0, nnames, sline(stmt))
 	code.AddASbx(OP_JMP, 0, bodylabel, sline(stmt))
 
+	context.LeaveBlock()
 	context.SetLabelPc(endlabel, code.LastPC())
 } // }}}
 
 func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) int { // {{{
+	switch expr.(type) {
+	case *ast.StringConcatOpExpr, *ast.RelationalOpExpr, *ast.LogicalOpExpr, *ast.UnaryNotOpExpr:
+		if folded := constFold(expr); folded != expr {
+			return compileExpr(context, reg, folded, ec)
+		}
+	}
 	code := context.Code
+	defer code.PopColumn(code.PushColumn(expr))
 	sreg := savereg(ec, reg)
 	sused := 1
 	if sreg < reg {
@@ -951,11 +1273,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(LString(ex.Value)), sline(ex))
 		return sused
 	case *ast.NumberExpr:
-		num, err := parseNumber(ex.Value)
-		if err != nil {
-			num = LNumber(math.NaN())
-		}
-		code.AddABx(OP_LOADK, sreg, context.ConstIndex(num), sline(ex))
+		code.AddABx(OP_LOADK, sreg, context.ConstIndex(numberExprValue(ex)), sline(ex))
 		return sused
 	case *constLValueExpr:
 		code.AddABx(OP_LOADK, sreg, context.ConstIndex(ex.Value), sline(ex))
@@ -972,7 +1290,11 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.IdentExpr:
 		switch getIdentRefType(context, context, ex) {
 		case ecGlobal:
-			code.AddABx(OP_GETGLOBAL, sreg, context.ConstIndex(LString(ex.Value)), sline(ex))
+			if Lua52Env {
+				compileEnvGet(context, sreg, ex.Value, sline(ex))
+			} else {
+				code.AddABx(OP_GETGLOBAL, sreg, context.ConstIndex(LString(ex.Value)), sline(ex))
+			}
 		case ecUpvalue:
 			code.AddABC(OP_GETUPVAL, sreg, context.Upvalues.RegisterUnique(ex.Value), 0, sline(ex))
 		case ecLocal:
@@ -1007,7 +1329,7 @@ func compileExpr(context *funcContext, reg int, expr ast.Expr, ec *expcontext) i
 	case *ast.StringConcatOpExpr:
 		compileStringConcatOpExpr(context, reg, ex, ec)
 		return sused
-	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr:
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
 		compileUnaryOpExpr(context, reg, ex, ec)
 		return sused
 	case *ast.RelationalOpExpr:
@@ -1064,47 +1386,221 @@ func compileExprWithMVPropagation(context *funcContext, expr ast.Expr, reg *int,
 	compileExprWithPropagation(context, expr, reg, save, context.Code.PropagateMV)
 } // }}}
 
+// constFold evaluates the constant parts of the expression: arithmetic on
+// numbers, concatenations of trailing strings and numbers, comparisons of
+// constants, and logical operators whose left operands are constants.
+// Operations that raise errors at runtime are not folded.
 func constFold(exp ast.Expr) ast.Expr { // {{{
 	switch expr := exp.(type) {
 	case *ast.ArithmeticOpExpr:
-		lvalue, lisconst := lnumberValue(expr.Lhs)
-		rvalue, risconst := lnumberValue(expr.Rhs)
+		lhs, rhs := constFold(expr.Lhs), constFold(expr.Rhs)
+		lvalue, lisconst := constNumberValue(lhs)
+		rvalue, risconst := constNumberValue(rhs)
 		if lisconst && risconst {
-			switch expr.Operator {
-			case "+":
-				return &constLValueExpr{Value: lvalue + rvalue}
-			case "-":
-				return &constLValueExpr{Value: lvalue - rvalue}
-			case "*":
-				return &constLValueExpr{Value: lvalue * rvalue}
-			case "/":
-				return &constLValueExpr{Value: lvalue / rvalue}
-			case "%":
-				return &constLValueExpr{Value: luaModulo(lvalue, rvalue)}
-			case "^":
-				return &constLValueExpr{Value: LNumber(math.Pow(float64(lvalue), float64(rvalue)))}
-			default:
-				panic(fmt.Sprintf("unknwon binop: %v", expr.Operator))
+			if value, ok := foldArith(expr.Operator, lvalue, rvalue); ok {
+				return newConstExpr(value, expr)
+			}
+		}
+		if lhs == expr.Lhs && rhs == expr.Rhs {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Lhs = lhs
+		retexpr.Rhs = rhs
+		return &retexpr
+	case *ast.StringConcatOpExpr:
+		// concatenations are evaluated from the right, so only the trailing
+		// constants can be folded without changing the operands of __concat.
+		lhs, rhs := constFold(expr.Lhs), constFold(expr.Rhs)
+		lstr, lisconst := constStringValue(lhs)
+		rstr, risconst := constStringValue(rhs)
+		if lisconst && risconst {
+			return newConstExpr(LString(lstr+rstr), expr)
+		}
+		if lhs == expr.Lhs && rhs == expr.Rhs {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Lhs = lhs
+		retexpr.Rhs = rhs
+		return &retexpr
+	case *ast.RelationalOpExpr:
+		lhs, rhs := constFold(expr.Lhs), constFold(expr.Rhs)
+		lvalue, lisconst := constValue(lhs)
+		rvalue, risconst := constValue(rhs)
+		if lisconst && risconst {
+			if value, ok := foldComparison(expr.Operator, lvalue, rvalue); ok {
+				return newConstExpr(LBool(value), expr)
 			}
-		} else {
-			retexpr := *expr
-			retexpr.Lhs = constFold(expr.Lhs)
-			retexpr.Rhs = constFold(expr.Rhs)
-			return &retexpr
 		}
+		if lhs == expr.Lhs && rhs == expr.Rhs {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Lhs = lhs
+		retexpr.Rhs = rhs
+		return &retexpr
+	case *ast.LogicalOpExpr:
+		lhs, rhs := constFold(expr.Lhs), constFold(expr.Rhs)
+		// the result is truncated to one value, so calls and varargs can not
+		// be the result by themselves.
+		if lvalue, ok := constValue(lhs); ok && !isVarArgReturnExpr(rhs) {
+			if LVAsBool(lvalue) == (expr.Operator == "and") {
+				return rhs
+			}
+			return lhs
+		}
+		if lhs == expr.Lhs && rhs == expr.Rhs {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Lhs = lhs
+		retexpr.Rhs = rhs
+		return &retexpr
 	case *ast.UnaryMinusOpExpr:
-		expr.Expr = constFold(expr.Expr)
-		if value, ok := lnumberValue(expr.Expr); ok {
-			return &constLValueExpr{Value: LNumber(-value)}
+		operand := constFold(expr.Expr)
+		if value, ok := constNumberValue(operand); ok {
+			return newConstExpr(unaryMinus(value), expr)
 		}
-		return expr
-	default:
-
-		return exp
+		if operand == expr.Expr {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Expr = operand
+		return &retexpr
+	case *ast.UnaryNotOpExpr:
+		operand := constFold(expr.Expr)
+		if value, ok := constValue(operand); ok {
+			return newConstExpr(LBool(!LVAsBool(value)), expr)
+		}
+		if operand == expr.Expr {
+			return expr
+		}
+		retexpr := *expr
+		retexpr.Expr = operand
+		return &retexpr
 	}
 	return exp
 } // }}}
 
+// newConstExpr returns the expression of the folded constant at the position
+// of the expression it replaces.
+func newConstExpr(value LValue, pos ast.PositionHolder) ast.Expr {
+	var expr ast.Expr
+	switch value {
+	case LNil:
+		expr = &ast.NilExpr{}
+	case LTrue:
+		expr = &ast.TrueExpr{}
+	case LFalse:
+		expr = &ast.FalseExpr{}
+	default:
+		expr = &constLValueExpr{Value: value}
+	}
+	expr.SetLine(pos.Line())
+	expr.SetLastLine(pos.LastLine())
+	expr.SetColumn(pos.Column())
+	return expr
+}
+
+// constValue returns the value of the constant expression.
+func constValue(expr ast.Expr) (LValue, bool) {
+	switch ex := expr.(type) {
+	case *ast.NilExpr:
+		return LNil, true
+	case *ast.TrueExpr:
+		return LTrue, true
+	case *ast.FalseExpr:
+		return LFalse, true
+	case *ast.NumberExpr:
+		return numberExprValue(ex), true
+	case *ast.StringExpr:
+		return LString(ex.Value), true
+	case *constLValueExpr:
+		return ex.Value, true
+	}
+	return LNil, false
+}
+
+// constNumberValue returns the value of the constant number expression.
+func constNumberValue(expr ast.Expr) (LValue, bool) {
+	if value, ok := constValue(expr); ok && value.Type() == LTNumber {
+		return value, true
+	}
+	return LNil, false
+}
+
+// constStringValue returns the value of the constant string or number
+// expression converted to a string like concatenations do.
+func constStringValue(expr ast.Expr) (string, bool) {
+	if value, ok := constValue(expr); ok && LVCanConvToString(value) {
+		return LVAsString(value), true
+	}
+	return "", false
+}
+
+// foldArith returns the result of the arithmetic operator on the numbers like
+// the VM, or false if the operation raises an error or the operator is
+// disabled.
+func foldArith(operator string, lhs, rhs LValue) (LValue, bool) {
+	opcode := arithmeticOpCode(operator)
+	switch opcode {
+	case OP_MOD, OP_IDIV:
+		if opcode == OP_IDIV && !Lua53Operators {
+			return LNil, false
+		}
+		_, lisint := lhs.(LInteger)
+		if i, ok := rhs.(LInteger); lisint && ok && i == 0 {
+			return LNil, false
+		}
+	case OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		_, ok1 := toIntegerValue(lhs)
+		_, ok2 := toIntegerValue(rhs)
+		if !Lua53Operators || !ok1 || !ok2 {
+			return LNil, false
+		}
+	}
+	// the state is used only to raise the errors excluded above.
+	v1, ok1 := lhs.(LNumber)
+	v2, ok2 := rhs.(LNumber)
+	if ok1 && ok2 && !Lua53Integer {
+		return numberArith(nil, opcode, v1, v2), true
+	}
+	if Lua53Integer {
+		return arith53(nil, opcode, lhs, rhs)
+	}
+	return LNil, false
+}
+
+// foldComparison returns the result of the relational operator on the
+// constants, or false if the comparison raises an error.
+func foldComparison(operator string, lhs, rhs LValue) (bool, bool) {
+	switch operator {
+	case "==":
+		return equals(nil, lhs, rhs, true), true
+	case "~=":
+		return !equals(nil, lhs, rhs, true), true
+	case ">", ">=":
+		lhs, rhs = rhs, lhs
+	}
+	var c int
+	if n, ok := compareNumbers(lhs, rhs); ok {
+		c = n
+	} else if s1, ok := lhs.(LString); ok {
+		s2, ok := rhs.(LString)
+		if !ok {
+			return false, false
+		}
+		c = strCmp(string(s1), string(s2))
+	} else {
+		return false, false
+	}
+	if operator == "<" || operator == ">" {
+		return c < 0, true
+	}
+	return c < 0 || c == 0, true
+}
+
 func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *expcontext) { // {{{
 	context.Proto.LineDefined = sline(funcexpr)
 	context.Proto.LastLineDefined = eline(funcexpr)
@@ -1135,9 +1631,11 @@ func compileFunctionExpr(context *funcContext, funcexpr *ast.FunctionExpr, ec *e
 	context.EndScope()
 	context.Proto.Code = context.Code.List()
 	context.Proto.DbgSourcePositions = context.Code.PosList()
+	context.Proto.DbgSourceColumns = context.Code.ColumnList()
 	context.Proto.DbgUpvalues = context.Upvalues.Names()
 	context.Proto.NumUpvalues = uint8(len(context.Proto.DbgUpvalues))
 	patchCode(context)
+	optimizeCode(context.Proto)
 } // }}}
 
 func compileTableExpr(context *funcContext, reg int, ex *ast.TableExpr, ec *expcontext) { // {{{
@@ -1218,23 +1716,33 @@ func compileArithmeticOpExpr(context *funcContext, reg int, expr *ast.Arithmetic
 	c := reg
 	compileExprWithKMVPropagation(context, expr.Rhs, &reg, &c)
 
-	op := 0
-	switch expr.Operator {
+	op := arithmeticOpCode(expr.Operator)
+	if _, isbitwise := bitwiseOpCodes[expr.Operator]; (isbitwise || op == OP_IDIV) && !Lua53Operators {
+		raiseCompileError(context, sline(expr), "operator '%v' is not supported (Lua53Operators is disabled)", expr.Operator)
+	}
+	context.Code.AddABC(op, a, b, c, sline(expr))
+} // }}}
+
+// arithmeticOpCode returns the opcode of the arithmetic or bitwise operator.
+func arithmeticOpCode(operator string) int {
+	switch operator {
 	case "+":
-		op = OP_ADD
+		return OP_ADD
 	case "-":
-		op = OP_SUB
+		return OP_SUB
 	case "*":
-		op = OP_MUL
+		return OP_MUL
 	case "/":
-		op = OP_DIV
+		return OP_DIV
 	case "%":
-		op = OP_MOD
+		return OP_MOD
 	case "^":
-		op = OP_POW
+		return OP_POW
+	case "//":
+		return OP_IDIV
 	}
-	context.Code.AddABC(op, a, b, c, sline(expr))
-} // }}}
+	return bitwiseOpCodes[operator]
+}
 
 func compileStringConcatOpExpr(context *funcContext, reg int, expr *ast.StringConcatOpExpr, ec *expcontext) { // {{{
 	code := context.Code
@@ -1287,6 +1795,12 @@ func compileUnaryOpExpr(context *funcContext, reg int, expr ast.Expr, ec *expcon
 	case *ast.UnaryLenOpExpr:
 		opcode = OP_LEN
 		operandexpr = ex.Expr
+	case *ast.UnaryBNotOpExpr:
+		if !Lua53Operators {
+			raiseCompileError(context, sline(expr), "operator '~' is not supported (Lua53Operators is disabled)")
+		}
+		opcode = OP_BNOT
+		operandexpr = ex.Expr
 	}
 
 	a := savereg(ec, reg)
@@ -1365,7 +1879,6 @@ func compileLogicalOpExpr(context *funcContext, reg int, expr *ast.LogicalOpExpr
 } // }}}
 
 func compileLogicalOpExprAux(context *funcContext, reg int, expr ast.Expr, ec *expcontext, thenlabel, elselabel int, hasnextcond bool, lb *lblabels) { // {{{
-	// TODO folding constants?
 	code := context.Code
 	flip := 0
 	jumplabel := elselabel
@@ -1399,7 +1912,7 @@ func compileLogicalOpExprAux(context *funcContext, reg int, expr ast.Expr, ec *e
 			code.AddASbx(OP_JMP, 0, thenlabel, sline(expr))
 		}
 		return
-	case *ast.NumberExpr, *ast.StringExpr:
+	case *ast.NumberExpr, *ast.StringExpr, *constLValueExpr:
 		if thenlabel == lb.e {
 			compileExpr(context, reg, expr, ec)
 			code.AddASbx(OP_JMP, 0, lb.e, sline(expr))
@@ -1511,6 +2024,10 @@ func loadRk(context *funcContext, reg *int, expr ast.Expr, cnst LValue) int { //
 
 func getIdentRefType(context *funcContext, current *funcContext, expr *ast.IdentExpr) expContextType { // {{{
 	if current == nil {
+		if Lua52Env && expr.Value == envName {
+			// _ENV is an upvalue of the main chunk
+			return ecUpvalue
+		}
 		return ecGlobal
 	} else if current.FindLocalVar(expr.Value) > -1 {
 		if current == context {
@@ -1521,6 +2038,37 @@ func getIdentRefType(context *funcContext, current *funcContext, expr *ast.Ident
 	return getIdentRefType(context, current.Parent, expr)
 } // }}}
 
+// envKey returns the RK operand of the global variable name. The name is
+// loaded to the register if the constant index does not fit in the operand.
+func envKey(context *funcContext, reg int, name string, line int) int { // {{{
+	cindex := context.ConstIndex(LString(name))
+	if cindex <= opMaxIndexRk {
+		return opRkAsk(cindex)
+	}
+	context.Code.AddABx(OP_LOADK, reg, cindex, line)
+	return reg
+} // }}}
+
+func compileEnvGet(context *funcContext, reg int, name string, line int) { // {{{
+	key := envKey(context, reg, name, line)
+	env := &ast.IdentExpr{Value: envName}
+	if getIdentRefType(context, context, env) == ecLocal {
+		context.Code.AddABC(OP_GETTABLE, reg, context.FindLocalVar(envName), key, line)
+	} else {
+		context.Code.AddABC(OP_GETTABUP, reg, context.Upvalues.RegisterUnique(envName), key, line)
+	}
+} // }}}
+
+func compileEnvSet(context *funcContext, reg int, name string, line int) { // {{{
+	key := envKey(context, reg+1, name, line)
+	env := &ast.IdentExpr{Value: envName}
+	if getIdentRefType(context, context, env) == ecLocal {
+		context.Code.AddABC(OP_SETTABLE, context.FindLocalVar(envName), key, reg, line)
+	} else {
+		context.Code.AddABC(OP_SETTABUP, context.Upvalues.RegisterUnique(envName), key, reg, line)
+	}
+} // }}}
+
 func getExprName(context *funcContext, expr ast.Expr) string { // {{{
 	switch ex := expr.(type) {
 	case *ast.IdentExpr:
@@ -1544,7 +2092,7 @@ func patchCode(context *funcContext) { // {{{
 	}
 	for pc, inst := range context.Code.List() {
 		switch opGetOpCode(inst) {
-		case OP_SETGLOBAL, OP_SETUPVAL, OP_EQ, OP_LT, OP_LE, OP_TEST,
+		case OP_SETGLOBAL, OP_SETUPVAL, OP_SETTABUP, OP_EQ, OP_LT, OP_LE, OP_TEST,
 			OP_TAILCALL, OP_RETURN, OP_FORPREP, OP_FORLOOP, OP_TFORLOOP,
 			OP_SETLIST, OP_CLOSE:
 			/* nothing to do */
@@ -1567,7 +2115,7 @@ func patchCode(context *funcContext) { // {{{
 		case OP_JMP: // jump to jump optimization
 			distance := 0
 			count := 0 // avoiding infinite loops
-			for jmp := inst; opGetOpCode(jmp) == OP_JMP && count < 5; jmp = context.Code.At(pc + distance + 1) {
+			for jmp := inst; count < 5; jmp = context.Code.At(pc + distance + 1) {
 				d := context.GetLabelPc(opGetArgSbx(jmp)) - pc
 				if d > opMaxArgSbx {
 					if distance == 0 {
@@ -1577,8 +2125,17 @@ func patchCode(context *funcContext) { // {{{
 				}
 				distance = d
 				count++
+				// jumps that close variables and jumps that are already patched
+				// can not be skipped.
+				next := pc + distance + 1
+				if next <= pc || next >= len(context.Code.List()) {
+					break
+				}
+				if nextinst := context.Code.At(next); opGetOpCode(nextinst) != OP_JMP || opGetArgA(nextinst) != 0 {
+					break
+				}
 			}
-			if distance == 0 {
+			if distance == 0 && opGetArgA(inst) == 0 {
 				context.Code.SetOpCode(pc, OP_NOP)
 			} else {
 				context.Code.SetSbx(pc, distance)
@@ -1610,6 +2167,9 @@ func Compile(chunk []ast.Stmt, name string) (proto *FunctionProto, err error) {
 	parlist := &ast.ParList{HasVargs: true, Names: []string{}}
 	funcexpr := &ast.FunctionExpr{ParList: parlist, Stmts: chunk}
 	context := newFuncContext(name, nil)
+	if Lua52Env {
+		context.Upvalues.RegisterUnique(envName)
+	}
 	compileFunctionExpr(context, funcexpr, ecnone(0))
 	proto = context.Proto
 	return
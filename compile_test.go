@@ -0,0 +1,221 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func TestGoto(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local s = 0
+	for i = 1, 5 do
+	  if i % 2 == 0 then goto continue end
+	  s = s + i
+	  ::continue::
+	end
+	assert(s == 9)
+
+	local n = 0
+	::top::
+	n = n + 1
+	if n < 3 then goto top end
+	assert(n == 3)
+
+	-- a label at the end of a block is out of the scope of its locals.
+	do
+	  goto done
+	  local x = 1
+	  ::done::
+	end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGotoErrors(t *testing.T) {
+	cases := []struct {
+		code string
+		want string
+	}{
+		{"goto nowhere", "line(1) column(1) <string>: no visible label 'nowhere' for goto"},
+		{"do\n  goto l\n  local x\n  ::l::\n  print(x)\nend", "line(2) column(3)"},
+		{"repeat\n  goto cont\n  local x = 1\n  ::cont::\nuntil x", "<goto cont> at line 2 jumps into the scope of local 'x'"},
+		{"::l:: ::l::", "label 'l' already defined on line 1"},
+	}
+	for _, c := range cases {
+		L := NewState()
+		err := L.DoString(c.code)
+		L.Close()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want %q", c.code, err, c.want)
+		}
+	}
+}
+
+func TestLua53Operators(t *testing.T) {
+	defer func(old bool) { Lua53Operators = old }(Lua53Operators)
+	Lua53Operators = false
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`return 7 // 2`); err == nil || !strings.Contains(err.Error(), "Lua53Operators is disabled") {
+		t.Errorf("got %v, want a compile error", err)
+	}
+
+	Lua53Operators = true
+	err := L.DoString(`
+	assert(7 // 2 == 3 and -7 // 2 == -4 and 7.5 // 2 == 3)
+	assert(5 & 3 == 1 and 5 | 3 == 7 and 5 ~ 3 == 6 and ~0 == -1)
+	assert(1 << 4 == 16 and 256 >> 4 == 16 and 1 << 64 == 0)
+	local x = 6
+	assert(x // 4 == 1 and x & 2 == 2)
+
+	local mt = {
+	  __idiv = function() return "idiv" end,
+	  __band = function() return "band" end,
+	  __bnot = function() return "bnot" end,
+	  __shl = function() return "shl" end,
+	}
+	local o = setmetatable({}, mt)
+	assert(o // 1 == "idiv" and 1 & o == "band" and ~o == "bnot" and o << 1 == "shl")
+
+	local ok, err = pcall(function() return 1.5 & 1 end)
+	assert(not ok and err:find("number has no integer representation"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLua52Env(t *testing.T) {
+	defer func(old bool) { Lua52Env = old }(Lua52Env)
+	Lua52Env = true
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local sandbox = {}
+	local f = load("x = 1 return x", "sandbox", "t", sandbox)
+	assert(f() == 1 and sandbox.x == 1 and x == nil)
+
+	local assert = assert
+	do
+	  local _ENV = {y = 2}
+	  z = y
+	  assert(_ENV.z == 2)
+	end
+	assert(z == nil)
+
+	local function setenv(env)
+	  local _ENV = env
+	  return function() return value end
+	end
+	assert(setenv({value = "a"})() == "a")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadAST(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader(`return print(1 + 2)`), "<ast>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes []string
+	ast.InspectChunk(chunk, func(node ast.PositionHolder) bool {
+		switch n := node.(type) {
+		case *ast.IdentExpr:
+			nodes = append(nodes, n.Value)
+			if n.Value == "print" {
+				n.Value = "tostring"
+			}
+		case *ast.ArithmeticOpExpr:
+			nodes = append(nodes, n.Operator)
+		}
+		return true
+	})
+	if got := strings.Join(nodes, " "); got != "print +" {
+		t.Errorf("got %q, want %q", got, "print +")
+	}
+
+	L := NewState()
+	defer L.Close()
+	// the AST can be compiled more than once.
+	for i := 0; i < 2; i++ {
+		fn, err := L.LoadAST(chunk, "<ast>")
+		if err != nil {
+			t.Fatal(err)
+		}
+		L.Push(fn)
+		L.Call(0, 1)
+		if got := L.Get(-1); got != LString("3") {
+			t.Errorf("got %v, want \"3\"", got)
+		}
+		L.Pop(1)
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	hasOp := func(src string, op int) bool {
+		fn, err := L.LoadString(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, inst := range fn.Proto.Code {
+			if opGetOpCode(inst) == op {
+				return true
+			}
+		}
+		return false
+	}
+	if hasOp(`local x = 2 * 3 + 1 return x`, OP_MUL) || hasOp(`local x = 2 * 3 + 1 return x`, OP_ADD) {
+		t.Error("arithmetic on numbers must be folded")
+	}
+	if hasOp(`local x = "a" .. 1 .. "b" return x`, OP_CONCAT) {
+		t.Error("concatenations of constants must be folded")
+	}
+	if hasOp(`local x if false then x = 1 + y end return x`, OP_ADD) {
+		t.Error("dead branches must not be emitted")
+	}
+	if hasOp(`while false do y = y + 1 end`, OP_ADD) {
+		t.Error("while false loops must not be emitted")
+	}
+	if !hasOp(`local x = y .. "a" .. "b" return x`, OP_CONCAT) {
+		t.Error("concatenations of variables must not be folded")
+	}
+
+	err := L.DoString(`
+	assert(2 * 3 + 1 == 7 and -(2 ^ 2) == -4 and 7 % 3 == 1)
+	assert((1 < 2) == true and ("a" == "b") == false and not nil == true)
+	assert((nil or "x") == "x" and (1 and 2) == 2 and (false and error("x")) == false)
+	local function two() return 1, 2 end
+	assert(select("#", false or two()) == 1)
+
+	-- only the trailing constants are folded, so __concat gets the same operands.
+	local args = {}
+	local mt = {__concat = function(a, b) args[#args + 1] = type(a) .. ":" .. type(b) return "r" end}
+	local o = setmetatable({}, mt)
+	assert(o .. "a" .. "b" == "r")
+	assert(table.concat(args, " ") == "table:string", table.concat(args, " "))
+
+	-- the branches that are not emitted are still compiled.
+	local ok = loadstring("if false then local x = = 1 end")
+	assert(ok == nil)
+	local ok = loadstring("if false then goto nowhere end")
+	assert(ok == nil)
+
+	-- errors are raised at runtime.
+	assert(not pcall(function() return 1 + {} end))
+	assert(1 / 0 == math.huge)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,6 +12,34 @@ var CallStackSize = 1024
 var MaxTableGetLoop = 100
 var MaxArrayIndex = 67108864
 
+// Lua53Operators enables the floor division and bitwise operators of Lua 5.3.
+var Lua53Operators = false
+
+// Lua53Integer enables the integer subtype of numbers of Lua 5.3.
+var Lua53Integer = false
+
+// PatternCacheSize is the maximum number of compiled patterns that the string
+// library caches. 0 disables the cache.
+var PatternCacheSize = 256
+
+// FieldCacheSize is the number of the inline caches that each state uses to
+// read globals and fields with constant names without looking them up in the
+// tables again. It is rounded up to a power of two. 0 disables the caches.
+var FieldCacheSize = 256
+
+// InternStringMaxLen is the maximum length of strings that states intern, so
+// that short strings created repeatedly by scripts share their memory.
+var InternStringMaxLen = 40
+
+// InternStringsMax is the maximum number of strings that each state interns.
+// The interned strings are discarded when the state has interned this many
+// strings.
+var InternStringsMax = 4096
+
+// Lua52Env makes the compiler resolve global variables through the _ENV
+// variable of Lua 5.2.
+var Lua52Env = false
+
 type LNumber float64
 
 const LNumberBit = 64
@@ -22,6 +50,10 @@ var LuaLDir string
 var LuaPathDefault string
 var LuaOS string
 
+// ModuleFSPathDefault is the default package.path of states with
+// Options.ModuleFS.
+var ModuleFSPathDefault = "?.lua;?/init.lua"
+
 func init() {
 	if os.PathSeparator == '/' { // unix-like
 		LuaOS = "unix"
@@ -0,0 +1,392 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Converter converts Lua values to Go values. The zero value converts with the
+// default options, which TableToMap and TableToSlice use.
+type Converter struct {
+	// NumberKeys converts number keys of tables to strings in maps. Tables
+	// with keys other than strings can not be converted to maps otherwise.
+	NumberKeys bool
+	// IntegerNumbers converts integral numbers to int64 instead of float64.
+	IntegerNumbers bool
+	// EmptyTableAsSlice converts empty nested tables to empty slices instead of
+	// empty maps.
+	EmptyTableAsSlice bool
+	// MaxDepth is the maximum nesting level of tables. 0 means no limit.
+	MaxDepth int
+	// NilValue is the Go value nil is converted to, so that nil elements of
+	// slices can be distinguished from missing values. It is nil by default.
+	NilValue interface{}
+}
+
+// TableToMap converts the table to a map with the default options. Nested
+// tables whose keys are the integers 1 to n(a few of them may be missing) are
+// converted to []interface{}, and other nested tables are converted to
+// map[string]interface{}. nil, booleans,
+// numbers and strings are converted to nil, bool, float64 and string, userdata
+// is converted to its value, and other values are kept as LValues. Tables with
+// cycles can not be converted.
+func TableToMap(tb *LTable) (map[string]interface{}, error) {
+	return Converter{}.TableToMap(tb)
+}
+
+// TableToSlice converts the elements 1 to #tb of the table to a slice with the
+// default options. The elements are converted like TableToMap does.
+func TableToSlice(tb *LTable) ([]interface{}, error) {
+	return Converter{}.TableToSlice(tb)
+}
+
+// TableToMap converts the table to a map with the options.
+func (c Converter) TableToMap(tb *LTable) (map[string]interface{}, error) {
+	return newTableConverter(c).toMap(tb)
+}
+
+// TableToSlice converts the table to a slice with the options.
+func (c Converter) TableToSlice(tb *LTable) ([]interface{}, error) {
+	return newTableConverter(c).toSlice(tb)
+}
+
+// ToGo converts the Lua value to a Go value with the options. Tables are
+// converted like TableToMap converts nested tables.
+func (c Converter) ToGo(lv LValue) (interface{}, error) {
+	return newTableConverter(c).toGo(lv)
+}
+
+// Decode converts the Lua value into the value pointed to by target. Tables
+// are decoded into structs, maps, slices and arrays recursively, and other
+// values are converted like the arguments of Go functions(see
+// NewFunctionFromGo). Fields of structs are looked up by the names given by
+// the `lua:"name"` tags or the field names, and fields whose keys are missing
+// are left unchanged. Pointers are allocated as needed. Values decoded into
+// interface{} are converted like ToGo.
+func (c Converter) Decode(lv LValue, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("non-nil pointer expected, got %T", target)
+	}
+	return newTableConverter(c).decode(lv, rv.Elem())
+}
+
+type tableConverter struct {
+	Converter
+	visiting map[*LTable]bool
+	depth    int
+}
+
+func newTableConverter(c Converter) *tableConverter {
+	return &tableConverter{Converter: c, visiting: make(map[*LTable]bool)}
+}
+
+func (tc *tableConverter) enter(tb *LTable) error {
+	if tc.visiting[tb] {
+		return errors.New("can not convert a table with cycles")
+	}
+	if tc.MaxDepth > 0 && tc.depth >= tc.MaxDepth {
+		return fmt.Errorf("tables are nested more than %v levels", tc.MaxDepth)
+	}
+	tc.visiting[tb] = true
+	tc.depth++
+	return nil
+}
+
+func (tc *tableConverter) leave(tb *LTable) {
+	delete(tc.visiting, tb)
+	tc.depth--
+}
+
+func (tc *tableConverter) toMap(tb *LTable) (map[string]interface{}, error) {
+	if err := tc.enter(tb); err != nil {
+		return nil, err
+	}
+	defer tc.leave(tb)
+	m := make(map[string]interface{})
+	var err error
+	tb.ForEach(func(key, value LValue) {
+		if err != nil {
+			return
+		}
+		var name string
+		switch k := key.(type) {
+		case LString:
+			name = string(k)
+		case LNumber, LInteger:
+			if !tc.NumberKeys {
+				err = fmt.Errorf("can not convert a table with number keys to a map")
+				return
+			}
+			name = k.String()
+		default:
+			err = fmt.Errorf("can not convert a table with %v keys to a map", key.Type())
+			return
+		}
+		m[name], err = tc.toGo(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (tc *tableConverter) toSlice(tb *LTable) ([]interface{}, error) {
+	return tc.toSliceN(tb, tb.Len())
+}
+
+func (tc *tableConverter) toSliceN(tb *LTable, n int) ([]interface{}, error) {
+	if err := tc.enter(tb); err != nil {
+		return nil, err
+	}
+	defer tc.leave(tb)
+	s := make([]interface{}, n)
+	for i := range s {
+		v, err := tc.toGo(tb.RawGet(LNumber(i + 1)))
+		if err != nil {
+			return nil, err
+		}
+		s[i] = v
+	}
+	return s, nil
+}
+
+func (tc *tableConverter) toGo(lv LValue) (interface{}, error) {
+	switch v := lv.(type) {
+	case *LNilType:
+		return tc.NilValue, nil
+	case LNumber:
+		if tc.IntegerNumbers {
+			if i, ok := lnumberToInt64(v); ok {
+				return i, nil
+			}
+		}
+		return float64(v), nil
+	case *LTable:
+		n, isArray := arrayLength(v)
+		if isArray || (n == 0 && tc.EmptyTableAsSlice) {
+			return tc.toSliceN(v, n)
+		}
+		return tc.toMap(v)
+	}
+	return toGoInterface(lv), nil
+}
+
+// arrayLength returns the largest key of the table and true if the keys are
+// positive integers and at least half of the integers up to the largest key
+// are present, so that arrays with a few nil elements are detected as arrays.
+// It returns 0 and false for empty tables.
+func arrayLength(tb *LTable) (int, bool) {
+	maxn, count := int64(0), int64(0)
+	isArray := true
+	tb.ForEach(func(key, value LValue) {
+		if !isArray {
+			return
+		}
+		i, ok := toIntegerValue(key)
+		if !ok || i <= 0 {
+			isArray = false
+			return
+		}
+		if i > maxn {
+			maxn = i
+		}
+		count++
+	})
+	if !isArray || count == 0 || maxn > count*2 {
+		return 0, false
+	}
+	return int(maxn), true
+}
+
+func (tc *tableConverter) decode(lv LValue, rv reflect.Value) error {
+	tb, istable := lv.(*LTable)
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() == 0 {
+			v, err := tc.toGo(lv)
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				rv.Set(reflect.Zero(rv.Type()))
+			} else {
+				rv.Set(reflect.ValueOf(v))
+			}
+			return nil
+		}
+	case reflect.Ptr:
+		if lv == LNil {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+		if _, isud := lv.(*LUserData); !isud {
+			if rv.IsNil() {
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			return tc.decode(lv, rv.Elem())
+		}
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		if istable {
+			if err := tc.enter(tb); err != nil {
+				return err
+			}
+			defer tc.leave(tb)
+			return tc.decodeTable(tb, rv)
+		}
+	}
+	v, err := toGoValue(lv, rv.Type())
+	if err != nil {
+		return err
+	}
+	rv.Set(v)
+	return nil
+}
+
+func (tc *tableConverter) decodeTable(tb *LTable, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Struct:
+		for name, index := range structFields(rv.Type()) {
+			value := tb.RawGetH(LString(name))
+			if value == LNil {
+				continue
+			}
+			field, ok := structField(rv, index)
+			if !ok {
+				continue
+			}
+			if err := tc.decode(value, field); err != nil {
+				return fmt.Errorf("%v: %w", name, err)
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		var err error
+		tb.ForEach(func(key, value LValue) {
+			if err != nil {
+				return
+			}
+			k := reflect.New(rv.Type().Key()).Elem()
+			if err = tc.decode(key, k); err != nil {
+				err = fmt.Errorf("key %v: %w", key, err)
+				return
+			}
+			v := reflect.New(rv.Type().Elem()).Elem()
+			if err = tc.decode(value, v); err != nil {
+				err = fmt.Errorf("%v: %w", key, err)
+				return
+			}
+			rv.SetMapIndex(k, v)
+		})
+		return err
+	default:
+		n := tb.Len()
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), n, n))
+		}
+		for i := 0; i < n && i < rv.Len(); i++ {
+			if err := tc.decode(tb.RawGet(LNumber(i+1)), rv.Index(i)); err != nil {
+				return fmt.Errorf("%v: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MapToTable copies the Go map into a new table. Maps, slices and arrays in the
+// map are copied as tables recursively, byte slices are converted to strings,
+// and other values are converted like the results of Go functions(see
+// NewFunctionFromGo). Maps and slices that contain themselves can not be
+// copied.
+func MapToTable(L *LState, m interface{}) (*LTable, error) {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("map expected, got %T", m)
+	}
+	gc := &goConverter{L: L, visiting: make(map[goRef]bool)}
+	return gc.toTable(rv)
+}
+
+// SliceToTable copies the Go slice or array into a new table like MapToTable.
+func SliceToTable(L *LState, s interface{}) (*LTable, error) {
+	rv := reflect.ValueOf(s)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("slice expected, got %T", s)
+	}
+	gc := &goConverter{L: L, visiting: make(map[goRef]bool)}
+	return gc.toTable(rv)
+}
+
+// goRef identifies a Go map or slice to detect cycles.
+type goRef struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+type goConverter struct {
+	L        *LState
+	visiting map[goRef]bool
+}
+
+func (gc *goConverter) toTable(rv reflect.Value) (*LTable, error) {
+	if rv.Kind() != reflect.Array {
+		if rv.IsNil() {
+			return newLTable(0, 0), nil
+		}
+		ref := goRef{rv.Pointer(), rv.Type(), rv.Len()}
+		if gc.visiting[ref] {
+			return nil, fmt.Errorf("can not convert a %v with cycles", rv.Kind())
+		}
+		gc.visiting[ref] = true
+		defer delete(gc.visiting, ref)
+	}
+	if rv.Kind() == reflect.Map {
+		tb := newLTable(0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := gc.toLua(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			if f, ok := key.(LNumber); key == LNil || ok && math.IsNaN(float64(f)) {
+				return nil, fmt.Errorf("invalid map key: %v", iter.Key())
+			}
+			value, err := gc.toLua(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			tb.RawSet(key, value)
+		}
+		return tb, nil
+	}
+	tb := newLTable(rv.Len(), 0)
+	for i := 0; i < rv.Len(); i++ {
+		value, err := gc.toLua(rv.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		tb.RawSetInt(i+1, value)
+	}
+	return tb, nil
+}
+
+func (gc *goConverter) toLua(rv reflect.Value) (LValue, error) {
+	for rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Map, reflect.Array:
+		return gc.toTable(rv)
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return LString(rv.Bytes()), nil
+		}
+		return gc.toTable(rv)
+	}
+	return gc.L.fromGoValue(rv), nil
+}
@@ -0,0 +1,168 @@
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableToMap(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	config = {name = "x", size = 3, ratio = 1.5, on = true, list = {1, "a"}, nested = {k = "v"}, empty = {}}
+	numbers = {[1] = "a", [2.5] = "b"}
+	cyclic = {} cyclic.self = cyclic
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err2 := TableToMap(L.GetGlobal("config").(*LTable))
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	want := map[string]interface{}{
+		"name": "x", "size": float64(3), "ratio": 1.5, "on": true,
+		"list":   []interface{}{float64(1), "a"},
+		"nested": map[string]interface{}{"k": "v"},
+		"empty":  map[string]interface{}{},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %#v, want %#v", m, want)
+	}
+
+	m, err2 = Converter{IntegerNumbers: true, EmptyTableAsSlice: true}.TableToMap(L.GetGlobal("config").(*LTable))
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if m["size"] != int64(3) || m["ratio"] != 1.5 || !reflect.DeepEqual(m["empty"], []interface{}{}) {
+		t.Errorf("got %#v", m)
+	}
+
+	if _, err := TableToMap(L.GetGlobal("numbers").(*LTable)); err == nil {
+		t.Error("number keys must not be converted without NumberKeys")
+	}
+	m, err2 = Converter{NumberKeys: true}.TableToMap(L.GetGlobal("numbers").(*LTable))
+	if err2 != nil || m["1"] != "a" || m["2.5"] != "b" {
+		t.Errorf("got %#v, %v", m, err2)
+	}
+	if _, err := TableToMap(L.GetGlobal("cyclic").(*LTable)); err == nil || !strings.Contains(err.Error(), "cycles") {
+		t.Errorf("got %v, want a cycle error", err)
+	}
+
+	s, err2 := TableToSlice(L.GetField(L.GetGlobal("config"), "list").(*LTable))
+	if err2 != nil || !reflect.DeepEqual(s, []interface{}{float64(1), "a"}) {
+		t.Errorf("got %#v, %v", s, err2)
+	}
+}
+
+func TestMapToTable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	tb, err := MapToTable(L, map[string]interface{}{
+		"ids":   []int{1, 2, 3},
+		"name":  "x",
+		"bytes": []byte("raw"),
+		"inner": map[int]bool{1: true},
+		"array": [2]string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("t", tb)
+	if err := L.DoString(`
+	assert(type(t.ids) == "table" and #t.ids == 3 and t.ids[3] == 3)
+	assert(t.name == "x" and t.bytes == "raw" and t.inner[1] == true)
+	assert(t.array[2] == "b")
+	`); err != nil {
+		t.Error(err)
+	}
+
+	tb, err = SliceToTable(L, []interface{}{"a", map[string]int{"x": 1}})
+	if err != nil || tb.Len() != 2 {
+		t.Errorf("got %v, %v", tb, err)
+	}
+	cyclic := []interface{}{nil}
+	cyclic[0] = cyclic
+	if _, err := SliceToTable(L, cyclic); err == nil || !strings.Contains(err.Error(), "cycles") {
+		t.Errorf("got %v, want a cycle error", err)
+	}
+	if _, err := MapToTable(L, []int{1}); err == nil {
+		t.Error("got no error for a slice")
+	}
+}
+
+func TestConverterToGo(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`sparse = {1, nil, 3} deep = {{{1}}}`); err != nil {
+		t.Fatal(err)
+	}
+	// arrays with a few nil elements are slices.
+	v, err := Converter{NilValue: "null"}.ToGo(L.GetGlobal("sparse"))
+	if want := []interface{}{float64(1), "null", float64(3)}; err != nil || !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, %v, want %#v", v, err, want)
+	}
+	if _, err := (Converter{MaxDepth: 2}).ToGo(L.GetGlobal("deep")); err == nil {
+		t.Error("got no error for a table deeper than MaxDepth")
+	}
+	if _, err := (Converter{MaxDepth: 3}).ToGo(L.GetGlobal("deep")); err != nil {
+		t.Error(err)
+	}
+	if v, err := (Converter{}).ToGo(LString("s")); err != nil || v != "s" {
+		t.Errorf("got %v, %v", v, err)
+	}
+}
+
+func TestConverterDecode(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	config = {
+	  host = "localhost", port = 8080, tags = {"a", "b"},
+	  limits = {cpu = 2}, extra = {x = 1}, owner = {X = 3},
+	}
+	bad = {port = "eighty"}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Host   string `lua:"host"`
+		Port   int    `lua:"port"`
+		Tags   []string
+		Limits map[string]int `lua:"limits"`
+		Extra  interface{}    `lua:"extra"`
+		Owner  *testPoint     `lua:"owner"`
+		Keep   string
+	}
+	cfg.Keep = "kept"
+	cfg.Tags = []string{"old"}
+	if err := (Converter{}).Decode(L.GetGlobal("config"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "localhost" || cfg.Port != 8080 || cfg.Limits["cpu"] != 2 || cfg.Keep != "kept" {
+		t.Errorf("got %+v", cfg)
+	}
+	// Tags is not tagged, so the field name is the key.
+	if !reflect.DeepEqual(cfg.Tags, []string{"old"}) {
+		t.Errorf("got %v, want the old tags", cfg.Tags)
+	}
+	if !reflect.DeepEqual(cfg.Extra, map[string]interface{}{"x": float64(1)}) {
+		t.Errorf("got %#v", cfg.Extra)
+	}
+	if cfg.Owner == nil || cfg.Owner.X != 3 {
+		t.Errorf("got %+v, want an allocated pointer", cfg.Owner)
+	}
+
+	if err := (Converter{}).Decode(L.GetGlobal("bad"), &cfg); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("got %v, want an error of port", err)
+	}
+	if err := (Converter{}).Decode(L.GetGlobal("config"), cfg); err == nil {
+		t.Error("got no error for a non-pointer target")
+	}
+	var n float64
+	if err := (Converter{}).Decode(LNumber(1.5), &n); err != nil || n != 1.5 {
+		t.Errorf("got %v, %v", n, err)
+	}
+}
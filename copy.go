@@ -0,0 +1,109 @@
+package lua
+
+// valueCopier deep-copies values into another state. Tables, Lua functions and
+// userdata are copied once, so shared references and cycles are preserved.
+// Function prototypes are immutable and shared between states, and values held
+// by userdata are not copied.
+type valueCopier struct {
+	ls       *LState
+	copies   map[LValue]LValue
+	upvalues map[*Upvalue]*Upvalue
+}
+
+func newValueCopier(ls *LState) *valueCopier {
+	return &valueCopier{
+		ls:       ls,
+		copies:   make(map[LValue]LValue),
+		upvalues: make(map[*Upvalue]*Upvalue),
+	}
+}
+
+func (vc *valueCopier) copyTable(tb *LTable) *LTable {
+	if tb == nil {
+		return nil
+	}
+	return vc.copy(tb).(*LTable)
+}
+
+func (vc *valueCopier) copy(lv LValue) LValue {
+	switch v := lv.(type) {
+	case *LTable:
+		if cp, ok := vc.copies[v]; ok {
+			return cp
+		}
+		tb := newLTable(len(v.array), len(v.dict))
+		if v.orderIndex != nil {
+			tb = newOrderedLTable(len(v.array), len(v.dict))
+		}
+		vc.copies[v] = tb
+		tb.Metatable = vc.copy(v.Metatable)
+		tb.weak = v.weak
+		tb.frozen = v.frozen
+		for _, value := range v.array {
+			tb.array = append(tb.array, tb.weakValue(vc.copy(strongValue(value))))
+		}
+		v.rangeDict(func(key, value LValue) {
+			key, value = strongValue(key), strongValue(value)
+			if key == LNil || value == LNil {
+				return
+			}
+			tb.setDict(tb.weakKey(vc.copy(key)), tb.weakValue(vc.copy(value)))
+		})
+		return tb
+	case *LFunction:
+		if cp, ok := vc.copies[v]; ok {
+			return cp
+		}
+		fn := &LFunction{
+			IsG:       v.IsG,
+			Proto:     v.Proto,
+			GFunction: v.GFunction,
+			Upvalues:  make([]*Upvalue, len(v.Upvalues)),
+		}
+		vc.copies[v] = fn
+		fn.Env = vc.copyTable(v.Env)
+		for i, uv := range v.Upvalues {
+			fn.Upvalues[i] = vc.copyUpvalue(uv)
+		}
+		return fn
+	case *LUserData:
+		if cp, ok := vc.copies[v]; ok {
+			return cp
+		}
+		ud := &LUserData{Value: v.Value}
+		if file, ok := v.Value.(*lFile); ok {
+			// the standard files use the streams of the new state.
+			if sf, ok := file.fp.(*stdioFile); ok {
+				ud.Value = newStdioLFile(vc.ls.G, sf.name, file)
+			}
+		}
+		vc.copies[v] = ud
+		ud.Env = vc.copyTable(v.Env)
+		ud.Metatable = vc.copy(v.Metatable)
+		return ud
+	case *LState:
+		if cp, ok := vc.copies[v]; ok {
+			return cp
+		}
+		// running coroutines can not be copied, they are copied as dead threads.
+		th := newLState(Options{})
+		th.G = vc.ls.G
+		th.closeThread(vc.ls)
+		vc.copies[v] = th
+		return th
+	}
+	return lv
+}
+
+func (vc *valueCopier) copyUpvalue(uv *Upvalue) *Upvalue {
+	if uv == nil {
+		return nil
+	}
+	if cp, ok := vc.upvalues[uv]; ok {
+		return cp
+	}
+	cp := &Upvalue{closed: true}
+	vc.upvalues[uv] = cp
+	cp.value = vc.copy(uv.Value())
+	return cp
+}
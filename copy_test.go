@@ -0,0 +1,69 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	counter = 0
+	function incr() counter = counter + 1 return counter end
+	local up = 0
+	function next_id() up = up + 1 return up end
+	shared = {}
+	refs = {a = shared, b = shared}
+	refs.self = refs
+	setmetatable(refs, {__index = function() return "default" end})
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2 := L.Clone()
+	defer L2.Close()
+	err = L2.DoString(`
+	assert(incr() == 1 and next_id() == 1)
+	assert(refs.a == refs.b and refs.self == refs)
+	assert(refs.missing == "default")
+	assert(string.format("%d", 1) == "1")
+	refs.a.x = 1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the original state is not affected.
+	if err := L.DoString(`assert(counter == 0 and next_id() == 1 and shared.x == nil)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	L := NewState()
+	if err := L.DoString(`value = 1`); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := L.Snapshot()
+	L.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			L := snapshot.NewState()
+			defer L.Close()
+			if err := L.DoString(`assert(value == 1) value = 2`); err != nil {
+				errs[i] = err
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -11,6 +11,7 @@ var coFuncs = map[string]LGFunction{
 	"running": coRunning,
 	"status":  coStatus,
 	"wrap":    coWrap,
+	"close":   coClose,
 }
 
 func coCreate(L *LState) int {
@@ -97,6 +98,24 @@ func coStatus(L *LState) int {
 	return 1
 }
 
+func coClose(L *LState) int {
+	th := L.CheckThread(1)
+	if th.isActive() {
+		status := "normal"
+		if th == L.G.CurrentThread {
+			status = "running"
+		}
+		L.RaiseError("can not close a %v thread", status)
+	}
+	if errobj := th.closeThread(L); errobj != LNil {
+		L.Push(LFalse)
+		L.Push(errobj)
+		return 2
+	}
+	L.Push(LTrue)
+	return 1
+}
+
 func wrapaux(L *LState) int {
 	L.Insert(L.ToThread(UpvalueIndex(1)), 1)
 	return coResume(L)
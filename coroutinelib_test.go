@@ -0,0 +1,163 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCoroutineClose(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local co = coroutine.create(function() coroutine.yield(1) end)
+	coroutine.resume(co)
+	assert(coroutine.status(co) == "suspended")
+	assert(coroutine.close(co) == true)
+	assert(coroutine.status(co) == "dead")
+	local ok, err = coroutine.resume(co)
+	assert(not ok and err:find("dead"))
+
+	-- the error that stopped the coroutine is returned.
+	co = coroutine.create(function() error("boom", 0) end)
+	coroutine.resume(co)
+	local ok, err = coroutine.close(co)
+	assert(ok == false and err == "boom")
+
+	-- pending to-be-closed variables are closed.
+	local closed = false
+	co = coroutine.create(function()
+	  local x <close> = setmetatable({}, {__close = function() closed = true end})
+	  coroutine.yield()
+	end)
+	coroutine.resume(co)
+	assert(coroutine.close(co) and closed)
+
+	-- running coroutines can not be closed.
+	co = coroutine.create(function() return coroutine.close(coroutine.running()) end)
+	local ok, err = coroutine.resume(co)
+	assert(not ok and err:find("can not close a running thread"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseThread(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function gen() coroutine.yield(1) error("boom") end`); err != nil {
+		t.Fatal(err)
+	}
+	co := L.NewThread()
+	fn := L.GetGlobal("gen").(*LFunction)
+	if st, err, _ := L.Resume(co, fn); st != ResumeYield || err != nil {
+		t.Fatalf("got %v, %v", st, err)
+	}
+	if err := L.CloseThread(co); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+	if st := L.Status(co); st != "dead" {
+		t.Errorf("got %v, want dead", st)
+	}
+
+	co = L.NewThread()
+	L.Resume(co, fn)
+	L.Resume(co, fn)
+	if err := L.CloseThread(co); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("got %v, want the error of the coroutine", err)
+	}
+}
+
+func TestCoroutineStackReuse(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function gen(n)
+	  return coroutine.wrap(function()
+	    for i = 1, n do coroutine.yield(i) end
+	  end)
+	end
+	local sum = 0
+	for k = 1, 100 do
+	  for v in gen(3) do sum = sum + v end
+	end
+	assert(sum == 600)
+
+	-- closures keep the values of the locals of finished coroutines.
+	local getters = {}
+	for k = 1, 3 do
+	  local co = coroutine.create(function()
+	    local x = k * 10
+	    getters[k] = function() return x end
+	  end)
+	  assert(coroutine.resume(co))
+	end
+	assert(getters[1]() == 10 and getters[2]() == 20 and getters[3]() == 30)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(L.G.threads.registries) == 0 || len(L.G.threads.segments) == 0 {
+		t.Fatal("the stacks of finished coroutines must be kept")
+	}
+	if len(L.G.threads.registries) > threadPoolRegistries || len(L.G.threads.segments) > threadPoolSegments {
+		t.Errorf("got %v registries and %v segments", len(L.G.threads.registries), len(L.G.threads.segments))
+	}
+	n := len(L.G.threads.registries)
+	co := L.NewThread()
+	if len(L.G.threads.registries) != n-1 {
+		t.Error("new coroutines must reuse the kept registries")
+	}
+
+	// the stacks of coroutines that died with errors are kept for
+	// debug.traceback.
+	fn := L.NewFunction(func(L *LState) int {
+		L.RaiseError("boom")
+		return 0
+	})
+	if st, err, _ := L.Resume(co, fn); st != ResumeError || err == nil {
+		t.Fatalf("got %v, %v", st, err)
+	}
+	if len(L.G.threads.registries) != n-1 {
+		t.Error("the registers of a coroutine that died with an error must not be reused")
+	}
+}
+
+func TestThreadStackSizes(t *testing.T) {
+	L := NewState(Options{ThreadRegistrySize: 16, ThreadRegistryMaxSize: 1024 * 20, ThreadCallStackSize: 20})
+	defer L.Close()
+	co := L.NewThread()
+	if n := len(co.reg.array); n != 16 {
+		t.Errorf("got a registry of %v, want 16", n)
+	}
+	if n := co.reg.maxSize; n != 1024*20 {
+		t.Errorf("got the maximum size %v, want %v", n, 1024*20)
+	}
+	co2 := L.NewThreadWithOptions(ThreadOptions{RegistrySize: 8, CallStackSize: 200})
+	if n := len(co2.reg.array); n != 8 {
+		t.Errorf("got a registry of %v, want 8", n)
+	}
+	err := L.DoString(`
+	local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+	-- the main thread has the default sizes.
+	assert(depth(100) == 100)
+	local co = coroutine.create(depth)
+	local ok, err = coroutine.resume(co, 100)
+	assert(not ok and err:find("stack overflow"), tostring(err))
+	-- the registry grows.
+	co = coroutine.create(function() return select("#", unpack({}, 1, 1000)) end)
+	local ok, n = coroutine.resume(co)
+	assert(ok and n == 1000, tostring(n))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := L.DoString(`function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end`); err != nil {
+		t.Fatal(err)
+	}
+	st, err2, values := L.Resume(co2, L.GetGlobal("depth").(*LFunction), LNumber(100))
+	if st != ResumeOK || err2 != nil || values[0] != LNumber(100) {
+		t.Errorf("got %v, %v, %v", st, err2, values)
+	}
+}
@@ -0,0 +1,172 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Coverage holds the number of times each source line has been executed.
+type Coverage struct {
+	Files map[string]*FileCoverage
+}
+
+// FileCoverage holds the execution counts of the lines of a source. Lines of
+// functions that have been loaded but not executed are included with 0.
+type FileCoverage struct {
+	Source string
+	Lines  map[int]int64
+}
+
+// Sources returns the names of the sources in sorted order.
+func (c *Coverage) Sources() []string {
+	sources := make([]string, 0, len(c.Files))
+	for source := range c.Files {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// LineNumbers returns the executable lines in sorted order.
+func (fc *FileCoverage) LineNumbers() []int {
+	lines := make([]int, 0, len(fc.Lines))
+	for line := range fc.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Hits returns the number of executed lines.
+func (fc *FileCoverage) Hits() int {
+	n := 0
+	for _, count := range fc.Lines {
+		if count > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteLCOV writes the coverage in the LCOV tracefile format.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, source := range c.Sources() {
+		fc := c.Files[source]
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", source)
+		for _, line := range fc.LineNumbers() {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, fc.Lines[line])
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(fc.Lines), fc.Hits())
+	}
+	return bw.Flush()
+}
+
+type coverageRecorder struct {
+	files     map[string]*FileCoverage
+	protos    map[*FunctionProto]bool
+	lastFrame *callFrame
+	lastPc    int
+}
+
+func newCoverageRecorder() *coverageRecorder {
+	return &coverageRecorder{
+		files:  make(map[string]*FileCoverage),
+		protos: make(map[*FunctionProto]bool),
+	}
+}
+
+func (cr *coverageRecorder) file(source string) *FileCoverage {
+	fc, ok := cr.files[source]
+	if !ok {
+		fc = &FileCoverage{Source: source, Lines: make(map[int]int64)}
+		cr.files[source] = fc
+	}
+	return fc
+}
+
+// addProto registers the lines of the function and its nested functions. The
+// last instruction is the implicit return of the function, its line is not
+// registered because the instruction can be unreachable.
+func (cr *coverageRecorder) addProto(proto *FunctionProto) {
+	if cr.protos[proto] {
+		return
+	}
+	cr.protos[proto] = true
+	fc := cr.file(proto.SourceName)
+	positions := proto.DbgSourcePositions
+	if len(positions) > 0 {
+		positions = positions[:len(positions)-1]
+	}
+	for _, line := range positions {
+		if _, ok := fc.Lines[line]; !ok && line > 0 {
+			fc.Lines[line] = 0
+		}
+	}
+	for _, child := range proto.FunctionPrototypes {
+		cr.addProto(child)
+	}
+}
+
+// hit counts the line of the current instruction when the execution enters a
+// new line, the same way as line hooks.
+func (cr *coverageRecorder) hit(cf *callFrame) {
+	proto := cf.Fn.Proto
+	if !cr.protos[proto] {
+		cr.addProto(proto)
+	}
+	pc := cf.Pc - 1
+	oldpc := cr.lastPc
+	if cf != cr.lastFrame {
+		oldpc = pc - 1
+	}
+	cr.lastPc = pc
+	cr.lastFrame = cf
+	positions := proto.DbgSourcePositions
+	if pc == 0 || pc <= oldpc || positions[pc] != positions[oldpc] {
+		if line := positions[pc]; line > 0 {
+			cr.file(proto.SourceName).Lines[line]++
+		}
+	}
+}
+
+func (cr *coverageRecorder) snapshot() *Coverage {
+	c := &Coverage{Files: make(map[string]*FileCoverage, len(cr.files))}
+	for source, fc := range cr.files {
+		lines := make(map[int]int64, len(fc.Lines))
+		for line, count := range fc.Lines {
+			lines[line] = count
+		}
+		c.Files[source] = &FileCoverage{Source: source, Lines: lines}
+	}
+	return c
+}
+
+// StartCoverage starts recording the lines executed by the state and its
+// coroutines. Recorded counts are kept if the coverage is already started.
+func (ls *LState) StartCoverage() {
+	if ls.G.coverage == nil {
+		ls.G.coverage = newCoverageRecorder()
+		ls.G.updateInstrumented()
+	}
+}
+
+// StopCoverage stops recording and returns the coverage. This returns nil if
+// the coverage is not started.
+func (ls *LState) StopCoverage() *Coverage {
+	c := ls.Coverage()
+	ls.G.coverage = nil
+	ls.G.updateInstrumented()
+	return c
+}
+
+// Coverage returns a copy of the coverage recorded so far, or nil if the
+// coverage is not started.
+func (ls *LState) Coverage() *Coverage {
+	if ls.G.coverage == nil {
+		return nil
+	}
+	return ls.G.coverage.snapshot()
+}
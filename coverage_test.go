@@ -0,0 +1,56 @@
+package lua
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.StartCoverage()
+	err := L.DoString(`local function f(x)
+  if x then
+    return 1
+  end
+  return 2
+end
+for i = 1, 3 do f(true) end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cov := L.StopCoverage()
+	fc := cov.Files["<string>"]
+	if fc == nil {
+		t.Fatalf("got %v, want <string>", cov.Sources())
+	}
+	if n := fc.Lines[3]; n != 3 {
+		t.Errorf("line 3 was executed %v times, want 3", n)
+	}
+	if n, ok := fc.Lines[5]; !ok || n != 0 {
+		t.Errorf("line 5 was executed %v times, want 0", n)
+	}
+	if fc.Hits() >= len(fc.Lines) {
+		t.Errorf("got %v hits of %v lines", fc.Hits(), len(fc.Lines))
+	}
+
+	var buf bytes.Buffer
+	if err := cov.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lcov := buf.String()
+	for _, s := range []string{"SF:<string>\n", "DA:3,3\n", "DA:5,0\n", "end_of_record\n"} {
+		if !strings.Contains(lcov, s) {
+			t.Errorf("the LCOV output does not have %q:\n%v", s, lcov)
+		}
+	}
+
+	// lines are not recorded after StopCoverage.
+	if err := L.DoString(`local x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if L.Coverage() != nil {
+		t.Error("Coverage must return nil after StopCoverage")
+	}
+}
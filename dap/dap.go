@@ -0,0 +1,492 @@
+// Package dap implements a Debug Adapter Protocol server for GopherLua, so Lua
+// scripts running in a Go program can be debugged from editors like VS Code.
+//
+// A Debugger is attached to a state with a line hook. While a client is
+// connected, the hook pauses the goroutine running the state at breakpoints
+// and steps, and executes the requests of the client (stack traces,
+// variables, evaluations) on that goroutine until the execution is resumed.
+package dap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// threadID is the only thread reported to clients. Coroutines are shown as
+// parts of the call stack of the thread resuming them.
+const threadID = 1
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+// Debugger debugs a state.
+type Debugger struct {
+	// Launch is called with the program and the arguments of a launch request
+	// after the client has finished the configuration. Launch must not block,
+	// it typically passes the program to the goroutine running the state.
+	// Launch requests are rejected if Launch is nil.
+	Launch func(program string, args []string) error
+
+	L *lua.LState
+
+	// active is 1 while a client is connected.
+	active int32
+
+	mu          sync.Mutex
+	session     *session
+	breakpoints map[string]map[int]string
+	step        stepMode
+	stepDepth   int
+	pause       string
+	stopped     *stoppedState
+
+	// paths caches absolute paths of sources. files maps base names of files
+	// given by the client to their paths, since LState.LoadFile names chunks
+	// by base names.
+	paths map[string]string
+	files map[string]string
+}
+
+// stoppedState is the state of a paused execution. The fields are used only
+// by the goroutine running the state.
+type stoppedState struct {
+	L        *lua.LState
+	commands chan func(*stoppedState) bool
+	frames   []frameRef
+	refs     []varRef
+}
+
+type frameRef struct {
+	L     *lua.LState
+	level int
+	info  lua.StackFrame
+}
+
+type varRefKind int
+
+const (
+	refValue varRefKind = iota
+	refLocals
+	refUpvalues
+)
+
+type varRef struct {
+	kind  varRefKind
+	frame frameRef
+	value lua.LValue
+}
+
+var errNotStopped = errors.New("the program is not paused")
+
+// Attach attaches a debugger to the state by setting a line hook. This must be
+// called by the goroutine running the state. Coroutines created before Attach
+// and hooks set by debug.sethook are not debugged.
+func Attach(L *lua.LState) *Debugger {
+	d := &Debugger{
+		L:           L,
+		breakpoints: map[string]map[int]string{},
+		paths:       map[string]string{},
+		files:       map[string]string{},
+	}
+	L.SetHook(d.hook, lua.HookLine, 0)
+	return d
+}
+
+// Detach removes the hook set by Attach. This must be called by the goroutine
+// running the state.
+func (d *Debugger) Detach() {
+	d.mu.Lock()
+	s := d.session
+	d.mu.Unlock()
+	d.disconnect(s)
+	d.L.SetHook(nil, 0, 0)
+}
+
+// ListenAndServe listens on the TCP address and serves clients one by one.
+func (d *Debugger) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		d.Serve(c)
+		c.Close()
+	}
+}
+
+// Exited tells the client that the program has exited with the code.
+func (d *Debugger) Exited(code int) {
+	d.sendEvent("exited", map[string]int{"exitCode": code})
+	d.sendEvent("terminated", nil)
+}
+
+// Output sends the text to the client. Category is "console", "stdout" or
+// "stderr".
+func (d *Debugger) Output(category, text string) {
+	d.sendEvent("output", map[string]string{"category": category, "output": text})
+}
+
+func (d *Debugger) sendEvent(name string, body interface{}) {
+	d.mu.Lock()
+	s := d.session
+	d.mu.Unlock()
+	if s != nil {
+		s.conn.write(&event{Event: name, Body: body})
+	}
+}
+
+func (d *Debugger) disconnect(s *session) {
+	d.mu.Lock()
+	if s == nil || d.session != s {
+		d.mu.Unlock()
+		return
+	}
+	d.session = nil
+	atomic.StoreInt32(&d.active, 0)
+	d.breakpoints = map[string]map[int]string{}
+	d.step = stepNone
+	d.pause = ""
+	stopped := d.stopped
+	d.mu.Unlock()
+	if stopped != nil {
+		done := make(chan struct{})
+		stopped.commands <- d.resumeCommand(stepNone, done)
+		<-done
+	}
+}
+
+// sourcePath returns the absolute path of the source, or an empty string if
+// the source is not a file. d.mu must be held.
+func (d *Debugger) sourcePath(src string) string {
+	path, ok := d.paths[src]
+	if !ok {
+		if info, err := os.Stat(src); err == nil && !info.IsDir() {
+			if path, err = filepath.Abs(src); err != nil {
+				path = src
+			}
+		}
+		d.paths[src] = path
+	}
+	if len(path) == 0 && filepath.Base(src) == src {
+		path = d.files[src]
+	}
+	return path
+}
+
+// addFile records the path given by the client. d.mu must be held.
+func (d *Debugger) addFile(path string) {
+	d.files[filepath.Base(path)] = path
+}
+
+func depth(L *lua.LState) int {
+	n := 0
+	for ; L != nil; L = L.Parent {
+		n += len(L.StackFrames())
+	}
+	return n
+}
+
+func (d *Debugger) hook(L *lua.LState, event lua.HookEvent, line int) {
+	if atomic.LoadInt32(&d.active) == 0 {
+		return
+	}
+	d.mu.Lock()
+	reason := d.pause
+	d.pause = ""
+	condition, hasBreakpoint := "", false
+	if reason == "" {
+		for path, lines := range d.breakpoints {
+			if cond, ok := lines[line]; ok {
+				if dbg, ok := L.GetStack(0); ok {
+					L.GetInfo("S", dbg, lua.LNil)
+					if d.sourcePath(dbg.Source) == path && len(path) > 0 {
+						condition, hasBreakpoint = cond, true
+						break
+					}
+				}
+			}
+		}
+	}
+	if reason == "" && !hasBreakpoint && d.step != stepNone {
+		switch n := depth(L); {
+		case d.step == stepIn,
+			d.step == stepOver && n <= d.stepDepth,
+			d.step == stepOut && n < d.stepDepth:
+			reason = "step"
+		}
+	}
+	d.mu.Unlock()
+	if hasBreakpoint {
+		if len(condition) > 0 {
+			st := &stoppedState{L: L}
+			if values, err := d.evaluate(st, frameRef{L: L}, condition); err != nil || len(values) == 0 || !lua.LVAsBool(values[0]) {
+				return
+			}
+		}
+		reason = "breakpoint"
+	}
+	if reason != "" {
+		d.stop(L, reason)
+	}
+}
+
+// stop pauses the execution and runs the commands from the client until one
+// of them resumes the execution.
+func (d *Debugger) stop(L *lua.LState, reason string) {
+	st := &stoppedState{L: L, commands: make(chan func(*stoppedState) bool)}
+	d.mu.Lock()
+	if d.session == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.step = stepNone
+	d.stopped = st
+	d.mu.Unlock()
+	d.sendEvent("stopped", map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+	for command := range st.commands {
+		if command(st) {
+			break
+		}
+	}
+}
+
+// inspect runs the function on the goroutine running the state while the
+// execution is paused.
+func (d *Debugger) inspect(f func(*stoppedState) error) error {
+	d.mu.Lock()
+	st := d.stopped
+	d.mu.Unlock()
+	if st == nil {
+		return errNotStopped
+	}
+	done := make(chan error, 1)
+	st.commands <- func(st *stoppedState) bool {
+		done <- f(st)
+		return false
+	}
+	return <-done
+}
+
+// resume resumes the paused execution with the step mode.
+func (d *Debugger) resume(mode stepMode) error {
+	d.mu.Lock()
+	st := d.stopped
+	d.mu.Unlock()
+	if st == nil {
+		return errNotStopped
+	}
+	done := make(chan struct{})
+	st.commands <- d.resumeCommand(mode, done)
+	<-done
+	return nil
+}
+
+// resumeCommand returns a command that resumes the execution. done is closed
+// after the debugger leaves the paused state, so requests after resuming do
+// not wait for the paused execution.
+func (d *Debugger) resumeCommand(mode stepMode, done chan struct{}) func(*stoppedState) bool {
+	return func(st *stoppedState) bool {
+		n := depth(st.L)
+		d.mu.Lock()
+		d.step = mode
+		d.stepDepth = n
+		d.stopped = nil
+		d.mu.Unlock()
+		close(done)
+		return true
+	}
+}
+
+func (st *stoppedState) stackFrames() []frameRef {
+	if st.frames == nil {
+		st.frames = []frameRef{}
+		for L := st.L; L != nil; L = L.Parent {
+			for level, info := range L.StackFrames() {
+				st.frames = append(st.frames, frameRef{L, level, info})
+			}
+		}
+	}
+	return st.frames
+}
+
+func (st *stoppedState) frame(id int) (frameRef, error) {
+	frames := st.stackFrames()
+	if id < 1 || id > len(frames) {
+		return frameRef{}, fmt.Errorf("invalid frame id: %v", id)
+	}
+	return frames[id-1], nil
+}
+
+func (st *stoppedState) newRef(ref varRef) int {
+	st.refs = append(st.refs, ref)
+	return len(st.refs)
+}
+
+// frameVariables returns the locals and the upvalues of the frame.
+func frameVariables(fr frameRef, kind varRefKind) ([]string, []lua.LValue) {
+	var names []string
+	var values []lua.LValue
+	dbg, ok := fr.L.GetStack(fr.level)
+	if !ok {
+		return nil, nil
+	}
+	if kind == refLocals {
+		for i := 1; ; i++ {
+			name, value := fr.L.GetLocal(dbg, i)
+			if len(name) == 0 {
+				break
+			}
+			if !strings.HasPrefix(name, "(") {
+				names = append(names, name)
+				values = append(values, value)
+			}
+		}
+		return names, values
+	}
+	fn, _ := fr.L.GetInfo("f", dbg, lua.LNil)
+	if lfn, ok := fn.(*lua.LFunction); ok {
+		for i := 1; ; i++ {
+			name, value := fr.L.GetUpvalue(lfn, i)
+			if len(name) == 0 {
+				break
+			}
+			names = append(names, name)
+			values = append(values, value)
+		}
+	}
+	return names, values
+}
+
+func (st *stoppedState) variable(name string, value lua.LValue) variable {
+	v := variable{Name: name, Value: value.String(), Type: value.Type().String()}
+	switch lv := value.(type) {
+	case lua.LString:
+		v.Value = fmt.Sprintf("%q", string(lv))
+	case *lua.LTable:
+		v.VariablesReference = st.newRef(varRef{kind: refValue, value: lv})
+	}
+	return v
+}
+
+func (st *stoppedState) variables(ref int) ([]variable, error) {
+	if ref < 1 || ref > len(st.refs) {
+		return nil, fmt.Errorf("invalid variables reference: %v", ref)
+	}
+	r := st.refs[ref-1]
+	vars := []variable{}
+	if r.kind != refValue {
+		names, values := frameVariables(r.frame, r.kind)
+		for i, name := range names {
+			vars = append(vars, st.variable(name, values[i]))
+		}
+		return vars, nil
+	}
+	tb, ok := r.value.(*lua.LTable)
+	if !ok {
+		return vars, nil
+	}
+	type field struct {
+		key, value lua.LValue
+	}
+	fields := []field{}
+	tb.ForEach(func(key, value lua.LValue) {
+		fields = append(fields, field{key, value})
+	})
+	// numbers first, then strings.
+	sort.SliceStable(fields, func(i, j int) bool {
+		ki, kj := fields[i].key, fields[j].key
+		ni, iok := ki.(lua.LNumber)
+		nj, jok := kj.(lua.LNumber)
+		if iok && jok {
+			return ni < nj
+		}
+		if iok != jok {
+			return iok
+		}
+		si, iok := ki.(lua.LString)
+		sj, jok := kj.(lua.LString)
+		if iok && jok {
+			return si < sj
+		}
+		return iok && !jok
+	})
+	for _, f := range fields {
+		name := "[" + f.key.String() + "]"
+		if s, ok := f.key.(lua.LString); ok {
+			name = string(s)
+		}
+		vars = append(vars, st.variable(name, f.value))
+	}
+	if tb.Metatable != lua.LNil {
+		vars = append(vars, st.variable("(metatable)", tb.Metatable))
+	}
+	return vars, nil
+}
+
+// evaluate evaluates the expression, or executes the statements, in the
+// frame. Locals and upvalues of the frame can be read as globals.
+func (d *Debugger) evaluate(st *stoppedState, fr frameRef, expr string) ([]lua.LValue, error) {
+	L := st.L
+	fn, err := L.LoadString("return " + expr)
+	if err != nil {
+		if fn, err = L.LoadString(expr); err != nil {
+			return nil, err
+		}
+	}
+	globals := L.Get(lua.GlobalsIndex)
+	env := L.NewTable()
+	if dbg, ok := fr.L.GetStack(fr.level); ok {
+		if f, _ := fr.L.GetInfo("f", dbg, lua.LNil); f != lua.LNil {
+			if lfn, ok := f.(*lua.LFunction); ok && lfn.Env != nil {
+				globals = lfn.Env
+			}
+		}
+		for _, kind := range []varRefKind{refUpvalues, refLocals} {
+			names, values := frameVariables(fr, kind)
+			for i, name := range names {
+				env.RawSetH(lua.LString(name), values[i])
+			}
+		}
+	}
+	mt := L.NewTable()
+	mt.RawSetH(lua.LString("__index"), globals)
+	mt.RawSetH(lua.LString("__newindex"), globals)
+	L.SetMetatable(env, mt)
+	fn.Env = env
+
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.Push(fn)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return nil, err
+	}
+	values := []lua.LValue{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, L.Get(i))
+	}
+	return values, nil
+}
@@ -0,0 +1,218 @@
+package dap
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// testClient is a DAP client that sends requests and waits for responses
+// and events.
+type testClient struct {
+	t        *testing.T
+	conn     *conn
+	seq      int
+	messages chan map[string]interface{}
+}
+
+func newTestClient(t *testing.T, c net.Conn) *testClient {
+	tc := &testClient{t: t, conn: newConn(c), messages: make(chan map[string]interface{}, 64)}
+	go func() {
+		defer close(tc.messages)
+		for {
+			header, err := tc.conn.r.ReadMIMEHeader()
+			if err != nil {
+				return
+			}
+			var n int
+			if err := json.Unmarshal([]byte(header.Get("Content-Length")), &n); err != nil {
+				return
+			}
+			body := make([]byte, n)
+			if _, err := io.ReadFull(tc.conn.r.R, body); err != nil {
+				return
+			}
+			msg := map[string]interface{}{}
+			if err := json.Unmarshal(body, &msg); err != nil {
+				return
+			}
+			tc.messages <- msg
+		}
+	}()
+	return tc
+}
+
+func (tc *testClient) send(command string, arguments interface{}) int {
+	tc.seq++
+	args, _ := json.Marshal(arguments)
+	if err := tc.conn.write(&request{Seq: tc.seq, Type: "request", Command: command, Arguments: args}); err != nil {
+		tc.t.Fatal(err)
+	}
+	return tc.seq
+}
+
+// wait returns the next message that matches, skipping other messages.
+func (tc *testClient) wait(match func(msg map[string]interface{}) bool) map[string]interface{} {
+	tc.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-tc.messages:
+			if !ok {
+				tc.t.Fatal("the connection is closed")
+			}
+			if match(msg) {
+				return msg
+			}
+		case <-timeout:
+			tc.t.Fatal("timed out")
+		}
+	}
+}
+
+func (tc *testClient) request(command string, arguments interface{}) map[string]interface{} {
+	tc.t.Helper()
+	seq := tc.send(command, arguments)
+	resp := tc.wait(func(msg map[string]interface{}) bool {
+		return msg["type"] == "response" && msg["request_seq"] == float64(seq)
+	})
+	if resp["success"] != true {
+		tc.t.Fatalf("%v: %v", command, resp["message"])
+	}
+	body, _ := resp["body"].(map[string]interface{})
+	return body
+}
+
+func (tc *testClient) event(name string) map[string]interface{} {
+	tc.t.Helper()
+	msg := tc.wait(func(msg map[string]interface{}) bool {
+		return msg["type"] == "event" && msg["event"] == name
+	})
+	body, _ := msg["body"].(map[string]interface{})
+	return body
+}
+
+func TestDebugger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.lua")
+	src := "local x = 10\n" +
+		"local t = {a = 1}\n" +
+		"for i = 1, 3 do\n" +
+		"  x = x + i\n" +
+		"end\n" +
+		"result = x\n"
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	d := Attach(L)
+	programs := make(chan string, 1)
+	d.Launch = func(program string, args []string) error {
+		programs <- program
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		program := <-programs
+		if err := L.DoFile(program); err != nil {
+			done <- err
+			return
+		}
+		d.Exited(0)
+		done <- nil
+	}()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go d.Serve(server)
+	tc := newTestClient(t, client)
+
+	tc.request("initialize", map[string]string{"adapterID": "test"})
+	tc.event("initialized")
+	bps := tc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []map[string]interface{}{{"line": 4, "condition": "i == 2"}},
+	})
+	if n := len(bps["breakpoints"].([]interface{})); n != 1 {
+		t.Fatalf("got %v breakpoints, want 1", n)
+	}
+	tc.request("launch", map[string]interface{}{"program": path})
+	tc.request("configurationDone", nil)
+
+	if reason := tc.event("stopped")["reason"]; reason != "breakpoint" {
+		t.Fatalf("got %v, want breakpoint", reason)
+	}
+	frames := tc.request("stackTrace", map[string]int{})["stackFrames"].([]interface{})
+	top := frames[0].(map[string]interface{})
+	if top["line"] != float64(4) || top["source"].(map[string]interface{})["path"] != path {
+		t.Errorf("got %v, want %v:4", top, path)
+	}
+
+	scopes := tc.request("scopes", map[string]int{"frameId": 1})["scopes"].([]interface{})
+	locals := scopes[0].(map[string]interface{})
+	vars := tc.request("variables", map[string]interface{}{"variablesReference": locals["variablesReference"]})["variables"].([]interface{})
+	values := map[string]interface{}{}
+	for _, v := range vars {
+		v := v.(map[string]interface{})
+		values[v["name"].(string)] = v["value"]
+	}
+	// the condition stops the loop at the second iteration.
+	if values["x"] != "11" || values["i"] != "2" {
+		t.Errorf("got %v, want x = 11 and i = 2", values)
+	}
+
+	result := tc.request("evaluate", map[string]interface{}{"expression": "x * 2 + t.a", "frameId": 1})
+	if result["result"] != "23" {
+		t.Errorf("got %v, want 23", result["result"])
+	}
+
+	tc.request("next", nil)
+	if reason := tc.event("stopped")["reason"]; reason != "step" {
+		t.Fatalf("got %v, want step", reason)
+	}
+	tc.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": path},
+		"breakpoints": []interface{}{},
+	})
+	tc.request("continue", nil)
+	if code := tc.event("exited")["exitCode"]; code != float64(0) {
+		t.Errorf("got the exit code %v, want 0", code)
+	}
+	tc.event("terminated")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := L.GetGlobal("result"); got != lua.LNumber(16) {
+		t.Errorf("got %v, want 16", got)
+	}
+	tc.request("disconnect", nil)
+}
+
+func TestDebuggerNotStopped(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	d := Attach(L)
+	defer d.Detach()
+	server, client := net.Pipe()
+	defer client.Close()
+	go d.Serve(server)
+	tc := newTestClient(t, client)
+
+	seq := tc.send("continue", nil)
+	resp := tc.wait(func(msg map[string]interface{}) bool { return msg["request_seq"] == float64(seq) })
+	if resp["success"] != false || resp["message"] != errNotStopped.Error() {
+		t.Errorf("got %v, want an error", resp)
+	}
+	seq = tc.send("launch", map[string]string{"program": "main.lua"})
+	resp = tc.wait(func(msg map[string]interface{}) bool { return msg["request_seq"] == float64(seq) })
+	if resp["success"] != false {
+		t.Errorf("got %v, want an error without Launch", resp)
+	}
+}
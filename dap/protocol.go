@@ -0,0 +1,134 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// request is a request from the client.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// conn reads and writes messages with the base protocol of DAP: a header with
+// Content-Length followed by a JSON body.
+type conn struct {
+	r   *textproto.Reader
+	w   io.Writer
+	mu  sync.Mutex
+	seq int
+}
+
+func newConn(rw io.ReadWriter) *conn {
+	return &conn{r: textproto.NewReader(bufio.NewReader(rw)), w: rw}
+}
+
+func (c *conn) read() (*request, error) {
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("dap: invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		return nil, err
+	}
+	req := &request{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return nil, fmt.Errorf("dap: invalid message: %v", err)
+	}
+	return req, nil
+}
+
+func (c *conn) write(msg interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = c.seq
+		m.Type = "response"
+	case *event:
+		m.Seq = c.seq
+		m.Type = "event"
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = c.w.Write(body)
+	return err
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line      int    `json:"line"`
+	Condition string `json:"condition"`
+}
+
+type breakpoint struct {
+	Verified bool `json:"verified"`
+	Line     int  `json:"line"`
+}
+
+type stackFrame struct {
+	ID               int     `json:"id"`
+	Name             string  `json:"name"`
+	Source           *source `json:"source,omitempty"`
+	Line             int     `json:"line"`
+	Column           int     `json:"column"`
+	PresentationHint string  `json:"presentationHint,omitempty"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
@@ -0,0 +1,293 @@
+package dap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yuin/gopher-lua"
+)
+
+type session struct {
+	d      *Debugger
+	conn   *conn
+	launch *launchArguments
+	// after is called after the response of the current request is sent.
+	after func()
+}
+
+type launchArguments struct {
+	Program     string   `json:"program"`
+	Args        []string `json:"args"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+}
+
+// Serve serves a client on the connection until the client disconnects. Only
+// one client can be connected to a debugger at a time.
+func (d *Debugger) Serve(rw io.ReadWriter) error {
+	s := &session{d: d, conn: newConn(rw)}
+	d.mu.Lock()
+	if d.session != nil {
+		d.mu.Unlock()
+		return errors.New("dap: another client is connected")
+	}
+	d.session = s
+	d.mu.Unlock()
+	atomic.StoreInt32(&d.active, 1)
+	defer d.disconnect(s)
+
+	for {
+		req, err := s.conn.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.Type != "request" {
+			continue
+		}
+		s.after = nil
+		body, err := s.handle(req)
+		resp := &response{RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := s.conn.write(resp); err != nil {
+			return err
+		}
+		if err == nil && s.after != nil {
+			s.after()
+		}
+		if req.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+func (s *session) startProgram() {
+	if s.launch == nil {
+		return
+	}
+	if err := s.d.Launch(s.launch.Program, s.launch.Args); err != nil {
+		s.d.Output("stderr", err.Error()+"\n")
+		s.conn.write(&event{Event: "terminated"})
+	}
+}
+
+func (s *session) handle(req *request) (interface{}, error) {
+	d := s.d
+	switch req.Command {
+	case "initialize":
+		s.after = func() {
+			s.conn.write(&event{Event: "initialized"})
+		}
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch":
+		if d.Launch == nil {
+			return nil, errors.New("launch is not supported, attach to the program instead")
+		}
+		args := &launchArguments{}
+		if err := json.Unmarshal(req.Arguments, args); err != nil {
+			return nil, err
+		}
+		s.launch = args
+		d.mu.Lock()
+		if path, err := filepath.Abs(args.Program); err == nil {
+			d.addFile(path)
+		}
+		if args.StopOnEntry {
+			d.pause = "entry"
+		}
+		d.mu.Unlock()
+		return nil, nil
+	case "configurationDone":
+		s.after = s.startProgram
+		return nil, nil
+	case "attach", "setExceptionBreakpoints", "disconnect":
+		return nil, nil
+	case "setBreakpoints":
+		return s.setBreakpoints(req.Arguments)
+	case "threads":
+		return map[string][]thread{"threads": {{ID: threadID, Name: "main"}}}, nil
+	case "stackTrace":
+		return s.stackTrace(req.Arguments)
+	case "scopes":
+		return s.scopes(req.Arguments)
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		var vars []variable
+		err := d.inspect(func(st *stoppedState) (err error) {
+			vars, err = st.variables(args.VariablesReference)
+			return
+		})
+		return map[string][]variable{"variables": vars}, err
+	case "evaluate":
+		return s.evaluate(req.Arguments)
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, s.resume(stepNone)
+	case "next":
+		return nil, s.resume(stepOver)
+	case "stepIn":
+		return nil, s.resume(stepIn)
+	case "stepOut":
+		return nil, s.resume(stepOut)
+	case "pause":
+		d.mu.Lock()
+		if d.stopped == nil {
+			d.pause = "pause"
+		}
+		d.mu.Unlock()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request: %v", req.Command)
+}
+
+// resume resumes the execution after the response is sent, so the response
+// precedes the next stopped event.
+func (s *session) resume(mode stepMode) error {
+	s.d.mu.Lock()
+	stopped := s.d.stopped != nil
+	s.d.mu.Unlock()
+	if !stopped {
+		return errNotStopped
+	}
+	s.after = func() {
+		s.d.resume(mode)
+	}
+	return nil
+}
+
+func (s *session) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	path := filepath.Clean(args.Source.Path)
+	lines := map[int]string{}
+	result := []breakpoint{}
+	for _, bp := range args.Breakpoints {
+		lines[bp.Line] = bp.Condition
+		result = append(result, breakpoint{Verified: true, Line: bp.Line})
+	}
+	s.d.mu.Lock()
+	s.d.addFile(path)
+	if len(lines) == 0 {
+		delete(s.d.breakpoints, path)
+	} else {
+		s.d.breakpoints[path] = lines
+	}
+	s.d.mu.Unlock()
+	return map[string][]breakpoint{"breakpoints": result}, nil
+}
+
+func (s *session) stackTrace(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	frames := []stackFrame{}
+	total := 0
+	err := s.d.inspect(func(st *stoppedState) error {
+		refs := st.stackFrames()
+		total = len(refs)
+		for i := args.StartFrame; i < len(refs); i++ {
+			if args.Levels > 0 && len(frames) >= args.Levels {
+				break
+			}
+			info := refs[i].info
+			frame := stackFrame{ID: i + 1, Name: info.Name}
+			if info.What == "G" {
+				frame.PresentationHint = "subtle"
+			} else {
+				s.d.mu.Lock()
+				frame.Source = &source{Name: filepath.Base(info.Source), Path: s.d.sourcePath(info.Source)}
+				s.d.mu.Unlock()
+				frame.Line = info.CurrentLine
+				frame.Column = info.CurrentColumn
+			}
+			frames = append(frames, frame)
+		}
+		return nil
+	})
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": total}, err
+}
+
+func (s *session) scopes(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	scopes := []scope{}
+	err := s.d.inspect(func(st *stoppedState) error {
+		fr, err := st.frame(args.FrameID)
+		if err != nil {
+			return err
+		}
+		scopes = append(scopes,
+			scope{Name: "Locals", VariablesReference: st.newRef(varRef{kind: refLocals, frame: fr})},
+			scope{Name: "Upvalues", VariablesReference: st.newRef(varRef{kind: refUpvalues, frame: fr})},
+			scope{Name: "Globals", VariablesReference: st.newRef(varRef{kind: refValue, value: st.L.Get(lua.GlobalsIndex)}), Expensive: true},
+		)
+		return nil
+	})
+	return map[string][]scope{"scopes": scopes}, err
+}
+
+func (s *session) evaluate(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Expression string `json:"expression"`
+		FrameID    int    `json:"frameId"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+	body := map[string]interface{}{}
+	err := s.d.inspect(func(st *stoppedState) error {
+		fr := frameRef{L: st.L}
+		if args.FrameID > 0 {
+			var err error
+			if fr, err = st.frame(args.FrameID); err != nil {
+				return err
+			}
+		}
+		values, err := s.d.evaluate(st, fr, args.Expression)
+		if err != nil {
+			return err
+		}
+		results := []string{}
+		for _, value := range values {
+			results = append(results, st.variable("", value).Value)
+		}
+		body["result"] = strings.Join(results, ", ")
+		body["variablesReference"] = 0
+		if len(values) == 1 {
+			v := st.variable("", values[0])
+			body["type"] = v.Type
+			body["variablesReference"] = v.VariablesReference
+		}
+		return nil
+	})
+	return body, err
+}
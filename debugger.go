@@ -0,0 +1,199 @@
+package lua
+
+import (
+	"sort"
+)
+
+// Breakpoint is a line of a chunk. Source is the chunk name, which is the base
+// name of the file for chunks loaded by LState.LoadFile and LState.DoFile.
+type Breakpoint struct {
+	Source string
+	Line   int
+}
+
+// BreakpointFunc is called when the execution reaches a breakpoint or finishes
+// a step, before the first instruction of the line is executed. The execution
+// is paused until the function returns. L is the running thread, L.GetStack(0)
+// returns the function at the breakpoint. Breakpoints are not checked while the
+// function runs.
+type BreakpointFunc func(L *LState, source string, line int)
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepInto
+	stepOver
+	stepOut
+)
+
+type debugger struct {
+	// lines maps lines to the sources that have breakpoints on the line.
+	lines   map[int]map[string]bool
+	handler BreakpointFunc
+	step    stepMode
+	// stepDepth is the call depth when the step started.
+	stepDepth int
+	// active is true if the debugger has to check instructions.
+	active    bool
+	running   bool
+	lastPc    int
+	lastFrame *callFrame
+}
+
+func (ls *LState) debugger() *debugger {
+	if ls.G.debugger == nil {
+		ls.G.debugger = &debugger{lines: map[int]map[string]bool{}}
+		ls.G.updateInstrumented()
+	}
+	return ls.G.debugger
+}
+
+func (d *debugger) update() {
+	d.active = d.handler != nil && (len(d.lines) > 0 || d.step != stepNone)
+}
+
+// callDepth returns the number of frames of the thread and the threads
+// resuming it.
+func (ls *LState) callDepth() int {
+	n := 0
+	for L := ls; L != nil; L = L.Parent {
+		n += L.stack.Sp()
+	}
+	return n
+}
+
+// SetBreakpoint sets a breakpoint on the line of the source. Breakpoints are
+// shared by the state and its coroutines.
+func (ls *LState) SetBreakpoint(source string, line int) {
+	d := ls.debugger()
+	sources, ok := d.lines[line]
+	if !ok {
+		sources = map[string]bool{}
+		d.lines[line] = sources
+	}
+	sources[source] = true
+	d.update()
+}
+
+// ClearBreakpoint removes the breakpoint on the line of the source.
+func (ls *LState) ClearBreakpoint(source string, line int) {
+	d := ls.G.debugger
+	if d == nil {
+		return
+	}
+	if sources, ok := d.lines[line]; ok {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(d.lines, line)
+		}
+	}
+	d.update()
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (ls *LState) ClearBreakpoints() {
+	if d := ls.G.debugger; d != nil {
+		d.lines = map[int]map[string]bool{}
+		d.update()
+	}
+}
+
+// Breakpoints returns the breakpoints sorted by their sources and lines.
+func (ls *LState) Breakpoints() []Breakpoint {
+	bps := []Breakpoint{}
+	if d := ls.G.debugger; d != nil {
+		for line, sources := range d.lines {
+			for source := range sources {
+				bps = append(bps, Breakpoint{Source: source, Line: line})
+			}
+		}
+	}
+	sort.Slice(bps, func(i, j int) bool {
+		if bps[i].Source != bps[j].Source {
+			return bps[i].Source < bps[j].Source
+		}
+		return bps[i].Line < bps[j].Line
+	})
+	return bps
+}
+
+// SetBreakpointHandler sets the function called at breakpoints. nil removes
+// the function, breakpoints are ignored without a function.
+func (ls *LState) SetBreakpointHandler(fn BreakpointFunc) {
+	d := ls.debugger()
+	d.handler = fn
+	d.update()
+}
+
+func (ls *LState) startStep(mode stepMode) {
+	d := ls.debugger()
+	d.step = mode
+	d.stepDepth = ls.callDepth()
+	d.update()
+}
+
+// StepInto pauses the execution at the next line, including lines of
+// functions called from the current line. The breakpoint handler is called
+// when the step finishes. Steps are usually started by the breakpoint handler,
+// and a breakpoint reached before the step finishes cancels the step.
+func (ls *LState) StepInto() {
+	ls.startStep(stepInto)
+}
+
+// StepOver pauses the execution at the next line of the current function or
+// its callers. If the state is not running, this is the same as StepInto.
+func (ls *LState) StepOver() {
+	ls.startStep(stepOver)
+}
+
+// StepOut pauses the execution at the next line after the current function
+// returns. If the state is not running, this is the same as StepInto.
+func (ls *LState) StepOut() {
+	ls.startStep(stepOut)
+}
+
+// CancelStep cancels the step started by StepInto, StepOver or StepOut.
+func (ls *LState) CancelStep() {
+	if d := ls.G.debugger; d != nil {
+		d.step = stepNone
+		d.update()
+	}
+}
+
+// check calls the handler when the execution enters a line that has a
+// breakpoint or finishes a step. Lines are entered the same way as line hooks.
+func (d *debugger) check(L *LState, cf *callFrame) {
+	if d.running {
+		return
+	}
+	pc := cf.Pc - 1
+	oldpc := d.lastPc
+	if cf != d.lastFrame {
+		oldpc = pc - 1
+	}
+	d.lastPc = pc
+	d.lastFrame = cf
+	proto := cf.Fn.Proto
+	positions := proto.DbgSourcePositions
+	if pc != 0 && pc > oldpc && positions[pc] == positions[oldpc] {
+		return
+	}
+	line := positions[pc]
+	pause := false
+	if sources, ok := d.lines[line]; ok && sources[proto.SourceName] {
+		pause = true
+	} else if d.step != stepNone {
+		n := L.callDepth()
+		pause = d.step == stepInto || d.stepDepth == 0 ||
+			(d.step == stepOver && n <= d.stepDepth) || (d.step == stepOut && n < d.stepDepth)
+	}
+	if !pause {
+		return
+	}
+	d.step = stepNone
+	d.update()
+	d.running = true
+	defer func() { d.running = false }()
+	d.handler(L, proto.SourceName, line)
+}
@@ -0,0 +1,126 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const debuggerScript = `local function add(a, b)
+  local c = a + b
+  return c
+end
+local x = add(1, 2)
+local y = add(x, 3)
+return y`
+
+func TestBreakpoints(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var hits []string
+	L.SetBreakpointHandler(func(L *LState, source string, line int) {
+		dbg, _ := L.GetStack(0)
+		name, value := L.GetLocal(dbg, 1)
+		hits = append(hits, fmt.Sprintf("%v:%v %v=%v", source, line, name, value))
+	})
+	L.SetBreakpoint("<string>", 2)
+	L.SetBreakpoint("<string>", 6)
+	L.SetBreakpoint("other", 5)
+	want := []Breakpoint{{"<string>", 2}, {"<string>", 6}, {"other", 5}}
+	if got := L.Breakpoints(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	L.ClearBreakpoint("other", 5)
+
+	if err := L.DoString(debuggerScript); err != nil {
+		t.Fatal(err)
+	}
+	wantHits := []string{"<string>:2 a=1", "<string>:6 add=function", "<string>:2 a=3"}
+	if len(hits) != len(wantHits) {
+		t.Fatalf("got %v, want %v", hits, wantHits)
+	}
+	for i := range hits {
+		if hits[i][:len(wantHits[i])] != wantHits[i] {
+			t.Errorf("got %v, want %v", hits[i], wantHits[i])
+		}
+	}
+
+	L.ClearBreakpoints()
+	hits = nil
+	if err := L.DoString(debuggerScript); err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 || len(L.Breakpoints()) != 0 {
+		t.Errorf("got %v after ClearBreakpoints", hits)
+	}
+}
+
+func TestBreakpointsCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	hits := 0
+	L.SetBreakpointHandler(func(L *LState, source string, line int) { hits++ })
+	L.SetBreakpoint("<string>", 2)
+	err := L.DoString(`local co = coroutine.wrap(function()
+  coroutine.yield(1)
+end)
+co()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 1 {
+		t.Errorf("got %v hits, want 1", hits)
+	}
+}
+
+// stepLines runs debuggerScript with a breakpoint on the line and starts the
+// step at the breakpoint, and returns the lines where the execution paused.
+func stepLines(t *testing.T, line int, step func(L *LState)) []int {
+	L := NewState()
+	defer L.Close()
+	var lines []int
+	L.SetBreakpointHandler(func(L *LState, source string, line int) {
+		lines = append(lines, line)
+		if len(lines) < 4 {
+			step(L)
+		}
+	})
+	L.SetBreakpoint("<string>", line)
+	if err := L.DoString(debuggerScript); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestStepInto(t *testing.T) {
+	got := stepLines(t, 5, (*LState).StepInto)
+	// returning to line 5 does not enter the line again.
+	if want := []int{5, 2, 3, 6}; !reflect.DeepEqual(got[:4], want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStepOver(t *testing.T) {
+	got := stepLines(t, 5, (*LState).StepOver)
+	if want := []int{5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStepOut(t *testing.T) {
+	got := stepLines(t, 2, (*LState).StepOut)
+	// the breakpoint on line 2 is hit again by the second call.
+	if want := []int{2, 6, 2, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCancelStep(t *testing.T) {
+	got := stepLines(t, 5, func(L *LState) {
+		L.StepInto()
+		L.CancelStep()
+	})
+	if want := []int{5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -6,15 +6,47 @@ func debugOpen(L *LState) {
 
 var debugFuncs = map[string]LGFunction{
 	"getfenv":      debugGetFEnv,
+	"gethook":      debugGetHook,
 	"getinfo":      debugGetInfo,
 	"getlocal":     debugGetLocal,
 	"getmetatable": debugGetMetatable,
 	"getupvalue":   debugGetUpvalue,
+	"listing":      debugListing,
 	"setfenv":      debugSetFEnv,
+	"sethook":      debugSetHook,
 	"setlocal":     debugSetLocal,
 	"setmetatable": debugSetMetatable,
 	"setupvalue":   debugSetUpvalue,
 	"traceback":    debugTraceback,
+	"upvalueid":    debugUpvalueId,
+	"upvaluejoin":  debugUpvalueJoin,
+}
+
+// debugThreadArg returns the thread given as the first argument, or the
+// current thread, and the index of the next argument.
+func debugThreadArg(L *LState) (*LState, int) {
+	if th, ok := L.Get(1).(*LState); ok {
+		return th, 1
+	}
+	return L, 0
+}
+
+// debugGetThreadStack returns the frame at the given level. Suspended threads
+// do not have the frame of coroutine.yield, level 1 is their running function.
+func debugGetThreadStack(L, th *LState, level int) (*Debug, bool) {
+	if th != L {
+		level--
+	}
+	return th.GetStack(level)
+}
+
+func debugCheckUpvalue(L *LState, fnidx, nidx int) (*LFunction, int) {
+	fn := L.CheckFunction(fnidx)
+	n := L.CheckInt(nidx)
+	if n < 1 || n > len(fn.Upvalues) || fn.Upvalues[n-1] == nil {
+		L.ArgError(nidx, "invalid upvalue index")
+	}
+	return fn, n - 1
 }
 
 func debugGetFEnv(L *LState) int {
@@ -22,10 +54,42 @@ func debugGetFEnv(L *LState) int {
 	return 1
 }
 
+func debugGetHook(L *LState) int {
+	th := L
+	if L.GetTop() > 0 {
+		th = L.CheckThread(1)
+	}
+	if th.hook == nil {
+		L.Push(LNil)
+		L.Push(LString(""))
+		L.Push(LNumber(0))
+		return 3
+	}
+	if th.hook.lfn != LNil {
+		L.Push(th.hook.lfn)
+	} else {
+		L.Push(LString("external hook"))
+	}
+	mask := ""
+	if th.hook.mask&HookCall != 0 {
+		mask += "c"
+	}
+	if th.hook.mask&HookReturn != 0 {
+		mask += "r"
+	}
+	if th.hook.mask&HookLine != 0 {
+		mask += "l"
+	}
+	L.Push(LString(mask))
+	L.Push(LNumber(th.hook.count))
+	return 3
+}
+
 func debugGetInfo(L *LState) int {
-	L.CheckTypes(1, LTFunction, LTNumber)
-	arg1 := L.Get(1)
-	what := L.OptString(2, "Slunf")
+	th, argbase := debugThreadArg(L)
+	L.CheckTypes(argbase+1, LTFunction, LTNumber)
+	arg1 := L.Get(argbase + 1)
+	what := L.OptString(argbase+2, "flnStu")
 	var dbg *Debug
 	var fn LValue
 	var err error
@@ -34,40 +98,67 @@ func debugGetInfo(L *LState) int {
 	case *LFunction:
 		dbg = &Debug{}
 		fn, err = L.GetInfo(">"+what, dbg, lv)
-	case LNumber:
-		dbg, ok = L.GetStack(int(lv))
+	case LNumber, LInteger:
+		dbg, ok = debugGetThreadStack(L, th, L.CheckInt(argbase+1))
 		if !ok {
 			L.Push(LNil)
 			return 1
 		}
-		fn, err = L.GetInfo(what, dbg, LNil)
+		fn, err = th.GetInfo(what, dbg, LNil)
 	}
 
 	if err != nil {
-		L.Push(LNil)
-		return 1
+		L.ArgError(argbase+2, "invalid option")
 	}
 	tbl := L.NewTable()
-	tbl.RawSetH(LString("name"), LString(dbg.Name))
-	tbl.RawSetH(LString("what"), LString(dbg.What))
-	tbl.RawSetH(LString("source"), LString(dbg.Source))
-	tbl.RawSetH(LString("currentline"), LNumber(dbg.CurrentLine))
-	tbl.RawSetH(LString("nups"), LNumber(dbg.NUpvalues))
-	tbl.RawSetH(LString("linedefined"), LNumber(dbg.LineDefined))
-	tbl.RawSetH(LString("lastlinedefined"), LNumber(dbg.LastLineDefined))
-	tbl.RawSetH(LString("func"), fn)
+	for _, c := range what {
+		switch c {
+		case 'S':
+			tbl.RawSetH(LString("what"), LString(dbg.What))
+			tbl.RawSetH(LString("source"), LString(dbg.Source))
+			tbl.RawSetH(LString("short_src"), LString(dbg.Source))
+			tbl.RawSetH(LString("linedefined"), integerValue(int64(dbg.LineDefined)))
+			tbl.RawSetH(LString("lastlinedefined"), integerValue(int64(dbg.LastLineDefined)))
+		case 'l':
+			tbl.RawSetH(LString("currentline"), integerValue(int64(dbg.CurrentLine)))
+			tbl.RawSetH(LString("currentcolumn"), integerValue(int64(dbg.CurrentColumn)))
+		case 'u':
+			tbl.RawSetH(LString("nups"), integerValue(int64(dbg.NUpvalues)))
+			tbl.RawSetH(LString("nparams"), integerValue(int64(dbg.NParams)))
+			tbl.RawSetH(LString("isvararg"), LBool(dbg.IsVarArg))
+		case 'n':
+			tbl.RawSetH(LString("name"), LString(dbg.Name))
+		case 't':
+			tbl.RawSetH(LString("istailcall"), LBool(dbg.IsTailCall))
+		case 'L':
+			if dbg.ActiveLines != nil {
+				lines := L.CreateTable(0, len(dbg.ActiveLines))
+				for _, line := range dbg.ActiveLines {
+					lines.RawSetInt(line, LTrue)
+				}
+				tbl.RawSetH(LString("activelines"), lines)
+			}
+		case 'f':
+			tbl.RawSetH(LString("func"), fn)
+		}
+	}
 	L.Push(tbl)
 	return 1
 }
 
 func debugGetLocal(L *LState) int {
-	level := L.CheckInt(1)
-	idx := L.CheckInt(2)
-	dbg, ok := L.GetStack(level)
+	th, argbase := debugThreadArg(L)
+	level := L.CheckInt(argbase + 1)
+	idx := L.CheckInt(argbase + 2)
+	dbg, ok := debugGetThreadStack(L, th, level)
 	if !ok {
-		L.ArgError(1, "invalid level")
+		L.ArgError(argbase+1, "invalid level")
+	}
+	name, value := th.GetLocal(dbg, idx)
+	if len(name) == 0 {
+		L.Push(LNil)
+		return 1
 	}
-	name, value := L.GetLocal(dbg, idx)
 	L.Push(LString(name))
 	L.Push(value)
 	return 2
@@ -96,15 +187,53 @@ func debugSetFEnv(L *LState) int {
 	return 0
 }
 
+func debugSetHook(L *LState) int {
+	th := L
+	argbase := 0
+	if lv, ok := L.Get(1).(*LState); ok {
+		th = lv
+		argbase = 1
+	}
+	if L.Get(argbase+1) == LNil {
+		th.setHook(nil, LNil, 0, 0)
+		return 0
+	}
+	fn := L.CheckFunction(argbase + 1)
+	var mask HookEvent
+	for _, c := range L.OptString(argbase+2, "") {
+		switch c {
+		case 'c':
+			mask |= HookCall
+		case 'r':
+			mask |= HookReturn
+		case 'l':
+			mask |= HookLine
+		}
+	}
+	count := L.OptInt(argbase+3, 0)
+	th.setHook(func(L *LState, event HookEvent, line int) {
+		L.Push(fn)
+		L.Push(LString(event.String()))
+		if line < 0 {
+			L.Push(LNil)
+		} else {
+			L.Push(LNumber(line))
+		}
+		L.Call(2, 0)
+	}, fn, mask, count)
+	return 0
+}
+
 func debugSetLocal(L *LState) int {
-	level := L.CheckInt(1)
-	idx := L.CheckInt(2)
-	value := L.CheckAny(3)
-	dbg, ok := L.GetStack(level)
+	th, argbase := debugThreadArg(L)
+	level := L.CheckInt(argbase + 1)
+	idx := L.CheckInt(argbase + 2)
+	value := L.CheckAny(argbase + 3)
+	dbg, ok := debugGetThreadStack(L, th, level)
 	if !ok {
-		L.ArgError(1, "invalid level")
+		L.ArgError(argbase+1, "invalid level")
 	}
-	name := L.SetLocal(dbg, idx, value)
+	name := th.SetLocal(dbg, idx, value)
 	if len(name) > 0 {
 		L.Push(LString(name))
 	} else {
@@ -137,6 +266,39 @@ func debugSetUpvalue(L *LState) int {
 
 func debugTraceback(L *LState) int {
 	msg := L.OptString(1, "")
-	L.Push(LString(L.stackTrace(msg, false)))
+	level := L.OptInt(2, 1)
+	L.Push(LString(L.stackTrace(msg, level)))
+	return 1
+}
+
+func debugUpvalueId(L *LState) int {
+	fn, n := debugCheckUpvalue(L, 1, 2)
+	uv := fn.Upvalues[n]
+	if uv.id == nil {
+		uv.id = L.NewUserData()
+	}
+	L.Push(uv.id)
+	return 1
+}
+
+func debugUpvalueJoin(L *LState) int {
+	fn1, n1 := debugCheckUpvalue(L, 1, 2)
+	fn2, n2 := debugCheckUpvalue(L, 3, 4)
+	if fn1.IsG {
+		L.ArgError(1, "Lua function expected")
+	}
+	if fn2.IsG {
+		L.ArgError(3, "Lua function expected")
+	}
+	fn1.Upvalues[n1] = fn2.Upvalues[n2]
+	return 0
+}
+
+func debugListing(L *LState) int {
+	fn := L.CheckFunction(1)
+	if fn.IsG {
+		L.ArgError(1, "Lua function expected")
+	}
+	L.Push(LString(Disassemble(fn.Proto)))
 	return 1
 }
@@ -0,0 +1,194 @@
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDebugSetHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local lines = {}
+	local function f()
+	  local x = 1
+	  return x
+	end
+	debug.sethook(function(event, line) lines[#lines + 1] = line end, "l")
+	f()
+	debug.sethook()
+	assert(#lines >= 3, #lines .. " lines")
+
+	local fn, mask, count = debug.gethook()
+	assert(fn == nil and mask == "" and count == 0)
+
+	local events = {}
+	debug.sethook(function(event) events[#events + 1] = event end, "cr")
+	f()
+	debug.sethook()
+	-- debug.sethook returns, f is called and returns, debug.sethook is called.
+	assert(table.concat(events, " ") == "return call return call", table.concat(events, " "))
+
+	local counts = 0
+	local hook = function() counts = counts + 1 end
+	debug.sethook(hook, "", 10)
+	for i = 1, 100 do end
+	debug.sethook()
+	assert(counts > 0)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugGetHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local hook = function() end
+	debug.sethook(hook, "crl", 5)
+	local fn, mask, count = debug.gethook()
+	debug.sethook()
+	assert(fn == hook and mask == "crl" and count == 5)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var events []HookEvent
+	L.SetHook(func(L *LState, event HookEvent, line int) {
+		events = append(events, event)
+	}, HookCall|HookReturn, 0)
+	if err := L.DoString(`local function f() end f()`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetHook(nil, 0, 0)
+	// the main chunk and f are called, and f returns. The main chunk returns
+	// to DoString.
+	want := []HookEvent{HookCall, HookCall, HookReturn, HookReturn}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got %v, want %v", events, want)
+	}
+}
+
+func TestSetHookCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	calls := 0
+	L.SetHook(func(L *LState, event HookEvent, line int) { calls++ }, HookCall, 0)
+	// the thread inherits the hook.
+	if err := L.DoString(`coroutine.wrap(function() end)()`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetHook(nil, 0, 0)
+	// the main chunk, coroutine.wrap, the wrapped function and the coroutine.
+	if calls != 4 {
+		t.Errorf("got %v calls, want 4", calls)
+	}
+}
+
+func TestDebugLocalsAndUpvalues(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function f()
+	  local a, b = 1, 2
+	  local name, value = debug.getlocal(1, 2)
+	  assert(name == "b" and value == 2)
+	  assert(debug.setlocal(1, 1, 10) == "a")
+	  return a
+	end
+	assert(f() == 10)
+
+	local co = coroutine.create(function(x) local y = x * 2 coroutine.yield() end)
+	coroutine.resume(co, 3)
+	local name, value = debug.getlocal(co, 1, 2)
+	assert(name == "y" and value == 6, name)
+
+	local u1, u2 = 1, 2
+	local function g() return u1 end
+	local function h() return u2 end
+	assert(debug.getupvalue(g, 1) == "u1")
+	assert(debug.setupvalue(g, 1, 5) == "u1" and u1 == 5)
+	assert(debug.upvalueid(g, 1) ~= debug.upvalueid(h, 1))
+	debug.upvaluejoin(g, 1, h, 1)
+	assert(debug.upvalueid(g, 1) == debug.upvalueid(h, 1) and g() == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugGetInfo(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local up = 1
+	local function f(a, b, ...)
+	  return up
+	end
+	local info = debug.getinfo(f, "u")
+	assert(info.nups == 1 and info.nparams == 2 and info.isvararg == true)
+	assert(info.source == nil and info.short_src == nil)
+
+	info = debug.getinfo(f, "SL")
+	assert(info.what == "Lua" and info.linedefined == 3 and info.lastlinedefined == 5)
+	assert(info.activelines[4] and not info.activelines[2])
+
+	local function g() local info = debug.getinfo(1, "t") return info end
+	local function tail() return g() end
+	assert(tail().istailcall == true)
+	assert(debug.getinfo(1, "t").istailcall == false)
+
+	local co = coroutine.create(function() coroutine.yield() end)
+	coroutine.resume(co)
+	info = debug.getinfo(co, 1, "Sl")
+	assert(info.what == "Lua" and info.currentline == 19)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSourceColumns(t *testing.T) {
+	L := NewState(Options{IncludeColumnInErrors: true})
+	defer L.Close()
+	err := L.DoString(`
+	local info = debug.getinfo(1, "l")
+	-- the column of the name of the called function.
+	assert(info.currentcolumn == 21, tostring(info.currentcolumn))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = L.DoString("local x = 1\nlocal y = x + nil")
+	if err == nil || !strings.Contains(err.Error(), "<string>:2:11:") {
+		t.Errorf("got %v, want the column in the message", err)
+	}
+}
+
+func TestDebugGetLocalScopeEnd(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	// locals are active at the last instruction of their scopes. The body of
+	// the loop is one instruction.
+	err := L.DoString(`
+	local x, name = 0, nil
+	debug.sethook(function(event, line)
+	  if line == 7 then name = debug.getlocal(2, 6) end
+	end, "l")
+	for i = 1, 1 do
+	  x = x + i
+	end
+	debug.sethook()
+	assert(name == "i", tostring(name))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
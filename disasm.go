@@ -0,0 +1,148 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Disassemble returns a listing of the function prototype and its nested
+// prototypes. The listing contains the instructions with their source
+// positions, the constants, the locals and the upvalues.
+func Disassemble(proto *FunctionProto) string {
+	buf := &strings.Builder{}
+	disassemble(buf, proto)
+	return buf.String()
+}
+
+func disassemble(buf *strings.Builder, proto *FunctionProto) {
+	kind := "function"
+	if proto.LineDefined == 0 {
+		kind = "main"
+	}
+	fmt.Fprintf(buf, "%v <%v:%v,%v> (%v instructions)\n", kind, proto.SourceName,
+		proto.LineDefined, proto.LastLineDefined, len(proto.Code))
+	vararg := ""
+	if proto.IsVarArg != 0 {
+		vararg = "+"
+	}
+	fmt.Fprintf(buf, "%v%v params, %v slots, %v upvalues, %v locals, %v constants, %v functions\n",
+		proto.NumParameters, vararg, proto.NumUsedRegisters, proto.NumUpvalues,
+		len(proto.DbgLocals), len(proto.Constants), len(proto.FunctionPrototypes))
+	for pc, inst := range proto.Code {
+		pos := "-"
+		if pc < len(proto.DbgSourcePositions) {
+			pos = fmt.Sprint(proto.DbgSourcePositions[pc])
+			if pc < len(proto.DbgSourceColumns) {
+				pos += fmt.Sprintf(":%v", proto.DbgSourceColumns[pc])
+			}
+		}
+		op := opGetOpCode(inst)
+		if op > opCodeMax {
+			fmt.Fprintf(buf, "\t%v\t[%v]\t<invalid %08x>\n", pc+1, pos, inst)
+			continue
+		}
+		prop := &opProps[op]
+		a := opGetArgA(inst)
+		var args string
+		switch prop.Type {
+		case opTypeABC:
+			args = fmt.Sprintf("%v %v %v", a, opGetArgB(inst), opGetArgC(inst))
+		case opTypeABx:
+			args = fmt.Sprintf("%v %v", a, opGetArgBx(inst))
+		case opTypeASbx:
+			args = fmt.Sprintf("%v %v", a, opGetArgSbx(inst))
+		}
+		line := fmt.Sprintf("\t%v\t[%v]\t%-9v\t%v", pc+1, pos, prop.Name, args)
+		if comment := disassembleComment(proto, pc, inst); comment != "" {
+			line += "\t; " + comment
+		}
+		buf.WriteString(line + "\n")
+	}
+	fmt.Fprintf(buf, "constants (%v):\n", len(proto.Constants))
+	for i, k := range proto.Constants {
+		fmt.Fprintf(buf, "\t%v\t%v\n", i, disassembleConstant(k))
+	}
+	fmt.Fprintf(buf, "locals (%v):\n", len(proto.DbgLocals))
+	for i, local := range proto.DbgLocals {
+		fmt.Fprintf(buf, "\t%v\t%v\t%v\t%v\n", i, local.Name, local.StartPc+1, local.EndPc+1)
+	}
+	fmt.Fprintf(buf, "upvalues (%v):\n", len(proto.DbgUpvalues))
+	for i, name := range proto.DbgUpvalues {
+		fmt.Fprintf(buf, "\t%v\t%v\n", i, name)
+	}
+	for _, child := range proto.FunctionPrototypes {
+		buf.WriteString("\n")
+		disassemble(buf, child)
+	}
+}
+
+func disassembleConstant(lv LValue) string {
+	if s, ok := lv.(LString); ok {
+		return fmt.Sprintf("%q", string(s))
+	}
+	return lv.String()
+}
+
+func disassembleUpvalue(proto *FunctionProto, idx int) string {
+	if idx < len(proto.DbgUpvalues) {
+		return proto.DbgUpvalues[idx]
+	}
+	return fmt.Sprintf("upvalue %v", idx)
+}
+
+// disassembleComment describes the constants, upvalues, jump targets and
+// functions referred by the instruction.
+func disassembleComment(proto *FunctionProto, pc int, inst uint32) string {
+	op := opGetOpCode(inst)
+	prop := &opProps[op]
+	constant := func(idx int) string {
+		if idx < len(proto.Constants) {
+			return disassembleConstant(proto.Constants[idx])
+		}
+		return "?"
+	}
+	switch op {
+	case OP_LOADK, OP_GETGLOBAL, OP_SETGLOBAL:
+		return constant(opGetArgBx(inst))
+	case OP_GETUPVAL, OP_SETUPVAL:
+		return disassembleUpvalue(proto, opGetArgB(inst))
+	case OP_GETTABUP:
+		return strings.TrimSpace(disassembleUpvalue(proto, opGetArgB(inst)) + " " + disassembleRK(proto, opGetArgC(inst)))
+	case OP_SETTABUP:
+		return strings.TrimSpace(disassembleUpvalue(proto, opGetArgA(inst)) + " " +
+			disassembleRK(proto, opGetArgB(inst)) + " " + disassembleRK(proto, opGetArgC(inst)))
+	case OP_JMP, OP_FORLOOP, OP_FORPREP:
+		return fmt.Sprintf("to %v", pc+opGetArgSbx(inst)+2)
+	case OP_CLOSURE:
+		if bx := opGetArgBx(inst); bx < len(proto.FunctionPrototypes) {
+			child := proto.FunctionPrototypes[bx]
+			return fmt.Sprintf("function <%v:%v>", child.SourceName, child.LineDefined)
+		}
+		return ""
+	}
+	if prop.Type != opTypeABC {
+		return ""
+	}
+	comments := []string{}
+	if prop.ModeArgB == opArgModeK {
+		if s := disassembleRK(proto, opGetArgB(inst)); s != "" {
+			comments = append(comments, s)
+		}
+	}
+	if prop.ModeArgC == opArgModeK {
+		if s := disassembleRK(proto, opGetArgC(inst)); s != "" {
+			comments = append(comments, s)
+		}
+	}
+	return strings.Join(comments, " ")
+}
+
+func disassembleRK(proto *FunctionProto, value int) string {
+	if !opIsK(value) {
+		return ""
+	}
+	if idx := opIndexK(value); idx < len(proto.Constants) {
+		return disassembleConstant(proto.Constants[idx])
+	}
+	return "?"
+}
@@ -0,0 +1,38 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	fn, err := L.LoadString(`local x = "hello"
+local function f(a, ...) return x .. a end
+return f`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := Disassemble(fn.Proto)
+	for _, s := range []string{
+		"main <<string>:0,0>",
+		"function <<string>:2,2>",
+		"1+ params",
+		"LOADK",
+		"CONCAT",
+		`"hello"`,
+		"upvalues (1):\n\t0\tx\n",
+	} {
+		if !strings.Contains(listing, s) {
+			t.Errorf("the listing does not have %q:\n%v", s, listing)
+		}
+	}
+
+	if err := L.DoString(`assert(debug.listing(function() end):find("RETURN"))`); err != nil {
+		t.Error(err)
+	}
+	if err := L.DoString(`assert(not pcall(debug.listing, print))`); err != nil {
+		t.Error(err)
+	}
+}
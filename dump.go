@@ -0,0 +1,452 @@
+package lua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	dumpSignature     = "\x1bLua"
+	dumpLuaVersion    = 0x51
+	dumpFormat        = 'G'
+	dumpFormatVersion = 5
+)
+
+const undumpMaxDepth = 200
+
+const (
+	dumpConstNil byte = iota
+	dumpConstFalse
+	dumpConstTrue
+	dumpConstNumber
+	dumpConstString
+	dumpConstInteger
+)
+
+type dumpState struct {
+	buf []byte
+}
+
+func (ds *dumpState) writeByte(b byte) {
+	ds.buf = append(ds.buf, b)
+}
+
+func (ds *dumpState) writeInt(i int) {
+	ds.buf = binary.AppendVarint(ds.buf, int64(i))
+}
+
+func (ds *dumpState) writeString(s string) {
+	ds.buf = binary.AppendUvarint(ds.buf, uint64(len(s)))
+	ds.buf = append(ds.buf, s...)
+}
+
+func (ds *dumpState) writeConstant(lv LValue) error {
+	switch v := lv.(type) {
+	case *LNilType:
+		ds.writeByte(dumpConstNil)
+	case LBool:
+		if v {
+			ds.writeByte(dumpConstTrue)
+		} else {
+			ds.writeByte(dumpConstFalse)
+		}
+	case LNumber:
+		ds.writeByte(dumpConstNumber)
+		ds.buf = binary.LittleEndian.AppendUint64(ds.buf, math.Float64bits(float64(v)))
+	case LString:
+		ds.writeByte(dumpConstString)
+		ds.writeString(string(v))
+	case LInteger:
+		ds.writeByte(dumpConstInteger)
+		ds.buf = binary.LittleEndian.AppendUint64(ds.buf, uint64(v))
+	default:
+		return errors.New("unable to dump a constant of type " + lv.Type().String())
+	}
+	return nil
+}
+
+func (ds *dumpState) writeProto(proto *FunctionProto) error {
+	ds.writeString(proto.SourceName)
+	ds.writeInt(proto.LineDefined)
+	ds.writeInt(proto.LastLineDefined)
+	ds.writeByte(proto.NumUpvalues)
+	ds.writeByte(proto.NumParameters)
+	ds.writeByte(proto.IsVarArg)
+	ds.writeByte(proto.NumUsedRegisters)
+
+	ds.writeInt(len(proto.Code))
+	for _, inst := range proto.Code {
+		ds.buf = binary.LittleEndian.AppendUint32(ds.buf, inst)
+	}
+	ds.writeInt(len(proto.Constants))
+	for _, lv := range proto.Constants {
+		if err := ds.writeConstant(lv); err != nil {
+			return err
+		}
+	}
+	ds.writeInt(len(proto.FunctionPrototypes))
+	for _, p := range proto.FunctionPrototypes {
+		if err := ds.writeProto(p); err != nil {
+			return err
+		}
+	}
+
+	ds.writeInt(len(proto.DbgSourcePositions))
+	for _, line := range proto.DbgSourcePositions {
+		ds.writeInt(line)
+	}
+	ds.writeInt(len(proto.DbgSourceColumns))
+	for _, column := range proto.DbgSourceColumns {
+		ds.writeInt(column)
+	}
+	ds.writeInt(len(proto.DbgLocals))
+	for _, local := range proto.DbgLocals {
+		ds.writeString(local.Name)
+		ds.writeInt(local.StartPc)
+		ds.writeInt(local.EndPc)
+	}
+	ds.writeInt(len(proto.DbgCalls))
+	for _, call := range proto.DbgCalls {
+		ds.writeString(call.Name)
+		ds.writeInt(call.Pc)
+	}
+	ds.writeInt(len(proto.DbgUpvalues))
+	for _, name := range proto.DbgUpvalues {
+		ds.writeString(name)
+	}
+	return nil
+}
+
+func dumpProto(proto *FunctionProto, w io.Writer) error {
+	ds := &dumpState{buf: make([]byte, 0, 1024)}
+	ds.buf = append(ds.buf, dumpSignature...)
+	ds.writeByte(dumpLuaVersion)
+	ds.writeByte(dumpFormat)
+	ds.writeByte(dumpFormatVersion)
+	if err := ds.writeProto(proto); err != nil {
+		return err
+	}
+	_, err := w.Write(ds.buf)
+	return err
+}
+
+type undumpState struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (us *undumpState) fail(format string, args ...interface{}) {
+	if us.err == nil {
+		us.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (us *undumpState) readByte() byte {
+	if us.err != nil {
+		return 0
+	}
+	if us.pos >= len(us.buf) {
+		us.fail("truncated precompiled chunk")
+		return 0
+	}
+	b := us.buf[us.pos]
+	us.pos++
+	return b
+}
+
+func (us *undumpState) readInt() int {
+	if us.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(us.buf[us.pos:])
+	if n <= 0 || v < math.MinInt32 || v > math.MaxInt32 {
+		us.fail("truncated precompiled chunk")
+		return 0
+	}
+	us.pos += n
+	return int(v)
+}
+
+// readCount reads a number of elements that are at least size bytes long each.
+func (us *undumpState) readCount(size int) int {
+	n := us.readInt()
+	if us.err != nil {
+		return 0
+	}
+	if n < 0 || n*size > len(us.buf)-us.pos {
+		us.fail("truncated precompiled chunk")
+		return 0
+	}
+	return n
+}
+
+func (us *undumpState) readString() string {
+	if us.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(us.buf[us.pos:])
+	if n <= 0 || l > uint64(len(us.buf)-us.pos-n) {
+		us.fail("truncated precompiled chunk")
+		return ""
+	}
+	us.pos += n
+	s := string(us.buf[us.pos : us.pos+int(l)])
+	us.pos += int(l)
+	return s
+}
+
+func (us *undumpState) readFixed(size int) []byte {
+	if us.err != nil {
+		return nil
+	}
+	if len(us.buf)-us.pos < size {
+		us.fail("truncated precompiled chunk")
+		return nil
+	}
+	b := us.buf[us.pos : us.pos+size]
+	us.pos += size
+	return b
+}
+
+func (us *undumpState) readConstant() LValue {
+	switch us.readByte() {
+	case dumpConstNil:
+		return LNil
+	case dumpConstFalse:
+		return LFalse
+	case dumpConstTrue:
+		return LTrue
+	case dumpConstNumber:
+		if b := us.readFixed(8); b != nil {
+			return LNumber(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		}
+	case dumpConstString:
+		return LString(us.readString())
+	case dumpConstInteger:
+		if b := us.readFixed(8); b != nil {
+			return LInteger(binary.LittleEndian.Uint64(b))
+		}
+	default:
+		us.fail("bad constant in precompiled chunk")
+	}
+	return LNil
+}
+
+func (us *undumpState) readProto(depth int) *FunctionProto {
+	if depth > undumpMaxDepth {
+		us.fail("too many nested functions in precompiled chunk")
+		return nil
+	}
+	proto := &FunctionProto{}
+	proto.SourceName = us.readString()
+	proto.LineDefined = us.readInt()
+	proto.LastLineDefined = us.readInt()
+	proto.NumUpvalues = us.readByte()
+	proto.NumParameters = us.readByte()
+	proto.IsVarArg = us.readByte()
+	proto.NumUsedRegisters = us.readByte()
+
+	proto.Code = make([]uint32, us.readCount(4))
+	for i := range proto.Code {
+		if b := us.readFixed(4); b != nil {
+			proto.Code[i] = binary.LittleEndian.Uint32(b)
+		}
+	}
+	proto.Constants = make([]LValue, us.readCount(1))
+	for i := range proto.Constants {
+		proto.Constants[i] = us.readConstant()
+	}
+	proto.FunctionPrototypes = make([]*FunctionProto, us.readCount(1))
+	for i := range proto.FunctionPrototypes {
+		proto.FunctionPrototypes[i] = us.readProto(depth + 1)
+		if us.err != nil {
+			return nil
+		}
+	}
+
+	proto.DbgSourcePositions = make([]int, us.readCount(1))
+	for i := range proto.DbgSourcePositions {
+		proto.DbgSourcePositions[i] = us.readInt()
+	}
+	proto.DbgSourceColumns = make([]int, us.readCount(1))
+	for i := range proto.DbgSourceColumns {
+		proto.DbgSourceColumns[i] = us.readInt()
+	}
+	proto.DbgLocals = make([]*DbgLocalInfo, us.readCount(3))
+	for i := range proto.DbgLocals {
+		proto.DbgLocals[i] = &DbgLocalInfo{Name: us.readString(), StartPc: us.readInt(), EndPc: us.readInt()}
+	}
+	proto.DbgCalls = make([]DbgCall, us.readCount(2))
+	for i := range proto.DbgCalls {
+		proto.DbgCalls[i] = DbgCall{Name: us.readString(), Pc: us.readInt()}
+	}
+	proto.DbgUpvalues = make([]string, us.readCount(1))
+	for i := range proto.DbgUpvalues {
+		proto.DbgUpvalues[i] = us.readString()
+	}
+	if us.err != nil {
+		return nil
+	}
+	if err := verifyProto(proto); err != nil {
+		us.fail("%v", err)
+		return nil
+	}
+	return proto
+}
+
+func undumpProto(data []byte) (*FunctionProto, error) {
+	us := &undumpState{buf: data}
+	if len(data) < len(dumpSignature)+3 || string(data[:len(dumpSignature)]) != dumpSignature {
+		return nil, errors.New("bad header in precompiled chunk")
+	}
+	us.pos = len(dumpSignature)
+	if us.readByte() != dumpLuaVersion || us.readByte() != dumpFormat {
+		return nil, errors.New("bad header in precompiled chunk")
+	}
+	if us.readByte() != dumpFormatVersion {
+		return nil, errors.New("version mismatch in precompiled chunk")
+	}
+	proto := us.readProto(0)
+	if us.err != nil {
+		return nil, us.err
+	}
+	if us.pos != len(data) {
+		return nil, errors.New("bad precompiled chunk(garbage at end of chunk)")
+	}
+	return proto, nil
+}
+
+// verifyProto checks that instructions of the proto never access constants,
+// upvalues, functions and instructions out of their bounds. NumUsedRegisters
+// is extended to cover all registers used by the instructions.
+func verifyProto(proto *FunctionProto) error {
+	code := proto.Code
+	ncode := len(code)
+	nconst := len(proto.Constants)
+	nups := int(proto.NumUpvalues)
+	bad := func(pc int, msg string) error {
+		return fmt.Errorf("bad code in precompiled chunk(%v at pc %v)", msg, pc+1)
+	}
+	if ncode == 0 || opGetOpCode(code[ncode-1]) != OP_RETURN {
+		return errors.New("bad code in precompiled chunk(missing return)")
+	}
+	if len(proto.DbgSourcePositions) != ncode || len(proto.DbgSourceColumns) != ncode {
+		return errors.New("bad precompiled chunk(broken line information)")
+	}
+	if len(proto.DbgUpvalues) != 0 && len(proto.DbgUpvalues) != nups {
+		return errors.New("bad precompiled chunk(broken upvalue information)")
+	}
+	maxreg := int(proto.NumUsedRegisters)
+	use := func(r int) {
+		if r+1 > maxreg {
+			maxreg = r + 1
+		}
+	}
+	isrk := func(rk int) bool {
+		if opIsK(rk) {
+			return opIndexK(rk) < nconst
+		}
+		use(rk)
+		return true
+	}
+	isjump := func(pc, sbx int) bool { return pc+1+sbx >= 0 && pc+1+sbx < ncode }
+	for pc := 0; pc < ncode; pc++ {
+		inst := code[pc]
+		op := opGetOpCode(inst)
+		a, b, c := opGetArgA(inst), opGetArgB(inst), opGetArgC(inst)
+		bx, sbx := opGetArgBx(inst), opGetArgSbx(inst)
+		if op > opCodeMax {
+			return bad(pc, "invalid opcode")
+		}
+		if op != OP_JMP && op != OP_NOP && op != OP_EQ && op != OP_LT && op != OP_LE && op != OP_SETTABUP {
+			use(a)
+		}
+		ok := true
+		switch op {
+		case OP_MOVE, OP_UNM, OP_NOT, OP_LEN, OP_LOADNIL, OP_TESTSET, OP_BNOT:
+			use(b)
+			ok = op != OP_TESTSET || pc+1 < ncode
+		case OP_LOADK, OP_GETGLOBAL, OP_SETGLOBAL:
+			ok = bx < nconst
+		case OP_LOADBOOL:
+			ok = c == 0 || pc+1 < ncode
+		case OP_GETUPVAL, OP_SETUPVAL:
+			ok = b < nups
+		case OP_GETTABUP:
+			ok = b < nups && isrk(c)
+		case OP_SETTABUP:
+			ok = a < nups && isrk(b) && isrk(c)
+		case OP_GETTABLE:
+			use(b)
+			ok = isrk(c)
+		case OP_SELF:
+			use(a + 1)
+			use(b)
+			ok = isrk(c)
+		case OP_SETTABLE, OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW,
+			OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+			ok = isrk(b) && isrk(c)
+		case OP_EQ, OP_LT, OP_LE:
+			ok = isrk(b) && isrk(c) && pc+1 < ncode
+		case OP_CONCAT:
+			use(c)
+			ok = b <= c
+		case OP_JMP:
+			if a > 0 {
+				use(a - 1)
+			}
+			ok = isjump(pc, sbx)
+		case OP_FORLOOP, OP_FORPREP:
+			use(a + 3)
+			ok = isjump(pc, sbx)
+		case OP_TEST:
+			ok = pc+1 < ncode
+		case OP_TFORLOOP:
+			use(a + 2 + c)
+			ok = pc+1 < ncode
+		case OP_CALL:
+			use(a + b - 1)
+			use(a + c - 2)
+		case OP_TAILCALL, OP_SETLIST:
+			use(a + b)
+			if op == OP_SETLIST && c == 0 {
+				ok = pc+1 < ncode
+				pc++
+			}
+		case OP_RETURN, OP_VARARG:
+			use(a + b - 2)
+		case OP_CLOSURE:
+			if bx >= len(proto.FunctionPrototypes) {
+				return bad(pc, "invalid function index")
+			}
+			nchildups := int(proto.FunctionPrototypes[bx].NumUpvalues)
+			if pc+nchildups >= ncode {
+				return bad(pc, "missing upvalue instructions")
+			}
+			for i := 1; i <= nchildups; i++ {
+				uvinst := code[pc+i]
+				switch opGetOpCode(uvinst) {
+				case OP_MOVE:
+					use(opGetArgB(uvinst))
+				case OP_GETUPVAL:
+					ok = ok && opGetArgB(uvinst) < nups
+				default:
+					ok = false
+				}
+			}
+			pc += nchildups
+		}
+		if !ok {
+			return bad(pc, "invalid argument of "+opProps[op].Name)
+		}
+	}
+	if maxreg > opMaxArgsA {
+		return errors.New("bad code in precompiled chunk(too many registers)")
+	}
+	proto.NumUsedRegisters = uint8(maxreg)
+	return nil
+}
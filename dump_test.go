@@ -0,0 +1,102 @@
+package lua
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStringDump(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function f(a, ...)
+	  local t = {n = select("#", ...), 1.5, "s", true}
+	  local function g(x) return x * 2 end
+	  return g(a), t.n, t[1], t[2], t[3]
+	end
+	local d = string.dump(f)
+	assert(d:sub(1, 4) == "\27Lua")
+	local a, n, x, s, b = assert(loadstring(d))(21, nil, nil)
+	assert(a == 42 and n == 2 and x == 1.5 and s == "s" and b == true)
+	assert(not pcall(string.dump, print))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpFunction(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function add(a, b) return a + b end`); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := L.DumpFunction(L.GetGlobal("add").(*LFunction), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DumpFunction(L.NewFunction(func(*LState) int { return 0 }), &buf); err == nil {
+		t.Error("Go functions must not be dumped")
+	}
+
+	L2 := NewState()
+	defer L2.Close()
+	fn, err := L2.Load(bytes.NewReader(buf.Bytes()), "add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L2.Push(fn)
+	L2.Push(LNumber(1))
+	L2.Push(LNumber(2))
+	L2.Call(2, 1)
+	if got := L2.Get(-1); got.String() != "3" {
+		t.Errorf("got %v, want 3", got)
+	}
+}
+
+func TestLoadBinaryChunk(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local d = string.dump(function(...) return select("#", ...), ... end)
+	local f = assert(load(d, "d", "b"))
+	local n, a = f("x")
+	assert(n == 1 and a == "x")
+
+	local f, err = load(d, "d", "t")
+	assert(f == nil and err:find("attempt to load a binary chunk"), err)
+	f, err = load("return 1", "d", "b")
+	assert(f == nil and err:find("attempt to load a text chunk"), err)
+
+	-- truncated and corrupted chunks are rejected.
+	f, err = loadstring(d:sub(1, math.floor(#d / 2)))
+	assert(f == nil, "truncated chunk")
+	f, err = loadstring("\27Lua garbage")
+	assert(f == nil, "corrupted chunk")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadBinaryFile(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function chunk() return "from file" end`); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := L.DumpFunction(L.GetGlobal("chunk").(*LFunction), &buf); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "chunk.luac")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("path", LString(path))
+	if err := L.DoString(`assert(loadfile(path)() == "from file")`); err != nil {
+		t.Error(err)
+	}
+}
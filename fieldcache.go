@@ -0,0 +1,71 @@
+package lua
+
+import (
+	"unsafe"
+)
+
+// fieldCacheEntry remembers the value that an instruction read from the hash
+// part of a table with a constant string key. The entry is valid as long as
+// the table has not been modified since then.
+type fieldCacheEntry struct {
+	inst    *uint32
+	table   *LTable
+	version uint32
+	value   LValue
+}
+
+// fieldCache is the inline caches of GETGLOBAL, GETTABLE, GETTABUP and SELF
+// instructions. The entries are indexed by the addresses of the instructions,
+// so instructions of different functions may evict each other.
+type fieldCache struct {
+	entries []fieldCacheEntry
+	mask    uintptr
+}
+
+func newFieldCache(size int) *fieldCache {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &fieldCache{entries: make([]fieldCacheEntry, n), mask: uintptr(n - 1)}
+}
+
+func (fc *fieldCache) entry(inst *uint32) *fieldCacheEntry {
+	// instructions are 4 bytes long.
+	return &fc.entries[(uintptr(unsafe.Pointer(inst))>>2)&fc.mask]
+}
+
+// reset discards the cached values, so that the cache does not keep them
+// alive.
+func (fc *fieldCache) reset() {
+	clear(fc.entries)
+}
+
+// getFieldCached is getField for the instruction inst that indexes obj with a
+// constant key. Values of string keys found in the hash parts of tables are
+// cached; other accesses, including those that call metamethods, are not.
+func (ls *LState) getFieldCached(inst *uint32, obj LValue, key LValue) LValue {
+	tb, ok := obj.(*LTable)
+	if !ok || tb.weak != 0 || FieldCacheSize <= 0 {
+		return ls.getField(obj, key)
+	}
+	skey, ok := key.(LString)
+	if !ok {
+		return ls.getField(obj, key)
+	}
+	fc := ls.G.fieldCache
+	if fc == nil {
+		fc = newFieldCache(FieldCacheSize)
+		ls.G.fieldCache = fc
+	}
+	e := fc.entry(inst)
+	if e.inst == inst && e.table == tb && e.version == tb.version {
+		return e.value
+	}
+	value, found := tb.dict[skey]
+	if !found || value == LNil {
+		return ls.getField(obj, key)
+	}
+	*e = fieldCacheEntry{inst: inst, table: tb, version: tb.version, value: value}
+	return value
+}
@@ -0,0 +1,74 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestFieldCache(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("setconfig", L.NewFunction(func(L *LState) int {
+		L.GetGlobal("config").(*LTable).RawSetH(LString("name"), L.Get(1))
+		return 0
+	}))
+	err := L.DoString(`
+	config = {name = "a"}
+	local names = {}
+	for i = 1, 3 do
+	  names[#names + 1] = config.name
+	  setconfig("b" .. i)
+	end
+	assert(table.concat(names, " ") == "a b1 b2", table.concat(names, " "))
+
+	-- globals.
+	x = 1
+	local sum = 0
+	for i = 1, 3 do
+	  sum = sum + x
+	  x = x + 1
+	end
+	assert(sum == 6, tostring(sum))
+
+	-- methods.
+	local obj = {}
+	function obj:get() return 1 end
+	local r = {}
+	for i = 1, 2 do
+	  r[i] = obj:get()
+	  obj.get = function() return 2 end
+	end
+	assert(r[1] == 1 and r[2] == 2)
+
+	-- values found through __index are not cached.
+	local proto = {v = 1}
+	local t = setmetatable({}, {__index = proto})
+	r = {}
+	for i = 1, 2 do
+	  r[i] = t.v
+	  proto.v = 2
+	end
+	assert(r[1] == 1 and r[2] == 2)
+
+	-- the same instruction reads different tables.
+	local function get(tb) return tb.k end
+	assert(get({k = 1}) == 1 and get({k = 2}) == 2 and get({}) == nil)
+	rawset(config, "name", "c")
+	assert(config.name == "c")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFieldCacheDisabled(t *testing.T) {
+	defer func(old int) { FieldCacheSize = old }(FieldCacheSize)
+	FieldCacheSize = 0
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`local t = {a = 1} for i = 1, 10 do assert(t.a == i) t.a = t.a + 1 end`); err != nil {
+		t.Fatal(err)
+	}
+	if L.G.fieldCache != nil {
+		t.Error("the caches must not be created")
+	}
+}
@@ -0,0 +1,110 @@
+package lua
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// File is a file opened by a FileSystem. *os.File implements File.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	// Name returns the name of the file as given to OpenFile.
+	Name() string
+}
+
+// FileSystem is the filesystem used by a state. loadfile, dofile, require,
+// io.open, io.lines, io.input, io.output, os.remove, os.rename and
+// LState.LoadFile access files through the FileSystem given by
+// Options.FileSystem.
+type FileSystem interface {
+	// OpenFile opens the file like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Remove removes the file or the empty directory like os.Remove.
+	Remove(name string) error
+	// Rename renames the file like os.Rename.
+	Rename(oldpath, newpath string) error
+}
+
+// OSFileSystem is the filesystem of the operating system. This is the default
+// filesystem of states.
+type OSFileSystem struct{}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// DirFileSystem returns a filesystem rooted at the directory. Absolute and
+// relative names are resolved in the directory and ".." can not go above it.
+// Symbolic links in the directory are followed, so they must not point outside
+// the directory if scripts are untrusted.
+func DirFileSystem(dir string) FileSystem {
+	return dirFileSystem(dir)
+}
+
+type dirFileSystem string
+
+// dirFile hides the path of the file in the host filesystem.
+type dirFile struct {
+	*os.File
+	name string
+}
+
+func (f *dirFile) Name() string { return f.name }
+
+func (dir dirFileSystem) path(name string) string {
+	return filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+filepath.ToSlash(name))))
+}
+
+func (dir dirFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(dir.path(name), flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errorCause(err)}
+	}
+	return &dirFile{File: file, name: name}, nil
+}
+
+func (dir dirFileSystem) Remove(name string) error {
+	if err := os.Remove(dir.path(name)); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: errorCause(err)}
+	}
+	return nil
+}
+
+func (dir dirFileSystem) Rename(oldpath, newpath string) error {
+	if err := os.Rename(dir.path(oldpath), dir.path(newpath)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errorCause(err)}
+	}
+	return nil
+}
+
+// errorCause strips the host paths from errors of the os package.
+func errorCause(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	}
+	return err
+}
+
+// fileSystem returns the filesystem of the state.
+func (ls *LState) fileSystem() FileSystem {
+	if fsys := ls.G.options.FileSystem; fsys != nil {
+		return fsys
+	}
+	return OSFileSystem{}
+}
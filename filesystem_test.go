@@ -0,0 +1,48 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirFileSystem(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "sandbox")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	L := NewState(Options{FileSystem: DirFileSystem(dir)})
+	defer L.Close()
+	err := L.DoString(`
+	local f = assert(io.open("/data.txt", "w"))
+	f:write("return 42")
+	f:close()
+	assert(dofile("data.txt") == 42)
+	assert(loadfile("../../data.txt")() == 42)
+	for line in io.lines("data.txt") do assert(line == "return 42") end
+
+	assert(os.rename("data.txt", "moved.lua"))
+	package.path = "?.lua"
+	assert(require("moved") == 42)
+	assert(os.remove("moved.lua"))
+
+	-- ".." can not go above the directory, and host paths are hidden.
+	local f, err = io.open("../secret.txt")
+	assert(f == nil and err:find("../secret.txt", 1, true), err)
+	assert(not err:find("sandbox"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved.lua")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the file to be removed", err)
+	}
+	if _, err := L.LoadFile("/missing.lua"); err == nil || strings.Contains(err.Error(), dir) {
+		t.Errorf("got %v, want an error without the host path", err)
+	}
+}
@@ -0,0 +1,598 @@
+// Package format formats Lua source code in a canonical style.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// maxInlineTableWidth is the maximum column of tables printed in one line.
+const maxInlineTableWidth = 100
+
+// Source formats the Lua source code. Comments and blank lines between
+// statements(collapsed into one) are kept. Blocks are indented with tabs and
+// each statement is printed on its own line. The first line is kept as is if it
+// starts with '#'.
+func Source(src []byte, name string) ([]byte, error) {
+	lines := strings.Split(string(src), "\n")
+	shebang := ""
+	if len(src) > 0 && src[0] == '#' {
+		shebang = strings.TrimRight(lines[0], "\r")
+		src = src[len(lines[0]):]
+	}
+	chunk, comments, err := parse.ParseWithComments(bytes.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	p := &printer{comments: comments, lines: lines}
+	p.write(shebang)
+	p.chunk(chunk)
+	return p.buf.Bytes(), nil
+}
+
+// Chunk formats the chunk, for example, an AST built or modified by a program.
+func Chunk(chunk []ast.Stmt) []byte {
+	p := &printer{}
+	p.chunk(chunk)
+	return p.buf.Bytes()
+}
+
+type printer struct {
+	buf      bytes.Buffer
+	indent   int
+	comments []*ast.Comment
+	// lines are the lines of the source, used to find blank lines and
+	// trailing comments.
+	lines []string
+	// blockStart is true until the first line of a block is printed.
+	blockStart bool
+	// line is the source line of the last printed line.
+	line int
+}
+
+func (p *printer) write(s string) {
+	p.buf.WriteString(s)
+}
+
+func (p *printer) column() int {
+	b := p.buf.Bytes()
+	col := 0
+	for i := len(b) - 1; i >= 0 && b[i] != '\n'; i-- {
+		if b[i] == '\t' {
+			col += 4
+		} else {
+			col++
+		}
+	}
+	return col
+}
+
+func (p *printer) sourceLine(line int) (string, bool) {
+	if line < 1 || line > len(p.lines) {
+		return "", false
+	}
+	return p.lines[line-1], true
+}
+
+// startLine starts a new line at the current indentation. A blank line is
+// inserted if the line before the given source line is blank.
+func (p *printer) startLine(line int, allowBlank bool) {
+	if p.buf.Len() > 0 {
+		p.write("\n")
+		if s, ok := p.sourceLine(line - 1); ok && allowBlank && !p.blockStart && line-1 > p.line && len(strings.TrimSpace(s)) == 0 {
+			p.write("\n")
+		}
+	}
+	if line > p.line {
+		p.line = line
+	}
+	p.blockStart = false
+	p.write(strings.Repeat("\t", p.indent))
+}
+
+func (p *printer) isTrailing(comment *ast.Comment) bool {
+	s, ok := p.sourceLine(comment.Line())
+	if !ok || comment.Column() < 1 || comment.Column() > len(s) {
+		return false
+	}
+	return len(strings.TrimSpace(s[:comment.Column()-1])) > 0
+}
+
+// flush prints the comments before the given line.
+func (p *printer) flush(line int) {
+	for len(p.comments) > 0 && p.comments[0].Line() < line {
+		comment := p.comments[0]
+		p.comments = p.comments[1:]
+		text := comment.Text
+		if !strings.Contains(text, "\n") {
+			text = strings.TrimRight(text, " \t")
+		}
+		if p.isTrailing(comment) && p.buf.Len() > 0 && !p.blockStart {
+			p.write(" " + text)
+			continue
+		}
+		p.startLine(comment.Line(), true)
+		p.write(text)
+	}
+}
+
+// hasComments reports whether there are comments in the given lines. Comments
+// in the last line are ignored since they may follow the node.
+func (p *printer) hasComments(first, last int) bool {
+	return len(p.comments) > 0 && p.comments[0].Line() >= first && p.comments[0].Line() < last
+}
+
+func (p *printer) chunk(chunk []ast.Stmt) {
+	for _, stmt := range chunk {
+		p.stmt(stmt)
+	}
+	p.flush(int(^uint(0) >> 1))
+	if p.buf.Len() > 0 {
+		p.write("\n")
+	}
+}
+
+func (p *printer) block(stmts []ast.Stmt, end int) {
+	p.indent++
+	p.blockStart = true
+	for _, stmt := range stmts {
+		p.stmt(stmt)
+	}
+	p.flush(end)
+	p.indent--
+	p.blockStart = false
+}
+
+func firstLine(stmts []ast.Stmt, def int) int {
+	if len(stmts) > 0 {
+		return stmts[0].Line()
+	}
+	return def
+}
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	p.flush(stmt.Line())
+	p.startLine(stmt.Line(), true)
+	start := p.buf.Len()
+	switch st := stmt.(type) {
+	case *ast.AssignStmt:
+		p.exprs(st.Lhs)
+		p.write(" = ")
+		p.exprs(st.Rhs)
+	case *ast.LocalAssignStmt:
+		p.localAssign(st)
+	case *ast.FuncCallStmt:
+		p.expr(st.Expr)
+	case *ast.DoBlockStmt:
+		p.write("do")
+		p.block(st.Stmts, st.LastLine())
+		p.startLine(st.LastLine(), false)
+		p.write("end")
+	case *ast.WhileStmt:
+		p.write("while ")
+		p.expr(st.Condition)
+		p.write(" do")
+		p.block(st.Stmts, st.LastLine())
+		p.startLine(st.LastLine(), false)
+		p.write("end")
+	case *ast.RepeatStmt:
+		p.write("repeat")
+		p.block(st.Stmts, st.Condition.Line())
+		p.startLine(st.Condition.Line(), false)
+		p.write("until ")
+		p.expr(st.Condition)
+	case *ast.IfStmt:
+		p.ifStmt(st)
+	case *ast.NumberForStmt:
+		p.write("for " + st.Name + " = ")
+		p.expr(st.Init)
+		p.write(", ")
+		p.expr(st.Limit)
+		if st.Step != nil {
+			p.write(", ")
+			p.expr(st.Step)
+		}
+		p.write(" do")
+		p.block(st.Stmts, st.LastLine())
+		p.startLine(st.LastLine(), false)
+		p.write("end")
+	case *ast.GenericForStmt:
+		p.write("for " + strings.Join(st.Names, ", ") + " in ")
+		p.exprs(st.Exprs)
+		p.write(" do")
+		p.block(st.Stmts, st.LastLine())
+		p.startLine(st.LastLine(), false)
+		p.write("end")
+	case *ast.FuncDefStmt:
+		p.write("function ")
+		if st.Name.Func != nil {
+			p.expr(st.Name.Func)
+		} else {
+			p.expr(st.Name.Receiver)
+			p.write(":" + st.Name.Method)
+		}
+		p.funcBody(st.Func)
+	case *ast.ReturnStmt:
+		p.write("return")
+		if len(st.Exprs) > 0 {
+			p.write(" ")
+			p.exprs(st.Exprs)
+		}
+	case *ast.BreakStmt:
+		p.write("break")
+	case *ast.GotoStmt:
+		p.write("goto " + st.Label)
+	case *ast.LabelStmt:
+		p.write("::" + st.Name + "::")
+	default:
+		panic(fmt.Sprintf("unknown statement: %T", stmt))
+	}
+	// a statement starting with '(' would be parsed as arguments of a call in
+	// the previous statement.
+	if b := p.buf.Bytes(); start < len(b) && b[start] == '(' {
+		rest := append([]byte{}, b[start:]...)
+		p.buf.Truncate(start)
+		p.write(";")
+		p.buf.Write(rest)
+	}
+}
+
+func (p *printer) localAssign(st *ast.LocalAssignStmt) {
+	if len(st.Names) == 1 && len(st.Exprs) == 1 && (len(st.Attribs) == 0 || st.Attribs[0] == "") {
+		if fn, ok := st.Exprs[0].(*ast.FunctionExpr); ok {
+			p.write("local function " + st.Names[0])
+			p.funcBody(fn)
+			return
+		}
+	}
+	p.write("local ")
+	for i, name := range st.Names {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.write(name)
+		if i < len(st.Attribs) && st.Attribs[i] != "" {
+			p.write(" <" + st.Attribs[i] + ">")
+		}
+	}
+	if len(st.Exprs) > 0 {
+		p.write(" = ")
+		p.exprs(st.Exprs)
+	}
+}
+
+func (p *printer) ifStmt(st *ast.IfStmt) {
+	end := st.LastLine()
+	p.write("if ")
+	p.expr(st.Condition)
+	p.write(" then")
+	for {
+		p.block(st.Then, firstLine(st.Else, end))
+		if len(st.Else) == 1 {
+			if elseif, ok := st.Else[0].(*ast.IfStmt); ok {
+				p.startLine(elseif.Line(), false)
+				p.write("elseif ")
+				p.expr(elseif.Condition)
+				p.write(" then")
+				st = elseif
+				continue
+			}
+		}
+		if len(st.Else) > 0 {
+			p.startLine(st.Else[0].Line(), false)
+			p.write("else")
+			p.block(st.Else, end)
+		}
+		break
+	}
+	p.startLine(end, false)
+	p.write("end")
+}
+
+func (p *printer) funcBody(fn *ast.FunctionExpr) {
+	params := append([]string{}, fn.ParList.Names...)
+	if fn.ParList.HasVargs {
+		params = append(params, "...")
+	}
+	p.write("(" + strings.Join(params, ", ") + ")")
+	if len(fn.Stmts) == 0 && !p.hasComments(fn.Line(), fn.LastLine()) {
+		p.write(" end")
+		return
+	}
+	p.block(fn.Stmts, fn.LastLine())
+	p.startLine(fn.LastLine(), false)
+	p.write("end")
+}
+
+func (p *printer) exprs(exprs []ast.Expr) {
+	for i, expr := range exprs {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(expr)
+	}
+}
+
+const (
+	precUnary   = 12
+	precPrimary = 100
+)
+
+var binaryPrecedence = map[string]int{
+	"or": 1, "and": 2,
+	"<": 3, ">": 3, "<=": 3, ">=": 3, "~=": 3, "==": 3,
+	"|": 4, "~": 5, "&": 6, "<<": 7, ">>": 7,
+	"..": 9, "+": 10, "-": 10, "*": 11, "/": 11, "//": 11, "%": 11,
+	"^": 14,
+}
+
+func precedence(expr ast.Expr) int {
+	switch ex := expr.(type) {
+	case *ast.LogicalOpExpr:
+		return binaryPrecedence[ex.Operator]
+	case *ast.RelationalOpExpr:
+		return binaryPrecedence[ex.Operator]
+	case *ast.ArithmeticOpExpr:
+		return binaryPrecedence[ex.Operator]
+	case *ast.StringConcatOpExpr:
+		return binaryPrecedence[".."]
+	case *ast.UnaryMinusOpExpr, *ast.UnaryNotOpExpr, *ast.UnaryLenOpExpr, *ast.UnaryBNotOpExpr:
+		return precUnary
+	}
+	return precPrimary
+}
+
+func (p *printer) operand(expr ast.Expr, prec int, strict bool) {
+	if eprec := precedence(expr); eprec < prec || (eprec == prec && strict) {
+		p.write("(")
+		p.expr(expr)
+		p.write(")")
+		return
+	}
+	p.expr(expr)
+}
+
+func (p *printer) binary(op string, lhs, rhs ast.Expr) {
+	prec := binaryPrecedence[op]
+	right := op == ".." || op == "^"
+	p.operand(lhs, prec, right)
+	p.write(" " + op + " ")
+	// "2 ^ -x" is parsed as "2 ^ (-x)".
+	if op == "^" && precedence(rhs) == precUnary {
+		p.expr(rhs)
+		return
+	}
+	p.operand(rhs, prec, !right)
+}
+
+func (p *printer) unary(op string, operand ast.Expr) {
+	p.write(op)
+	start := p.buf.Len()
+	p.operand(operand, precUnary, false)
+	// "- -x" must not be printed as a comment.
+	if b := p.buf.Bytes(); op == "-" && start < len(b) && b[start] == '-' {
+		rest := append([]byte{}, b[start:]...)
+		p.buf.Truncate(start)
+		p.write(" ")
+		p.buf.Write(rest)
+	}
+}
+
+// prefixExpr prints the expression as an object of an index or a call.
+func (p *printer) prefixExpr(expr ast.Expr) {
+	switch expr.(type) {
+	case *ast.IdentExpr, *ast.AttrGetExpr, *ast.FuncCallExpr:
+		p.expr(expr)
+	default:
+		p.write("(")
+		p.expr(expr)
+		p.write(")")
+	}
+}
+
+func (p *printer) expr(expr ast.Expr) {
+	switch ex := expr.(type) {
+	case *ast.TrueExpr:
+		p.write("true")
+	case *ast.FalseExpr:
+		p.write("false")
+	case *ast.NilExpr:
+		p.write("nil")
+	case *ast.NumberExpr:
+		p.write(ex.Value)
+	case *ast.StringExpr:
+		p.write(quoteString(ex.Value))
+	case *ast.Comma3Expr:
+		p.write("...")
+	case *ast.IdentExpr:
+		p.write(ex.Value)
+	case *ast.AttrGetExpr:
+		p.prefixExpr(ex.Object)
+		if key, ok := ex.Key.(*ast.StringExpr); ok && isName(key.Value) {
+			p.write("." + key.Value)
+		} else {
+			p.write("[")
+			p.expr(ex.Key)
+			p.write("]")
+		}
+	case *ast.TableExpr:
+		p.table(ex)
+	case *ast.FuncCallExpr:
+		if ex.AdjustRet {
+			p.write("(")
+		}
+		if ex.Func != nil {
+			p.prefixExpr(ex.Func)
+		} else {
+			p.prefixExpr(ex.Receiver)
+			p.write(":" + ex.Method)
+		}
+		p.write("(")
+		p.exprs(ex.Args)
+		p.write(")")
+		if ex.AdjustRet {
+			p.write(")")
+		}
+	case *ast.LogicalOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs)
+	case *ast.RelationalOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs)
+	case *ast.StringConcatOpExpr:
+		p.binary("..", ex.Lhs, ex.Rhs)
+	case *ast.ArithmeticOpExpr:
+		p.binary(ex.Operator, ex.Lhs, ex.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		p.unary("-", ex.Expr)
+	case *ast.UnaryNotOpExpr:
+		p.unary("not ", ex.Expr)
+	case *ast.UnaryLenOpExpr:
+		p.unary("#", ex.Expr)
+	case *ast.UnaryBNotOpExpr:
+		p.unary("~", ex.Expr)
+	case *ast.FunctionExpr:
+		p.write("function")
+		p.funcBody(ex)
+	default:
+		panic(fmt.Sprintf("unknown expression: %T", expr))
+	}
+}
+
+func (p *printer) field(field *ast.Field) {
+	if field.Key != nil {
+		if key, ok := field.Key.(*ast.StringExpr); ok && isName(key.Value) {
+			p.write(key.Value)
+		} else {
+			p.write("[")
+			p.expr(field.Key)
+			p.write("]")
+		}
+		p.write(" = ")
+	}
+	p.expr(field.Value)
+}
+
+// table prints the table in one line if it fits, one field per line
+// otherwise.
+func (p *printer) table(tb *ast.TableExpr) {
+	if len(tb.Fields) == 0 {
+		p.write("{}")
+		return
+	}
+	if !p.hasComments(tb.Line(), tb.LastLine()) {
+		inline := &printer{indent: p.indent}
+		inline.write("{")
+		for i, field := range tb.Fields {
+			if i > 0 {
+				inline.write(", ")
+			}
+			inline.field(field)
+		}
+		inline.write("}")
+		s := inline.buf.String()
+		if !strings.Contains(s, "\n") && p.column()+len(s) <= maxInlineTableWidth {
+			p.write(s)
+			return
+		}
+	}
+	p.write("{")
+	p.indent++
+	p.blockStart = true
+	for _, field := range tb.Fields {
+		line := field.Value.Line()
+		if field.Key != nil {
+			line = field.Key.Line()
+		}
+		p.flush(line)
+		p.startLine(line, true)
+		p.field(field)
+		p.write(",")
+	}
+	p.flush(tb.LastLine())
+	p.indent--
+	p.startLine(tb.LastLine(), false)
+	p.write("}")
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+func isName(s string) bool {
+	if len(s) == 0 || keywords[s] {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteString returns a string literal for the string. Strings that have
+// multiple lines are printed as long strings if possible.
+func quoteString(s string) string {
+	if strings.Contains(strings.TrimRight(s, "\n"), "\n") && canBeLongString(s) {
+		eq := ""
+		for strings.Contains(s+"]", "]"+eq+"]") {
+			eq += "="
+		}
+		if s[0] == '\n' {
+			s = "\n" + s
+		}
+		return "[" + eq + "[" + s + "]" + eq + "]"
+	}
+	quote := byte('"')
+	if strings.IndexByte(s, '"') >= 0 && strings.IndexByte(s, '\'') < 0 {
+		quote = '\''
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(quote)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case quote, '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\a':
+			buf.WriteString("\\a")
+		case '\b':
+			buf.WriteString("\\b")
+		case '\f':
+			buf.WriteString("\\f")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\v':
+			buf.WriteString("\\v")
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&buf, "\\%03d", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte(quote)
+	return buf.String()
+}
+
+func canBeLongString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\n' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func TestSource(t *testing.T) {
+	src := "local a=1 -- one\n\n\nif a==1 then print( a ,\"x\") elseif a then end\nlocal t={1,2,x=3}\nfunction m.f(a,...) return a+1 end\n"
+	want := "local a = 1 -- one\n" +
+		"\n" +
+		"if a == 1 then\n" +
+		"\tprint(a, \"x\")\n" +
+		"elseif a then\n" +
+		"end\n" +
+		"local t = {1, 2, x = 3}\n" +
+		"function m.f(a, ...)\n" +
+		"\treturn a + 1\n" +
+		"end\n"
+	out, err := Source([]byte(src), "<string>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+	// formatting is idempotent.
+	out2, err := Source(out, "<string>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out2) != string(out) {
+		t.Errorf("got:\n%s\nwant:\n%s", out2, out)
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	if _, err := Source([]byte("local = 1"), "<string>"); err == nil {
+		t.Error("syntax errors must be returned")
+	}
+}
+
+func TestChunk(t *testing.T) {
+	chunk, err := parse.Parse(strings.NewReader("-- dropped\nlocal x = (1 + 2) * 3"), "<string>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(Chunk(chunk)); got != "local x = (1 + 2) * 3\n" {
+		t.Errorf("got %q", got)
+	}
+}
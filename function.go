@@ -3,6 +3,7 @@ package lua
 import (
 	"fmt"
 	"strings"
+	"sync/atomic"
 )
 
 const (
@@ -35,19 +36,28 @@ type FunctionProto struct {
 	FunctionPrototypes []*FunctionProto
 
 	DbgSourcePositions []int
+	DbgSourceColumns   []int
 	DbgLocals          []*DbgLocalInfo
 	DbgCalls           []DbgCall
 	DbgUpvalues        []string
+
+	// executions is the number of instructions run before the function is
+	// specialized, and specialized is the specialized code(see Specialize).
+	executions  atomic.Int32
+	specialized atomic.Pointer[specializedCode]
 }
 
 /* Upvalue {{{ */
 
 type Upvalue struct {
+	// next is the open upvalue of the nearest lower register.
 	next   *Upvalue
 	reg    *registry
 	index  int
 	value  LValue
 	closed bool
+	// id is the value returned by debug.upvalueid.
+	id *LUserData
 }
 
 func (uv *Upvalue) Value() LValue {
@@ -99,6 +109,7 @@ func newFunctionProto(name string) *FunctionProto {
 		FunctionPrototypes: make([]*FunctionProto, 0, 16),
 
 		DbgSourcePositions: make([]int, 0, 128),
+		DbgSourceColumns:   make([]int, 0, 128),
 		DbgLocals:          make([]*DbgLocalInfo, 0, 16),
 		DbgCalls:           make([]DbgCall, 0, 128),
 		DbgUpvalues:        make([]string, 0, 16),
@@ -149,14 +160,49 @@ func (fp *FunctionProto) str(level int, count int) string {
 /* LFunction {{{ */
 
 func newLFunctionL(proto *FunctionProto, env *LTable, nupvalue int) *LFunction {
-	return &LFunction{
+	fn, upvalues := allocateLFunction(nupvalue)
+	*fn = LFunction{
 		IsG: false,
 		Env: env,
 
 		Proto:     proto,
 		GFunction: nil,
-		Upvalues:  make([]*Upvalue, nupvalue),
+		Upvalues:  upvalues,
+	}
+	return fn
+}
+
+// allocateLFunction allocates a function and its upvalues. Functions with few
+// upvalues, such as closures created in loops, are allocated with their
+// upvalues at once.
+func allocateLFunction(nupvalue int) (*LFunction, []*Upvalue) {
+	switch nupvalue {
+	case 1:
+		c := &struct {
+			fn       LFunction
+			upvalues [1]*Upvalue
+		}{}
+		return &c.fn, c.upvalues[:]
+	case 2:
+		c := &struct {
+			fn       LFunction
+			upvalues [2]*Upvalue
+		}{}
+		return &c.fn, c.upvalues[:]
+	case 3:
+		c := &struct {
+			fn       LFunction
+			upvalues [3]*Upvalue
+		}{}
+		return &c.fn, c.upvalues[:]
+	case 4:
+		c := &struct {
+			fn       LFunction
+			upvalues [4]*Upvalue
+		}{}
+		return &c.fn, c.upvalues[:]
 	}
+	return &LFunction{}, make([]*Upvalue, nupvalue)
 }
 
 func newLFunctionG(gfunc LGFunction, env *LTable, nupvalue int) *LFunction {
@@ -170,13 +216,15 @@ func newLFunctionG(gfunc LGFunction, env *LTable, nupvalue int) *LFunction {
 	}
 }
 
+// LocalName returns the name of the regno-th local variable that is active at
+// pc. EndPc is the last instruction of the scope of a local variable.
 func (fn *LFunction) LocalName(regno, pc int) (string, bool) {
 	if fn.IsG {
 		return "", false
 	}
 	p := fn.Proto
-	for i := 0; i < len(p.DbgLocals) && p.DbgLocals[i].StartPc < pc; i++ {
-		if pc < p.DbgLocals[i].EndPc {
+	for i := 0; i < len(p.DbgLocals) && p.DbgLocals[i].StartPc <= pc; i++ {
+		if pc <= p.DbgLocals[i].EndPc {
 			regno--
 			if regno == 0 {
 				return p.DbgLocals[i].Name, true
@@ -0,0 +1,67 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestOpenUpvalues(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	for _, idx := range []int{3, 1, 5, 3} {
+		L.findUpvalue(idx)
+	}
+	var indices []int
+	for uv := L.uvcache; uv != nil; uv = uv.next {
+		indices = append(indices, uv.index)
+	}
+	// the list is ordered from the top, without duplicates.
+	if len(indices) != 3 || indices[0] != 5 || indices[1] != 3 || indices[2] != 1 {
+		t.Fatalf("got %v", indices)
+	}
+	uv := L.findUpvalue(3)
+	L.closeUpvalues(2)
+	if !uv.closed || L.uvcache == nil || L.uvcache.index != 1 || L.uvcache.next != nil {
+		t.Error("the upvalues of the registers 2 and above must be closed")
+	}
+	L.closeUpvalues(0)
+	if L.uvcache != nil {
+		t.Error("all the upvalues must be closed")
+	}
+
+	err := L.DoString(`
+	local fns = {}
+	for i = 1, 3 do
+	  local a, b = i, i * 10
+	  fns[i] = {function() return a + b end, function(x) a = x end}
+	end
+	fns[2][2](5)
+	assert(fns[1][1]() == 11 and fns[2][1]() == 25 and fns[3][1]() == 33)
+
+	local function counter()
+	  local n = 0
+	  local function get() return n end
+	  local function incr() n = n + 1 end
+	  return get, incr
+	end
+	local get, incr = counter()
+	incr() incr()
+	assert(get() == 2)
+
+	local a, b, c, d, e = 1, 2, 3, 4, 5
+	local function five() return a + b + c + d + e end
+	e = 10
+	assert(five() == 20)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateLFunction(t *testing.T) {
+	for n := 0; n <= 6; n++ {
+		fn, upvalues := allocateLFunction(n)
+		if fn == nil || len(upvalues) != n {
+			t.Errorf("got %v upvalues, want %v", len(upvalues), n)
+		}
+	}
+}
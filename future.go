@@ -0,0 +1,62 @@
+package lua
+
+import (
+	"context"
+)
+
+// Future is the result of a call started by LState.PCallAsync.
+type Future struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	values []LValue
+	err    error
+}
+
+// Done returns a channel that is closed when the call finishes.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits until the call finishes and returns the results of the call or
+// the error.
+func (f *Future) Wait() ([]LValue, error) {
+	<-f.done
+	return f.values, f.err
+}
+
+// Cancel aborts the call with a Lua error. The error is returned by Wait.
+func (f *Future) Cancel() {
+	f.cancel()
+}
+
+// PCallAsync calls the function with the arguments in protected mode on a new
+// goroutine and returns a Future for the results. The call is aborted when the
+// context is done or Future.Cancel is called. The state must not be used until
+// the call finishes, the context of the state is restored then.
+func (ls *LState) PCallAsync(ctx context.Context, fn LValue, args ...LValue) *Future {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Future{done: make(chan struct{}), cancel: cancel}
+	go func() {
+		defer close(f.done)
+		defer cancel()
+		oldctx := ls.ctx
+		ls.SetContext(ctx)
+		defer ls.SetContext(oldctx)
+
+		top := ls.GetTop()
+		ls.Push(fn)
+		for _, arg := range args {
+			ls.Push(arg)
+		}
+		if err := ls.PCall(len(args), MultRet, nil); err != nil {
+			f.err = err
+			return
+		}
+		f.values = make([]LValue, 0, ls.GetTop()-top)
+		for i := top + 1; i <= ls.GetTop(); i++ {
+			f.values = append(f.values, ls.Get(i))
+		}
+		ls.SetTop(top)
+	}()
+	return f
+}
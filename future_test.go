@@ -0,0 +1,60 @@
+package lua
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPCallAsync(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function add(a, b) return a + b, "done" end`); err != nil {
+		t.Fatal(err)
+	}
+	f := L.PCallAsync(context.Background(), L.GetGlobal("add"), LNumber(1), LNumber(2))
+	<-f.Done()
+	values, err := f.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != LNumber(3) || values[1] != LString("done") {
+		t.Errorf("got %v, want [3 done]", values)
+	}
+	if top := L.GetTop(); top != 0 {
+		t.Errorf("got the stack top %v, want 0", top)
+	}
+
+	f = L.PCallAsync(context.Background(), L.GetGlobal("add"), LNumber(1))
+	if _, err := f.Wait(); err == nil || !strings.Contains(err.Error(), "add operation") {
+		t.Errorf("got %v, want the error of the call", err)
+	}
+}
+
+func TestPCallAsyncCancel(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function loop() while true do end end`); err != nil {
+		t.Fatal(err)
+	}
+	f := L.PCallAsync(context.Background(), L.GetGlobal("loop"))
+	f.Cancel()
+	if _, err := f.Wait(); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("got %v, want a cancel error", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	f = L.PCallAsync(ctx, L.GetGlobal("loop"))
+	if _, err := f.Wait(); err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+	// the context of the state is restored.
+	if L.Context() != nil {
+		t.Error("got a context, want nil")
+	}
+	if err := L.DoString(`assert(1 + 1 == 2)`); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,156 @@
+package lua
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weak"
+)
+
+// finalizerQueue holds objects that have become unreachable and whose __gc
+// metamethods have not been called yet. Go finalizers run on their own
+// goroutine, so __gc metamethods are called later by the state at safe points.
+type finalizerQueue struct {
+	mu      sync.Mutex
+	pending int32
+	objects []LValue
+	// weak references to objects that are marked for finalization, in order of
+	// marking.
+	marked []LValue
+}
+
+func (fq *finalizerQueue) push(lv LValue) {
+	fq.mu.Lock()
+	fq.objects = append(fq.objects, lv)
+	fq.mu.Unlock()
+	atomic.StoreInt32(&fq.pending, 1)
+}
+
+func (fq *finalizerQueue) take() []LValue {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	objects := fq.objects
+	fq.objects = nil
+	atomic.StoreInt32(&fq.pending, 0)
+	return objects
+}
+
+func (fq *finalizerQueue) mark(lv LValue) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if len(fq.marked) >= 64 && len(fq.marked) == cap(fq.marked) {
+		// remove weak references to finalized objects
+		marked := fq.marked[:0]
+		for _, wr := range fq.marked {
+			if strongValue(wr) != LNil {
+				marked = append(marked, wr)
+			}
+		}
+		fq.marked = marked
+	}
+	fq.marked = append(fq.marked, makeWeakRef(lv))
+}
+
+// markForFinalization registers the object to the Go garbage collector if
+// the metatable has __gc metamethod.
+//
+// Go finalizers are used instead of runtime.AddCleanup because __gc
+// metamethods take the collected objects, which cleanups cannot receive. Go
+// never collects an object with a finalizer that is reachable from itself, so
+// __gc metamethods of such objects(e.g. t.self = t) are called only by
+// closeFinalizers.
+func (ls *LState) markForFinalization(obj LValue, mt LValue) {
+	tb, ok := mt.(*LTable)
+	if !ok || tb.RawGetH(LString("__gc")) == LNil {
+		return
+	}
+	// the finalizer must not have a strong reference to the state, or the
+	// state would never be collected.
+	wg := weak.Make(ls.G)
+	switch v := obj.(type) {
+	case *LTable:
+		if v.gcMarked {
+			return
+		}
+		v.gcMarked = true
+		runtime.SetFinalizer(v, func(tb *LTable) {
+			if g := wg.Value(); g != nil {
+				g.finalizers.push(tb)
+			}
+		})
+	case *LUserData:
+		if v.gcMarked {
+			return
+		}
+		v.gcMarked = true
+		runtime.SetFinalizer(v, func(ud *LUserData) {
+			if g := wg.Value(); g != nil {
+				g.finalizers.push(ud)
+			}
+		})
+	default:
+		return
+	}
+	ls.G.finalizers.mark(obj)
+}
+
+func (ls *LState) callFinalizer(obj LValue) {
+	fn, ok := ls.metaOp1(obj, "__gc").(*LFunction)
+	if !ok {
+		return
+	}
+	ls.Push(fn)
+	ls.Push(obj)
+	// errors in __gc metamethods are ignored
+	ls.PCall(1, 0, nil)
+}
+
+// runFinalizers calls __gc metamethods of objects that have been collected.
+func (ls *LState) runFinalizers() {
+	g := ls.G
+	if g.gcRunningFinalizers || atomic.LoadInt32(&g.finalizers.pending) == 0 {
+		return
+	}
+	g.gcRunningFinalizers = true
+	defer func() { g.gcRunningFinalizers = false }()
+	for _, obj := range g.finalizers.take() {
+		ls.callFinalizer(obj)
+	}
+}
+
+// closeFinalizers calls __gc metamethods of all objects that are marked for
+// finalization. This is called when the state is closed.
+func (ls *LState) closeFinalizers() {
+	g := ls.G
+	g.gcRunningFinalizers = true
+	defer func() { g.gcRunningFinalizers = false }()
+	g.finalizers.mu.Lock()
+	marked := g.finalizers.marked
+	g.finalizers.marked = nil
+	g.finalizers.mu.Unlock()
+	objects := make([]LValue, 0, len(marked))
+	for i := len(marked) - 1; i >= 0; i-- {
+		if obj := strongValue(marked[i]); obj != LNil {
+			runtime.SetFinalizer(obj, nil)
+			objects = append(objects, obj)
+		}
+	}
+	objects = append(g.finalizers.take(), objects...)
+	for _, obj := range objects {
+		ls.callFinalizer(obj)
+	}
+}
+
+// waitFinalizers waits until Go finalizers of objects that have been collected
+// so far are completed.
+func waitFinalizers() {
+	done := make(chan struct{})
+	// the sentinel is large enough not to be allocated by the tiny allocator.
+	runtime.SetFinalizer(new([32]byte), func(*[32]byte) { close(done) })
+	runtime.GC()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,71 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestGCMetamethod(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	collected = {}
+	local mt = {__gc = function(o) collected[#collected + 1] = o.name end}
+	local function make()
+	  for i = 1, 10 do setmetatable({name = i}, mt) end
+	  -- __gc set after setmetatable is not called.
+	  local late = setmetatable({name = "late"}, {})
+	  getmetatable(late).__gc = mt.__gc
+	end
+	make()
+	collectgarbage()
+	collectgarbage()
+	-- the last object may still be referenced by a register that is not
+	-- overwritten yet.
+	assert(#collected >= 9, #collected .. " objects")
+	for _, name in ipairs(collected) do assert(name ~= "late") end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCMetamethodError(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	// errors in __gc metamethods are ignored.
+	err := L.DoString(`
+	local function make() setmetatable({}, {__gc = function() error("gc") end}) end
+	make()
+	collectgarbage()
+	collectgarbage()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCMetamethodClose(t *testing.T) {
+	L := NewState()
+	called := 0
+	L.SetGlobal("called", L.NewFunction(func(L *LState) int {
+		called++
+		return 0
+	}))
+	err := L.DoString(`
+	keep = setmetatable({}, {__gc = called})
+	local cycle = setmetatable({}, {__gc = called})
+	cycle.self = cycle
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud := L.NewUserData()
+	L.SetMetatable(ud, L.GetGlobal("keep").(*LTable).Metatable)
+	L.SetGlobal("ud", ud)
+	L.Close()
+	// reachable objects and objects reachable from themselves are finalized
+	// when the state is closed.
+	if called != 3 {
+		t.Errorf("got %v calls, want 3", called)
+	}
+}
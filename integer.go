@@ -0,0 +1,302 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// LInteger is the integer subtype of numbers. Integers are created only when
+// Lua53Integer is enabled.
+type LInteger int64
+
+func (it LInteger) String() string   { return strconv.FormatInt(int64(it), 10) }
+func (it LInteger) Type() LValueType { return LTNumber }
+
+// fmt.Formatter interface
+func (it LInteger) Format(f fmt.State, c rune) {
+	switch c {
+	case 'q', 's':
+		defaultFormat(it.String(), f, c)
+	case 'e', 'E', 'f', 'F', 'g', 'G':
+		defaultFormat(float64(it), f, c)
+	case 'i':
+		defaultFormat(int64(it), f, 'd')
+	default:
+		defaultFormat(int64(it), f, c)
+	}
+}
+
+// integerValue returns an LInteger if Lua53Integer is enabled, an LNumber
+// otherwise.
+func integerValue(i int64) LValue {
+	if Lua53Integer {
+		return LInteger(i)
+	}
+	return LNumber(i)
+}
+
+// parseNumberValue converts the string to a number. Decimal integers that fit
+// into int64 and hexadecimal integers are converted to LIntegers if
+// Lua53Integer is enabled.
+func parseNumberValue(number string) (LValue, error) {
+	if Lua53Integer {
+		s := strings.Trim(number, " \t\n")
+		body := s
+		if len(body) > 0 && (body[0] == '+' || body[0] == '-') {
+			body = body[1:]
+		}
+		if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+			if v, err := strconv.ParseUint(body[2:], 16, 64); err == nil {
+				if s[0] == '-' {
+					return LInteger(-int64(v)), nil
+				}
+				return LInteger(v), nil
+			}
+		} else if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return LInteger(v), nil
+		}
+	}
+	return parseNumber(number)
+}
+
+// toFloatValue returns the value of the number as a float.
+func toFloatValue(lv LValue) (LNumber, bool) {
+	switch v := lv.(type) {
+	case LNumber:
+		return v, true
+	case LInteger:
+		return LNumber(v), true
+	}
+	return 0, false
+}
+
+// toIntegerValue returns the value of the number as an integer if the number
+// has an exact integer representation.
+func toIntegerValue(lv LValue) (int64, bool) {
+	switch v := lv.(type) {
+	case LInteger:
+		return int64(v), true
+	case LNumber:
+		return lnumberToInt64(v)
+	}
+	return 0, false
+}
+
+// checkIntegerValue checks whether the given argument is a number with an exact
+// integer representation or a string convertible to such a number.
+func checkIntegerValue(L *LState, n int) int64 {
+	lv := L.Get(n)
+	if str, ok := lv.(LString); ok {
+		if v, err := parseNumberValue(string(str)); err == nil {
+			lv = v
+		}
+	}
+	if i, ok := toIntegerValue(lv); ok {
+		return i
+	}
+	if _, ok := toFloatValue(lv); ok {
+		L.ArgError(n, "number has no integer representation")
+	}
+	L.TypeError(n, LTNumber)
+	return 0
+}
+
+func integerArith(L *LState, opcode int, lhs, rhs int64) LValue {
+	switch opcode {
+	case OP_ADD:
+		return LInteger(lhs + rhs)
+	case OP_SUB:
+		return LInteger(lhs - rhs)
+	case OP_MUL:
+		return LInteger(lhs * rhs)
+	case OP_MOD:
+		if rhs == 0 {
+			L.RaiseError("attempt to perform '%v'", "n%0")
+		}
+		v := lhs % rhs
+		if v != 0 && (v^rhs) < 0 {
+			v += rhs
+		}
+		return LInteger(v)
+	case OP_IDIV:
+		if rhs == 0 {
+			L.RaiseError("attempt to perform '%v'", "n//0")
+		}
+		v := lhs / rhs
+		if lhs%rhs != 0 && (lhs < 0) != (rhs < 0) {
+			v--
+		}
+		return LInteger(v)
+	case OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_BNOT:
+		return LInteger(luaBitwise(opcode, lhs, rhs))
+	}
+	return numberArith(L, opcode, LNumber(lhs), LNumber(rhs))
+}
+
+// arith53 performs arithmetic operations on numbers with the integer subtype.
+// This returns false if the operands are not numbers.
+func arith53(L *LState, opcode int, lhs, rhs LValue) (LValue, bool) {
+	i1, ok1 := lhs.(LInteger)
+	i2, ok2 := rhs.(LInteger)
+	if ok1 && ok2 {
+		return integerArith(L, opcode, int64(i1), int64(i2)), true
+	}
+	f1, ok1 := toFloatValue(lhs)
+	f2, ok2 := toFloatValue(rhs)
+	if !ok1 || !ok2 {
+		return LNil, false
+	}
+	switch opcode {
+	case OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_BNOT:
+		i1, ok1 := toIntegerValue(lhs)
+		i2, ok2 := toIntegerValue(rhs)
+		if !ok1 || !ok2 {
+			L.RaiseError("number has no integer representation")
+		}
+		return LInteger(luaBitwise(opcode, i1, i2)), true
+	}
+	return numberArith(L, opcode, f1, f2), true
+}
+
+func unaryMinus(lv LValue) LValue {
+	if v, ok := lv.(LInteger); ok {
+		return -v
+	}
+	return -lv.(LNumber)
+}
+
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case math.IsNaN(f):
+		return 2
+	case f >= 1<<63:
+		return -1
+	case f < -(1 << 63):
+		return 1
+	}
+	t := math.Trunc(f)
+	switch it := int64(t); {
+	case i < it:
+		return -1
+	case i > it:
+		return 1
+	case f > t:
+		return -1
+	case f < t:
+		return 1
+	}
+	return 0
+}
+
+// compareNumbers compares numbers exactly, even if one of them is an integer
+// and the other is a float. This returns -1, 0 or 1, 2 if they are not
+// ordered, and false if the operands are not numbers.
+func compareNumbers(lhs, rhs LValue) (int, bool) {
+	switch v1 := lhs.(type) {
+	case LInteger:
+		switch v2 := rhs.(type) {
+		case LInteger:
+			switch {
+			case v1 < v2:
+				return -1, true
+			case v1 > v2:
+				return 1, true
+			}
+			return 0, true
+		case LNumber:
+			return compareIntFloat(int64(v1), float64(v2)), true
+		}
+	case LNumber:
+		switch v2 := rhs.(type) {
+		case LInteger:
+			if c := compareIntFloat(int64(v2), float64(v1)); c != 2 {
+				return -c, true
+			}
+			return 2, true
+		case LNumber:
+			switch {
+			case v1 < v2:
+				return -1, true
+			case v1 > v2:
+				return 1, true
+			case v1 == v2:
+				return 0, true
+			}
+			return 2, true
+		}
+	}
+	return 0, false
+}
+
+// tableKey returns the float value for the integer if the float has the same
+// value, so tables do not distinguish 1 and 1.0.
+func (it LInteger) tableKey() LValue {
+	if f := float64(it); f < 1<<63 && int64(f) == int64(it) {
+		return LNumber(f)
+	}
+	return it
+}
+
+// keyValue converts float keys with integral values to integers if
+// Lua53Integer is enabled.
+func keyValue(key LValue) LValue {
+	if Lua53Integer {
+		if v, ok := key.(LNumber); ok {
+			if i, ok := lnumberToInt64(v); ok {
+				return LInteger(i)
+			}
+		}
+	}
+	return key
+}
+
+// forPrepInteger prepares a numeric for loop whose initial value and step
+// are integers. The number of remaining iterations is held instead of the
+// limit. This returns false if the loop must not run.
+func forPrepInteger(L *LState, init, step LInteger, limit LValue) (LInteger, bool) {
+	if step == 0 {
+		L.RaiseError("'for' step is zero")
+	}
+	var ilimit int64
+	switch v := limit.(type) {
+	case LInteger:
+		ilimit = int64(v)
+	case LNumber:
+		f := float64(v)
+		if step > 0 {
+			f = math.Floor(f)
+		} else {
+			f = math.Ceil(f)
+		}
+		switch {
+		case math.IsNaN(f):
+			return 0, false
+		case f >= 1<<63:
+			if step < 0 {
+				return 0, false
+			}
+			ilimit = math.MaxInt64
+		case f < -(1 << 63):
+			if step > 0 {
+				return 0, false
+			}
+			ilimit = math.MinInt64
+		default:
+			ilimit = int64(f)
+		}
+	default:
+		L.RaiseError("for statement limit must be a number")
+	}
+	if step > 0 {
+		if int64(init) > ilimit {
+			return 0, false
+		}
+		return LInteger((uint64(ilimit) - uint64(init)) / uint64(step)), true
+	}
+	if int64(init) < ilimit {
+		return 0, false
+	}
+	return LInteger((uint64(init) - uint64(ilimit)) / (uint64(-(step + 1)) + 1)), true
+}
@@ -0,0 +1,47 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestLua53Integer(t *testing.T) {
+	defer func(old bool) { Lua53Integer = old }(Lua53Integer)
+	Lua53Integer = true
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(math.type(1) == "integer" and math.type(1.0) == "float" and math.type("1") == nil)
+	assert(tostring(10 / 2) == "5.0" and tostring(2 * 3) == "6")
+	assert(4611686018427387904 + 1 == 4611686018427387905)
+	assert(math.maxinteger + 1 == math.mininteger)
+	assert(math.type(#"abc") == "integer" and math.type(math.floor(1.5)) == "integer")
+	assert(1 == 1.0 and math.tointeger(3.0) == 3 and math.tointeger(3.5) == nil)
+	assert(string.format("%d", 3.0) == "3")
+	assert(not pcall(string.format, "%d", 3.5))
+	local t = {}
+	t[1.0] = "a"
+	assert(t[1] == "a")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	L.Push(LInteger(42))
+	if got := L.CheckInt64(-1); got != 42 {
+		t.Errorf("got %v, want 42", got)
+	}
+}
+
+func TestLua53IntegerDisabled(t *testing.T) {
+	defer func(old bool) { Lua53Integer = old }(Lua53Integer)
+	Lua53Integer = false
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(tostring(10 / 2) == "5")
+	assert(math.type(1) == "integer" and math.type(1.5) == "float")
+	assert(math.maxinteger == 2^53 - 1)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
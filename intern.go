@@ -0,0 +1,72 @@
+package lua
+
+import (
+	"strings"
+)
+
+// stringInterner keeps a single copy of each short string that a state
+// creates, so that strings built repeatedly, for example table keys built by
+// concatenation, are allocated once and share their memory. Comparing strings
+// that share their memory, as table lookups do, does not compare their bytes.
+// The interner is emptied when it has InternStringsMax strings.
+type stringInterner struct {
+	strings map[string]LString
+}
+
+// intern returns the interned copy of s, interning s if it is short enough.
+// A copy of s is interned, so that the interner does not keep a longer string
+// that s may be a part of alive.
+func (si *stringInterner) intern(s string) LString {
+	if len(s) > InternStringMaxLen {
+		return LString(s)
+	}
+	if str, ok := si.strings[s]; ok {
+		return str
+	}
+	s = strings.Clone(s)
+	si.add(s)
+	return LString(s)
+}
+
+// internBytes returns the interned copy of the bytes. A new string is
+// allocated only if the bytes are not interned yet.
+func (si *stringInterner) internBytes(b []byte) LString {
+	if len(b) > InternStringMaxLen {
+		return LString(b)
+	}
+	// the conversion in the index expression does not allocate.
+	if str, ok := si.strings[string(b)]; ok {
+		return str
+	}
+	s := string(b)
+	si.add(s)
+	return LString(s)
+}
+
+// concatBufferSize is the maximum length of concatenations that are built in
+// a buffer on the stack to be interned.
+const concatBufferSize = 64
+
+// concat returns the concatenation of the strings whose total length is
+// length. Short results are interned without allocating them if they are
+// interned already.
+func (si *stringInterner) concat(strs []string, length int) LString {
+	if length > InternStringMaxLen || length > concatBufferSize {
+		return LString(strings.Join(strs, ""))
+	}
+	var buf [concatBufferSize]byte
+	b := buf[:0]
+	for _, s := range strs {
+		b = append(b, s...)
+	}
+	return si.internBytes(b)
+}
+
+func (si *stringInterner) add(s string) {
+	if si.strings == nil {
+		si.strings = make(map[string]LString)
+	} else if len(si.strings) >= InternStringsMax {
+		clear(si.strings)
+	}
+	si.strings[s] = LString(s)
+}
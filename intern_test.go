@@ -0,0 +1,61 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func sameString(a, b LString) bool {
+	return unsafe.StringData(string(a)) == unsafe.StringData(string(b))
+}
+
+func TestStringInterner(t *testing.T) {
+	var si stringInterner
+	a := si.intern(strings.Repeat("k", 3))
+	if b := si.internBytes([]byte("kkk")); !sameString(a, b) {
+		t.Error("internBytes must return the interned string")
+	}
+	if b := si.concat([]string{"k", "kk"}, 3); !sameString(a, b) {
+		t.Error("concat must return the interned string")
+	}
+	if n := testing.AllocsPerRun(100, func() { si.concat([]string{"kk", "k"}, 3) }); n != 0 {
+		t.Errorf("got %v allocations, want 0", n)
+	}
+	long := strings.Repeat("x", InternStringMaxLen+1)
+	if si.intern(long); len(si.strings) != 1 {
+		t.Error("long strings must not be interned")
+	}
+
+	defer func(old int) { InternStringsMax = old }(InternStringsMax)
+	InternStringsMax = 2
+	si.intern("a")
+	si.intern("b")
+	if len(si.strings) != 1 {
+		t.Errorf("got %v strings, want the interner to be emptied", len(si.strings))
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local i = 1
+	x = "key" .. i
+	y = "key" .. i
+	z = string.format("key%d", i)
+	c1 = "const"
+	local function f() return "const" end
+	c2 = f()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y, z := L.GetGlobal("x").(LString), L.GetGlobal("y").(LString), L.GetGlobal("z").(LString)
+	if !sameString(x, y) || !sameString(x, z) {
+		t.Error("strings built by the state must be interned")
+	}
+	if !sameString(L.GetGlobal("c1").(LString), L.GetGlobal("c2").(LString)) {
+		t.Error("the string constants of a chunk must be interned")
+	}
+}
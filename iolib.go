@@ -2,24 +2,40 @@ package lua
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"syscall"
+	"strings"
 	"unsafe"
 )
 
 const lFileClass = "FILE*"
 
 type lFile struct {
-	fp     *os.File
+	fp     File
 	pp     *exec.Cmd
 	writer io.Writer
-	reader *bufio.Reader
-	closed bool
+	// rawWriter is the writer without the buffer set by file:setvbuf.
+	rawWriter io.Writer
+	reader    *bufio.Reader
+	closed    bool
+}
+
+// lineWriter is a buffered writer that flushes the buffer whenever a newline
+// is written.
+type lineWriter struct {
+	*bufio.Writer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err == nil && bytes.IndexByte(p, '\n') >= 0 {
+		err = w.Flush()
+	}
+	return n, err
 }
 
 type lFileType int
@@ -49,11 +65,11 @@ func errorIfFileIsClosed(L *LState, file *lFile) {
 	}
 }
 
-func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode, writable, readable bool) (*LUserData, error) {
+func newFile(L *LState, file File, path string, flag int, perm os.FileMode, writable, readable bool) (*LUserData, error) {
 	ud := L.NewUserData()
 	var err error
 	if file == nil {
-		file, err = os.OpenFile(path, flag, perm)
+		file, err = L.fileSystem().OpenFile(path, flag, perm)
 		if err != nil {
 			return nil, err
 		}
@@ -62,6 +78,7 @@ func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode,
 	ud.Value = lfile
 	if writable {
 		lfile.writer = file
+		lfile.rawWriter = file
 	}
 	if readable {
 		lfile.reader = bufio.NewReaderSize(file, fileDefaultReadBuffer)
@@ -70,17 +87,31 @@ func newFile(L *LState, file *os.File, path string, flag int, perm os.FileMode,
 	return ud, nil
 }
 
+// newProcess runs the command with the shell like os.execute. The standard
+// input or output of the process is connected to the file, and the others are
+// inherited.
 func newProcess(L *LState, cmd string, writable, readable bool) (*LUserData, error) {
+	if err := L.checkCommand(cmd); err != nil {
+		return nil, err
+	}
 	ud := L.NewUserData()
-	pp := exec.Command(cmd)
+	shell, args := shellCommand()
+	pp := exec.Command(shell, append(args, cmd)...)
+	pp.Stdout, pp.Stderr = L.G.stdoutWriter(), L.G.stderrWriter()
+	if stdin := L.G.stdinFile(); stdin != nil {
+		pp.Stdin = stdin
+	}
 	lfile := &lFile{fp: nil, pp: pp, writer: nil, reader: nil, closed: false}
 	ud.Value = lfile
 
 	var err error
 	if writable {
+		pp.Stdin = nil
 		lfile.writer, err = pp.StdinPipe()
+		lfile.rawWriter = lfile.writer
 	}
 	if readable {
+		pp.Stdout = nil
 		var reader io.Reader
 		reader, err = pp.StdoutPipe()
 		lfile.reader = bufio.NewReaderSize(reader, fileDefaultReadBuffer)
@@ -114,6 +145,14 @@ func (file *lFile) Name() string {
 	return ""
 }
 
+// Flush writes the data buffered by file:setvbuf.
+func (file *lFile) Flush() error {
+	if bwriter, ok := file.writer.(interface{ Flush() error }); ok {
+		return bwriter.Flush()
+	}
+	return nil
+}
+
 func (file *lFile) AbandonReadBuffer() error {
 	if file.Type() == lFileFile && file.reader != nil {
 		_, err := file.fp.Seek(-int64(file.reader.Buffered()), 1)
@@ -155,13 +194,12 @@ func fileIsReadable(L *LState, file *lFile) int {
 
 var stdFiles = []struct {
 	name     string
-	file     *os.File
 	writable bool
 	readable bool
 }{
-	{"stdout", os.Stdout, true, false},
-	{"stdin", os.Stdin, false, true},
-	{"stderr", os.Stderr, true, false},
+	{"stdout", true, false},
+	{"stdin", false, true},
+	{"stderr", true, false},
 }
 
 func ioOpen(L *LState) {
@@ -172,7 +210,7 @@ func ioOpen(L *LState) {
 	mt.RawSetH(LString("lines"), L.NewClosure(fileLines, L.NewFunction(fileLinesIter)))
 
 	for _, finfo := range stdFiles {
-		file, _ := newFile(L, finfo.file, "", 0, os.FileMode(0), finfo.writable, finfo.readable)
+		file, _ := newFile(L, &stdioFile{L.G, finfo.name}, "", 0, os.FileMode(0), finfo.writable, finfo.readable)
 		mod.RawSetH(LString(finfo.name), file)
 	}
 	uv := L.CreateTable(2, 0)
@@ -181,11 +219,12 @@ func ioOpen(L *LState) {
 	for name, fn := range ioFuncs {
 		mod.RawSetH(LString(name), L.NewClosure(fn, uv))
 	}
-	mod.RawSetH(LString("lines"), L.NewClosure(ioLines, uv, L.NewClosure(ioLinesIter, uv)))
+	mod.RawSetH(LString("lines"), L.NewClosure(ioLines, uv))
 }
 
 var fileMethods = map[string]LGFunction{
 	"__tostring": fileToString,
+	"__gc":       fileGC,
 	"write":      fileWrite,
 	"close":      fileClose,
 	"flush":      fileFlush,
@@ -224,7 +263,7 @@ func fileWriteAux(L *LState, file *lFile, idx int) int {
 	for i := idx; i <= top; i++ {
 		L.CheckTypes(i, LTNumber, LTString)
 		s := LVAsString(L.Get(i))
-		if _, err = out.Write(*(*[]byte)(unsafe.Pointer(&s))); err != nil {
+		if _, err = out.Write(unsafe.Slice(unsafe.StringData(s), len(s))); err != nil {
 			goto errreturn
 		}
 	}
@@ -242,14 +281,20 @@ errreturn:
 }
 
 func fileCloseAux(L *LState, file *lFile) int {
+	if _, isstdio := file.fp.(*stdioFile); isstdio {
+		if err := file.Flush(); err != nil {
+			L.Push(LNil)
+			L.Push(LString(err.Error()))
+			return 2
+		}
+		L.Push(LNil)
+		L.Push(LString("cannot close standard file"))
+		return 2
+	}
 	file.closed = true
 	var err error
-	if file.writer != nil {
-		if bwriter, ok := file.writer.(*bufio.Writer); ok {
-			if err = bwriter.Flush(); err != nil {
-				goto errreturn
-			}
-		}
+	if err = file.Flush(); err != nil {
+		goto errreturn
 	}
 	file.AbandonReadBuffer()
 
@@ -261,21 +306,15 @@ func fileCloseAux(L *LState, file *lFile) int {
 		L.Push(LTrue)
 		return 1
 	case lFileProcess:
-		err = file.pp.Wait()
-		var exitStatus int = 0
-		if err != nil {
-			if e2, ok := err.(*exec.ExitError); ok {
-				if s, ok := e2.Sys().(syscall.WaitStatus); ok {
-					exitStatus = s.ExitStatus()
-				} else {
-					err = errors.New("Unimplemented for system where exec.ExitError.Sys() is not syscall.WaitStatus.")
-				}
-			}
-		} else {
-			exitStatus = 0
+		if closer, ok := file.rawWriter.(io.Closer); ok {
+			closer.Close()
 		}
-		L.Push(LNumber(exitStatus))
-		return 1
+		if err = file.pp.Wait(); err != nil && file.pp.ProcessState == nil {
+			L.Push(LNil)
+			L.Push(LString(err.Error()))
+			return 2
+		}
+		return pushExitStatus(L, file.pp.ProcessState)
 	}
 
 errreturn:
@@ -289,31 +328,33 @@ func fileFlushAux(L *LState, file *lFile) int {
 	}
 	errorIfFileIsClosed(L, file)
 
-	if bwriter, ok := file.writer.(*bufio.Writer); ok {
-		if err := bwriter.Flush(); err != nil {
-			L.Push(LNil)
-			L.Push(LString(err.Error()))
-			return 2
-		}
+	if err := file.Flush(); err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
 	}
 	L.Push(LTrue)
 	return 1
 }
 
+// fileReadAux reads the file in the formats given from the stack index idx.
+// A format is a number of bytes to read, or "n", "a", "l" or "L" optionally
+// prefixed by "*". Reading stops at the first format that fails, which
+// returns nil.
 func fileReadAux(L *LState, file *lFile, idx int) int {
 	if n := fileIsReadable(L, file); n != 0 {
 		return n
 	}
 	errorIfFileIsClosed(L, file)
 	if L.GetTop() == idx-1 {
-		L.Push(LString("*l"))
+		L.Push(LString("l"))
 	}
 	var err error
 	top := L.GetTop()
 	for i := idx; i <= top; i++ {
-		switch lv := L.Get(i).(type) {
-		case LNumber:
-			size := int64(lv)
+		switch L.Get(i).(type) {
+		case LNumber, LInteger:
+			size := L.CheckInt64(i)
 			if size == 0 {
 				_, err = file.reader.ReadByte()
 				if err == io.EOF {
@@ -324,6 +365,7 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 			}
 			var buf []byte
 			var iseof bool
+			L.allocateObject(LTString, memStringSize+int(size))
 			buf, err, iseof = readBufioSize(file.reader, size)
 			if iseof {
 				L.Push(LNil)
@@ -333,50 +375,45 @@ func fileReadAux(L *LState, file *lFile, idx int) int {
 				goto errreturn
 			}
 			L.Push(LString(string(buf)))
-		case LString:
-			options := L.CheckString(i)
-			if len(options) > 0 && options[0] != '*' {
-				L.ArgError(2, "invalid options:"+options)
+		default:
+			format := strings.TrimPrefix(L.CheckString(i), "*")
+			if len(format) == 0 {
+				L.ArgError(i, "invalid format")
 			}
-			for _, opt := range options[1:] {
-				switch opt {
-				case 'n':
-					var v LNumber
-					_, err = fmt.Fscanf(file.reader, LNumberScanFormat, &v)
-					if err == io.EOF {
-						L.Push(LNil)
-						goto normalreturn
-					}
-					if err != nil {
-						goto errreturn
-					}
-					L.Push(v)
-				case 'a':
-					var buf []byte
-					buf, err = ioutil.ReadAll(file.reader)
-					if err == io.EOF {
-						L.Push(LString(""))
-						goto normalreturn
-					}
-					if err != nil {
-						goto errreturn
-					}
-					L.Push(LString(string(buf)))
-				case 'l':
-					var buf []byte
-					var iseof bool
-					buf, err, iseof = readBufioLine(file.reader)
-					if iseof {
-						L.Push(LNil)
-						goto normalreturn
-					}
-					if err != nil {
-						goto errreturn
-					}
-					L.Push(LString(string(buf)))
-				default:
-					L.ArgError(2, "invalid options:"+string(opt))
+			switch format[0] {
+			case 'n':
+				var numeral string
+				numeral, err = readBufioNumber(file.reader)
+				if err != nil {
+					goto errreturn
 				}
+				v, perr := parseNumberValue(numeral)
+				if perr != nil {
+					L.Push(LNil)
+					goto normalreturn
+				}
+				L.Push(v)
+			case 'a':
+				var buf []byte
+				buf, err = ioutil.ReadAll(file.reader)
+				if err != nil {
+					goto errreturn
+				}
+				L.Push(L.allocateString(string(buf)))
+			case 'l', 'L':
+				var buf []byte
+				var iseof bool
+				buf, err, iseof = readBufioLine(file.reader, format[0] == 'l')
+				if iseof {
+					L.Push(LNil)
+					goto normalreturn
+				}
+				if err != nil {
+					goto errreturn
+				}
+				L.Push(LString(string(buf)))
+			default:
+				L.ArgError(i, "invalid format")
 			}
 		}
 	}
@@ -410,18 +447,23 @@ func fileSeek(L *LState) int {
 
 	var pos int64
 	var err error
+	whence := L.CheckOption(2, fileSeekOptions)
+	offset := L.CheckInt64(3)
 
+	if err = file.Flush(); err != nil {
+		goto errreturn
+	}
 	err = file.AbandonReadBuffer()
 	if err != nil {
 		goto errreturn
 	}
 
-	pos, err = file.fp.Seek(L.CheckInt64(3), L.CheckOption(2, fileSeekOptions))
+	pos, err = file.fp.Seek(offset, whence)
 	if err != nil {
 		goto errreturn
 	}
 
-	L.Push(LNumber(pos))
+	L.Push(integerValue(pos))
 	return 1
 
 errreturn:
@@ -438,27 +480,31 @@ func fileClose(L *LState) int {
 	return fileCloseAux(L, checkFile(L))
 }
 
+func fileGC(L *LState) int {
+	file := checkFile(L)
+	if _, isstdio := file.fp.(*stdioFile); file.closed || isstdio {
+		return 0
+	}
+	fileCloseAux(L, file)
+	return 0
+}
+
 func fileFlush(L *LState) int {
 	return fileFlushAux(L, checkFile(L))
 }
 
-func fileLinesIter(L *LState) int {
-	var file *lFile
-	if ud, ok := L.Get(1).(*LUserData); ok {
-		file = ud.Value.(*lFile)
-	} else {
-		file = L.Get(UpvalueIndex(2)).(*LUserData).Value.(*lFile)
-	}
-	buf, _, err := file.reader.ReadLine()
-	if err != nil {
-		if err == io.EOF {
-			L.Push(LNil)
-			return 1
-		}
-		L.RaiseError(err.Error())
+// fileLinesRead reads the file in the formats kept in the upvalues of the
+// iterator from the third one.
+func fileLinesRead(L *LState, file *lFile) int {
+	top := L.GetTop()
+	for i := 3; L.Get(UpvalueIndex(i)) != LNil; i++ {
+		L.Push(L.Get(UpvalueIndex(i)))
 	}
-	L.Push(LString(string(buf)))
-	return 1
+	return fileReadAux(L, file, top+1)
+}
+
+func fileLinesIter(L *LState) int {
+	return fileLinesRead(L, L.Get(UpvalueIndex(2)).(*LUserData).Value.(*lFile))
 }
 
 func fileLines(L *LState) int {
@@ -467,7 +513,11 @@ func fileLines(L *LState) int {
 	if n := fileIsReadable(L, file); n != 0 {
 		return 0
 	}
-	L.Push(L.NewClosure(fileLinesIter, L.Get(UpvalueIndex(1)), ud))
+	upvalues := []LValue{L.Get(UpvalueIndex(1)), ud}
+	for i := 2; i <= L.GetTop(); i++ {
+		upvalues = append(upvalues, L.Get(i))
+	}
+	L.Push(L.NewClosure(fileLinesIter, upvalues...))
 	return 1
 }
 
@@ -475,45 +525,33 @@ func fileRead(L *LState) int {
 	return fileReadAux(L, checkFile(L), 2)
 }
 
-var filebufOptions = []string{"no", "full"}
+var filebufOptions = []string{"no", "full", "line"}
 
+// fileSetVBuf sets the buffering mode of the file. Data in the old buffer is
+// written first. "line" flushes the buffer whenever a newline is written.
 func fileSetVBuf(L *LState) int {
-	var err error
-	var writer io.Writer
 	file := checkFile(L)
 	if n := fileIsWritable(L, file); n != 0 {
 		return n
 	}
-	switch filebufOptions[L.CheckOption(2, filebufOptions)] {
+	errorIfFileIsClosed(L, file)
+	mode := filebufOptions[L.CheckOption(2, filebufOptions)]
+	bufsize := L.OptInt(3, fileDefaultWriteBuffer)
+	if err := file.Flush(); err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	switch mode {
 	case "no":
-		switch file.Type() {
-		case lFileFile:
-			file.writer = file.fp
-		case lFileProcess:
-			file.writer, err = file.pp.StdinPipe()
-			if err != nil {
-				goto errreturn
-			}
-		}
-	case "full", "line": // TODO line buffer not supported
-		bufsize := L.OptInt(3, fileDefaultWriteBuffer)
-		switch file.Type() {
-		case lFileFile:
-			file.writer = bufio.NewWriterSize(file.fp, bufsize)
-		case lFileProcess:
-			writer, err = file.pp.StdinPipe()
-			if err != nil {
-				goto errreturn
-			}
-			file.writer = bufio.NewWriterSize(writer, bufsize)
-		}
+		file.writer = file.rawWriter
+	case "full":
+		file.writer = bufio.NewWriterSize(file.rawWriter, bufsize)
+	case "line":
+		file.writer = &lineWriter{bufio.NewWriterSize(file.rawWriter, bufsize)}
 	}
 	L.Push(LTrue)
 	return 1
-errreturn:
-	L.Push(LNil)
-	L.Push(LString(err.Error()))
-	return 2
 }
 
 var ioFuncs = map[string]LGFunction{
@@ -567,43 +605,37 @@ func ioFlush(L *LState) int {
 	return fileFlushAux(L, fileDefOut(L).Value.(*lFile))
 }
 
+// ioLinesIter is like fileLinesIter, but closes the file when nothing is
+// read.
 func ioLinesIter(L *LState) int {
-	var file *lFile
-	toclose := false
-	if ud, ok := L.Get(1).(*LUserData); ok {
-		file = ud.Value.(*lFile)
-	} else {
-		file = L.Get(UpvalueIndex(2)).(*LUserData).Value.(*lFile)
-		toclose = true
-	}
-	buf, _, err := file.reader.ReadLine()
-	if err != nil {
-		if err == io.EOF {
-			if toclose {
-				fileCloseAux(L, file)
-			}
-			L.Push(LNil)
-			return 1
-		}
-		L.RaiseError(err.Error())
+	file := L.Get(UpvalueIndex(2)).(*LUserData).Value.(*lFile)
+	n := fileLinesRead(L, file)
+	if n > 0 && L.Get(-n) == LNil {
+		top := L.GetTop()
+		fileCloseAux(L, file)
+		L.SetTop(top)
 	}
-	L.Push(LString(string(buf)))
-	return 1
+	return n
 }
 
 func ioLines(L *LState) int {
-	if L.GetTop() == 0 {
-		L.Push(L.Get(UpvalueIndex(2)))
-		L.Push(fileDefIn(L))
-		return 2
+	var ud *LUserData
+	iter := ioLinesIter
+	if L.Get(1) == LNil {
+		ud = fileDefIn(L)
+		iter = fileLinesIter
+	} else {
+		var err error
+		ud, err = newFile(L, nil, L.CheckString(1), os.O_RDONLY, os.FileMode(0600), false, true)
+		if err != nil {
+			return 0
+		}
 	}
-
-	path := L.CheckString(1)
-	ud, err := newFile(L, nil, path, os.O_RDONLY, os.FileMode(0600), false, true)
-	if err != nil {
-		return 0
+	upvalues := []LValue{L.Get(UpvalueIndex(1)), ud}
+	for i := 2; i <= L.GetTop(); i++ {
+		upvalues = append(upvalues, L.Get(i))
 	}
-	L.Push(L.NewClosure(ioLinesIter, L.Get(UpvalueIndex(1)), ud))
+	L.Push(L.NewClosure(iter, upvalues...))
 	return 1
 }
 
@@ -0,0 +1,175 @@
+package lua
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIOWriteFile(t *testing.T) {
+	// os.File writes the given bytes directly, so the capacity of the slice
+	// converted from the string must be valid.
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	L := NewState()
+	defer L.Close()
+	L.SetStdout(f)
+	if err := L.DoString(`
+	for k = 1, 3 do
+	  local name = debug.getlocal(1, k)
+	  io.write(name, " ")
+	end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "(for index) (for limit) (for step) " {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestIOPopen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX shell")
+	}
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("path", LString(filepath.Join(t.TempDir(), "out.txt")))
+	err := L.DoString(`
+	local f = assert(io.popen("echo hello; echo world | tr a-z A-Z"))
+	assert(f:read("*a") == "hello\nWORLD\n")
+	local ok, what, code = f:close()
+	assert(ok == true and what == "exit" and code == 0)
+
+	f = assert(io.popen("exit 2"))
+	ok, what, code = f:close()
+	assert(ok == nil and what == "exit" and code == 2)
+
+	f = assert(io.popen("cat > '" .. path .. "'", "w"))
+	f:write("written")
+	assert(f:close())
+	local r = assert(io.open(path))
+	assert(r:read("*a") == "written")
+	r:close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	var commands []string
+	L := NewState(Options{CommandPolicy: func(cmd string) error {
+		commands = append(commands, cmd)
+		return errors.New("denied")
+	}})
+	defer L.Close()
+	err := L.DoString(`
+	local ok, err = os.execute("rm -rf /")
+	assert(ok == nil and err == "denied")
+	local f, err = io.popen("ls")
+	assert(f == nil and err == "denied")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || commands[0] != "rm -rf /" || commands[1] != "ls" {
+		t.Errorf("got %v", commands)
+	}
+}
+
+func TestIOReadFormats(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	path := filepath.Join(t.TempDir(), "in.txt")
+	if err := os.WriteFile(path, []byte("12 0x1F -3.5e1\nline two\nline three\nrest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("path", LString(path))
+	err := L.DoString(`
+	local f = assert(io.open(path))
+	local a, b, c = f:read("n", "*n", "n")
+	assert(a == 12 and b == 31 and c == -35, tostring(c))
+	assert(f:read("l") == "")
+	assert(f:read("L") == "line two\n")
+	assert(f:read(4) == "line" and f:read(0) == "")
+	assert(f:read("*l") == " three")
+	assert(f:read("a") == "rest")
+	assert(f:read("a") == "" and f:read("l") == nil and f:read(0) == nil)
+	assert(not pcall(f.read, f, "x"))
+	f:close()
+
+	f = assert(io.open(path))
+	assert(f:read("n") == 12)
+	f:seek("set", 0)
+	assert(f:read("l") == "12 0x1F -3.5e1")
+	f:close()
+
+	-- the lines functions pass their arguments to the iterator.
+	local chunks = {}
+	for a, b in io.lines(path, 2, "l") do chunks[#chunks + 1] = a .. "|" .. b end
+	assert(chunks[1] == "12| 0x1F -3.5e1" and chunks[2] == "li|ne two", chunks[2])
+	f = assert(io.open(path))
+	local n = 0
+	for l in f:lines("L") do n = n + 1 assert(n == 4 or l:sub(-1) == "\n") end
+	assert(n == 4)
+	f:close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIOSeekAndSetVBuf(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	path := filepath.Join(t.TempDir(), "out.txt")
+	L.SetGlobal("path", LString(path))
+	L.SetGlobal("contents", L.NewFunction(func(L *LState) int {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(LString(data))
+		return 1
+	}))
+	err := L.DoString(`
+	local f = assert(io.open(path, "w+"))
+	assert(f:setvbuf("full", 1024))
+	f:write("abc")
+	assert(contents() == "")
+	-- seek writes the buffered data first.
+	assert(f:seek("set", 1) == 1)
+	assert(contents() == "abc")
+	f:write("X")
+	f:seek("set", 0)
+	assert(f:read("a") == "aXc")
+
+	assert(f:setvbuf("line"))
+	f:seek("end")
+	f:write("de")
+	assert(contents() == "aXc")
+	-- writing a newline flushes the whole buffer.
+	f:write("f\ng")
+	assert(contents() == "aXcdef\ng")
+	f:write("h")
+	assert(contents() == "aXcdef\ng")
+	-- changing the mode writes the old buffer.
+	assert(f:setvbuf("no"))
+	assert(contents() == "aXcdef\ngh")
+	assert(f:seek() == 9)
+	assert(not pcall(f.setvbuf, f, "bad"))
+	f:close()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
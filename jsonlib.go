@@ -0,0 +1,345 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSONNull is the value encoded as null by ToJSON. It is available to scripts
+// as json.null, so null can be represented in tables.
+var JSONNull = &LUserData{Metatable: LNil}
+
+// JSONOptions are options for converting values to and from JSON.
+type JSONOptions struct {
+	// Indent is the string used for each indentation level. The JSON is not
+	// indented if Indent is empty.
+	Indent string
+	// EmptyTableAsArray encodes empty tables as [] instead of {}.
+	EmptyTableAsArray bool
+	// FloatPrecision is the number of significant digits of non-integral
+	// numbers. 0 means the smallest number of digits that represents the number
+	// exactly.
+	FloatPrecision int
+	// Null is the value decoded from null. nil means LNil, which leaves holes in
+	// arrays and omits keys of objects.
+	Null LValue
+}
+
+// ToJSON encodes the value as JSON with the default options. Tables whose keys
+// are the integers 1 to n are encoded as arrays, and other tables are encoded
+// as objects whose keys must be strings or numbers. Functions, threads,
+// userdata other than JSONNull, tables with cycles and NaN or infinite
+// numbers can not be encoded.
+func ToJSON(lv LValue) ([]byte, error) {
+	return JSONOptions{}.ToJSON(lv)
+}
+
+// FromJSON decodes the JSON with the default options. Arrays and objects are
+// decoded as tables without metatables, which can be used by any state.
+// Integral numbers are decoded as integers if Lua53Integer is enabled.
+func FromJSON(data []byte) (LValue, error) {
+	return JSONOptions{}.FromJSON(data)
+}
+
+// ToJSON encodes the value as JSON with the options.
+func (opts JSONOptions) ToJSON(lv LValue) ([]byte, error) {
+	je := &jsonEncoder{opts: opts, visiting: make(map[*LTable]bool)}
+	if err := je.encode(lv); err != nil {
+		return nil, err
+	}
+	if opts.Indent == "" {
+		return je.buf.Bytes(), nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, je.buf.Bytes(), "", opts.Indent); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// FromJSON decodes the JSON with the options.
+func (opts JSONOptions) FromJSON(data []byte) (LValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return LNil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return LNil, errors.New("invalid character after top-level value")
+	}
+	null := opts.Null
+	if null == nil {
+		null = LNil
+	}
+	return jsonToValue(v, null)
+}
+
+type jsonEncoder struct {
+	opts     JSONOptions
+	buf      bytes.Buffer
+	visiting map[*LTable]bool
+}
+
+func (je *jsonEncoder) encode(lv LValue) error {
+	switch v := lv.(type) {
+	case *LNilType:
+		je.buf.WriteString("null")
+	case LBool:
+		je.buf.WriteString(v.String())
+	case LInteger:
+		je.buf.WriteString(v.String())
+	case LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("can not encode %v as JSON", v)
+		}
+		if isInteger(v) && math.Abs(f) < 1e15 {
+			je.buf.WriteString(strconv.FormatInt(int64(f), 10))
+		} else if je.opts.FloatPrecision > 0 {
+			je.buf.WriteString(strconv.FormatFloat(f, 'g', je.opts.FloatPrecision, 64))
+		} else {
+			je.buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case LString:
+		je.writeString(string(v))
+	case *LTable:
+		return je.encodeTable(v)
+	case *LUserData:
+		if v == JSONNull {
+			je.buf.WriteString("null")
+			return nil
+		}
+		return fmt.Errorf("can not encode a %v as JSON", lv.Type())
+	default:
+		return fmt.Errorf("can not encode a %v as JSON", lv.Type())
+	}
+	return nil
+}
+
+func (je *jsonEncoder) encodeTable(tb *LTable) error {
+	if je.visiting[tb] {
+		return errors.New("can not encode a table with cycles as JSON")
+	}
+	je.visiting[tb] = true
+	defer delete(je.visiting, tb)
+
+	keys, values, isArray := tableEntries(tb)
+	if len(keys) == 0 {
+		if je.opts.EmptyTableAsArray {
+			je.buf.WriteString("[]")
+		} else {
+			je.buf.WriteString("{}")
+		}
+		return nil
+	}
+
+	if isArray {
+		je.buf.WriteByte('[')
+		for i, value := range values {
+			if i > 0 {
+				je.buf.WriteByte(',')
+			}
+			if err := je.encode(value); err != nil {
+				return err
+			}
+		}
+		je.buf.WriteByte(']')
+		return nil
+	}
+
+	names := make([]string, len(keys))
+	indices := make([]int, len(keys))
+	for i, key := range keys {
+		switch key.(type) {
+		case LString, LNumber, LInteger:
+			names[i] = key.String()
+		default:
+			return fmt.Errorf("can not encode a table with %v keys as JSON", key.Type())
+		}
+		indices[i] = i
+	}
+	if !tb.IsOrdered() {
+		sort.Slice(indices, func(i, j int) bool { return names[indices[i]] < names[indices[j]] })
+	}
+	je.buf.WriteByte('{')
+	for n, i := range indices {
+		if n > 0 {
+			je.buf.WriteByte(',')
+		}
+		je.writeString(names[i])
+		je.buf.WriteByte(':')
+		if err := je.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	je.buf.WriteByte('}')
+	return nil
+}
+
+// tableEntries returns the keys and the values of the table. isArray is true
+// if the keys are the integers 1 to n, and the entries are sorted by the keys
+// then.
+func tableEntries(tb *LTable) (keys, values []LValue, isArray bool) {
+	maxn := int64(0)
+	isArray = true
+	tb.ForEach(func(key, value LValue) {
+		keys = append(keys, key)
+		values = append(values, value)
+		if i, ok := toIntegerValue(key); ok && i > 0 {
+			if i > maxn {
+				maxn = i
+			}
+		} else {
+			isArray = false
+		}
+	})
+	if len(keys) == 0 || !isArray || maxn != int64(len(keys)) {
+		return keys, values, false
+	}
+	for i := range keys {
+		keys[i] = integerValue(int64(i + 1))
+		values[i] = tb.RawGet(LNumber(i + 1))
+	}
+	return keys, values, true
+}
+
+// writeString writes the string as a JSON string. Invalid UTF-8 sequences are
+// replaced with U+FFFD.
+func (je *jsonEncoder) writeString(s string) {
+	const hex = "0123456789abcdef"
+	je.buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				je.buf.WriteByte('\\')
+				je.buf.WriteByte(c)
+			case c == '\n':
+				je.buf.WriteString(`\n`)
+			case c == '\r':
+				je.buf.WriteString(`\r`)
+			case c == '\t':
+				je.buf.WriteString(`\t`)
+			case c < 0x20 || c == 0x7f:
+				je.buf.WriteString(`\u00`)
+				je.buf.WriteByte(hex[c>>4])
+				je.buf.WriteByte(hex[c&0xf])
+			default:
+				je.buf.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			je.buf.WriteString("\ufffd")
+		} else {
+			je.buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	je.buf.WriteByte('"')
+}
+
+func jsonToValue(v interface{}, null LValue) (LValue, error) {
+	switch v := v.(type) {
+	case nil:
+		return null, nil
+	case bool:
+		return LBool(v), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return integerValue(i), nil
+		}
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return LNil, err
+		}
+		return LNumber(f), nil
+	case string:
+		return LString(v), nil
+	case []interface{}:
+		tb := newLTable(len(v), 0)
+		for i, elem := range v {
+			lv, err := jsonToValue(elem, null)
+			if err != nil {
+				return LNil, err
+			}
+			tb.RawSetInt(i+1, lv)
+		}
+		return tb, nil
+	case map[string]interface{}:
+		tb := newLTable(0, len(v))
+		for key, elem := range v {
+			lv, err := jsonToValue(elem, null)
+			if err != nil {
+				return LNil, err
+			}
+			if lv != LNil {
+				tb.RawSetH(LString(key), lv)
+			}
+		}
+		return tb, nil
+	}
+	return LNil, fmt.Errorf("unexpected JSON value %T", v)
+}
+
+// OpenJSON opens the json module, which is not opened by OpenLibs. OpenJSON
+// can be given to LState.PreloadModule as a loader.
+func OpenJSON(L *LState) int {
+	mod := L.RegisterModule("json", jsonFuncs).(*LTable)
+	mod.RawSetH(LString("null"), JSONNull)
+	L.Push(mod)
+	return 1
+}
+
+var jsonFuncs = map[string]LGFunction{
+	"encode": jsonEncode,
+	"decode": jsonDecode,
+}
+
+// jsonOptions reads the options table at the given stack index. The keys are
+// indent, empty_table_as_array, precision and null.
+func jsonOptions(L *LState, n int) JSONOptions {
+	var opts JSONOptions
+	tb := L.OptTable(n, nil)
+	if tb == nil {
+		return opts
+	}
+	opts.Indent = LVAsString(tb.RawGetH(LString("indent")))
+	opts.EmptyTableAsArray = LVAsBool(tb.RawGetH(LString("empty_table_as_array")))
+	opts.FloatPrecision = int(LVAsNumber(tb.RawGetH(LString("precision"))))
+	opts.Null = tb.RawGetH(LString("null"))
+	return opts
+}
+
+func jsonEncode(L *LState) int {
+	data, err := jsonOptions(L, 2).ToJSON(L.CheckAny(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(LString(data))
+	return 1
+}
+
+// jsonDecode decodes the JSON string. It returns nil and an error message if
+// the string is not valid JSON.
+func jsonDecode(L *LState) int {
+	lv, err := jsonOptions(L, 2).FromJSON([]byte(L.CheckString(1)))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(lv)
+	return 1
+}
@@ -0,0 +1,66 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("json", OpenJSON)
+	err := L.DoString(`
+	local json = require("json")
+	local s = json.encode({b = {1, 2, "x"}, a = true, c = "q\"\n", d = 1.5})
+	assert(s == '{"a":true,"b":[1,2,"x"],"c":"q\\"\\n","d":1.5}', s)
+	assert(json.encode({}) == "{}")
+	assert(json.encode({}, {empty_table_as_array = true}) == "[]")
+	assert(json.encode({1 / 3}, {precision = 3}) == "[0.333]")
+	assert(json.encode({a = 1}, {indent = "  "}) == '{\n  "a": 1\n}', json.encode({a = 1}, {indent = "  "}))
+	assert(json.encode(json.null) == "null")
+
+	local v = json.decode('{"list": [1, null, 3], "name": "x", "obj": {"k": false}}')
+	assert(v.name == "x" and v.list[1] == 1 and v.list[2] == nil and v.list[3] == 3)
+	assert(v.obj.k == false)
+	v = json.decode('[1, null]', {null = json.null})
+	assert(v[2] == json.null and #v == 2)
+
+	local v, err = json.decode("{")
+	assert(v == nil and type(err) == "string")
+
+	assert(not pcall(json.encode, print))
+	assert(not pcall(json.encode, 0/0))
+	local t = {} t.self = t
+	local ok, err = pcall(json.encode, t)
+	assert(not ok and err:find("cycles"), tostring(err))
+	assert(not pcall(json.encode, {[true] = 1}))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	v, err := FromJSON([]byte(`{"a": [1, 2], "b": "s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ToJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != `{"a":[1,2],"b":"s"}` {
+		t.Errorf("got %v", got)
+	}
+	data, err = JSONOptions{Indent: "\t"}.ToJSON(v)
+	if err != nil || !strings.Contains(string(data), "\n\t\"a\": [") {
+		t.Errorf("got %s, %v", data, err)
+	}
+	if _, err := FromJSON([]byte(`[1,`)); err == nil {
+		t.Error("invalid JSON must not be decoded")
+	}
+	v, err = JSONOptions{Null: JSONNull}.FromJSON([]byte(`{"x": null}`))
+	if err != nil || v.(*LTable).RawGetH(LString("x")) != JSONNull {
+		t.Errorf("got %v, %v, want JSONNull", v, err)
+	}
+}
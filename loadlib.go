@@ -1,9 +1,13 @@
 package lua
 
 import (
+	"bytes"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -37,7 +41,32 @@ func loFindFile(L *LState, name, pname string) (string, string) {
 	messages := []string{}
 	for _, pattern := range strings.Split(string(path), ";") {
 		luapath := strings.Replace(pattern, "?", name, -1)
-		if _, err := os.Stat(luapath); err == nil {
+		if file, err := L.fileSystem().OpenFile(luapath, os.O_RDONLY, 0); err == nil {
+			file.Close()
+			return luapath, ""
+		} else {
+			messages = append(messages, err.Error())
+		}
+	}
+	return "", strings.Join(messages, "\n\t")
+}
+
+// loFindFileFS searches the module in the filesystem of
+// Options.ModuleFS. Patterns that are not valid fs.FS paths are skipped.
+func loFindFileFS(L *LState, fsys fs.FS, name, pname string) (string, string) {
+	name = strings.Replace(name, ".", "/", -1)
+	lv := L.GetField(L.GetField(L.Get(EnvironIndex), "package"), pname)
+	luapaths, ok := lv.(LString)
+	if !ok {
+		L.RaiseError("package.%s must be a string", pname)
+	}
+	messages := []string{}
+	for _, pattern := range strings.Split(string(luapaths), ";") {
+		luapath := path.Clean(strings.Replace(pattern, "?", name, -1))
+		if !fs.ValidPath(luapath) {
+			continue
+		}
+		if _, err := fs.Stat(fsys, luapath); err == nil {
 			return luapath, ""
 		} else {
 			messages = append(messages, err.Error())
@@ -56,13 +85,19 @@ func loadOpen(L *LState) {
 		L.RawSetInt(loaders, i+1, L.NewFunction(loader))
 	}
 	L.SetField(packagemod, "loaders", loaders)
+	L.SetField(packagemod, "searchers", loaders)
 	L.SetField(L.Get(RegistryIndex), "_LOADERS", loaders)
 
 	loaded := L.NewTable()
 	L.SetField(packagemod, "loaded", loaded)
 	L.SetField(L.Get(RegistryIndex), "_LOADED", loaded)
+	L.SetField(L.Get(RegistryIndex), "_SOURCES", L.NewTable())
 
-	L.SetField(packagemod, "path", LString(loGetPath(LuaPath, LuaPathDefault)))
+	if L.G.options.ModuleFS != nil {
+		L.SetField(packagemod, "path", LString(ModuleFSPathDefault))
+	} else {
+		L.SetField(packagemod, "path", LString(loGetPath(LuaPath, LuaPathDefault)))
+	}
 	L.SetField(packagemod, "cpath", LString(""))
 }
 
@@ -88,6 +123,9 @@ func loLoaderPreload(L *LState) int {
 
 func loLoaderLua(L *LState) int {
 	name := L.CheckString(1)
+	if fsys := L.G.options.ModuleFS; fsys != nil {
+		return loLoaderLuaFS(L, fsys, name)
+	}
 	path, msg := loFindFile(L, name, "path")
 	if len(path) == 0 {
 		L.Push(LString(msg))
@@ -98,7 +136,27 @@ func loLoaderLua(L *LState) int {
 		L.RaiseError(err1.Error())
 	}
 	L.Push(fn)
-	return 1
+	L.Push(LString(path))
+	return 2
+}
+
+func loLoaderLuaFS(L *LState, fsys fs.FS, name string) int {
+	path, msg := loFindFileFS(L, fsys, name, "path")
+	if len(path) == 0 {
+		L.Push(LString(msg))
+		return 1
+	}
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		L.RaiseError("can not read %v: %v", path, err.Error())
+	}
+	fn, err1 := L.Load(bytes.NewReader(data), path)
+	if err1 != nil {
+		L.RaiseError("%s", err1.Error())
+	}
+	L.Push(fn)
+	L.Push(LString(path))
+	return 2
 }
 
 func loLoadLib(L *LState) int {
@@ -119,4 +177,68 @@ func loSeeAll(L *LState) int {
 
 /* }}} */
 
+// AddSearcher appends the searcher to package.searchers(package.loaders), so
+// require can find modules that are not files, for example modules stored in
+// a database. The searcher is called with the module name and returns a loader
+// function(and an optional value passed to the loader as the second argument)
+// or a string explaining why the module was not found.
+func (ls *LState) AddSearcher(searcher LGFunction) {
+	loaders, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADERS").(*LTable)
+	if !ok {
+		ls.RaiseError("package.loaders must be a table")
+	}
+	loaders.Append(ls.NewFunction(searcher))
+}
+
+// LoadedModule is a module in package.loaded.
+type LoadedModule struct {
+	Name   string
+	Module LValue
+	// Source is the value given to the loader by the searcher that found the
+	// module(the file name for Lua files). Source is empty for modules loaded
+	// without require, like the standard libraries.
+	Source string
+}
+
+// LoadedModules returns the modules in package.loaded sorted by their names.
+func (ls *LState) LoadedModules() []LoadedModule {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok {
+		return nil
+	}
+	sources, _ := ls.GetField(ls.Get(RegistryIndex), "_SOURCES").(*LTable)
+	modules := []LoadedModule{}
+	loaded.ForEach(func(key, value LValue) {
+		name, ok := key.(LString)
+		if !ok || value == loopdetection {
+			return
+		}
+		module := LoadedModule{Name: string(name), Module: value}
+		if sources != nil {
+			if source, ok := sources.RawGetH(name).(LString); ok {
+				module.Source = string(source)
+			}
+		}
+		modules = append(modules, module)
+	})
+	sort.Slice(modules, func(i, j int) bool { return modules[i].Name < modules[j].Name })
+	return modules
+}
+
+// UnloadModule removes the module from package.loaded, so the next require
+// loads the module again. Values that refer to the module(for example, global
+// variables) are not changed. UnloadModule reports whether the module was
+// loaded.
+func (ls *LState) UnloadModule(name string) bool {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok || loaded.RawGetH(LString(name)) == LNil {
+		return false
+	}
+	loaded.RawSetH(LString(name), LNil)
+	if sources, ok := ls.GetField(ls.Get(RegistryIndex), "_SOURCES").(*LTable); ok {
+		sources.RawSetH(LString(name), LNil)
+	}
+	return true
+}
+
 //
@@ -0,0 +1,130 @@
+package lua
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAddSearcher(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	scripts := map[string]string{
+		"greet": `local name, extra = ... return {name = name, extra = extra}`,
+	}
+	L.AddSearcher(func(L *LState) int {
+		name := L.CheckString(1)
+		src, ok := scripts[name]
+		if !ok {
+			L.Push(LString("\n\tno script '" + name + "'"))
+			return 1
+		}
+		fn, err := L.LoadString(src)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(fn)
+		L.Push(LString("db"))
+		return 2
+	})
+	err := L.DoString(`
+	assert(package.searchers == package.loaders)
+	local m = require("greet")
+	assert(m.name == "greet" and m.extra == "db")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = L.DoString(`require("missing")`)
+	if err == nil || !strings.Contains(err.Error(), "no script 'missing'") {
+		t.Errorf("got %v, want the message of the searcher", err)
+	}
+}
+
+func TestRequireFileName(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mod.lua")
+	if err := os.WriteFile(path, []byte(`return select(2, ...)`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	L.SetField(L.GetGlobal("package"), "path", LString(filepath.Join(dir, "?.lua")))
+	if err := L.DoString(`file = require("mod")`); err != nil {
+		t.Fatal(err)
+	}
+	// the Lua searcher passes the file name to the loader.
+	if got := L.GetGlobal("file").String(); got != path {
+		t.Errorf("got %v, want %v", got, path)
+	}
+}
+
+func TestModuleFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/util.lua": {Data: []byte(`return {name = ..., file = select(2, ...)}`)},
+		"app/init.lua": {Data: []byte(`return "app"`)},
+		"broken.lua":   {Data: []byte(`return = 1`)},
+	}
+	L := NewState(Options{ModuleFS: fsys})
+	defer L.Close()
+	err := L.DoString(`
+	assert(package.path == "?.lua;?/init.lua", package.path)
+	local util = require("app.util")
+	assert(util.name == "app.util" and util.file == "app/util.lua", util.file)
+	assert(require("app") == "app")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`require("missing")`); err == nil || !strings.Contains(err.Error(), "module missing not found") {
+		t.Errorf("got %v, want a not found error", err)
+	}
+	if err := L.DoString(`require("broken")`); err == nil || !strings.Contains(err.Error(), "broken.lua") {
+		t.Errorf("got %v, want a syntax error", err)
+	}
+	// patterns that are not valid fs.FS paths are skipped.
+	L.SetField(L.GetGlobal("package"), "path", LString("../?.lua;/?.lua;app/?.lua"))
+	if err := L.DoString(`assert(require("util"))`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadedModules(t *testing.T) {
+	fsys := fstest.MapFS{
+		"plugins/foo.lua": {Data: []byte(`loads = (loads or 0) + 1 return {}`)},
+	}
+	L := NewState(Options{ModuleFS: fsys})
+	defer L.Close()
+	L.PreloadModule("bar", func(L *LState) int {
+		L.Push(L.NewTable())
+		return 1
+	})
+	if err := L.DoString(`require("plugins.foo") require("bar")`); err != nil {
+		t.Fatal(err)
+	}
+	sources := map[string]string{}
+	for _, m := range L.LoadedModules() {
+		sources[m.Name] = m.Source
+	}
+	if s, ok := sources["plugins.foo"]; !ok || s != "plugins/foo.lua" {
+		t.Errorf("got %q, want the file name", s)
+	}
+	if s, ok := sources["bar"]; !ok || s != "" {
+		t.Errorf("got %q, want no source", s)
+	}
+	if s, ok := sources["string"]; !ok || s != "" {
+		t.Errorf("got %q, want the string library", s)
+	}
+
+	if !L.UnloadModule("plugins.foo") {
+		t.Error("got false, want true")
+	}
+	if L.UnloadModule("plugins.foo") {
+		t.Error("got true for a module that is not loaded")
+	}
+	if err := L.DoString(`require("plugins.foo") assert(loads == 2)`); err != nil {
+		t.Error(err)
+	}
+}
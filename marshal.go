@@ -0,0 +1,265 @@
+package lua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	marshalSignature = "\x1bLuaV"
+	marshalVersion   = 1
+)
+
+const unmarshalMaxDepth = 10000
+
+const (
+	marshalTable byte = dumpConstInteger + 1 + iota
+	marshalTableRef
+)
+
+type valueEncoder struct {
+	dumpState
+	tables map[*LTable]int
+}
+
+func (ve *valueEncoder) encode(lv LValue) error {
+	switch v := lv.(type) {
+	case *LNilType, LBool, LNumber, LInteger, LString:
+		return ve.writeConstant(lv)
+	case *LTable:
+		if id, ok := ve.tables[v]; ok {
+			ve.writeByte(marshalTableRef)
+			ve.writeInt(id)
+			return nil
+		}
+		ve.tables[v] = len(ve.tables)
+		ve.writeByte(marshalTable)
+		if v.frozen {
+			ve.writeByte(1)
+		} else {
+			ve.writeByte(0)
+		}
+		var keys, values []LValue
+		v.ForEach(func(key, value LValue) {
+			keys = append(keys, key)
+			values = append(values, value)
+		})
+		ve.writeInt(len(keys))
+		for i, key := range keys {
+			if err := ve.encode(key); err != nil {
+				return err
+			}
+			if err := ve.encode(values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can not marshal a %v", lv.Type())
+}
+
+// MarshalValue encodes the value into a binary form that UnmarshalValue
+// decodes. The value can be nil, a boolean, a number, a string or a table whose
+// keys and values are such values. Shared references and cycles of tables are
+// preserved, and metatables are not encoded.
+func MarshalValue(lv LValue) ([]byte, error) {
+	ve := &valueEncoder{dumpState: dumpState{buf: make([]byte, 0, 64)}, tables: make(map[*LTable]int)}
+	ve.buf = append(ve.buf, marshalSignature...)
+	ve.writeByte(marshalVersion)
+	if err := ve.encode(lv); err != nil {
+		return nil, err
+	}
+	return ve.buf, nil
+}
+
+type valueDecoder struct {
+	buf    []byte
+	pos    int
+	err    error
+	root   *LTable
+	tables []*LTable
+}
+
+func (vd *valueDecoder) fail(format string, args ...interface{}) {
+	if vd.err == nil {
+		vd.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (vd *valueDecoder) readByte() byte {
+	if vd.err != nil {
+		return 0
+	}
+	if vd.pos >= len(vd.buf) {
+		vd.fail("truncated marshaled value")
+		return 0
+	}
+	b := vd.buf[vd.pos]
+	vd.pos++
+	return b
+}
+
+func (vd *valueDecoder) readInt() int {
+	if vd.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(vd.buf[vd.pos:])
+	if n <= 0 || v < 0 || v > math.MaxInt32 {
+		vd.fail("truncated marshaled value")
+		return 0
+	}
+	vd.pos += n
+	return int(v)
+}
+
+func (vd *valueDecoder) readFixed(size int) []byte {
+	if vd.err != nil {
+		return nil
+	}
+	if len(vd.buf)-vd.pos < size {
+		vd.fail("truncated marshaled value")
+		return nil
+	}
+	b := vd.buf[vd.pos : vd.pos+size]
+	vd.pos += size
+	return b
+}
+
+func (vd *valueDecoder) readString() string {
+	if vd.err != nil {
+		return ""
+	}
+	l, n := binary.Uvarint(vd.buf[vd.pos:])
+	if n <= 0 || l > uint64(len(vd.buf)-vd.pos-n) {
+		vd.fail("truncated marshaled value")
+		return ""
+	}
+	vd.pos += n
+	s := string(vd.buf[vd.pos : vd.pos+int(l)])
+	vd.pos += int(l)
+	return s
+}
+
+func (vd *valueDecoder) decode(depth int) LValue {
+	if depth > unmarshalMaxDepth {
+		vd.fail("too many nested tables in marshaled value")
+		return LNil
+	}
+	switch tag := vd.readByte(); tag {
+	case dumpConstNil:
+		return LNil
+	case dumpConstFalse:
+		return LFalse
+	case dumpConstTrue:
+		return LTrue
+	case dumpConstNumber:
+		if b := vd.readFixed(8); b != nil {
+			return LNumber(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		}
+	case dumpConstString:
+		return LString(vd.readString())
+	case dumpConstInteger:
+		if b := vd.readFixed(8); b != nil {
+			return integerValue(int64(binary.LittleEndian.Uint64(b)))
+		}
+	case marshalTable:
+		return vd.decodeTable(depth)
+	case marshalTableRef:
+		id := vd.readInt()
+		if vd.err == nil && id >= len(vd.tables) {
+			vd.fail("bad table reference in marshaled value")
+		}
+		if vd.err == nil {
+			return vd.tables[id]
+		}
+	default:
+		if vd.err == nil {
+			vd.fail("bad value in marshaled value")
+		}
+	}
+	return LNil
+}
+
+func (vd *valueDecoder) decodeTable(depth int) LValue {
+	frozen := vd.readByte() != 0
+	n := vd.readInt()
+	if vd.err != nil {
+		return LNil
+	}
+	// each entry is at least 2 bytes long.
+	if n*2 > len(vd.buf)-vd.pos {
+		vd.fail("truncated marshaled value")
+		return LNil
+	}
+	tb := vd.root
+	if tb == nil || len(vd.tables) > 0 {
+		tb = newLTable(0, 0)
+	}
+	vd.tables = append(vd.tables, tb)
+	for i := 0; i < n && vd.err == nil; i++ {
+		key := vd.decode(depth + 1)
+		value := vd.decode(depth + 1)
+		if vd.err != nil {
+			break
+		}
+		if key == LNil {
+			vd.fail("table index is nil in marshaled value")
+			break
+		}
+		if f, ok := key.(LNumber); ok && math.IsNaN(float64(f)) {
+			vd.fail("table index is NaN in marshaled value")
+			break
+		}
+		tb.RawSet(key, value)
+	}
+	tb.frozen = frozen
+	return tb
+}
+
+func (vd *valueDecoder) run() (LValue, error) {
+	if len(vd.buf) < len(marshalSignature)+1 || string(vd.buf[:len(marshalSignature)]) != marshalSignature {
+		return LNil, errors.New("bad header in marshaled value")
+	}
+	vd.pos = len(marshalSignature)
+	if vd.readByte() != marshalVersion {
+		return LNil, errors.New("version mismatch in marshaled value")
+	}
+	lv := vd.decode(0)
+	if vd.err != nil {
+		return LNil, vd.err
+	}
+	if vd.pos != len(vd.buf) {
+		return LNil, errors.New("garbage at end of marshaled value")
+	}
+	return lv, nil
+}
+
+// UnmarshalValue decodes the value encoded by MarshalValue. Tables are created
+// without metatables and can be used by any state.
+func UnmarshalValue(data []byte) (LValue, error) {
+	vd := &valueDecoder{buf: data}
+	return vd.run()
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler with MarshalValue, so
+// tables can be encoded by encoding/gob.
+func (tb *LTable) MarshalBinary() ([]byte, error) {
+	return MarshalValue(tb)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It replaces the
+// contents of the table with the table encoded by MarshalValue.
+func (tb *LTable) UnmarshalBinary(data []byte) error {
+	*tb = *newLTable(0, 0)
+	vd := &valueDecoder{buf: data, root: tb}
+	lv, err := vd.run()
+	if err != nil {
+		return err
+	}
+	if lv != tb {
+		return fmt.Errorf("can not unmarshal a %v into a table", lv.Type())
+	}
+	return nil
+}
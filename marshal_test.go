@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestMarshalValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local inventory = {"sword", "shield"}
+	savegame = {name = "hero", level = 3, hp = 12.5, alive = true, bag = inventory, hands = inventory, [1] = "first"}
+	savegame.self = savegame
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, merr := MarshalValue(L.GetGlobal("savegame"))
+	if merr != nil {
+		t.Fatal(merr)
+	}
+	v, uerr := UnmarshalValue(data)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	L.SetGlobal("loaded", v)
+	err = L.DoString(`
+	assert(loaded ~= savegame)
+	assert(loaded.name == "hero" and loaded.level == 3 and loaded.hp == 12.5 and loaded.alive == true)
+	assert(loaded[1] == "first" and loaded.bag[2] == "shield")
+	assert(loaded.bag == loaded.hands and loaded.self == loaded)
+	`)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, lv := range []LValue{LNil, LTrue, LNumber(1.5), LString("s")} {
+		data, err := MarshalValue(lv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := UnmarshalValue(data); err != nil || got != lv {
+			t.Errorf("got %v, %v, want %v", got, err, lv)
+		}
+	}
+	if _, err := MarshalValue(L.GetGlobal("print")); err == nil {
+		t.Error("functions must not be encoded")
+	}
+	if _, err := UnmarshalValue(data[:len(data)/2]); err == nil {
+		t.Error("truncated data must not be decoded")
+	}
+}
+
+func TestTableGob(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	type save struct {
+		Name string
+		Data *LTable
+	}
+	tb := L.NewTable()
+	tb.RawSetH(LString("x"), LNumber(1))
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(save{Name: "s", Data: tb}); err != nil {
+		t.Fatal(err)
+	}
+	var got save
+	if err := gob.NewDecoder(&buf).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "s" || got.Data.RawGetH(LString("x")) != LNumber(1) {
+		t.Errorf("got %+v", got)
+	}
+}
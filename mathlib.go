@@ -3,12 +3,21 @@ package lua
 import (
 	"math"
 	"math/rand"
+	"time"
 )
 
 func mathOpen(L *LState) {
 	mod := L.RegisterModule("math", mathFuncs).(*LTable)
 	mod.RawSetH(LString("pi"), LNumber(math.Pi))
-	mod.RawSetH(LString("huge"), LNumber(math.MaxFloat64))
+	mod.RawSetH(LString("huge"), LNumber(math.Inf(1)))
+	if Lua53Integer {
+		mod.RawSetH(LString("maxinteger"), LInteger(math.MaxInt64))
+		mod.RawSetH(LString("mininteger"), LInteger(math.MinInt64))
+	} else {
+		// the range of integers that floats can represent exactly
+		mod.RawSetH(LString("maxinteger"), LNumber(1<<53-1))
+		mod.RawSetH(LString("mininteger"), LNumber(-(1 << 53)))
+	}
 }
 
 var mathFuncs = map[string]LGFunction{
@@ -41,6 +50,9 @@ var mathFuncs = map[string]LGFunction{
 	"sqrt":       mathSqrt,
 	"tan":        mathTan,
 	"tanh":       mathTanh,
+	"tointeger":  mathToInteger,
+	"type":       mathType,
+	"ult":        mathUlt,
 }
 
 func mathAbs(L *LState) int {
@@ -69,7 +81,7 @@ func mathAtan2(L *LState) int {
 }
 
 func mathCeil(L *LState) int {
-	L.Push(LNumber(math.Ceil(float64(L.CheckNumber(1)))))
+	L.Push(mathRound(L, math.Ceil))
 	return 1
 }
 
@@ -94,10 +106,25 @@ func mathExp(L *LState) int {
 }
 
 func mathFloor(L *LState) int {
-	L.Push(LNumber(math.Floor(float64(L.CheckNumber(1)))))
+	L.Push(mathRound(L, math.Floor))
 	return 1
 }
 
+// mathRound returns an integer if Lua53Integer is enabled and the rounded value
+// fits into an integer.
+func mathRound(L *LState, round func(float64) float64) LValue {
+	if v, ok := L.CheckAny(1).(LInteger); ok {
+		return v
+	}
+	f := LNumber(round(float64(L.CheckNumber(1))))
+	if Lua53Integer {
+		if i, ok := lnumberToInt64(f); ok {
+			return LInteger(i)
+		}
+	}
+	return f
+}
+
 func mathFmod(L *LState) int {
 	L.Push(LNumber(math.Mod(float64(L.CheckNumber(1)), float64(L.CheckNumber(2)))))
 	return 1
@@ -181,23 +208,87 @@ func mathRad(L *LState) int {
 	return 1
 }
 
+// SeedRandom seeds the random number generator of the state and its threads,
+// so math.random returns the same sequence for the same seed.
+func (ls *LState) SeedRandom(seed int64) {
+	ls.G.rand = rand.New(rand.NewSource(seed))
+}
+
+// SetRandSource sets the source of the random numbers that math.random of the
+// state and its threads returns. The source is not used concurrently.
+func (ls *LState) SetRandSource(src rand.Source) {
+	ls.G.rand = rand.New(src)
+}
+
+// random returns the random number generator of the state. Each state has its
+// own generator, which is seeded randomly unless SeedRandom is called.
+func (ls *LState) random() *rand.Rand {
+	if ls.G.rand == nil {
+		ls.SeedRandom(ls.randomSeed())
+	}
+	return ls.G.rand
+}
+
+// randomSeed returns a seed that differs between runs, or 0 in deterministic
+// mode.
+func (ls *LState) randomSeed() int64 {
+	if ls.G.options.Deterministic {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// mathRandom returns a float in [0, 1) without arguments, an integer in
+// [1, m] with one argument and an integer in [m, n] with two arguments.
 func mathRandom(L *LState) int {
+	r := L.random()
+	var low, up int64
 	switch L.GetTop() {
 	case 0:
-		L.Push(LNumber(rand.Float64()))
+		L.Push(LNumber(r.Float64()))
+		return 1
 	case 1:
-		n := L.CheckInt(1)
-		L.Push(LNumber(rand.Intn(n-1) + 1))
+		low, up = 1, L.CheckInt64(1)
+	default:
+		low, up = L.CheckInt64(1), L.CheckInt64(2)
+	}
+	if low > up {
+		L.ArgError(L.GetTop(), "interval is empty")
+	}
+	span := uint64(up-low) + 1
+	var v uint64
+	switch {
+	case span == 0:
+		// the whole range of int64.
+		v = r.Uint64()
+	case span <= math.MaxInt64:
+		v = uint64(r.Int63n(int64(span)))
 	default:
-		min := L.CheckInt(1)
-		max := L.CheckInt(2) + 1
-		L.Push(LNumber(rand.Intn(max-min) + min))
+		for v = r.Uint64(); v >= span; v = r.Uint64() {
+		}
 	}
+	L.Push(integerValue(low + int64(v)))
 	return 1
 }
 
+// mathRandomseed seeds the random number generator of the state with the
+// number, or randomly without arguments.
 func mathRandomseed(L *LState) int {
-	rand.Seed(L.CheckInt64(1))
+	if L.GetTop() == 0 {
+		L.SeedRandom(L.randomSeed())
+		return 0
+	}
+	switch v := L.CheckAny(1).(type) {
+	case LInteger:
+		L.SeedRandom(int64(v))
+	default:
+		f := L.CheckNumber(1)
+		if i, ok := lnumberToInt64(f); ok {
+			L.SeedRandom(i)
+		} else {
+			L.SeedRandom(int64(math.Float64bits(float64(f))))
+		}
+	}
 	return 0
 }
 
@@ -226,4 +317,37 @@ func mathTanh(L *LState) int {
 	return 1
 }
 
+func mathToInteger(L *LState) int {
+	lv := L.CheckAny(1)
+	if i, ok := toIntegerValue(lv); ok {
+		L.Push(integerValue(i))
+	} else {
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func mathType(L *LState) int {
+	switch v := L.CheckAny(1).(type) {
+	case LInteger:
+		L.Push(LString("integer"))
+	case LNumber:
+		// all numbers are floats unless Lua53Integer is enabled, so floats
+		// with integral values are reported as integers.
+		if _, ok := lnumberToInt64(v); ok && !Lua53Integer {
+			L.Push(LString("integer"))
+		} else {
+			L.Push(LString("float"))
+		}
+	default:
+		L.Push(LNil)
+	}
+	return 1
+}
+
+func mathUlt(L *LState) int {
+	L.Push(LBool(uint64(checkIntegerValue(L, 1)) < uint64(checkIntegerValue(L, 2))))
+	return 1
+}
+
 //
@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestMath53(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(math.type(3) == "integer" and math.type(3.5) == "float" and math.type("3") == nil)
+	assert(math.tointeger(3.0) == 3 and math.tointeger(3.5) == nil and math.tointeger("x") == nil)
+	assert(math.ult(1, 2) and not math.ult(2, 1) and math.ult(1, -1))
+	assert(math.maxinteger == 2^53 - 1 and math.mininteger == -2^53)
+	assert(math.maxinteger + 0.0 == 9007199254740991)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMathRandom(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	math.randomseed(42)
+	local a = {math.random(), math.random(10), math.random(-5, 5)}
+	math.randomseed(42)
+	local b = {math.random(), math.random(10), math.random(-5, 5)}
+	for i = 1, 3 do assert(a[i] == b[i]) end
+	assert(a[1] >= 0 and a[1] < 1)
+	for i = 1, 100 do
+	  local x = math.random(3)
+	  assert(x >= 1 and x <= 3 and x % 1 == 0)
+	  x = math.random(-2, 2)
+	  assert(x >= -2 and x <= 2)
+	end
+	assert(math.random(7, 7) == 7)
+	local ok, err = pcall(math.random, 2, 1)
+	assert(not ok and err:find("interval is empty"), err)
+	assert(not pcall(math.random, 0))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeedRandom(t *testing.T) {
+	sequence := func(L *LState) string {
+		if err := L.DoString(`s = math.random(1000) .. "," .. math.random(1000)`); err != nil {
+			t.Fatal(err)
+		}
+		return L.GetGlobal("s").String()
+	}
+	L1 := NewState()
+	defer L1.Close()
+	L2 := NewState()
+	defer L2.Close()
+	L1.SeedRandom(7)
+	L2.SeedRandom(7)
+	if s1, s2 := sequence(L1), sequence(L2); s1 != s2 {
+		t.Errorf("got %v and %v, want the same sequence", s1, s2)
+	}
+	// each state has its own generator.
+	L1.SeedRandom(7)
+	sequence(L2)
+	L2.SeedRandom(7)
+	if s1, s2 := sequence(L1), sequence(L2); s1 != s2 {
+		t.Errorf("got %v and %v, want the same sequence", s1, s2)
+	}
+	L1.SetRandSource(rand.NewSource(1))
+	L2.SetRandSource(rand.NewSource(1))
+	if s1, s2 := sequence(L1), sequence(L2); s1 != s2 {
+		t.Errorf("got %v and %v, want the same sequence", s1, s2)
+	}
+}
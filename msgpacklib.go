@@ -0,0 +1,344 @@
+package lua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const msgpackMaxDepth = 10000
+
+// ToMsgPack encodes the value as MessagePack. Tables whose keys are the
+// integers 1 to n are encoded as arrays, and other tables are encoded as maps.
+// Strings are encoded as str, and integral numbers are encoded as integers.
+// Functions, threads, userdata and tables with cycles can not be encoded.
+func ToMsgPack(lv LValue) ([]byte, error) {
+	me := &msgpackEncoder{visiting: make(map[*LTable]bool)}
+	if err := me.encode(lv); err != nil {
+		return nil, err
+	}
+	return me.buf, nil
+}
+
+// FromMsgPack decodes the MessagePack. Arrays and maps are decoded as tables
+// without metatables, which can be used by any state, and bin is decoded as a
+// string. nil in maps omits the keys. Extension types are not supported.
+func FromMsgPack(data []byte) (LValue, error) {
+	md := &msgpackDecoder{buf: data}
+	lv := md.decode(0)
+	if md.err != nil {
+		return LNil, md.err
+	}
+	if md.pos != len(data) {
+		return LNil, errors.New("garbage at end of MessagePack")
+	}
+	return lv, nil
+}
+
+type msgpackEncoder struct {
+	buf      []byte
+	visiting map[*LTable]bool
+}
+
+func (me *msgpackEncoder) writeInt(i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		me.buf = append(me.buf, byte(i))
+	case i < 0 && i >= -32:
+		me.buf = append(me.buf, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		me.buf = append(me.buf, 0xd0, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		me.buf = append(me.buf, 0xcc, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		me.buf = append(me.buf, 0xd1)
+		me.buf = binary.BigEndian.AppendUint16(me.buf, uint16(i))
+	case i >= 0 && i <= math.MaxUint16:
+		me.buf = append(me.buf, 0xcd)
+		me.buf = binary.BigEndian.AppendUint16(me.buf, uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		me.buf = append(me.buf, 0xd2)
+		me.buf = binary.BigEndian.AppendUint32(me.buf, uint32(i))
+	case i >= 0 && i <= math.MaxUint32:
+		me.buf = append(me.buf, 0xce)
+		me.buf = binary.BigEndian.AppendUint32(me.buf, uint32(i))
+	default:
+		me.buf = append(me.buf, 0xd3)
+		me.buf = binary.BigEndian.AppendUint64(me.buf, uint64(i))
+	}
+}
+
+// writeHeader writes the header of a str, an array or a map. fix is the first
+// byte of the fix format and code16 is the first byte of the 16-bit format,
+// which is followed by the 32-bit format.
+func (me *msgpackEncoder) writeHeader(n int, fix byte, fixmax int, code16 byte) {
+	switch {
+	case n <= fixmax:
+		me.buf = append(me.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		me.buf = append(me.buf, code16)
+		me.buf = binary.BigEndian.AppendUint16(me.buf, uint16(n))
+	default:
+		me.buf = append(me.buf, code16+1)
+		me.buf = binary.BigEndian.AppendUint32(me.buf, uint32(n))
+	}
+}
+
+func (me *msgpackEncoder) encode(lv LValue) error {
+	switch v := lv.(type) {
+	case *LNilType:
+		me.buf = append(me.buf, 0xc0)
+	case LBool:
+		if v {
+			me.buf = append(me.buf, 0xc3)
+		} else {
+			me.buf = append(me.buf, 0xc2)
+		}
+	case LInteger:
+		me.writeInt(int64(v))
+	case LNumber:
+		if i, ok := lnumberToInt64(v); ok {
+			me.writeInt(i)
+			break
+		}
+		me.buf = append(me.buf, 0xcb)
+		me.buf = binary.BigEndian.AppendUint64(me.buf, math.Float64bits(float64(v)))
+	case LString:
+		if len(v) <= math.MaxUint8 && len(v) > 31 {
+			me.buf = append(me.buf, 0xd9, byte(len(v)))
+		} else {
+			me.writeHeader(len(v), 0xa0, 31, 0xda)
+		}
+		me.buf = append(me.buf, v...)
+	case *LTable:
+		return me.encodeTable(v)
+	default:
+		return fmt.Errorf("can not encode a %v as MessagePack", lv.Type())
+	}
+	return nil
+}
+
+func (me *msgpackEncoder) encodeTable(tb *LTable) error {
+	if me.visiting[tb] {
+		return errors.New("can not encode a table with cycles as MessagePack")
+	}
+	me.visiting[tb] = true
+	defer delete(me.visiting, tb)
+
+	keys, values, isArray := tableEntries(tb)
+	if isArray {
+		me.writeHeader(len(values), 0x90, 15, 0xdc)
+		for _, value := range values {
+			if err := me.encode(value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	me.writeHeader(len(keys), 0x80, 15, 0xde)
+	for i, key := range keys {
+		if err := me.encode(key); err != nil {
+			return err
+		}
+		if err := me.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (md *msgpackDecoder) fail(format string, args ...interface{}) {
+	if md.err == nil {
+		md.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (md *msgpackDecoder) read(size int) []byte {
+	if md.err != nil {
+		return nil
+	}
+	if size < 0 || len(md.buf)-md.pos < size {
+		md.fail("truncated MessagePack")
+		return nil
+	}
+	b := md.buf[md.pos : md.pos+size]
+	md.pos += size
+	return b
+}
+
+// readUint reads a big endian unsigned integer of the given size.
+func (md *msgpackDecoder) readUint(size int) uint64 {
+	b := md.read(size)
+	if b == nil {
+		return 0
+	}
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (md *msgpackDecoder) decode(depth int) LValue {
+	if depth > msgpackMaxDepth {
+		md.fail("too many nested values in MessagePack")
+		return LNil
+	}
+	b := md.read(1)
+	if b == nil {
+		return LNil
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return integerValue(int64(c))
+	case c >= 0xe0:
+		return integerValue(int64(int8(c)))
+	case c&0xf0 == 0x80:
+		return md.decodeMap(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return md.decodeArray(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return LString(md.read(int(c & 0x1f)))
+	}
+	switch c := b[0]; c {
+	case 0xc0:
+		return LNil
+	case 0xc2:
+		return LFalse
+	case 0xc3:
+		return LTrue
+	case 0xc4, 0xd9:
+		return LString(md.read(int(md.readUint(1))))
+	case 0xc5, 0xda:
+		return LString(md.read(int(md.readUint(2))))
+	case 0xc6, 0xdb:
+		return LString(md.read(int(md.readUint(4))))
+	case 0xca:
+		return LNumber(math.Float32frombits(uint32(md.readUint(4))))
+	case 0xcb:
+		return LNumber(math.Float64frombits(md.readUint(8)))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v := md.readUint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return LNumber(v)
+		}
+		return integerValue(int64(v))
+	case 0xd0:
+		return integerValue(int64(int8(md.readUint(1))))
+	case 0xd1:
+		return integerValue(int64(int16(md.readUint(2))))
+	case 0xd2:
+		return integerValue(int64(int32(md.readUint(4))))
+	case 0xd3:
+		return integerValue(int64(md.readUint(8)))
+	case 0xdc:
+		return md.decodeArray(int(md.readUint(2)), depth)
+	case 0xdd:
+		return md.decodeArray(int(md.readUint(4)), depth)
+	case 0xde:
+		return md.decodeMap(int(md.readUint(2)), depth)
+	case 0xdf:
+		return md.decodeMap(int(md.readUint(4)), depth)
+	}
+	md.fail("unsupported MessagePack type 0x%02x", b[0])
+	return LNil
+}
+
+// checkCount checks that n values of at least size bytes each remain.
+func (md *msgpackDecoder) checkCount(n, size int) bool {
+	if md.err != nil {
+		return false
+	}
+	if n > (len(md.buf)-md.pos)/size {
+		md.fail("truncated MessagePack")
+		return false
+	}
+	return true
+}
+
+func (md *msgpackDecoder) decodeArray(n, depth int) LValue {
+	if !md.checkCount(n, 1) {
+		return LNil
+	}
+	tb := newLTable(n, 0)
+	for i := 1; i <= n && md.err == nil; i++ {
+		tb.RawSetInt(i, md.decode(depth+1))
+	}
+	return tb
+}
+
+func (md *msgpackDecoder) decodeMap(n, depth int) LValue {
+	if !md.checkCount(n, 2) {
+		return LNil
+	}
+	tb := newLTable(0, n)
+	for i := 0; i < n && md.err == nil; i++ {
+		key := md.decode(depth + 1)
+		value := md.decode(depth + 1)
+		if md.err != nil {
+			break
+		}
+		if key == LNil {
+			md.fail("map key is nil in MessagePack")
+			break
+		}
+		if f, ok := key.(LNumber); ok && math.IsNaN(float64(f)) {
+			md.fail("map key is NaN in MessagePack")
+			break
+		}
+		if _, ok := key.(*LTable); ok {
+			md.fail("map key is a table in MessagePack")
+			break
+		}
+		if value != LNil {
+			tb.RawSet(key, value)
+		}
+	}
+	return tb
+}
+
+// OpenMsgPack opens the msgpack module, which is not opened by OpenLibs.
+// OpenMsgPack can be given to LState.PreloadModule as a loader.
+func OpenMsgPack(L *LState) int {
+	mod := L.RegisterModule("msgpack", msgpackFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var msgpackFuncs = map[string]LGFunction{
+	"encode": msgpackEncode,
+	"decode": msgpackDecode,
+}
+
+func msgpackEncode(L *LState) int {
+	data, err := ToMsgPack(L.CheckAny(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(LString(data))
+	return 1
+}
+
+// msgpackDecode decodes the MessagePack string. It returns nil and an error
+// message if the string is not valid MessagePack.
+func msgpackDecode(L *LState) int {
+	lv, err := FromMsgPack([]byte(L.CheckString(1)))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(lv)
+	return 1
+}
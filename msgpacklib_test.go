@@ -0,0 +1,57 @@
+package lua
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMsgPackModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("msgpack", OpenMsgPack)
+	err := L.DoString(`
+	local msgpack = require("msgpack")
+	local v = {1, -1, 200, -200, 70000, 2^40, 1.5, "s", string.rep("x", 40), true, false}
+	local got = msgpack.decode(msgpack.encode(v))
+	for i = 1, #v do assert(got[i] == v[i], tostring(i)) end
+	assert(#got == #v)
+
+	local m = msgpack.decode(msgpack.encode({[1.5] = "float", [true] = "bool", name = {x = 1}}))
+	assert(m[1.5] == "float" and m[true] == "bool" and m.name.x == 1)
+
+	local v, err = msgpack.decode("\193")
+	assert(v == nil and type(err) == "string")
+	assert(not pcall(msgpack.encode, print))
+	local t = {} t[1] = t
+	assert(not pcall(msgpack.encode, t))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToMsgPack(t *testing.T) {
+	tb := newLTable(2, 0)
+	tb.RawSetInt(1, LNumber(1))
+	tb.RawSetInt(2, LString("a"))
+	data, err := ToMsgPack(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fixarray of a positive fixint and a fixstr.
+	if want := []byte{0x92, 0x01, 0xa1, 'a'}; !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+	// bin is decoded as a string.
+	v, err := FromMsgPack([]byte{0xc4, 0x02, 'h', 'i'})
+	if err != nil || v != LString("hi") {
+		t.Errorf("got %v, %v, want hi", v, err)
+	}
+	// a huge array count in a short input is rejected.
+	if _, err := FromMsgPack([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Error("truncated data must not be decoded")
+	}
+	if _, err := FromMsgPack([]byte{0xd4, 0x01, 0x00}); err == nil {
+		t.Error("extension types must not be decoded")
+	}
+}
@@ -66,7 +66,7 @@ const (
 
 	OP_CONCAT /*    A B C   R(A) := R(B).. ... ..R(C)                       */
 
-	OP_JMP /*       sBx     pc+=sBx                                 */
+	OP_JMP /*       A sBx   pc+=sBx; if (A) close all variables in the stack up to (>=) R(A - 1) */
 
 	OP_EQ /*        A B C   if ((RK(B) == RK(C)) ~= A) then pc++            */
 	OP_LT /*        A B C   if ((RK(B) <  RK(C)) ~= A) then pc++            */
@@ -92,6 +92,19 @@ const (
 
 	OP_VARARG /*     A B     R(A) R(A+1) ... R(A+B-1) = vararg            */
 
+	OP_TBC /*        A       mark R(A) as to-be-closed                     */
+
+	OP_IDIV /*      A B C   R(A) := RK(B) // RK(C)                      */
+	OP_BAND /*      A B C   R(A) := RK(B) & RK(C)                       */
+	OP_BOR  /*      A B C   R(A) := RK(B) | RK(C)                       */
+	OP_BXOR /*      A B C   R(A) := RK(B) ~ RK(C)                       */
+	OP_SHL  /*      A B C   R(A) := RK(B) << RK(C)                      */
+	OP_SHR  /*      A B C   R(A) := RK(B) >> RK(C)                      */
+	OP_BNOT /*      A B     R(A) := ~R(B)                               */
+
+	OP_GETTABUP /*  A B C   R(A) := UpValue[B][RK(C)]                   */
+	OP_SETTABUP /*  A B C   UpValue[A][RK(B)] := RK(C)                  */
+
 	OP_NOP /* NOP */
 )
 const opCodeMax = OP_NOP
@@ -161,6 +174,16 @@ var opProps = []opProp{
 	opProp{"CLOSE", false, false, opArgModeN, opArgModeN, opTypeABC},
 	opProp{"CLOSURE", false, true, opArgModeU, opArgModeN, opTypeABx},
 	opProp{"VARARG", false, true, opArgModeU, opArgModeN, opTypeABC},
+	opProp{"TBC", false, false, opArgModeN, opArgModeN, opTypeABC},
+	opProp{"IDIV", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BAND", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BXOR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"SHL", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"SHR", false, true, opArgModeK, opArgModeK, opTypeABC},
+	opProp{"BNOT", false, true, opArgModeR, opArgModeN, opTypeABC},
+	opProp{"GETTABUP", false, true, opArgModeU, opArgModeK, opTypeABC},
+	opProp{"SETTABUP", false, false, opArgModeK, opArgModeK, opTypeABC},
 	opProp{"NOP", false, false, opArgModeR, opArgModeN, opTypeASbx},
 }
 
@@ -322,6 +345,9 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf("; R(%v) := R(%v).. ... ..R(%v)", arga, argb, argc)
 	case OP_JMP:
 		buf += fmt.Sprintf("; pc+=%v", argsbx)
+		if arga != 0 {
+			buf += fmt.Sprintf("; close all variables in the stack up to (>=) R(%v)", arga-1)
+		}
 	case OP_EQ:
 		buf += fmt.Sprintf("; if ((RK(%v) == RK(%v)) ~= %v) then pc++", argb, argc, arga)
 	case OP_LT:
@@ -352,6 +378,26 @@ func opToString(inst uint32) string {
 		buf += fmt.Sprintf("; R(%v) := closure(KPROTO[%v] R(%v) ... R(%v+n))", arga, argbx, arga, arga)
 	case OP_VARARG:
 		buf += fmt.Sprintf(";  R(%v) R(%v+1) ... R(%v+%v-1) = vararg", arga, arga, arga, argb)
+	case OP_TBC:
+		buf += fmt.Sprintf("; mark R(%v) as to-be-closed", arga)
+	case OP_IDIV:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) // RK(%v)", arga, argb, argc)
+	case OP_BAND:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) & RK(%v)", arga, argb, argc)
+	case OP_BOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) | RK(%v)", arga, argb, argc)
+	case OP_BXOR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) ~ RK(%v)", arga, argb, argc)
+	case OP_SHL:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) << RK(%v)", arga, argb, argc)
+	case OP_SHR:
+		buf += fmt.Sprintf("; R(%v) := RK(%v) >> RK(%v)", arga, argb, argc)
+	case OP_BNOT:
+		buf += fmt.Sprintf("; R(%v) := ~R(%v)", arga, argb)
+	case OP_GETTABUP:
+		buf += fmt.Sprintf("; R(%v) := UpValue[%v][RK(%v)]", arga, argb, argc)
+	case OP_SETTABUP:
+		buf += fmt.Sprintf("; UpValue[%v][RK(%v)] := RK(%v)", arga, argb, argc)
 	case OP_NOP:
 		/* nothing to do */
 	}
@@ -0,0 +1,246 @@
+package lua
+
+// optimizeCode rewrites the code of the compiled function without changing
+// what it does: jumps to unconditional jumps are redirected to the final
+// targets, adjacent LOADNILs are merged, and NOPs, moves of registers to
+// themselves and unreachable instructions are removed. The debug information
+// of the function is updated for the new code.
+func optimizeCode(proto *FunctionProto) {
+	code := proto.Code
+	if len(code) == 0 {
+		return
+	}
+	threadJumps(code)
+
+	reachable, pinned := analyzeFlow(proto)
+	targets := jumpTargets(code, reachable)
+	removed := make([]bool, len(code))
+	for pc, inst := range code {
+		switch {
+		case pinned[pc]:
+		case !reachable[pc]:
+			removed[pc] = true
+		case opGetOpCode(inst) == OP_NOP:
+			removed[pc] = true
+		case opGetOpCode(inst) == OP_MOVE && opGetArgA(inst) == opGetArgB(inst):
+			removed[pc] = true
+		}
+	}
+	mergeLoadNils(code, removed, pinned, targets)
+	compactCode(proto, removed)
+}
+
+// jumpTarget returns the pc of the target of the instruction that jumps
+// relatively.
+func jumpTarget(pc int, inst uint32) int {
+	return pc + 1 + opGetArgSbx(inst)
+}
+
+// threadJumps redirects jumps whose targets are jumps that do not close
+// variables to the targets of the latter.
+func threadJumps(code []uint32) {
+	for pc, inst := range code {
+		if opGetOpCode(inst) != OP_JMP {
+			continue
+		}
+		target := jumpTarget(pc, inst)
+		for n := 0; n < len(code) && target >= 0 && target < len(code); n++ {
+			next := code[target]
+			if opGetOpCode(next) != OP_JMP || opGetArgA(next) != 0 || jumpTarget(target, next) == target {
+				break
+			}
+			target = jumpTarget(target, next)
+		}
+		if target >= 0 && target <= len(code) {
+			code[pc] = opCreateASbx(OP_JMP, opGetArgA(inst), target-pc-1)
+		}
+	}
+}
+
+// analyzeFlow returns the instructions that can be run, and the instructions
+// that can not be removed because the VM uses their positions: instructions
+// skipped by conditional instructions and data following CLOSURE and SETLIST.
+// The final RETURN is pinned as well, because functions must end with a
+// RETURN even if it can not be reached, e.g. after an infinite loop(see
+// verifyProto).
+func analyzeFlow(proto *FunctionProto) (reachable, pinned []bool) {
+	code := proto.Code
+	reachable = make([]bool, len(code))
+	pinned = make([]bool, len(code))
+	if opGetOpCode(code[len(code)-1]) == OP_RETURN {
+		pinned[len(code)-1] = true
+	}
+	stack := []int{0}
+	visit := func(pc int) {
+		if pc >= 0 && pc < len(code) && !reachable[pc] {
+			reachable[pc] = true
+			stack = append(stack, pc)
+		}
+	}
+	reachable[0] = true
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		inst := code[pc]
+		switch opGetOpCode(inst) {
+		case OP_JMP:
+			visit(jumpTarget(pc, inst))
+		case OP_RETURN:
+		case OP_FORPREP:
+			// the loop is entered directly or skipped with integers.
+			visit(pc + 1)
+			visit(jumpTarget(pc, inst))
+			visit(jumpTarget(pc, inst) + 1)
+		case OP_FORLOOP:
+			visit(pc + 1)
+			visit(jumpTarget(pc, inst))
+		case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET, OP_TFORLOOP:
+			pinnedNext(pinned, pc)
+			visit(pc + 1)
+			visit(pc + 2)
+		case OP_LOADBOOL:
+			if opGetArgC(inst) != 0 {
+				pinnedNext(pinned, pc)
+				visit(pc + 2)
+			} else {
+				visit(pc + 1)
+			}
+		case OP_CLOSURE:
+			n := int(proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
+			for i := pc + 1; i <= pc+n && i < len(code); i++ {
+				reachable[i] = true
+				pinned[i] = true
+			}
+			visit(pc + 1 + n)
+		case OP_SETLIST:
+			if opGetArgC(inst) == 0 {
+				if pc+1 < len(code) {
+					reachable[pc+1] = true
+					pinned[pc+1] = true
+				}
+				visit(pc + 2)
+			} else {
+				visit(pc + 1)
+			}
+		default:
+			visit(pc + 1)
+		}
+	}
+	return reachable, pinned
+}
+
+func pinnedNext(pinned []bool, pc int) {
+	if pc+1 < len(pinned) {
+		pinned[pc+1] = true
+	}
+}
+
+// jumpTargets returns the instructions that reachable instructions jump to,
+// including the instructions after the skipped ones.
+func jumpTargets(code []uint32, reachable []bool) []bool {
+	targets := make([]bool, len(code)+2)
+	for pc, inst := range code {
+		if !reachable[pc] {
+			continue
+		}
+		switch opGetOpCode(inst) {
+		case OP_JMP, OP_FORLOOP:
+			targets[jumpTarget(pc, inst)] = true
+		case OP_FORPREP:
+			targets[jumpTarget(pc, inst)] = true
+			targets[jumpTarget(pc, inst)+1] = true
+		case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET, OP_TFORLOOP, OP_LOADBOOL:
+			targets[pc+2] = true
+		}
+	}
+	return targets
+}
+
+// mergeLoadNils merges LOADNILs of adjacent or overlapping registers that run
+// one after another.
+func mergeLoadNils(code []uint32, removed, pinned, targets []bool) {
+	last := -1
+	// jumps to removed instructions land on the next instruction.
+	target := false
+	for pc, inst := range code {
+		target = target || targets[pc]
+		if removed[pc] {
+			continue
+		}
+		istarget := target
+		target = false
+		if opGetOpCode(inst) != OP_LOADNIL {
+			last = -1
+			continue
+		}
+		if last >= 0 && !pinned[pc] && !istarget {
+			prev := code[last]
+			a1, b1 := opGetArgA(prev), opGetArgB(prev)
+			a2, b2 := opGetArgA(inst), opGetArgB(inst)
+			if a2 <= b1+1 && a1 <= b2+1 {
+				code[last] = opCreateABC(OP_LOADNIL, min(a1, a2), max(b1, b2), 0)
+				removed[pc] = true
+				continue
+			}
+		}
+		last = pc
+	}
+}
+
+// compactCode removes the instructions and updates the jumps and the debug
+// information of the function.
+func compactCode(proto *FunctionProto, removed []bool) {
+	code := proto.Code
+	// newpcs[pc] is the new pc of the instruction, or of the next instruction
+	// that is not removed.
+	newpcs := make([]int, len(code)+1)
+	n := 0
+	for pc := range code {
+		newpcs[pc] = n
+		if !removed[pc] {
+			n++
+		}
+	}
+	newpcs[len(code)] = n
+	if n == len(code) {
+		return
+	}
+	for pc := len(code) - 1; pc >= 0; pc-- {
+		if removed[pc] {
+			newpcs[pc] = newpcs[pc+1]
+		}
+	}
+
+	newcode := make([]uint32, 0, n)
+	positions := make([]int, 0, n)
+	columns := make([]int, 0, n)
+	for pc, inst := range code {
+		if removed[pc] {
+			continue
+		}
+		switch opGetOpCode(inst) {
+		case OP_JMP, OP_FORPREP, OP_FORLOOP:
+			target := newpcs[jumpTarget(pc, inst)]
+			inst = opCreateASbx(opGetOpCode(inst), opGetArgA(inst), target-newpcs[pc]-1)
+		}
+		newcode = append(newcode, inst)
+		if pc < len(proto.DbgSourcePositions) {
+			positions = append(positions, proto.DbgSourcePositions[pc])
+		}
+		if pc < len(proto.DbgSourceColumns) {
+			columns = append(columns, proto.DbgSourceColumns[pc])
+		}
+	}
+	proto.Code = newcode
+	proto.DbgSourcePositions = positions
+	proto.DbgSourceColumns = columns
+	for _, local := range proto.DbgLocals {
+		local.StartPc = newpcs[min(max(local.StartPc, 0), len(code))]
+		if local.EndPc >= 0 {
+			local.EndPc = newpcs[min(local.EndPc, len(code))]
+		}
+	}
+	for i := range proto.DbgCalls {
+		proto.DbgCalls[i].Pc = newpcs[min(max(proto.DbgCalls[i].Pc, 0), len(code))]
+	}
+}
@@ -0,0 +1,90 @@
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOptimizeCode(t *testing.T) {
+	local := &DbgLocalInfo{Name: "x", StartPc: 4, EndPc: 6}
+	proto := &FunctionProto{
+		Code: []uint32{
+			opCreateASbx(OP_JMP, 0, 1),
+			opCreateABC(OP_RETURN, 0, 1, 0),
+			opCreateASbx(OP_JMP, 0, 0),
+			opCreateABC(OP_LOADNIL, 0, 0, 0),
+			opCreateABC(OP_LOADNIL, 1, 1, 0),
+			opCreateABC(OP_MOVE, 2, 2, 0),
+			opCreateABC(OP_RETURN, 0, 1, 0),
+		},
+		DbgSourcePositions: []int{1, 2, 3, 4, 5, 6, 7},
+		DbgLocals:          []*DbgLocalInfo{local},
+	}
+	optimizeCode(proto)
+	// the jumps are threaded, the unreachable RETURN and JMP and the MOVE are
+	// removed, and the LOADNILs are merged.
+	want := []uint32{
+		opCreateASbx(OP_JMP, 0, 0),
+		opCreateABC(OP_LOADNIL, 0, 1, 0),
+		opCreateABC(OP_RETURN, 0, 1, 0),
+	}
+	if !reflect.DeepEqual(proto.Code, want) {
+		t.Errorf("got\n%v", Disassemble(proto))
+	}
+	if !reflect.DeepEqual(proto.DbgSourcePositions, []int{1, 4, 7}) {
+		t.Errorf("got the lines %v", proto.DbgSourcePositions)
+	}
+	if local.StartPc != 2 || local.EndPc != 2 {
+		t.Errorf("got the range %v-%v", local.StartPc, local.EndPc)
+	}
+}
+
+func TestOptimizeCodeScripts(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function f(n)
+	  local a, b
+	  local c
+	  while true do
+	    if n > 10 then break end
+	    n = n + 1
+	  end
+	  for i = 1, 3 do
+	    if i == 2 then goto continue end
+	    n = n + i
+	    ::continue::
+	  end
+	  return n, a, b, c
+	end
+	local n, a, b, c = f(0)
+	assert(n == 15 and a == nil and b == nil and c == nil, tostring(n))
+	assert(f(20) == 24)
+
+	local function g(x)
+	  return x and 1 or 2
+	  -- unreachable.
+	end
+	assert(g(true) == 1 and g(false) == 2)
+
+	-- the lines of errors follow the rewritten code.
+	local ok, err = pcall(function()
+	  local x
+	  if x then return end
+	  return x.y
+	end)
+	assert(not ok and err:find(":30:"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn, err2 := L.LoadString("local a\nlocal b\nreturn a, b")
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if n := strings.Count(Disassemble(fn.Proto), "LOADNIL"); n != 1 {
+		t.Errorf("got %v LOADNILs, want 1", n)
+	}
+}
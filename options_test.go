@@ -0,0 +1,81 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+// a script that needs many registers.
+const manyValuesScript = `
+local t = {}
+for i = 1, 2000 do t[i] = i end
+return #{unpack(t)}
+`
+
+func TestOptionsRegistryMaxSize(t *testing.T) {
+	L := NewState(Options{RegistrySize: 256, RegistryMaxSize: 4096})
+	defer L.Close()
+	if err := L.DoString(manyValuesScript); err != nil {
+		t.Fatal(err)
+	}
+	if got := L.Get(-1); got != LNumber(2000) {
+		t.Errorf("got %v, want 2000", got)
+	}
+}
+
+func TestOptionsRegistryOverflow(t *testing.T) {
+	L := NewState(Options{RegistrySize: 256})
+	defer L.Close()
+	if err := L.DoString(manyValuesScript); err == nil || !strings.Contains(err.Error(), "registry overflow") {
+		t.Errorf("got %v, want a registry overflow", err)
+	}
+}
+
+func TestOptionsSkipOpenLibs(t *testing.T) {
+	L := NewState(Options{SkipOpenLibs: true})
+	defer L.Close()
+	if L.GetGlobal("string") != LNil || L.GetGlobal("print") != LNil {
+		t.Error("the standard libraries must not be opened")
+	}
+	L.OpenLibs()
+	if L.GetGlobal("string") == LNil {
+		t.Error("OpenLibs must open the standard libraries")
+	}
+}
+
+func TestOptionsIncludeGoStackTrace(t *testing.T) {
+	L := NewState(Options{IncludeGoStackTrace: true})
+	defer L.Close()
+	err := L.DoString(`local x = nil + 1`)
+	if err == nil || !strings.Contains(err.Error(), "go stack traceback:") {
+		t.Errorf("got %v, want a Go stack trace", err)
+	}
+}
+
+func TestCallStackGrowth(t *testing.T) {
+	L := NewState(Options{CallStackSize: 10000, RegistryMaxSize: 1024 * 64})
+	defer L.Close()
+	err := L.DoString(`
+	local function depth(n) if n == 0 then return 0 end return 1 + depth(n - 1) end
+	assert(depth(5000) == 5000)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCallStackOverflow(t *testing.T) {
+	L := NewState(Options{CallStackSize: 200, RegistryMaxSize: 1024 * 64})
+	defer L.Close()
+	err := L.DoString(`
+	local function depth(n) return 1 + depth(n + 1) end
+	local ok, err = pcall(depth, 0)
+	assert(not ok and err:find("stack overflow"), err)
+	-- the state can be used after the overflow.
+	local function f(n) if n == 0 then return 0 end return 1 + f(n - 1) end
+	assert(f(100) == 100)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,8 +2,11 @@ package lua
 
 import (
 	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -13,20 +16,57 @@ func init() {
 	startedAt = time.Now()
 }
 
-func getIntField(L *LState, tb *LTable, key string, v int) int {
-	ret := tb.RawGetH(LString(key))
-	if ln, ok := ret.(LNumber); ok {
-		return int(ln)
+// deterministicEpoch is the time of the clock of states in deterministic mode
+// without Options.Clock.
+var deterministicEpoch = time.Unix(0, 0)
+
+// now returns the current time according to the clock of the state.
+func (ls *LState) now() time.Time {
+	if clock := ls.G.options.Clock; clock != nil {
+		return clock()
 	}
-	return v
+	if ls.G.options.Deterministic {
+		return deterministicEpoch
+	}
+	return time.Now()
 }
 
-func getBoolField(L *LState, tb *LTable, key string, v bool) bool {
+// getDateField returns the integer field of the date table. d < 0 means the
+// field is required.
+func getDateField(L *LState, tb *LTable, key string, d int) int {
 	ret := tb.RawGetH(LString(key))
-	if lb, ok := ret.(LBool); ok {
-		return bool(lb)
+	if ret == LNil {
+		if d < 0 {
+			L.RaiseError("field '%s' missing in date table", key)
+		}
+		return d
+	}
+	if str, ok := ret.(LString); ok {
+		if v, err := parseNumberValue(string(str)); err == nil {
+			ret = v
+		}
+	}
+	i, ok := toIntegerValue(ret)
+	if !ok {
+		L.RaiseError("field '%s' is not an integer", key)
 	}
-	return v
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		L.RaiseError("field '%s' is out-of-bound", key)
+	}
+	return int(i)
+}
+
+// setDateFields sets the fields of the date table like os.date("*t").
+func setDateFields(tb *LTable, t time.Time) {
+	tb.RawSetH(LString("year"), integerValue(int64(t.Year())))
+	tb.RawSetH(LString("month"), integerValue(int64(t.Month())))
+	tb.RawSetH(LString("day"), integerValue(int64(t.Day())))
+	tb.RawSetH(LString("hour"), integerValue(int64(t.Hour())))
+	tb.RawSetH(LString("min"), integerValue(int64(t.Minute())))
+	tb.RawSetH(LString("sec"), integerValue(int64(t.Second())))
+	tb.RawSetH(LString("wday"), integerValue(int64(t.Weekday())+1))
+	tb.RawSetH(LString("yday"), integerValue(int64(t.YearDay())))
+	tb.RawSetH(LString("isdst"), LBool(t.IsDST()))
 }
 
 func osOpen(L *LState) {
@@ -49,7 +89,7 @@ var osFuncs = map[string]LGFunction{
 }
 
 func osClock(L *LState) int {
-	L.Push(LNumber(float64(time.Now().Sub(startedAt)) / float64(time.Second)))
+	L.Push(LNumber(float64(L.now().Sub(L.G.startedAt)) / float64(time.Second)))
 	return 1
 }
 
@@ -58,70 +98,118 @@ func osDiffTime(L *LState) int {
 	return 1
 }
 
-func osExecute(L *LState) int {
-	var procAttr os.ProcAttr
-	procAttr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
-	cmd := "/bin/sh"
-	args := []string{"-c"}
+// shellCommand returns the shell and the arguments that run the command.
+func shellCommand() (string, []string) {
 	if LuaOS == "windows" {
-		cmd = "C:\\Windows\\system32\\cmd.exe"
-		args = []string{"/c"}
-	} else {
-		envsh := os.Getenv("SHELL")
-		if len(envsh) > 0 {
-			cmd = envsh
-		}
+		return "C:\\Windows\\system32\\cmd.exe", []string{"/c"}
 	}
-	args = append(args, L.CheckString(1))
-	process, err := os.StartProcess(cmd, args, &procAttr)
-	if err != nil {
-		L.Push(LNumber(1))
-		return 1
+	if envsh := os.Getenv("SHELL"); len(envsh) > 0 {
+		return envsh, []string{"-c"}
 	}
+	return "/bin/sh", []string{"-c"}
+}
 
-	_, err = process.Wait()
-	if err != nil {
-		L.Push(LNumber(1))
+// checkCommand returns an error if CommandPolicy of the state denies the
+// command.
+func (ls *LState) checkCommand(cmd string) error {
+	if policy := ls.G.options.CommandPolicy; policy != nil {
+		return policy(cmd)
+	}
+	return nil
+}
+
+// pushExitStatus pushes the results of os.execute and file:close of io.popen
+// like Lua 5.2: true or nil, "exit" or "signal", and the exit status or the
+// signal number.
+func pushExitStatus(L *LState, ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(interface {
+		Signaled() bool
+		Signal() syscall.Signal
+	}); ok && ws.Signaled() {
+		L.Push(LNil)
+		L.Push(LString("signal"))
+		L.Push(integerValue(int64(ws.Signal())))
+		return 3
+	}
+	if ps.Success() {
+		L.Push(LTrue)
+	} else {
+		L.Push(LNil)
+	}
+	L.Push(LString("exit"))
+	L.Push(integerValue(int64(ps.ExitCode())))
+	return 3
+}
+
+// osExecute runs the command with the shell and returns the exit status like
+// Lua 5.2. Without a command, it returns whether the shell is available.
+func osExecute(L *LState) int {
+	cmd, args := shellCommand()
+	if L.Get(1) == LNil {
+		_, err := os.Stat(cmd)
+		L.Push(LBool(err == nil))
 		return 1
 	}
-	L.Push(LNumber(0))
-	return 0
+	command := L.CheckString(1)
+	if err := L.checkCommand(command); err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	c := exec.Command(cmd, append(args, command)...)
+	c.Stdout, c.Stderr = L.G.stdoutWriter(), L.G.stderrWriter()
+	if stdin := L.G.stdinFile(); stdin != nil {
+		c.Stdin = stdin
+	}
+	if err := c.Run(); err != nil && c.ProcessState == nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	return pushExitStatus(L, c.ProcessState)
 }
 
+// osExit exits the process with the status, which is a number or a boolean
+// (true means success). The state is closed before exiting if close is true.
 func osExit(L *LState) int {
-	os.Exit(L.OptInt(1, 0))
-	return 1
+	code := 0
+	switch v := L.Get(1).(type) {
+	case LBool:
+		if !v {
+			code = 1
+		}
+	case *LNilType:
+	default:
+		code = L.CheckInt(1)
+	}
+	if L.OptBool(2, false) {
+		L.G.MainThread.Close()
+	}
+	os.Exit(code)
+	return 0
 }
 
 func osDate(L *LState) int {
-	t := time.Now()
-	cfmt := "%c"
-	if L.GetTop() >= 1 {
-		cfmt = L.CheckString(1)
-		if strings.HasPrefix(cfmt, "!") {
-			t = time.Now().UTC()
-			cfmt = strings.TrimLeft(cfmt, "!")
-		}
-		if L.GetTop() >= 2 {
-			t = time.Unix(L.CheckInt64(2), 0)
-		}
-		if strings.HasPrefix(cfmt, "*t") {
-			ret := L.NewTable()
-			ret.RawSetH(LString("year"), LNumber(t.Year()))
-			ret.RawSetH(LString("month"), LNumber(t.Month()))
-			ret.RawSetH(LString("day"), LNumber(t.Day()))
-			ret.RawSetH(LString("hour"), LNumber(t.Hour()))
-			ret.RawSetH(LString("min"), LNumber(t.Minute()))
-			ret.RawSetH(LString("sec"), LNumber(t.Second()))
-			ret.RawSetH(LString("wday"), LNumber(t.Weekday()))
-			// TODO yday & dst
-			ret.RawSetH(LString("yday"), LNumber(0))
-			ret.RawSetH(LString("isdst"), LFalse)
-			L.Push(ret)
-			return 1
-		}
+	cfmt := L.OptString(1, "%c")
+	t := L.now()
+	if L.Get(2) != LNil {
+		t = time.Unix(checkIntegerValue(L, 2), 0)
+	}
+	if strings.HasPrefix(cfmt, "!") {
+		t = t.UTC()
+		cfmt = cfmt[1:]
 	}
-	L.Push(LString(strftime(t, cfmt)))
+	if strings.HasPrefix(cfmt, "*t") {
+		ret := L.CreateTable(0, 9)
+		setDateFields(ret, t)
+		L.Push(ret)
+		return 1
+	}
+	s, err := strftime(t, cfmt)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	L.Push(LString(s))
 	return 1
 }
 
@@ -136,7 +224,7 @@ func osGetEnv(L *LState) int {
 }
 
 func osRemove(L *LState) int {
-	err := os.Remove(L.CheckString(1))
+	err := L.fileSystem().Remove(L.CheckString(1))
 	if err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
@@ -148,7 +236,7 @@ func osRemove(L *LState) int {
 }
 
 func osRename(L *LState) int {
-	err := os.Rename(L.CheckString(1), L.CheckString(2))
+	err := L.fileSystem().Rename(L.CheckString(1), L.CheckString(2))
 	if err != nil {
 		L.Push(LNil)
 		L.Push(LString(err.Error()))
@@ -177,25 +265,33 @@ func osSetEnv(L *LState) int {
 	}
 }
 
+// osTime returns the current time, or the time of the date table. Fields out of
+// their ranges are normalized, and the table is updated with the normalized
+// fields like Lua 5.3.
 func osTime(L *LState) int {
-	if L.GetTop() == 0 {
-		L.Push(LNumber(time.Now().Unix()))
-	} else {
-		tbl := L.CheckTable(1)
-		sec := getIntField(L, tbl, "sec", 0)
-		min := getIntField(L, tbl, "min", 0)
-		hour := getIntField(L, tbl, "hour", 12)
-		day := getIntField(L, tbl, "day", -1)
-		month := getIntField(L, tbl, "month", -1)
-		year := getIntField(L, tbl, "year", -1)
-		isdst := getBoolField(L, tbl, "isdst", false)
-		t := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
-		// TODO dst
-		if false {
-			print(isdst)
+	if L.Get(1) == LNil {
+		L.Push(integerValue(L.now().Unix()))
+		return 1
+	}
+	tbl := L.CheckTable(1)
+	year := getDateField(L, tbl, "year", -1)
+	month := getDateField(L, tbl, "month", -1)
+	day := getDateField(L, tbl, "day", -1)
+	hour := getDateField(L, tbl, "hour", 12)
+	min := getDateField(L, tbl, "min", 0)
+	sec := getDateField(L, tbl, "sec", 0)
+	t := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
+	// isdst tells whether the fields are in daylight saving time like tm_isdst
+	// of mktime.
+	if isdst, ok := tbl.RawGetH(LString("isdst")).(LBool); ok && bool(isdst) != t.IsDST() {
+		if isdst {
+			t = t.Add(-time.Hour)
+		} else {
+			t = t.Add(time.Hour)
 		}
-		L.Push(LNumber(t.Unix()))
 	}
+	setDateFields(tbl, t)
+	L.Push(integerValue(t.Unix()))
 	return 1
 }
 
@@ -0,0 +1,119 @@
+package lua
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+func TestOSDate(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	// 2024-01-02 15:04:05 UTC, a Tuesday.
+	err := L.DoString(`
+	local t = 1704207845
+	local function check(f, want)
+	  local got = os.date("!" .. f, t)
+	  assert(got == want, f .. ": " .. got)
+	end
+	check("%Y-%m-%d %H:%M:%S", "2024-01-02 15:04:05")
+	check("%a %A %b %B", "Tue Tuesday Jan January")
+	check("%c", "Tue Jan  2 15:04:05 2024")
+	check("%x %X %D %T %R %F", "01/02/24 15:04:05 01/02/24 15:04:05 15:04 2024-01-02")
+	check("%e|%j|%u|%w|%y|%C|%I|%p", " 2|002|2|2|24|20|03|PM")
+	check("%g %G %V %U %W", "24 2024 01 00 01")
+	check("%h %n%t%%", "Jan \n\t%")
+	check("%Ec %EY %Od %OH", "Tue Jan  2 15:04:05 2024 2024 02 15")
+	check("%z %Z", "+0000 UTC")
+	assert(not pcall(os.date, "%Q", t), "invalid conversion specifier")
+	assert(not pcall(os.date, "%", t), "invalid conversion specifier")
+	assert(not pcall(os.date, "%Ez", t), "invalid modifier")
+
+	local d = os.date("!*t", t)
+	assert(d.year == 2024 and d.month == 1 and d.day == 2 and d.hour == 15 and d.min == 4 and d.sec == 5)
+	assert(d.wday == 3 and d.yday == 2 and d.isdst == false)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOSTime(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(math.type(os.time()) == "integer")
+	local t = os.time({year = 2024, month = 1, day = 2, hour = 15, min = 4, sec = 5})
+	local d = os.date("*t", t)
+	assert(d.year == 2024 and d.month == 1 and d.day == 2 and d.hour == 15)
+
+	-- out-of-range fields are normalized and the table is updated.
+	local date = {year = 2024, month = 1, day = 32, hour = 0, min = 0, sec = -1}
+	os.time(date)
+	assert(date.month == 1 and date.day == 31 and date.hour == 23 and date.min == 59 and date.sec == 59)
+	assert(date.yday == 31 and date.wday == 4)
+
+	-- hour defaults to 12, and fields can be strings.
+	date = {year = "2024", month = 2, day = 29}
+	os.time(date)
+	assert(date.hour == 12 and date.month == 2 and date.day == 29)
+
+	local ok, err = pcall(os.time, {year = 2024, month = 1})
+	assert(not ok and err:find("field 'day' missing in date table"), err)
+	ok, err = pcall(os.time, {year = 2024, month = 1, day = 1.5})
+	assert(not ok and err:find("field 'day' is not an integer"), err)
+	ok, err = pcall(os.time, {year = 2^40, month = 1, day = 1})
+	assert(not ok and err:find("field 'year' is out%-of%-bound"), err)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOSExecute(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX shell")
+	}
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(os.execute() == true)
+	local ok, what, code = os.execute("exit 0")
+	assert(ok == true and what == "exit" and code == 0)
+	ok, what, code = os.execute("exit 3")
+	assert(ok == nil and what == "exit" and code == 3, tostring(code))
+	ok, what, code = os.execute("kill -9 $$")
+	assert(ok == nil and what == "signal" and code == 9, tostring(code))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOSExit(t *testing.T) {
+	if script := os.Getenv("GLUA_TEST_EXIT"); script != "" {
+		L := NewState()
+		L.DoString(script)
+		return
+	}
+	for script, want := range map[string]int{
+		`os.exit()`:        0,
+		`os.exit(true)`:    0,
+		`os.exit(false)`:   1,
+		`os.exit(3, true)`: 3,
+	} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOSExit$")
+		cmd.Env = append(os.Environ(), "GLUA_TEST_EXIT="+script)
+		err := cmd.Run()
+		code := 0
+		if ee, ok := err.(*exec.ExitError); ok {
+			code = ee.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("%v: got %v, want %v", script, code, want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package lua
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+const (
+	packMaxIntSize  = 16
+	packNativeAlign = 8
+	packSizeT       = 8
+)
+
+type packOption int
+
+const (
+	packInt packOption = iota
+	packUint
+	packFloat
+	packChar
+	packString
+	packZString
+	packPadding
+	packPaddingAlign
+	packNop
+)
+
+var packNativeLittle = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// packState holds the state of parsing a format string of string.pack,
+// string.unpack and string.packsize.
+type packState struct {
+	L        *LState
+	format   string
+	pos      int
+	little   bool
+	maxAlign int
+}
+
+func newPackState(L *LState, format string) *packState {
+	return &packState{L: L, format: format, little: packNativeLittle, maxAlign: 1}
+}
+
+func (ps *packState) more() bool {
+	return ps.pos < len(ps.format)
+}
+
+func (ps *packState) isDigit() bool {
+	return ps.pos < len(ps.format) && '0' <= ps.format[ps.pos] && ps.format[ps.pos] <= '9'
+}
+
+func (ps *packState) readNumber(d int) int {
+	if !ps.isDigit() {
+		return d
+	}
+	n := 0
+	for ps.isDigit() && n <= (math.MaxInt32-9)/10 {
+		n = n*10 + int(ps.format[ps.pos]-'0')
+		ps.pos++
+	}
+	return n
+}
+
+func (ps *packState) readSize(d int) int {
+	size := ps.readNumber(d)
+	if size > packMaxIntSize || size <= 0 {
+		ps.L.RaiseError("integral size (%v) out of limits [1,%v]", size, packMaxIntSize)
+	}
+	return size
+}
+
+// option reads the next option of the format and returns its kind and size.
+func (ps *packState) option() (packOption, int) {
+	opt := ps.format[ps.pos]
+	ps.pos++
+	switch opt {
+	case 'b':
+		return packInt, 1
+	case 'B':
+		return packUint, 1
+	case 'h':
+		return packInt, 2
+	case 'H':
+		return packUint, 2
+	case 'l', 'j':
+		return packInt, 8
+	case 'L', 'J', 'T':
+		return packUint, 8
+	case 'f':
+		return packFloat, 4
+	case 'd', 'n':
+		return packFloat, 8
+	case 'i':
+		return packInt, ps.readSize(4)
+	case 'I':
+		return packUint, ps.readSize(4)
+	case 's':
+		return packString, ps.readSize(packSizeT)
+	case 'c':
+		size := ps.readNumber(-1)
+		if size == -1 {
+			ps.L.RaiseError("missing size for format option 'c'")
+		}
+		return packChar, size
+	case 'z':
+		return packZString, 0
+	case 'x':
+		return packPadding, 1
+	case 'X':
+		return packPaddingAlign, 0
+	case ' ':
+	case '<':
+		ps.little = true
+	case '>':
+		ps.little = false
+	case '=':
+		ps.little = packNativeLittle
+	case '!':
+		ps.maxAlign = ps.readSize(packNativeAlign)
+	default:
+		ps.L.RaiseError("invalid format option '%c'", opt)
+	}
+	return packNop, 0
+}
+
+// details reads the next option and returns its kind, size and the number of
+// padding bytes to align the option at the given offset.
+func (ps *packState) details(total int) (packOption, int, int) {
+	opt, size := ps.option()
+	align := size
+	if opt == packPaddingAlign {
+		if !ps.more() {
+			ps.L.ArgError(1, "invalid next option for option 'X'")
+		}
+		var nopt packOption
+		nopt, align = ps.option()
+		if nopt == packChar || align == 0 {
+			ps.L.ArgError(1, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == packChar {
+		return opt, size, 0
+	}
+	if align > ps.maxAlign {
+		align = ps.maxAlign
+	}
+	if align&(align-1) != 0 {
+		ps.L.ArgError(1, "format asks for alignment not power of 2")
+	}
+	return opt, size, (align - (total & (align - 1))) & (align - 1)
+}
+
+func packInteger(buf []byte, v uint64, little bool, size int, neg bool) []byte {
+	b := make([]byte, size)
+	for i := 0; i < size; i++ {
+		var c byte
+		switch {
+		case i < 8:
+			c = byte(v >> (8 * uint(i)))
+		case neg:
+			c = 0xff
+		}
+		if little {
+			b[i] = c
+		} else {
+			b[size-1-i] = c
+		}
+	}
+	return append(buf, b...)
+}
+
+func unpackInteger(L *LState, data string, little bool, size int, signed bool) int64 {
+	var v uint64
+	limit := size
+	if limit > 8 {
+		limit = 8
+	}
+	at := func(i int) byte {
+		if little {
+			return data[i]
+		}
+		return data[size-1-i]
+	}
+	for i := limit - 1; i >= 0; i-- {
+		v = v<<8 | uint64(at(i))
+	}
+	if size < 8 {
+		if signed {
+			mask := uint64(1) << (uint(size)*8 - 1)
+			v = (v ^ mask) - mask
+		}
+	} else if size > 8 {
+		var ext byte
+		if signed && int64(v) < 0 {
+			ext = 0xff
+		}
+		for i := limit; i < size; i++ {
+			if at(i) != ext {
+				L.RaiseError("%v-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(v)
+}
+
+func strPack(L *LState) int {
+	ps := newPackState(L, L.CheckString(1))
+	buf := []byte{}
+	arg := 1
+	for ps.more() {
+		opt, size, ntoalign := ps.details(len(buf))
+		buf = append(buf, make([]byte, ntoalign)...)
+		switch opt {
+		case packInt:
+			arg++
+			v := checkIntegerValue(L, arg)
+			if size < 8 {
+				lim := int64(1) << (uint(size)*8 - 1)
+				if v < -lim || v >= lim {
+					L.ArgError(arg, "integer overflow")
+				}
+			}
+			buf = packInteger(buf, uint64(v), ps.little, size, v < 0)
+		case packUint:
+			arg++
+			v := checkIntegerValue(L, arg)
+			if size < 8 && uint64(v) >= uint64(1)<<(uint(size)*8) {
+				L.ArgError(arg, "unsigned overflow")
+			}
+			buf = packInteger(buf, uint64(v), ps.little, size, false)
+		case packFloat:
+			arg++
+			v := float64(L.CheckNumber(arg))
+			if size == 4 {
+				buf = packInteger(buf, uint64(math.Float32bits(float32(v))), ps.little, size, false)
+			} else {
+				buf = packInteger(buf, math.Float64bits(v), ps.little, size, false)
+			}
+		case packChar:
+			arg++
+			str := L.CheckString(arg)
+			if len(str) > size {
+				L.ArgError(arg, "string longer than given size")
+			}
+			buf = append(buf, str...)
+			buf = append(buf, make([]byte, size-len(str))...)
+		case packString:
+			arg++
+			str := L.CheckString(arg)
+			if size < 8 && uint64(len(str)) >= uint64(1)<<(uint(size)*8) {
+				L.ArgError(arg, "string length does not fit in given size")
+			}
+			buf = packInteger(buf, uint64(len(str)), ps.little, size, false)
+			buf = append(buf, str...)
+		case packZString:
+			arg++
+			str := L.CheckString(arg)
+			if strings.IndexByte(str, 0) >= 0 {
+				L.ArgError(arg, "string contains zeros")
+			}
+			buf = append(buf, str...)
+			buf = append(buf, 0)
+		case packPadding:
+			buf = append(buf, 0)
+		}
+	}
+	L.Push(L.allocateString(string(buf)))
+	return 1
+}
+
+func strPackSize(L *LState) int {
+	ps := newPackState(L, L.CheckString(1))
+	total := 0
+	for ps.more() {
+		opt, size, ntoalign := ps.details(total)
+		size += ntoalign
+		if total > math.MaxInt32-size {
+			L.ArgError(1, "format result too large")
+		}
+		total += size
+		if opt == packString || opt == packZString {
+			L.ArgError(1, "variable-length format")
+		}
+	}
+	L.Push(integerValue(int64(total)))
+	return 1
+}
+
+func strUnpack(L *LState) int {
+	ps := newPackState(L, L.CheckString(1))
+	data := L.CheckString(2)
+	ld := len(data)
+	pos := L.OptInt(3, 1)
+	if pos < 0 {
+		if -pos > ld {
+			pos = 0
+		} else {
+			pos = ld + pos + 1
+		}
+	}
+	pos--
+	if pos < 0 || pos > ld {
+		L.ArgError(3, "initial position out of string")
+	}
+	n := 0
+	for ps.more() {
+		opt, size, ntoalign := ps.details(pos)
+		if ntoalign+size > ld-pos {
+			L.ArgError(2, "data string too short")
+		}
+		pos += ntoalign
+		switch opt {
+		case packInt, packUint:
+			L.Push(integerValue(unpackInteger(L, data[pos:], ps.little, size, opt == packInt)))
+		case packFloat:
+			v := uint64(unpackInteger(L, data[pos:], ps.little, size, false))
+			if size == 4 {
+				L.Push(LNumber(math.Float32frombits(uint32(v))))
+			} else {
+				L.Push(LNumber(math.Float64frombits(v)))
+			}
+		case packChar:
+			L.Push(LString(data[pos : pos+size]))
+		case packString:
+			length := uint64(unpackInteger(L, data[pos:], ps.little, size, false))
+			if length > uint64(ld-pos-size) {
+				L.ArgError(2, "data string too short")
+			}
+			L.Push(LString(data[pos+size : pos+size+int(length)]))
+			pos += int(length)
+		case packZString:
+			length := strings.IndexByte(data[pos:], 0)
+			if length < 0 {
+				L.ArgError(2, "unfinished string for format 'z'")
+			}
+			L.Push(LString(data[pos : pos+length]))
+			pos += length + 1
+		default:
+			n--
+		}
+		pos += size
+		n++
+	}
+	L.Push(integerValue(int64(pos + 1)))
+	return n + 1
+}
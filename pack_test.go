@@ -0,0 +1,33 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestStringPack(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	assert(string.pack("<i4", 1) == "\1\0\0\0")
+	assert(string.pack(">i2", 258) == "\1\2")
+	assert(string.pack("B", 255) == "\255")
+	assert(string.unpack("<i4", "\1\0\0\0") == 1)
+	assert(string.unpack("<i2", "\255\255") == -1)
+	assert(string.unpack("<I2", "\255\255") == 65535)
+
+	local s = string.pack("<i4 d z s1", -5, 1.5, "zero", "len")
+	local a, b, c, d, pos = string.unpack("<i4 d z s1", s)
+	assert(a == -5 and b == 1.5 and c == "zero" and d == "len" and pos == #s + 1)
+
+	assert(string.packsize("i4 i8") == 12)
+	assert(string.packsize("!8 i1 i8") == 16)
+	assert(string.unpack("i1", string.pack("i1 i1", 1, 2), 2) == 2)
+
+	assert(not pcall(string.pack, "i1", 200))
+	assert(not pcall(string.packsize, "s"))
+	assert(not pcall(string.unpack, "i4", "ab"))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ParallelMap calls fn once for each argument and returns the results in the
+// order of the arguments. The calls run concurrently in the given number of
+// goroutines(0 means runtime.GOMAXPROCS(0)), each of them has its own state
+// forked from this state like Clone does. Globals and loaded modules of the
+// state are visible to fn, but changes made by fn are not visible to the
+// state and to the other goroutines.
+//
+// Arguments are deep-copied into the forked states, and the first result of
+// each call is deep-copied back into this state, so they should be plain data
+// like numbers, strings and tables. ParallelMap stops calling fn after an
+// error and returns the first error. The context of the state is given to the
+// forked states. The state must not be used until ParallelMap returns.
+func (ls *LState) ParallelMap(fn *LFunction, args []LValue, workers int) ([]LValue, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(args) {
+		workers = len(args)
+	}
+	results := make([]LValue, len(args))
+	if len(args) == 0 {
+		return results, nil
+	}
+
+	// base is never modified, so the workers can copy it concurrently.
+	base, vc := ls.clone()
+	defer base.Close()
+	basefn := vc.copy(fn)
+	baseargs := make([]LValue, len(args))
+	for i, arg := range args {
+		baseargs[i] = vc.copy(arg)
+	}
+
+	var (
+		mu       sync.Mutex
+		firsterr error
+		wg       sync.WaitGroup
+	)
+	indices := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L, wvc := base.clone()
+			defer L.Close()
+			if ls.ctx != nil {
+				L.SetContext(ls.ctx)
+			}
+			wfn := wvc.copy(basefn)
+			for i := range indices {
+				L.Push(wfn)
+				L.Push(wvc.copy(baseargs[i]))
+				err := L.PCall(1, 1, nil)
+				mu.Lock()
+				if err != nil {
+					if firsterr == nil {
+						firsterr = err
+					}
+				} else {
+					results[i] = newValueCopier(ls).copy(L.Get(-1))
+				}
+				mu.Unlock()
+				L.SetTop(0)
+			}
+		}()
+	}
+	for i := range args {
+		mu.Lock()
+		failed := firsterr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	if firsterr != nil {
+		return nil, firsterr
+	}
+	return results, nil
+}
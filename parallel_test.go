@@ -0,0 +1,78 @@
+package lua
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParallelMap(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	factor = 10
+	function work(item)
+	  last = item.id
+	  return {id = item.id, value = item.id * factor}
+	end
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := make([]LValue, 20)
+	for i := range args {
+		item := L.NewTable()
+		item.RawSetH(LString("id"), LNumber(i))
+		args[i] = item
+	}
+	results, perr := L.ParallelMap(L.GetGlobal("work").(*LFunction), args, 4)
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	for i, result := range results {
+		tb, ok := result.(*LTable)
+		if !ok {
+			t.Fatalf("got %v, want a table", result)
+		}
+		if id, value := tb.RawGetH(LString("id")), tb.RawGetH(LString("value")); id != LNumber(i) || value != LNumber(i*10) {
+			t.Errorf("got %v, %v, want %v, %v", id, value, i, i*10)
+		}
+	}
+	// changes made by the calls are not visible to the state.
+	if v := L.GetGlobal("last"); v != LNil {
+		t.Errorf("got %v, want nil", v)
+	}
+
+	if results, err := L.ParallelMap(L.GetGlobal("work").(*LFunction), nil, 0); err != nil || len(results) != 0 {
+		t.Errorf("got %v, %v, want no results", results, err)
+	}
+}
+
+func TestParallelMapError(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function work(x) if x == 3 then error("bad item") end return x end`); err != nil {
+		t.Fatal(err)
+	}
+	args := []LValue{LNumber(1), LNumber(2), LNumber(3), LNumber(4)}
+	_, err := L.ParallelMap(L.GetGlobal("work").(*LFunction), args, 2)
+	if err == nil || !strings.Contains(err.Error(), "bad item") {
+		t.Errorf("got %v, want the error of the call", err)
+	}
+}
+
+func TestParallelMapContext(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`function work() while true do end end`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	_, err := L.ParallelMap(L.GetGlobal("work").(*LFunction), []LValue{LNumber(1), LNumber(2)}, 0)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+}
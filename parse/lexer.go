@@ -21,12 +21,18 @@ type Error struct {
 	Token   string
 }
 
+// Incomplete reports whether the error is caused by the end of the input, for
+// example, an unclosed block or string.
+func (e *Error) Incomplete() bool {
+	return e.Pos.Line == EOF
+}
+
 func (e *Error) Error() string {
 	pos := e.Pos
 	if pos.Line == EOF {
-		return fmt.Sprintf("%v at EOF:   %s\n", pos.Source, e.Message)
+		return fmt.Sprintf("%v at EOF:   %s", pos.Source, e.Message)
 	} else {
-		return fmt.Sprintf("%v line:%d(column:%d) near '%v':   %s\n", pos.Source, pos.Line, pos.Column, e.Token, e.Message)
+		return fmt.Sprintf("%v line:%d(column:%d) near '%v':   %s", pos.Source, pos.Line, pos.Column, e.Token, e.Message)
 	}
 }
 
@@ -45,6 +51,12 @@ func isDigit(ch int) bool {
 type Scanner struct {
 	Pos    ast.Position
 	reader *bufio.Reader
+
+	// Comments holds the comments skipped by the scanner if KeepComments is
+	// true.
+	KeepComments bool
+	Comments     []*ast.Comment
+	recording    *bytes.Buffer
 }
 
 func NewScanner(reader io.Reader, source string) *Scanner {
@@ -63,6 +75,9 @@ func (sc *Scanner) readNext() int {
 	if err == io.EOF {
 		return EOF
 	}
+	if sc.recording != nil {
+		sc.recording.WriteByte(ch)
+	}
 	return int(ch)
 }
 
@@ -97,6 +112,9 @@ func (sc *Scanner) Peek() int {
 	ch := sc.readNext()
 	if ch != EOF {
 		sc.reader.UnreadByte()
+		if sc.recording != nil {
+			sc.recording.Truncate(sc.recording.Len() - 1)
+		}
 	}
 	return ch
 }
@@ -129,6 +147,20 @@ func (sc *Scanner) skipComments(ch int) error {
 	return nil
 }
 
+// scanComment skips a comment after the first '-' and adds it to Comments.
+func (sc *Scanner) scanComment() error {
+	comment := &ast.Comment{}
+	comment.SetLine(sc.Pos.Line)
+	comment.SetColumn(sc.Pos.Column)
+	sc.recording = bytes.NewBufferString("-")
+	err := sc.skipComments(sc.Next())
+	comment.Text = strings.TrimRight(sc.recording.String(), "\r\n")
+	sc.recording = nil
+	comment.SetLastLine(comment.Line() + strings.Count(comment.Text, "\n"))
+	sc.Comments = append(sc.Comments, comment)
+	return err
+}
+
 func (sc *Scanner) scanIdent(ch int, buf *bytes.Buffer) error {
 	writeChar(buf, ch)
 	for isIdent(sc.Peek(), 1) {
@@ -284,7 +316,7 @@ var reservedWords = map[string]int{
 	"end": TEnd, "false": TFalse, "for": TFor, "function": TFunction,
 	"if": TIf, "in": TIn, "local": TLocal, "nil": TNil, "not": TNot, "or": TOr,
 	"return": TReturn, "repeat": TRepeat, "then": TThen, "true": TTrue,
-	"until": TUntil, "while": TWhile}
+	"until": TUntil, "while": TWhile, "goto": TGoto}
 
 func (sc *Scanner) Scan(lexer *Lexer) (ast.Token, error) {
 redo:
@@ -327,7 +359,11 @@ redo:
 			tok.Type = EOF
 		case '-':
 			if sc.Peek() == '-' {
-				err = sc.skipComments(sc.Next())
+				if sc.KeepComments {
+					err = sc.scanComment()
+				} else {
+					err = sc.skipComments(sc.Next())
+				}
 				if err != nil {
 					goto finally
 				}
@@ -364,13 +400,18 @@ redo:
 				tok.Str = "~="
 				sc.Next()
 			} else {
-				err = sc.Error("~", "Invalid '~' token")
+				tok.Type = ch
+				tok.Str = "~"
 			}
 		case '<':
 			if sc.Peek() == '=' {
 				tok.Type = TLte
 				tok.Str = "<="
 				sc.Next()
+			} else if sc.Peek() == '<' {
+				tok.Type = TShl
+				tok.Str = "<<"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(ch)
@@ -380,6 +421,10 @@ redo:
 				tok.Type = TGte
 				tok.Str = ">="
 				sc.Next()
+			} else if sc.Peek() == '>' {
+				tok.Type = TShr
+				tok.Str = ">>"
+				sc.Next()
 			} else {
 				tok.Type = ch
 				tok.Str = string(ch)
@@ -404,7 +449,25 @@ redo:
 				tok.Type = '.'
 			}
 			tok.Str = buf.String()
-		case '+', '*', '/', '%', '^', '#', '(', ')', '{', '}', ']', ';', ':', ',':
+		case ':':
+			if sc.Peek() == ':' {
+				tok.Type = T2Colon
+				tok.Str = "::"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = ":"
+			}
+		case '/':
+			if sc.Peek() == '/' {
+				tok.Type = T2Slash
+				tok.Str = "//"
+				sc.Next()
+			} else {
+				tok.Type = ch
+				tok.Str = "/"
+			}
+		case '+', '*', '%', '^', '#', '(', ')', '{', '}', ']', ';', ',', '&', '|':
 			tok.Type = ch
 			tok.Str = string(ch)
 		default:
@@ -426,14 +489,58 @@ type Lexer struct {
 	Stmts    []ast.Stmt
 	PNewLine bool
 	Token    ast.Token
+
+	// tolerant makes errors be collected instead of aborting the parse.
+	tolerant bool
+	errors   []*Error
+	// syncLine is the line of a syntax error in tolerant mode, the lexer
+	// skips tokens until a keyword that starts or ends a statement or the
+	// next line, and returns TSync before the token. 0 means no tokens are
+	// skipped.
+	syncLine int
+	// pending is the token returned after TSync.
+	pending *ast.Token
+	// resume is set if the parser resumes at the token of a syntax error,
+	// see resumes.
+	resume bool
+	// errorLine is the line of the last syntax error.
+	errorLine int
+	// eof is set when the lexer reaches the end of the chunk.
+	eof bool
+}
+
+// statementTokens are the keywords that start statements.
+var statementTokens = map[int]bool{
+	TLocal: true, TFunction: true, TIf: true, TWhile: true, TFor: true,
+	TRepeat: true, TReturn: true, TBreak: true, TDo: true, TGoto: true,
+	T2Colon: true,
+}
+
+// closingTokens are the keywords that end blocks.
+var closingTokens = map[int]bool{
+	TEnd: true, TElse: true, TElseIf: true, TUntil: true,
 }
 
 func (lx *Lexer) Lex(lval *yySymType) int {
-	tok, err := lx.scanner.Scan(lx)
-	if err != nil {
-		panic(err)
+	if tok := lx.pending; tok != nil {
+		lx.pending = nil
+		lval.token = *tok
+		lx.Token = *tok
+		return int(tok.Type)
+	}
+	tok, ok := lx.scan()
+	if line := lx.syncLine; line > 0 {
+		lx.syncLine = 0
+		for ok && tok.Type != EOF && tok.Pos.Line <= line && !statementTokens[tok.Type] && !closingTokens[tok.Type] {
+			tok, ok = lx.scan()
+		}
+		if ok && tok.Type != EOF {
+			lx.pending = &tok
+			return TSync
+		}
 	}
-	if tok.Type < 0 {
+	if !ok || tok.Type == EOF {
+		lx.eof = true
 		return 0
 	}
 	lval.token = tok
@@ -441,16 +548,77 @@ func (lx *Lexer) Lex(lval *yySymType) int {
 	return int(tok.Type)
 }
 
+// scan returns the next token. In tolerant mode, invalid tokens are recorded
+// and skipped, and scan returns false if the scanner does not advance.
+func (lx *Lexer) scan() (ast.Token, bool) {
+	tok, err := lx.scanner.Scan(lx)
+	for err != nil {
+		if !lx.tolerant {
+			panic(err)
+		}
+		pos := lx.scanner.Pos
+		lx.errors = append(lx.errors, err.(*Error))
+		tok, err = lx.scanner.Scan(lx)
+		if err != nil && lx.scanner.Pos == pos {
+			return tok, false
+		}
+	}
+	return tok, true
+}
+
+// Error reports a syntax error found by the parser. In tolerant mode, the
+// tokens after the error are skipped until the parser can resynchronize.
 func (lx *Lexer) Error(message string) {
-	panic(lx.scanner.Error(lx.Token.Str, message))
+	lx.raise(lx.scanner.Error(lx.Token.Str, message))
+	if !lx.tolerant || lx.eof {
+		return
+	}
+	lx.errorLine = lx.Token.Pos.Line
+	switch {
+	case statementTokens[lx.Token.Type]:
+		lx.resume = true
+	case !closingTokens[lx.Token.Type]:
+		lx.syncLine = lx.Token.Pos.Line
+	}
+}
+
+// resumes reports whether the parser recovering from a syntax error resumes
+// at the token of the error, which starts a statement.
+func (lx *Lexer) resumes() bool {
+	resume := lx.resume
+	lx.resume = false
+	return resume
+}
+
+// strayCloser reports a keyword that closes a block at the top level. In
+// tolerant mode, a keyword on the line of the last syntax error is ignored
+// because it probably closes the block that has the error.
+func (lx *Lexer) strayCloser(tok ast.Token) {
+	if lx.tolerant && tok.Pos.Line == lx.errorLine {
+		return
+	}
+	lx.raise(lx.scanner.Error(tok.Str, "syntax error"))
+}
+
+// actionError reports an error found by an action of the grammar. The parser
+// goes on with the next token.
+func (lx *Lexer) actionError(message string) {
+	lx.raise(lx.scanner.Error(lx.Token.Str, message))
 }
 
 func (lx *Lexer) TokenError(tok ast.Token, message string) {
-	panic(lx.scanner.TokenError(tok, message))
+	lx.raise(lx.scanner.TokenError(tok, message))
+}
+
+func (lx *Lexer) raise(err *Error) {
+	if !lx.tolerant {
+		panic(err)
+	}
+	lx.errors = append(lx.errors, err)
 }
 
 func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
-	lexer := &Lexer{NewScanner(reader, name), nil, false, ast.Token{Str: ""}}
+	lexer := &Lexer{scanner: NewScanner(reader, name), Token: ast.Token{Str: ""}}
 	chunk = nil
 	defer func() {
 		if e := recover(); e != nil {
@@ -462,6 +630,34 @@ func Parse(reader io.Reader, name string) (chunk []ast.Stmt, err error) {
 	return
 }
 
+// ParseWithComments parses the chunk like Parse, and returns the comments of
+// the chunk in order.
+func ParseWithComments(reader io.Reader, name string) (chunk []ast.Stmt, comments []*ast.Comment, err error) {
+	lexer := &Lexer{scanner: NewScanner(reader, name), Token: ast.Token{Str: ""}}
+	lexer.scanner.KeepComments = true
+	defer func() {
+		if e := recover(); e != nil {
+			err, _ = e.(error)
+		}
+	}()
+	yyParse(lexer)
+	return lexer.Stmts, lexer.scanner.Comments, nil
+}
+
+// ParseTolerant parses the chunk like Parse, but does not stop at the first
+// syntax error. The parser skips tokens until a keyword that starts or ends a
+// statement, or the next line, and returns all errors in the order they are
+// found. The chunk has the statements parsed successfully, it is nil if the
+// parser could not recover from an error. Statements of a block that is not
+// closed at EOF are dropped.
+func ParseTolerant(reader io.Reader, name string) ([]ast.Stmt, []*Error) {
+	lexer := &Lexer{scanner: NewScanner(reader, name), Token: ast.Token{Str: ""}, tolerant: true}
+	if yyParse(lexer) != 0 {
+		return nil, lexer.errors
+	}
+	return lexer.Stmts, lexer.errors
+}
+
 // }}}
 
 // Dump {{{
@@ -5,6 +5,7 @@ import (
   "github.com/yuin/gopher-lua/ast"
 )
 %}
+%type<stmts> file
 %type<stmts> chunk
 %type<stmts> chunk1
 %type<stmts> block
@@ -16,6 +17,8 @@ import (
 %type<exprlist> varlist
 %type<expr> var
 %type<namelist> namelist
+%type<localstmt> attnamelist
+%type<attrib> attrib
 %type<exprlist> exprlist
 %type<expr> expr
 %type<expr> string
@@ -49,44 +52,75 @@ import (
 
   namelist []string
   parlist  *ast.ParList
+
+  localstmt *ast.LocalAssignStmt
+  attrib    string
 }
 
 /* Reserved words */
-%token<token> TAnd TBreak TDo TElse TElseIf TEnd TFalse TFor TFunction TIf TIn TLocal TNil TNot TOr TReturn TRepeat TThen TTrue TUntil TWhile 
+%token<token> TAnd TBreak TDo TElse TElseIf TEnd TFalse TFor TFunction TIf TIn TLocal TNil TNot TOr TReturn TRepeat TThen TTrue TUntil TWhile TGoto
 
 /* Literals */
-%token<token> TEqeq TNeq TLte TGte T2Comma T3Comma TIdent TNumber TString '{' '('
+%token<token> TEqeq TNeq TLte TGte T2Comma T3Comma T2Colon T2Slash TShl TShr TIdent TNumber TString '{' '}' '('
+
+/* The lexer of ParseTolerant returns TSync where the parser resumes after a syntax error */
+%token<token> TSync
 
 /* Operators */
 %left TOr
 %left TAnd
 %left '>' '<' TGte TLte TEqeq TNeq
+%left '|'
+%left '~'
+%left '&'
+%left TShl TShr
 %right T2Comma
 %left '+' '-'
-%left '*' '/' '%'
-%right UNARY /* not # -(unary) */
+%left '*' '/' T2Slash '%'
+%right UNARY /* not # -(unary) ~(unary) */
 %right '^'
 
 %%
 
-chunk: 
-        chunk1 {
+file:
+        chunk {
             $$ = $1
             if l, ok := yylex.(*Lexer); ok {
                 l.Stmts = $$
             }
         } |
-        chunk1 laststat {
-            $$ = append($1, $2)
+        /* error recovery of ParseTolerant: a keyword that closes a block at
+           the top level(errors abort Parse) */
+        file closer chunk {
+            $$ = append($1, $3...)
             if l, ok := yylex.(*Lexer); ok {
                 l.Stmts = $$
             }
+        }
+
+closer:
+        TEnd {
+            yylex.(*Lexer).strayCloser($1)
+        } |
+        TElse {
+            yylex.(*Lexer).strayCloser($1)
+        } |
+        TElseIf {
+            yylex.(*Lexer).strayCloser($1)
+        } |
+        TUntil {
+            yylex.(*Lexer).strayCloser($1)
+        }
+
+chunk: 
+        chunk1 {
+            $$ = $1
+        } |
+        chunk1 laststat {
+            $$ = append($1, $2)
         } | 
         chunk1 laststat ';' {
             $$ = append($1, $2)
-            if l, ok := yylex.(*Lexer); ok {
-                l.Stmts = $$
-            }
         }
 
 chunk1: 
@@ -94,10 +128,25 @@ chunk1:
             $$ = []ast.Stmt{}
         } |
         chunk1 stat {
-            $$ = append($1, $2)
+            $$ = $1
+            if $2 != nil {
+                $$ = append($1, $2)
+            }
         } | 
         chunk1 ';' {
             $$ = $1
+        } |
+        /* error recovery of ParseTolerant(errors abort Parse). Errflag = 0
+           is yyerrok of yacc, so the next error is reported at once */
+        chunk1 error {
+            $$ = $1
+            if yylex.(*Lexer).resumes() {
+                Errflag = 0
+            }
+        } |
+        chunk1 TSync {
+            $$ = $1
+            Errflag = 0
         }
 
 block: 
@@ -109,29 +158,35 @@ stat:
         varlist '=' exprlist {
             $$ = &ast.AssignStmt{Lhs: $1, Rhs: $3}
             $$.SetLine($1[0].Line())
+            $$.SetColumn($1[0].Column())
         } |
         /* 'stat = functioncal' causes a reduce/reduce conflict */
         prefixexp {
             if _, ok := $1.(*ast.FuncCallExpr); !ok {
-               yylex.(*Lexer).Error("parse error")
+               yylex.(*Lexer).actionError("parse error")
+               $$ = nil
             } else {
               $$ = &ast.FuncCallStmt{Expr: $1}
               $$.SetLine($1.Line())
+              $$.SetColumn($1.Column())
             }
         } |
         TDo block TEnd {
             $$ = &ast.DoBlockStmt{Stmts: $2}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($3.Pos.Line)
         } |
         TWhile expr TDo block TEnd {
             $$ = &ast.WhileStmt{Condition: $2, Stmts: $4}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($5.Pos.Line)
         } |
         TRepeat block TUntil expr {
             $$ = &ast.RepeatStmt{Condition: $4, Stmts: $2}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($4.Line())
         } |
         TIf expr TThen block elseifs TEnd {
@@ -142,6 +197,7 @@ stat:
                 cur = elseif
             }
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($6.Pos.Line)
         } |
         TIf expr TThen block elseifs TElse block TEnd {
@@ -153,40 +209,60 @@ stat:
             }
             cur.(*ast.IfStmt).Else = $7
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($8.Pos.Line)
         } |
         TFor TIdent '=' expr ',' expr TDo block TEnd {
             $$ = &ast.NumberForStmt{Name: $2.Str, Init: $4, Limit: $6, Stmts: $8}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($9.Pos.Line)
         } |
         TFor TIdent '=' expr ',' expr ',' expr TDo block TEnd {
             $$ = &ast.NumberForStmt{Name: $2.Str, Init: $4, Limit: $6, Step:$8, Stmts: $10}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($11.Pos.Line)
         } |
         TFor namelist TIn exprlist TDo block TEnd {
             $$ = &ast.GenericForStmt{Names:$2, Exprs:$4, Stmts: $6}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($7.Pos.Line)
         } |
         TFunction funcname funcbody {
             $$ = &ast.FuncDefStmt{Name: $2, Func: $3}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($3.LastLine())
         } |
         TLocal TFunction TIdent funcbody {
-            $$ = &ast.LocalAssignStmt{Names:[]string{$3.Str}, Exprs: []ast.Expr{$4}}
+            $$ = &ast.LocalAssignStmt{Names:[]string{$3.Str}, Attribs: []string{""}, Exprs: []ast.Expr{$4}}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($4.LastLine())
         } | 
-        TLocal namelist '=' exprlist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:$4}
+        TLocal attnamelist '=' exprlist {
+            $2.Exprs = $4
+            $$ = $2
+            $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
+        } |
+        TLocal attnamelist {
+            $2.Exprs = []ast.Expr{}
+            $$ = $2
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } |
-        TLocal namelist {
-            $$ = &ast.LocalAssignStmt{Names: $2, Exprs:[]ast.Expr{}}
+        TGoto TIdent {
+            $$ = &ast.GotoStmt{Label: $2.Str}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
+        } |
+        T2Colon TIdent T2Colon {
+            $$ = &ast.LabelStmt{Name: $2.Str}
+            $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         }
 
 elseifs: 
@@ -196,20 +272,24 @@ elseifs:
         elseifs TElseIf expr TThen block {
             $$ = append($1, &ast.IfStmt{Condition: $3, Then: $5})
             $$[len($$)-1].SetLine($2.Pos.Line)
+            $$[len($$)-1].SetColumn($2.Pos.Column)
         }
 
 laststat:
         TReturn {
             $$ = &ast.ReturnStmt{Exprs:nil}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } |
         TReturn exprlist {
             $$ = &ast.ReturnStmt{Exprs:$2}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } |
         TBreak  {
             $$ = &ast.BreakStmt{}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         }
 
 funcname: 
@@ -224,12 +304,15 @@ funcname1:
         TIdent {
             $$ = &ast.FuncName{Func: &ast.IdentExpr{Value:$1.Str}}
             $$.Func.SetLine($1.Pos.Line)
+            $$.Func.SetColumn($1.Pos.Column)
         } | 
         funcname1 '.' TIdent {
             key:= &ast.StringExpr{Value:$3.Str}
             key.SetLine($3.Pos.Line)
+            key.SetColumn($3.Pos.Column)
             fn := &ast.AttrGetExpr{Object: $1.Func, Key: key}
             fn.SetLine($3.Pos.Line)
+            fn.SetColumn($3.Pos.Column)
             $$ = &ast.FuncName{Func: fn}
         }
 
@@ -245,16 +328,20 @@ var:
         TIdent {
             $$ = &ast.IdentExpr{Value:$1.Str}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } |
         prefixexp '[' expr ']' {
             $$ = &ast.AttrGetExpr{Object: $1, Key: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($3.Column())
         } | 
         prefixexp '.' TIdent {
             key := &ast.StringExpr{Value:$3.Str}
             key.SetLine($3.Pos.Line)
+            key.SetColumn($3.Pos.Column)
             $$ = &ast.AttrGetExpr{Object: $1, Key: key}
             $$.SetLine($1.Line())
+            $$.SetColumn($3.Pos.Column)
         }
 
 namelist:
@@ -265,6 +352,24 @@ namelist:
             $$ = append($1, $3.Str)
         }
 
+attnamelist:
+        TIdent attrib {
+            $$ = &ast.LocalAssignStmt{Names: []string{$1.Str}, Attribs: []string{$2}}
+        } |
+        attnamelist ',' TIdent attrib {
+            $1.Names = append($1.Names, $3.Str)
+            $1.Attribs = append($1.Attribs, $4)
+            $$ = $1
+        }
+
+attrib:
+        {
+            $$ = ""
+        } |
+        '<' TIdent '>' {
+            $$ = $2.Str
+        }
+
 exprlist:
         expr {
             $$ = []ast.Expr{$1}
@@ -277,22 +382,27 @@ expr:
         TNil {
             $$ = &ast.NilExpr{}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } | 
         TFalse {
             $$ = &ast.FalseExpr{}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } | 
         TTrue {
             $$ = &ast.TrueExpr{}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } | 
         TNumber {
             $$ = &ast.NumberExpr{Value: $1.Str}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } | 
         T3Comma {
             $$ = &ast.Comma3Expr{}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } |
         function {
             $$ = $1
@@ -309,80 +419,134 @@ expr:
         expr TOr expr {
             $$ = &ast.LogicalOpExpr{Lhs: $1, Operator: "or", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr TAnd expr {
             $$ = &ast.LogicalOpExpr{Lhs: $1, Operator: "and", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '>' expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: ">", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '<' expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: "<", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr TGte expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: ">=", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr TLte expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: "<=", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr TEqeq expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: "==", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr TNeq expr {
             $$ = &ast.RelationalOpExpr{Lhs: $1, Operator: "~=", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr T2Comma expr {
             $$ = &ast.StringConcatOpExpr{Lhs: $1, Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '+' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "+", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '-' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "-", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '*' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "*", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '/' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "/", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '%' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "%", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr T2Slash expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "//", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr '&' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "&", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr '|' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "|", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr '~' expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "~", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr TShl expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "<<", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
+        } |
+        expr TShr expr {
+            $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: ">>", Rhs: $3}
+            $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         expr '^' expr {
             $$ = &ast.ArithmeticOpExpr{Lhs: $1, Operator: "^", Rhs: $3}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         '-' expr %prec UNARY {
             $$ = &ast.UnaryMinusOpExpr{Expr: $2}
             $$.SetLine($2.Line())
+            $$.SetColumn($2.Column())
         } |
         TNot expr %prec UNARY {
             $$ = &ast.UnaryNotOpExpr{Expr: $2}
             $$.SetLine($2.Line())
+            $$.SetColumn($2.Column())
         } |
         '#' expr %prec UNARY {
             $$ = &ast.UnaryLenOpExpr{Expr: $2}
             $$.SetLine($2.Line())
+            $$.SetColumn($2.Column())
+        } |
+        '~' expr %prec UNARY {
+            $$ = &ast.UnaryBNotOpExpr{Expr: $2}
+            $$.SetLine($2.Line())
+            $$.SetColumn($2.Column())
         }
 
 string: 
         TString {
             $$ = &ast.StringExpr{Value: $1.Str}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         } 
 
 prefixexp:
@@ -398,6 +562,7 @@ prefixexp:
         '(' expr ')' {
             $$ = $2
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
         }
 
 afunctioncall:
@@ -410,10 +575,12 @@ functioncall:
         prefixexp args {
             $$ = &ast.FuncCallExpr{Func: $1, Args: $2}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         } |
         prefixexp ':' TIdent args {
             $$ = &ast.FuncCallExpr{Method: $3.Str, Receiver: $1, Args: $4}
             $$.SetLine($1.Line())
+            $$.SetColumn($1.Column())
         }
 
 args:
@@ -440,6 +607,7 @@ function:
         TFunction funcbody {
             $$ = &ast.FunctionExpr{ParList:$2.ParList, Stmts: $2.Stmts}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($2.LastLine())
         }
 
@@ -447,11 +615,13 @@ funcbody:
         '(' parlist ')' block TEnd {
             $$ = &ast.FunctionExpr{ParList: $2, Stmts: $4}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($5.Pos.Line)
         } | 
         '(' ')' block TEnd {
             $$ = &ast.FunctionExpr{ParList: &ast.ParList{HasVargs: false, Names: []string{}}, Stmts: $3}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
             $$.SetLastLine($4.Pos.Line)
         }
 
@@ -473,10 +643,20 @@ tableconstructor:
         '{' '}' {
             $$ = &ast.TableExpr{Fields: []*ast.Field{}}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
+            $$.SetLastLine($2.Pos.Line)
         } |
         '{' fieldlist '}' {
             $$ = &ast.TableExpr{Fields: $2}
             $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
+            $$.SetLastLine($3.Pos.Line)
+        } |
+        '{' fieldlist fieldsep '}' {
+            $$ = &ast.TableExpr{Fields: $2}
+            $$.SetLine($1.Pos.Line)
+            $$.SetColumn($1.Pos.Column)
+            $$.SetLastLine($4.Pos.Line)
         }
 
 
@@ -486,15 +666,13 @@ fieldlist:
         } | 
         fieldlist fieldsep field {
             $$ = append($1, $3)
-        } | 
-        fieldlist fieldsep {
-            $$ = $1
         }
 
 field:
         TIdent '=' expr {
             $$ = &ast.Field{Key: &ast.StringExpr{Value:$1.Str}, Value: $3}
             $$.Key.SetLine($1.Pos.Line)
+            $$.Key.SetColumn($1.Pos.Column)
         } | 
         '[' expr ']' '=' expr {
             $$ = &ast.Field{Key: $2, Value: $5}
@@ -514,9 +692,10 @@ fieldsep:
 %%
 
 func TokenName(c int) string {
-	if c >= TAnd && c-TAnd < len(yyToknames) {
-		if yyToknames[c-TAnd] != "" {
-			return yyToknames[c-TAnd]
+	// yyToknames starts with "$end", "error" and "$unk"
+	if c >= TAnd && c-yyPrivate+1 < len(yyToknames) {
+		if yyToknames[c-yyPrivate+1] != "" {
+			return yyToknames[c-yyPrivate+1]
 		}
 	}
     return string([]byte{byte(c)})
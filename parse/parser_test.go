@@ -0,0 +1,48 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua/ast"
+)
+
+func TestColumns(t *testing.T) {
+	chunk, err := Parse(strings.NewReader("local a = 1\n  print(a + 2)"), "<string>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk) != 2 {
+		t.Fatalf("got %v statements, want 2", len(chunk))
+	}
+	if line, column := chunk[1].Line(), chunk[1].Column(); line != 2 || column != 3 {
+		t.Errorf("got %v:%v, want 2:3", line, column)
+	}
+	call := chunk[1].(*ast.FuncCallStmt).Expr.(*ast.FuncCallExpr)
+	if arg := call.Args[0]; arg.Column() != 9 {
+		t.Errorf("got the column %v, want 9", arg.Column())
+	}
+}
+
+func TestParseTolerant(t *testing.T) {
+	src := "local a = = 1\nprint(a)\nlocal b = )\nreturn a\n"
+	chunk, errs := ParseTolerant(strings.NewReader(src), "<string>")
+	if len(errs) != 2 {
+		t.Fatalf("got %v errors, want 2: %v", len(errs), errs)
+	}
+	if errs[0].Pos.Line != 1 || errs[1].Pos.Line != 3 {
+		t.Errorf("got errors at lines %v and %v, want 1 and 3", errs[0].Pos.Line, errs[1].Pos.Line)
+	}
+	if chunk == nil {
+		t.Fatal("the statements parsed successfully must be returned")
+	}
+	if _, ok := chunk[len(chunk)-1].(*ast.ReturnStmt); !ok {
+		t.Errorf("got %T, want the return statement", chunk[len(chunk)-1])
+	}
+
+	// an unclosed block is reported at EOF.
+	_, errs = ParseTolerant(strings.NewReader("if x then\nprint(1)\n"), "<string>")
+	if len(errs) != 1 || !errs[0].Incomplete() {
+		t.Errorf("got %v, want an incomplete input error", errs)
+	}
+}
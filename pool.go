@@ -0,0 +1,196 @@
+package lua
+
+import (
+	"errors"
+	"sync"
+)
+
+type StatePoolOptions struct {
+	// Options are passed to NewState when the pool creates a new state.
+	Options Options
+	// Init is called once for each new state, before the first use.
+	Init func(L *LState) error
+	// MaxIdle is the maximum number of idle states kept in the pool.
+	// States returned to a full pool are closed. 0 means no limit.
+	MaxIdle int
+}
+
+type StatePoolStats struct {
+	Created   int
+	Gets      int
+	Puts      int
+	Discarded int
+	Idle      int
+	InUse     int
+}
+
+type StatePool struct {
+	mu        sync.Mutex
+	opts      StatePoolOptions
+	idle      []*LState
+	snapshots map[*LState]*Snapshot
+	stats     StatePoolStats
+	closed    bool
+}
+
+func NewStatePool(opts StatePoolOptions) *StatePool {
+	return &StatePool{
+		opts:      opts,
+		idle:      make([]*LState, 0, opts.MaxIdle),
+		snapshots: make(map[*LState]*Snapshot),
+	}
+}
+
+func (pl *StatePool) Get() (*LState, error) {
+	pl.mu.Lock()
+	if pl.closed {
+		pl.mu.Unlock()
+		return nil, errors.New("state pool is closed")
+	}
+	pl.stats.Gets++
+	if n := len(pl.idle); n > 0 {
+		L := pl.idle[n-1]
+		pl.idle[n-1] = nil
+		pl.idle = pl.idle[:n-1]
+		pl.stats.InUse++
+		pl.mu.Unlock()
+		return L, nil
+	}
+	pl.mu.Unlock()
+
+	L := NewState(pl.opts.Options)
+	if pl.opts.Init != nil {
+		if err := pl.opts.Init(L); err != nil {
+			L.Close()
+			return nil, err
+		}
+	}
+	L.SetTop(0)
+	// the snapshot is the state just after the initialization, which is never
+	// used, so the states created from it are not affected by the borrowers.
+	snapshot := L.Snapshot()
+
+	pl.mu.Lock()
+	pl.snapshots[L] = snapshot
+	pl.stats.Created++
+	pl.stats.InUse++
+	pl.mu.Unlock()
+	return L, nil
+}
+
+// Put closes L and puts a new state created from the snapshot of L taken after
+// the initialization into the pool. L must not be used after Put.
+func (pl *StatePool) Put(L *LState) {
+	pl.mu.Lock()
+	snapshot, ok := pl.snapshots[L]
+	if !ok {
+		pl.mu.Unlock()
+		return
+	}
+	delete(pl.snapshots, L)
+	pl.stats.Puts++
+	pl.stats.InUse--
+	if pl.closed || (pl.opts.MaxIdle > 0 && len(pl.idle) >= pl.opts.MaxIdle) {
+		pl.stats.Discarded++
+		pl.mu.Unlock()
+		L.Close()
+		return
+	}
+	pl.mu.Unlock()
+
+	L.Close()
+	L = snapshot.NewState()
+
+	pl.mu.Lock()
+	if pl.closed {
+		pl.stats.Discarded++
+		pl.mu.Unlock()
+		L.Close()
+		return
+	}
+	pl.snapshots[L] = snapshot
+	pl.idle = append(pl.idle, L)
+	pl.mu.Unlock()
+}
+
+func (pl *StatePool) Stats() StatePoolStats {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	stats := pl.stats
+	stats.Idle = len(pl.idle)
+	return stats
+}
+
+// Close closes all idle states. States that are in use are closed when they
+// are returned to the pool.
+func (pl *StatePool) Close() {
+	pl.mu.Lock()
+	idle := pl.idle
+	pl.idle = nil
+	pl.closed = true
+	for _, L := range idle {
+		delete(pl.snapshots, L)
+	}
+	pl.mu.Unlock()
+	for _, L := range idle {
+		L.Close()
+	}
+}
+
+// maximum numbers of register arrays and call frame segments that a state keeps
+// for new coroutines.
+const (
+	threadPoolRegistries = 4
+	threadPoolSegments   = 64
+)
+
+// threadPool keeps the registers and the call frames of dead coroutines, so
+// that new coroutines reuse them instead of allocating them. Coroutines that
+// are created and finished repeatedly allocate their stacks only once.
+type threadPool struct {
+	registries [][]LValue
+	segments   [][]callFrame
+}
+
+func (tp *threadPool) newRegistry(ls *LState, size, maxSize int) *registry {
+	for i := len(tp.registries) - 1; i >= 0; i-- {
+		if array := tp.registries[i]; len(array) >= size {
+			tp.registries = append(tp.registries[:i], tp.registries[i+1:]...)
+			return &registry{array, 0, intMax(size, maxSize), ls}
+		}
+	}
+	return newRegistry(ls, size, maxSize)
+}
+
+func (tp *threadPool) newcallFrameStack(maxSize int) *callFrameStack {
+	cs := newcallFrameStack(maxSize)
+	cs.pool = tp
+	return cs
+}
+
+// segment returns a segment of call frames.
+func (tp *threadPool) segment() []callFrame {
+	if n := len(tp.segments); n > 0 {
+		segment := tp.segments[n-1]
+		tp.segments[n-1] = nil
+		tp.segments = tp.segments[:n-1]
+		return segment
+	}
+	return make([]callFrame, callFrameSegmentSize)
+}
+
+// put clears the registers and the call frames and keeps them if the pool is
+// not full.
+func (tp *threadPool) put(rg *registry, cs *callFrameStack) {
+	if len(rg.array) > 0 && len(tp.registries) < threadPoolRegistries {
+		clear(rg.array)
+		tp.registries = append(tp.registries, rg.array)
+	}
+	for _, segment := range cs.segments {
+		if len(tp.segments) >= threadPoolSegments {
+			break
+		}
+		clear(segment)
+		tp.segments = append(tp.segments, segment)
+	}
+}
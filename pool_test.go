@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatePool(t *testing.T) {
+	inits := 0
+	pool := NewStatePool(StatePoolOptions{
+		Init: func(L *LState) error {
+			inits++
+			if err := L.DoString(`config = {name = "pool"}`); err != nil {
+				return err
+			}
+			return nil
+		},
+	})
+	defer pool.Close()
+
+	L, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(config.name == "pool") config.name = "dirty" leaked = true`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(L)
+
+	// the returned state is reset to the state just after the initialization.
+	L, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`assert(config.name == "pool" and leaked == nil)`); err != nil {
+		t.Error(err)
+	}
+	pool.Put(L)
+	if inits != 1 {
+		t.Errorf("Init was called %v times, want 1", inits)
+	}
+
+	stats := pool.Stats()
+	if stats.Created != 1 || stats.Gets != 2 || stats.Puts != 2 || stats.Idle != 1 || stats.InUse != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestStatePoolMaxIdle(t *testing.T) {
+	pool := NewStatePool(StatePoolOptions{MaxIdle: 1})
+	defer pool.Close()
+	L1, _ := pool.Get()
+	L2, _ := pool.Get()
+	pool.Put(L1)
+	pool.Put(L2)
+	if stats := pool.Stats(); stats.Idle != 1 || stats.Discarded != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestStatePoolInitError(t *testing.T) {
+	want := errors.New("init")
+	pool := NewStatePool(StatePoolOptions{Init: func(L *LState) error { return want }})
+	defer pool.Close()
+	if _, err := pool.Get(); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+func TestStatePoolClosed(t *testing.T) {
+	pool := NewStatePool(StatePoolOptions{})
+	pool.Close()
+	if _, err := pool.Get(); err == nil {
+		t.Error("a closed pool must not return states")
+	}
+}
@@ -0,0 +1,244 @@
+package lua
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const defaultProfileInterval = 10 * time.Millisecond
+
+// profiler samples the Lua call stacks of a state. A timer goroutine only
+// increments the number of pending ticks, the stacks are recorded by the VM
+// between instructions because states are not goroutine-safe.
+type profiler struct {
+	w        io.Writer
+	interval time.Duration
+	ticks    int32
+	start    time.Time
+	done     chan struct{}
+
+	samples   map[string]*profileSample
+	order     []*profileSample
+	locations map[profileLocation]uint64
+	functions map[profileFunction]uint64
+	locList   []profileLocation
+	funcList  []profileFunction
+}
+
+type profileSample struct {
+	locations []uint64
+	count     int64
+}
+
+type profileFunction struct {
+	name      string
+	source    string
+	startLine int
+}
+
+type profileLocation struct {
+	function uint64
+	line     int
+}
+
+func newProfiler(w io.Writer, interval time.Duration) *profiler {
+	return &profiler{
+		w:         w,
+		interval:  interval,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+		samples:   make(map[string]*profileSample),
+		locations: make(map[profileLocation]uint64),
+		functions: make(map[profileFunction]uint64),
+	}
+}
+
+func (p *profiler) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			atomic.AddInt32(&p.ticks, 1)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (p *profiler) functionID(fn profileFunction) uint64 {
+	if id, ok := p.functions[fn]; ok {
+		return id
+	}
+	p.funcList = append(p.funcList, fn)
+	id := uint64(len(p.funcList))
+	p.functions[fn] = id
+	return id
+}
+
+func (p *profiler) locationID(loc profileLocation) uint64 {
+	if id, ok := p.locations[loc]; ok {
+		return id
+	}
+	p.locList = append(p.locList, loc)
+	id := uint64(len(p.locList))
+	p.locations[loc] = id
+	return id
+}
+
+// sample records the call stack of the running thread and the threads that
+// resumed it. Ticks elapsed while Go functions were running are accounted to
+// the stack at the next instruction.
+func (p *profiler) sample(L *LState) {
+	n := atomic.SwapInt32(&p.ticks, 0)
+	if n <= 0 {
+		return
+	}
+	locs := []uint64{}
+	for th := L; th != nil; th = th.Parent {
+		for cf := th.currentFrame; cf != nil; cf = cf.Parent {
+			fn := profileFunction{name: th.frameFuncName(cf), source: "[G]"}
+			line := 0
+			if !cf.Fn.IsG {
+				proto := cf.Fn.Proto
+				fn.source = proto.SourceName
+				fn.startLine = proto.LineDefined
+				if cf.Pc > 0 {
+					line = proto.DbgSourcePositions[cf.Pc-1]
+				}
+			}
+			locs = append(locs, p.locationID(profileLocation{p.functionID(fn), line}))
+		}
+	}
+	key := make([]byte, 0, len(locs)*4)
+	for _, id := range locs {
+		key = appendVarint(key, id)
+	}
+	s, ok := p.samples[string(key)]
+	if !ok {
+		s = &profileSample{locations: locs}
+		p.samples[string(key)] = s
+		p.order = append(p.order, s)
+	}
+	s.count += int64(n)
+}
+
+// write writes the samples as a gzip-compressed profile.proto message that
+// can be read by go tool pprof.
+func (p *profiler) write(end time.Time) error {
+	strs := map[string]int64{"": 0}
+	strList := []string{""}
+	str := func(s string) uint64 {
+		if i, ok := strs[s]; ok {
+			return uint64(i)
+		}
+		strs[s] = int64(len(strList))
+		strList = append(strList, s)
+		return uint64(len(strList) - 1)
+	}
+	valueType := func(typ, unit string) []byte {
+		b := appendProtoUint(nil, 1, str(typ))
+		return appendProtoUint(b, 2, str(unit))
+	}
+
+	var buf []byte
+	buf = appendProtoBytes(buf, 1, valueType("samples", "count"))
+	buf = appendProtoBytes(buf, 1, valueType("cpu", "nanoseconds"))
+	for _, s := range p.order {
+		var b []byte
+		b = appendProtoPacked(b, 1, s.locations)
+		b = appendProtoPacked(b, 2, []uint64{uint64(s.count), uint64(s.count * int64(p.interval))})
+		buf = appendProtoBytes(buf, 2, b)
+	}
+	for i, loc := range p.locList {
+		line := appendProtoUint(nil, 1, loc.function)
+		line = appendProtoUint(line, 2, uint64(loc.line))
+		b := appendProtoUint(nil, 1, uint64(i+1))
+		b = appendProtoBytes(b, 4, line)
+		buf = appendProtoBytes(buf, 4, b)
+	}
+	for i, fn := range p.funcList {
+		b := appendProtoUint(nil, 1, uint64(i+1))
+		b = appendProtoUint(b, 2, str(fn.name))
+		b = appendProtoUint(b, 3, str(fn.name))
+		b = appendProtoUint(b, 4, str(fn.source))
+		b = appendProtoUint(b, 5, uint64(fn.startLine))
+		buf = appendProtoBytes(buf, 5, b)
+	}
+	period := valueType("cpu", "nanoseconds")
+	for _, s := range strList {
+		buf = appendProtoBytes(buf, 6, []byte(s))
+	}
+	buf = appendProtoUint(buf, 9, uint64(p.start.UnixNano()))
+	buf = appendProtoUint(buf, 10, uint64(end.Sub(p.start)))
+	buf = appendProtoBytes(buf, 11, period)
+	buf = appendProtoUint(buf, 12, uint64(p.interval))
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(buf); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func appendProtoUint(b []byte, field int, x uint64) []byte {
+	if x == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, x)
+}
+
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoPacked(b []byte, field int, xs []uint64) []byte {
+	var data []byte
+	for _, x := range xs {
+		data = appendVarint(data, x)
+	}
+	return appendProtoBytes(b, field, data)
+}
+
+// StartProfile starts sampling the Lua call stacks of the state and its
+// coroutines every interval(10ms if interval <= 0). The profile is written to
+// w in the pprof format when StopProfile is called.
+func (ls *LState) StartProfile(w io.Writer, interval time.Duration) error {
+	if ls.G.profiler != nil {
+		return errors.New("profiling already in use")
+	}
+	if interval <= 0 {
+		interval = defaultProfileInterval
+	}
+	ls.G.profiler = newProfiler(w, interval)
+	ls.G.updateInstrumented()
+	go ls.G.profiler.run()
+	return nil
+}
+
+// StopProfile stops the profiling started by StartProfile and writes the
+// profile.
+func (ls *LState) StopProfile() error {
+	p := ls.G.profiler
+	if p == nil {
+		return errors.New("profiling is not started")
+	}
+	ls.G.profiler = nil
+	ls.G.updateInstrumented()
+	close(p.done)
+	return p.write(time.Now())
+}
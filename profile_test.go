@@ -0,0 +1,52 @@
+package lua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var buf bytes.Buffer
+	if err := L.StartProfile(&buf, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.StartProfile(&buf, time.Millisecond); err == nil {
+		t.Error("profiling must not be started twice")
+	}
+	if err := L.DoString(`
+	function busy()
+	  local t = os.clock()
+	  local x = 0
+	  while os.clock() - t < 0.1 do x = x + 1 end
+	  return x
+	end
+	busy()
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.StopProfile(); err == nil {
+		t.Error("profiling must not be stopped twice")
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"busy", "<string>", "cpu", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("the profile does not have %q", s)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const mapProxyClass = "GOMAP*"
+const sliceProxyClass = "GOSLICE*"
+
+// NewMapProxy returns userdata that exposes the Go map to scripts without
+// copying it. Indexing the userdata reads the map, assignments write the map
+// (assigning nil deletes the key), the length operator returns the number of
+// entries and pairs iterates over the entries. Keys and values are converted
+// between Lua and Go values, maps in the map are exposed as proxies too. m must
+// be a non-nil map, and must not be modified by other goroutines while the
+// state uses it.
+func (ls *LState) NewMapProxy(m interface{}) *LUserData {
+	rv := reflect.ValueOf(m)
+	if rv.Kind() != reflect.Map || rv.IsNil() {
+		ls.RaiseError("NewMapProxy: non-nil map expected, got %T", m)
+	}
+	return ls.newMapProxy(rv)
+}
+
+func (ls *LState) newMapProxy(rv reflect.Value) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = rv.Interface()
+	ud.Metatable = ls.mapProxyMetatable()
+	return ud
+}
+
+func (ls *LState) mapProxyMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, mapProxyClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(mapProxyClass)
+	ls.RegisterModuleToTable(mt, map[string]LGFunction{
+		"__index":    mapProxyIndex,
+		"__newindex": mapProxyNewIndex,
+		"__len":      mapProxyLen,
+		"__pairs":    mapProxyPairs,
+	})
+	ls.SetField(mt, "__metatable", LString(mapProxyClass))
+	return mt
+}
+
+func checkMapProxy(L *LState) reflect.Value {
+	ud := L.CheckUserData(1)
+	rv := reflect.ValueOf(ud.Value)
+	if rv.Kind() != reflect.Map {
+		L.ArgError(1, "map proxy expected")
+	}
+	return rv
+}
+
+func mapProxyIndex(L *LState) int {
+	rv := checkMapProxy(L)
+	key, err := toGoValue(L.CheckAny(2), rv.Type().Key())
+	if err != nil {
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(L.fromGoValue(rv.MapIndex(key)))
+	return 1
+}
+
+func mapProxyNewIndex(L *LState) int {
+	rv := checkMapProxy(L)
+	key, err := toGoValue(L.CheckAny(2), rv.Type().Key())
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+	if L.CheckAny(3) == LNil {
+		rv.SetMapIndex(key, reflect.Value{})
+		return 0
+	}
+	value, err := toGoValue(L.Get(3), rv.Type().Elem())
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	rv.SetMapIndex(key, value)
+	return 0
+}
+
+func mapProxyLen(L *LState) int {
+	L.Push(integerValue(int64(checkMapProxy(L).Len())))
+	return 1
+}
+
+// mapProxyPairs iterates over the keys of the map when pairs is called.
+// Entries deleted during the iteration are skipped.
+func mapProxyPairs(L *LState) int {
+	rv := checkMapProxy(L)
+	keys := rv.MapKeys()
+	i := 0
+	L.Push(L.NewFunction(func(L *LState) int {
+		for ; i < len(keys); i++ {
+			value := rv.MapIndex(keys[i])
+			if !value.IsValid() {
+				continue
+			}
+			L.Push(L.fromGoValue(keys[i]))
+			L.Push(L.fromGoValue(value))
+			i++
+			return 2
+		}
+		L.Push(LNil)
+		return 1
+	}))
+	L.Push(L.Get(1))
+	L.Push(LNil)
+	return 3
+}
+
+// NewSliceProxy returns userdata that exposes the Go slice to scripts without
+// copying it. Indexing the userdata with 1-based indices reads the elements,
+// assignments write them, the length operator returns the length of the slice
+// and ipairs and pairs iterate over the elements. Indices out of the range
+// read nil, and assignments to them raise errors. Elements are converted
+// between Lua and Go values like NewMapProxy does. s must be a non-nil slice.
+func (ls *LState) NewSliceProxy(s interface{}) *LUserData {
+	rv := reflect.ValueOf(s)
+	if rv.Kind() != reflect.Slice || rv.IsNil() {
+		ls.RaiseError("NewSliceProxy: non-nil slice expected, got %T", s)
+	}
+	return ls.newSliceProxy(rv)
+}
+
+func (ls *LState) newSliceProxy(rv reflect.Value) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = rv.Interface()
+	ud.Metatable = ls.sliceProxyMetatable()
+	return ud
+}
+
+func (ls *LState) sliceProxyMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, sliceProxyClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(sliceProxyClass)
+	ls.RegisterModuleToTable(mt, map[string]LGFunction{
+		"__index":    sliceProxyIndex,
+		"__newindex": sliceProxyNewIndex,
+		"__len":      sliceProxyLen,
+	})
+	iter := ls.NewFunction(sliceProxyNext)
+	pairs := ls.NewClosure(sliceProxyIpairs, iter)
+	ls.SetField(mt, "__ipairs", pairs)
+	ls.SetField(mt, "__pairs", pairs)
+	ls.SetField(mt, "__metatable", LString(sliceProxyClass))
+	return mt
+}
+
+func checkSliceProxy(L *LState) reflect.Value {
+	ud := L.CheckUserData(1)
+	rv := reflect.ValueOf(ud.Value)
+	if rv.Kind() != reflect.Slice {
+		L.ArgError(1, "slice proxy expected")
+	}
+	return rv
+}
+
+func sliceProxyIndex(L *LState) int {
+	rv := checkSliceProxy(L)
+	i, ok := toGoInteger(L.CheckAny(2))
+	if !ok || i < 1 || i > int64(rv.Len()) {
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(L.fromGoValue(rv.Index(int(i - 1))))
+	return 1
+}
+
+func sliceProxyNewIndex(L *LState) int {
+	rv := checkSliceProxy(L)
+	i, ok := toGoInteger(L.CheckAny(2))
+	if !ok || i < 1 || i > int64(rv.Len()) {
+		L.ArgError(2, fmt.Sprintf("index out of range [1, %v]", rv.Len()))
+	}
+	value, err := toGoValue(L.CheckAny(3), rv.Type().Elem())
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	rv.Index(int(i - 1)).Set(value)
+	return 0
+}
+
+func sliceProxyLen(L *LState) int {
+	L.Push(integerValue(int64(checkSliceProxy(L).Len())))
+	return 1
+}
+
+func sliceProxyIpairs(L *LState) int {
+	checkSliceProxy(L)
+	L.Push(L.Get(UpvalueIndex(1)))
+	L.Push(L.Get(1))
+	L.Push(integerValue(0))
+	return 3
+}
+
+func sliceProxyNext(L *LState) int {
+	rv := checkSliceProxy(L)
+	i := L.CheckInt(2) + 1
+	if i > rv.Len() {
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(integerValue(int64(i)))
+	L.Push(L.fromGoValue(rv.Index(i - 1)))
+	return 2
+}
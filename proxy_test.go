@@ -0,0 +1,109 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMapProxy(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	config := map[string]int{"width": 640, "height": 480}
+	nested := map[string]map[string]int{"size": config}
+	L.SetGlobal("config", L.NewMapProxy(config))
+	L.SetGlobal("nested", L.NewMapProxy(nested))
+	err := L.DoString(`
+	assert(config.width == 640 and config.missing == nil)
+	assert(config[1] == nil, "keys of other types read nil")
+	assert(#config == 2)
+	config.depth = 32
+	config.height = nil
+	local n = 0
+	for k, v in pairs(config) do
+	  assert(config[k] == v)
+	  n = n + 1
+	end
+	assert(n == 2, tostring(n))
+	assert(getmetatable(config) == "GOMAP*")
+
+	-- maps in the map are proxies of the same map.
+	nested.size.width = 800
+	assert(config.width == 800)
+
+	local ok, err = pcall(function() config.width = "wide" end)
+	assert(not ok, "values of other types can not be assigned")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["depth"] != 32 || config["width"] != 800 {
+		t.Errorf("got %v", config)
+	}
+	if _, ok := config["height"]; ok {
+		t.Error("assigning nil must delete the key")
+	}
+
+	L.SetGlobal("proxy", L.NewFunction(func(L *LState) int {
+		L.Push(L.NewMapProxy(L.CheckAny(1)))
+		return 1
+	}))
+	if err := L.DoString(`proxy({})`); err == nil || !strings.Contains(err.Error(), "non-nil map expected") {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestMapProxyDeleteInPairs(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	m := map[int]bool{1: true, 2: true, 3: true, 4: true}
+	L.SetGlobal("m", L.NewMapProxy(m))
+	// entries deleted during the iteration are skipped.
+	err := L.DoString(`
+	local n = 0
+	for k in pairs(m) do
+	  n = n + 1
+	  for other in pairs(m) do
+	    if other ~= k then m[other] = nil end
+	  end
+	end
+	assert(n == 1 and #m == 1, tostring(n))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSliceProxy(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	samples := []float64{1.5, 2.5, 3}
+	L.SetGlobal("samples", L.NewSliceProxy(samples))
+	L.SetGlobal("matrix", L.NewSliceProxy([][]int{{1, 2}, {3, 4}}))
+	err := L.DoString(`
+	assert(#samples == 3 and samples[1] == 1.5 and samples[3] == 3)
+	assert(samples[0] == nil and samples[4] == nil and samples.x == nil)
+	samples[2] = 10
+
+	local sum = 0
+	for i, v in ipairs(samples) do sum = sum + v end
+	assert(sum == 14.5, tostring(sum))
+	local n = 0
+	for i, v in pairs(samples) do n = n + i end
+	assert(n == 6)
+
+	-- the slice never grows.
+	local ok, err = pcall(function() samples[4] = 1 end)
+	assert(not ok and err:find("index out of range"), tostring(err))
+	ok = pcall(function() samples[1] = "x" end)
+	assert(not ok, "values of other types can not be assigned")
+
+	-- slices in the slice are proxies too.
+	assert(matrix[2][1] == 3 and #matrix[1] == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples[1] != 10 {
+		t.Errorf("got %v, want 10", samples[1])
+	}
+}
@@ -0,0 +1,300 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+var (
+	lvalueType    = reflect.TypeOf((*LValue)(nil)).Elem()
+	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// fromGoValue converts the Go value to a Lua value. Maps, slices, structs and
+// pointers to structs are converted to proxies(see NewMapProxy,
+// NewSliceProxy and NewStructProxy), functions are wrapped by
+// NewFunctionFromGo, channels are wrapped by NewChannel, shared tables are
+// wrapped by NewSharedTableValue, string buffers are wrapped by
+// NewStringBufferValue, times are wrapped by NewTime, and other
+// values that have no Lua counterparts are converted to userdata holding them.
+func (ls *LState) fromGoValue(rv reflect.Value) LValue {
+	if !rv.IsValid() {
+		return LNil
+	}
+	if rv.Type() == sharedTableType && !rv.IsNil() {
+		return ls.NewSharedTableValue(rv.Interface().(*SharedTable))
+	}
+	if rv.Type() == stringBufferType && !rv.IsNil() {
+		return ls.NewStringBufferValue(rv.Interface().(*StringBuffer))
+	}
+	if rv.Type() == timeType {
+		return ls.NewTime(rv.Interface().(time.Time))
+	}
+	if rv.Type().Implements(lvalueType) {
+		if rv.Kind() == reflect.Interface && rv.IsNil() {
+			return LNil
+		}
+		return rv.Interface().(LValue)
+	}
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return LNil
+		}
+		return ls.fromGoValue(rv.Elem())
+	case reflect.Bool:
+		return LBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return integerValue(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v := rv.Uint(); v <= math.MaxInt64 {
+			return integerValue(int64(v))
+		}
+		return LNumber(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return LNumber(rv.Float())
+	case reflect.String:
+		return LString(rv.String())
+	case reflect.Map:
+		if rv.IsNil() {
+			return LNil
+		}
+		return ls.newMapProxy(rv)
+	case reflect.Slice:
+		if rv.IsNil() {
+			return LNil
+		}
+		return ls.newSliceProxy(rv)
+	case reflect.Struct:
+		return ls.newStructProxy(rv)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return LNil
+		}
+		if rv.Elem().Kind() == reflect.Struct {
+			return ls.newStructProxy(rv)
+		}
+	case reflect.Func:
+		if rv.IsNil() {
+			return LNil
+		}
+		return ls.newFunctionFromGo(rv)
+	case reflect.Chan:
+		if rv.IsNil() {
+			return LNil
+		}
+		return ls.newChannel(rv)
+	}
+	ud := ls.NewUserData()
+	ud.Value = rv.Interface()
+	return ud
+}
+
+// toGoValue converts the Lua value to a Go value of the type.
+func toGoValue(lv LValue, typ reflect.Type) (reflect.Value, error) {
+	if typ == lvalueType {
+		return reflect.ValueOf(&lv).Elem(), nil
+	}
+	if typ == timeType {
+		if t, ok := toTime(lv); ok {
+			return reflect.ValueOf(t), nil
+		}
+	}
+	if typ == interfaceType {
+		rv := reflect.New(typ).Elem()
+		switch lv.(type) {
+		case *LTable:
+			// tables are copied, so Go does not hold the internals of the state.
+			v, err := Converter{}.ToGo(lv)
+			if err != nil {
+				return rv, err
+			}
+			rv.Set(reflect.ValueOf(v))
+			return rv, nil
+		case *LFunction, *LState:
+			return rv, fmt.Errorf("cannot convert %v to %v", lv.Type(), typ)
+		}
+		if v := toGoInterface(lv); v != nil {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return rv, nil
+	}
+	if reflect.TypeOf(lv).AssignableTo(typ) && lv != LNil {
+		return reflect.ValueOf(lv), nil
+	}
+	if tb, ok := lv.(*LTable); ok && isDecodableKind(typ) {
+		rv := reflect.New(typ).Elem()
+		if err := newTableConverter(Converter{}).decode(tb, rv); err != nil {
+			return rv, err
+		}
+		return rv, nil
+	}
+	if ud, ok := lv.(*LUserData); ok && ud.Value != nil {
+		v := reflect.ValueOf(ud.Value)
+		if v.Type().AssignableTo(typ) {
+			return v, nil
+		}
+		if v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Type().AssignableTo(typ) {
+			return v.Elem(), nil
+		}
+	}
+	rv := reflect.New(typ).Elem()
+	if lv == LNil {
+		switch typ.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return rv, nil
+		}
+		return rv, fmt.Errorf("cannot convert nil to %v", typ)
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		if b, ok := lv.(LBool); ok {
+			rv.SetBool(bool(b))
+			return rv, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := toGoInteger(lv); ok && !rv.OverflowInt(i) {
+			rv.SetInt(i)
+			return rv, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := toGoInteger(lv); ok && i >= 0 && !rv.OverflowUint(uint64(i)) {
+			rv.SetUint(uint64(i))
+			return rv, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toFloatValue(lv); ok {
+			rv.SetFloat(float64(f))
+			return rv, nil
+		}
+	case reflect.String:
+		if s, ok := lv.(LString); ok {
+			rv.SetString(string(s))
+			return rv, nil
+		}
+	}
+	return rv, fmt.Errorf("cannot convert %v to %v", lv.Type(), typ)
+}
+
+// isDecodableKind reports whether tables are decoded into values of the type
+// by Converter.Decode.
+func isDecodableKind(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+		return true
+	case reflect.Ptr:
+		return typ.Elem().Kind() == reflect.Struct
+	}
+	return false
+}
+
+// toGoInteger returns the integer value of the number.
+func toGoInteger(lv LValue) (int64, bool) {
+	switch v := lv.(type) {
+	case LInteger:
+		return int64(v), true
+	case LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return int64(f), true
+		}
+	}
+	return 0, false
+}
+
+// toGoInterface converts the Lua value to the natural Go value: nil, bool,
+// float64, int64(for LInteger), string or the value held by userdata. Other
+// values are returned as they are.
+func toGoInterface(lv LValue) interface{} {
+	switch v := lv.(type) {
+	case *LNilType:
+		return nil
+	case LBool:
+		return bool(v)
+	case LNumber:
+		return float64(v)
+	case LInteger:
+		return int64(v)
+	case LString:
+		return string(v)
+	case *LUserData:
+		return v.Value
+	}
+	return lv
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// NewFunctionFromGo returns a Lua function that calls the Go function. Lua
+// arguments are converted to the parameter types of fn(variadic parameters
+// take the rest of the arguments), and the results are converted to Lua values.
+// Tables are decoded into slice, array, map, struct and pointer to struct
+// parameters like Converter.Decode, and are copied into interface{} parameters
+// like Converter.ToGo. Functions and threads are passed only to LValue,
+// *LFunction and *LState parameters. A non-nil error returned as the last result is raised as a Lua
+// error and is not returned to the script. Arguments that can not be converted
+// raise errors. LGFunctions are returned as they are by NewFunction.
+func (ls *LState) NewFunctionFromGo(fn interface{}) *LFunction {
+	switch f := fn.(type) {
+	case LGFunction:
+		return ls.NewFunction(f)
+	case func(*LState) int:
+		return ls.NewFunction(f)
+	}
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		ls.RaiseError("NewFunctionFromGo: non-nil function expected, got %T", fn)
+	}
+	return ls.newFunctionFromGo(rv)
+}
+
+func (ls *LState) newFunctionFromGo(rv reflect.Value) *LFunction {
+	return ls.NewFunction(func(L *LState) int {
+		return L.callGoFunc(rv, 1)
+	})
+}
+
+// callGoFunc calls the Go function with the arguments from the base-th
+// argument and pushes the results. A non-nil error returned as the last result
+// is raised as a Lua error.
+func (ls *LState) callGoFunc(fn reflect.Value, base int) int {
+	typ := fn.Type()
+	nargs := ls.GetTop() - base + 1
+	if nargs < 0 {
+		nargs = 0
+	}
+	nin := typ.NumIn()
+	if typ.IsVariadic() {
+		nin--
+	}
+	args := make([]reflect.Value, 0, nargs)
+	for i := 0; i < nargs || i < nin; i++ {
+		var t reflect.Type
+		switch {
+		case i < nin:
+			t = typ.In(i)
+		case typ.IsVariadic():
+			t = typ.In(nin).Elem()
+		default:
+			ls.RaiseError("too many arguments: %v expected, got %v", nin, nargs)
+		}
+		arg, err := toGoValue(ls.Get(base+i), t)
+		if err != nil {
+			ls.ArgError(base+i, err.Error())
+		}
+		args = append(args, arg)
+	}
+	results := fn.Call(args)
+	if n := len(results); n > 0 && typ.Out(n-1) == errorType {
+		if err := results[n-1]; !err.IsNil() {
+			ls.RaiseError("%s", err.Interface().(error).Error())
+		}
+		results = results[:n-1]
+	}
+	for _, result := range results {
+		ls.Push(ls.fromGoValue(result))
+	}
+	return len(results)
+}
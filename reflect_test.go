@@ -0,0 +1,123 @@
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func doStringWithGo(t *testing.T, L *LState, name string, fn interface{}, code string) {
+	t.Helper()
+	L.SetGlobal(name, L.NewFunctionFromGo(fn))
+	if err := L.DoString(code); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewFunctionFromGoSliceParameter(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	doStringWithGo(t, L, "sum", func(xs []int) int {
+		total := 0
+		for _, x := range xs {
+			total += x
+		}
+		return total
+	}, `assert(sum({1, 2, 3}) == 6)`)
+}
+
+func TestNewFunctionFromGoMapParameter(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var got map[string]int
+	doStringWithGo(t, L, "set", func(m map[string]int) {
+		got = m
+	}, `set({a = 1, b = 2})`)
+	if want := map[string]int{"a": 1, "b": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+type reflectTestPerson struct {
+	Name string `lua:"name"`
+	Age  int
+}
+
+func TestNewFunctionFromGoStructParameter(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	doStringWithGo(t, L, "greet", func(p reflectTestPerson) string {
+		return p.Name + " " + strings.Repeat("!", p.Age)
+	}, `assert(greet({name = "Bob", Age = 3}) == "Bob !!!")`)
+	doStringWithGo(t, L, "birthday", func(p *reflectTestPerson) int {
+		p.Age++
+		return p.Age
+	}, `assert(birthday({Age = 41}) == 42)`)
+}
+
+func TestNewFunctionFromGoTableErrors(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("sum", L.NewFunctionFromGo(func(xs []int) int { return len(xs) }))
+	err := L.DoString(`sum({1, "x"})`)
+	if err == nil || !strings.Contains(err.Error(), "bad argument #1 to sum") {
+		t.Errorf("got %v, want an argument error", err)
+	}
+}
+
+func TestNewFunctionFromGoInterfaceParameter(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var got interface{}
+	L.SetGlobal("keep", L.NewFunctionFromGo(func(v interface{}) { got = v }))
+	if err := L.DoString(`keep({x = {1, 2}})`); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"x": []interface{}{float64(1), float64(2)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if err := L.DoString(`keep(print)`); err == nil {
+		t.Error("functions must not be passed to interface{} parameters")
+	}
+}
+
+func TestNewFunctionFromGoVariadic(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	doStringWithGo(t, L, "join", func(sep string, parts ...string) string {
+		return strings.Join(parts, sep)
+	}, `
+	assert(join(",") == "")
+	assert(join(",", "a", "b", "c") == "a,b,c")
+	assert(not pcall(join, ",", "a", {}))
+	`)
+}
+
+func TestNewFunctionFromGoErrorResult(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	doStringWithGo(t, L, "check", func(ok bool) (string, error) {
+		if !ok {
+			return "", errors.New("not ok")
+		}
+		return "ok", nil
+	}, `
+	assert(select("#", check(true)) == 1)
+	assert(check(true) == "ok")
+	local ok, err = pcall(check, false)
+	assert(not ok and err:find("not ok"))
+	`)
+}
+
+func TestNewFunctionFromGoMultipleResults(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	doStringWithGo(t, L, "divmod", func(a, b int) (int, int) {
+		return a / b, a % b
+	}, `
+	local q, r = divmod(7, 2)
+	assert(q == 3 and r == 1)
+	`)
+}
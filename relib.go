@@ -0,0 +1,246 @@
+package lua
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const regexpClass = "REGEXP*"
+
+// OpenRe opens the re module, which is not opened by OpenLibs. The module
+// matches strings with Go regular expressions(RE2 syntax), which run in time
+// linear in the size of the input unlike Lua patterns. OpenRe can be given to
+// LState.PreloadModule as a loader.
+func OpenRe(L *LState) int {
+	mod := L.RegisterModule("re", reFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var reFuncs = map[string]LGFunction{
+	"compile": reCompile,
+	"quote":   reQuote,
+	"find":    reFunction(reFind),
+	"match":   reFunction(reMatch),
+	"gmatch":  reFunction(reGmatch),
+	"gsub":    reFunction(reGsub),
+	"split":   reFunction(reSplit),
+}
+
+// NewRegexpValue returns userdata that exposes the compiled regular expression
+// to scripts with the methods find, match, gmatch, gsub and split of the re
+// module, whose first arguments are the subject strings.
+func (ls *LState) NewRegexpValue(re *regexp.Regexp) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = re
+	ud.Metatable = ls.regexpMetatable()
+	return ud
+}
+
+func (ls *LState) regexpMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, regexpClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(regexpClass)
+	ls.SetField(mt, "__index", ls.RegisterModuleToTable(ls.NewTable(), map[string]LGFunction{
+		"find":   reMethod(reFind),
+		"match":  reMethod(reMatch),
+		"gmatch": reMethod(reGmatch),
+		"gsub":   reMethod(reGsub),
+		"split":  reMethod(reSplit),
+	}))
+	ls.SetField(mt, "__tostring", ls.NewFunction(regexpToString))
+	ls.SetField(mt, "__metatable", LString(regexpClass))
+	return mt
+}
+
+// reFunc is a function of the re module. Its optional arguments start at the
+// stack index 3 whether it is called as a function or as a method.
+type reFunc func(L *LState, re *regexp.Regexp, str string) int
+
+// reFunction returns the module function, which takes the subject string and
+// the pattern.
+func reFunction(fn reFunc) LGFunction {
+	return func(L *LState) int {
+		str := L.CheckString(1)
+		return fn(L, checkRegexp(L, 2), str)
+	}
+}
+
+// reMethod returns the method of compiled patterns, which takes the subject
+// string.
+func reMethod(fn reFunc) LGFunction {
+	return func(L *LState) int {
+		re := CheckUserDataValue[*regexp.Regexp](L, 1)
+		return fn(L, re, L.CheckString(2))
+	}
+}
+
+// checkRegexp returns the compiled pattern or compiles the pattern string at
+// the stack index n. Compiled pattern strings are cached like Lua patterns.
+func checkRegexp(L *LState, n int) *regexp.Regexp {
+	if re, ok := ToUserDataValue[*regexp.Regexp](L.Get(n)); ok {
+		return re
+	}
+	re, err := compileCachedRegex(L.CheckString(n), false)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return re
+}
+
+// reCompile returns the compiled pattern, or nil and an error message if the
+// pattern is invalid.
+func reCompile(L *LState) int {
+	re, err := regexp.Compile(L.CheckString(1))
+	if err != nil {
+		L.Push(LNil)
+		L.Push(LString(err.Error()))
+		return 2
+	}
+	L.Push(L.NewRegexpValue(re))
+	return 1
+}
+
+func reQuote(L *LState) int {
+	L.Push(L.allocateString(regexp.QuoteMeta(L.CheckString(1))))
+	return 1
+}
+
+// reInit returns the byte offset given by the optional 1-based position at the
+// stack index 3, or -1 if it is after the end of the string.
+func reInit(L *LState, str string) int {
+	init := luaIndex2StringIndex(str, L.OptInt(3, 1), true)
+	if init > len(str) {
+		return -1
+	}
+	return init
+}
+
+// pushCaptures pushes the captures of the match, or the whole match if the
+// pattern has no groups. Groups that did not participate in the match are nil.
+func pushCaptures(L *LState, str string, match []int) int {
+	if len(match) == 2 {
+		L.Push(LString(str[match[0]:match[1]]))
+		return 1
+	}
+	for i := 2; i < len(match); i += 2 {
+		if match[i] < 0 {
+			L.Push(LNil)
+		} else {
+			L.Push(LString(str[match[i]:match[i+1]]))
+		}
+	}
+	return len(match)/2 - 1
+}
+
+// reFind returns the 1-based start and end positions of the first match after
+// init and the captures, or nil.
+func reFind(L *LState, re *regexp.Regexp, str string) int {
+	init := reInit(L, str)
+	if init < 0 {
+		L.Push(LNil)
+		return 1
+	}
+	match := re.FindStringSubmatchIndex(str[init:])
+	if match == nil {
+		L.Push(LNil)
+		return 1
+	}
+	L.Push(integerValue(int64(init + match[0] + 1)))
+	L.Push(integerValue(int64(init + match[1])))
+	if len(match) == 2 {
+		return 2
+	}
+	return pushCaptures(L, str[init:], match) + 2
+}
+
+// reMatch returns the captures of the first match after init, or nil.
+func reMatch(L *LState, re *regexp.Regexp, str string) int {
+	init := reInit(L, str)
+	if init < 0 {
+		L.Push(LNil)
+		return 1
+	}
+	match := re.FindStringSubmatchIndex(str[init:])
+	if match == nil {
+		L.Push(LNil)
+		return 1
+	}
+	return pushCaptures(L, str[init:], match)
+}
+
+// reGmatch returns an iterator over the captures of the matches.
+func reGmatch(L *LState, re *regexp.Regexp, str string) int {
+	matches := re.FindAllStringSubmatchIndex(str, -1)
+	L.Push(L.NewFunction(func(L *LState) int {
+		if len(matches) == 0 {
+			return 0
+		}
+		match := matches[0]
+		matches = matches[1:]
+		return pushCaptures(L, str, match)
+	}))
+	return 1
+}
+
+// reGsub replaces the first n(all by default) matches with repl and returns
+// the result and the number of the matches. A string repl is expanded like
+// regexp.Regexp.Expand($1 or ${name} is a capture). A table repl is indexed by
+// the first capture, and a function repl is called with the captures. The
+// match is kept if they return false or nil.
+func reGsub(L *LState, re *regexp.Regexp, str string) int {
+	L.CheckTypes(3, LTString, LTTable, LTFunction)
+	repl := L.Get(3)
+	matches := re.FindAllStringSubmatchIndex(str, L.OptInt(4, -1))
+	infoList := make([]replaceInfo, 0, len(matches))
+	for _, match := range matches {
+		var value LValue
+		switch lv := repl.(type) {
+		case LString:
+			value = LString(re.ExpandString(nil, string(lv), str, match))
+		case *LTable:
+			top := L.GetTop()
+			pushCaptures(L, str, match)
+			value = L.getField(lv, L.Get(top+1))
+			L.SetTop(top)
+		case *LFunction:
+			top := L.GetTop()
+			L.Push(lv)
+			L.Call(pushCaptures(L, str, match), 1)
+			value = L.Get(-1)
+			L.SetTop(top)
+		}
+		if LVIsFalse(value) {
+			continue
+		}
+		switch value.(type) {
+		case LString, LNumber, LInteger:
+		default:
+			L.RaiseError("invalid replacement value (a %v)", value.Type())
+		}
+		infoList = append(infoList, replaceInfo{[]int{match[0], match[1]}, LVAsString(value)})
+	}
+	L.Push(L.allocateString(strGsubDoReplace(str, infoList)))
+	L.Push(integerValue(int64(len(matches))))
+	return 2
+}
+
+// reSplit returns a table of the substrings between the matches. n limits the
+// number of the substrings like regexp.Regexp.Split.
+func reSplit(L *LState, re *regexp.Regexp, str string) int {
+	parts := re.Split(str, L.OptInt(3, -1))
+	tb := L.CreateTable(len(parts), 0)
+	for _, part := range parts {
+		tb.Append(LString(part))
+	}
+	L.Push(tb)
+	return 1
+}
+
+func regexpToString(L *LState) int {
+	re := CheckUserDataValue[*regexp.Regexp](L, 1)
+	L.Push(LString(fmt.Sprintf("regexp: %v", re)))
+	return 1
+}
@@ -0,0 +1,56 @@
+package lua
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestReModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("re", OpenRe)
+	err := L.DoString(`
+	local re = require("re")
+	local s, e, k, v = re.find("x a=1", [[(\w+)=(\w+)]])
+	assert(s == 3 and e == 5 and k == "a" and v == "1")
+	assert(re.find("abc", "z") == nil)
+	assert(re.find("abcabc", "b", 3) == 5)
+	assert(re.match("2024-01-02", [[\d+]]) == "2024")
+	local a, b = re.match("ab", "(a)(x)?")
+	assert(a == "a" and b == nil)
+
+	local keys = {}
+	for k, v in re.gmatch("a=1, b=2", [[(\w+)=(\w+)]]) do keys[#keys + 1] = k .. v end
+	assert(table.concat(keys, ",") == "a1,b2")
+
+	local r, n = re.gsub("2024-01-02", [[(\d+)-(\d+)-(\d+)]], "$3/$2/$1")
+	assert(r == "02/01/2024" and n == 1)
+	assert(re.gsub("a b", [[(?P<w>\w)]], "<${w}>") == "<a> <b>")
+	assert(re.gsub("a b c", [[\w]], {a = "1", b = false}) == "1 b c")
+	assert(re.gsub("a b c", [[\w]], string.upper, 2) == "A B c")
+
+	local parts = re.split("a, b,c", [[,\s*]])
+	assert(#parts == 3 and parts[2] == "b")
+	assert(#re.split("a,b,c", ",", 2) == 2)
+	assert(re.quote("a.b*c") == [[a\.b\*c]])
+
+	local kv = assert(re.compile([[(\w+)=(\w+)]]))
+	assert(select(2, kv:match("a=1")) == "1")
+	assert(kv:gsub("a=1", "$2=$1") == "1=a")
+	local p, err = re.compile("(")
+	assert(p == nil and type(err) == "string")
+	assert(not pcall(re.find, "a", "("))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRegexpValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("words", L.NewRegexpValue(regexp.MustCompile(`[a-z]+`)))
+	if err := L.DoString(`assert(words:find("12 ab") == 4 and words:match("12 ab") == "ab")`); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,154 @@
+package lua
+
+import (
+	"slices"
+	"weak"
+)
+
+// ReloadOptions are the options for LState.ReloadModule.
+type ReloadOptions struct {
+	// Patch keeps the table of the old module and patches it with the fields of
+	// the new module, so references to the old module held by other modules
+	// see the new code. Lua functions of the old module are updated in place:
+	// they run the new code, and their upvalues keep the values of the old
+	// functions unless the new upvalues hold functions. Functions that are
+	// running, on the stack of the state or of a suspended coroutine, are not
+	// patched: they finish with the old code, and the module gets the new
+	// functions, which share the upvalues of the old ones.
+	Patch bool
+}
+
+// ReloadModule loads the module with the loaders of require again(even if it
+// is already loaded) and replaces package.loaded[name] with the new module.
+// package.loaded[name] is left unchanged if the module can not be loaded.
+func (ls *LState) ReloadModule(name string, opts ReloadOptions) (LValue, *ApiError) {
+	loaded, ok := ls.GetField(ls.Get(RegistryIndex), "_LOADED").(*LTable)
+	if !ok {
+		return LNil, newApiError(ApiErrorRun, "package.loaded must be a table", LNil)
+	}
+	old := ls.GetField(loaded, name)
+	top := ls.GetTop()
+	defer ls.SetTop(top)
+	ls.Push(ls.NewFunction(func(L *LState) int {
+		L.Push(loLoadModule(L, loaded, name))
+		return 1
+	}))
+	if err := ls.PCall(0, 1, nil); err != nil {
+		ls.SetField(loaded, name, old)
+		return LNil, err
+	}
+	mod := ls.Get(-1)
+	if opts.Patch {
+		oldtb, ok1 := old.(*LTable)
+		newtb, ok2 := mod.(*LTable)
+		if ok1 && ok2 && oldtb != newtb {
+			patchModule(oldtb, newtb, ls.G.runningFunctions())
+			mod = oldtb
+		}
+	}
+	ls.SetField(loaded, name, mod)
+	return mod, nil
+}
+
+// patchModule replaces the fields of the old module with the fields of the new
+// module. Lua functions found in both modules are patched instead, so the
+// old function values stay valid, unless they are running.
+func patchModule(old, new *LTable, running map[*LFunction]bool) {
+	keys := []LValue{}
+	old.ForEach(func(key, value LValue) {
+		if new.RawGet(key) == LNil {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		old.RawSet(key, LNil)
+	}
+	new.ForEach(func(key, value LValue) {
+		if value == LValue(new) {
+			// _M and similar fields refer to the module itself.
+			value = old
+		}
+		oldfn, ok1 := old.RawGet(key).(*LFunction)
+		newfn, ok2 := value.(*LFunction)
+		if ok1 && ok2 && !oldfn.IsG && !newfn.IsG {
+			upvalues := patchUpvalues(oldfn, newfn, old, new)
+			if running[oldfn] {
+				// frames of the old function run its code and upvalues.
+				newfn.Upvalues = upvalues
+				old.RawSet(key, newfn)
+				return
+			}
+			oldfn.Proto = newfn.Proto
+			oldfn.Env = newfn.Env
+			oldfn.Upvalues = upvalues
+			return
+		}
+		old.RawSet(key, value)
+	})
+}
+
+// patchUpvalues returns the upvalues of the new function patched into the old
+// function. Upvalues with the same name as an upvalue of the old function keep
+// their old values unless they hold functions. Upvalues referring to the new
+// module are redirected to the old module.
+func patchUpvalues(old, new *LFunction, oldmod, newmod *LTable) []*Upvalue {
+	upvalues := make([]*Upvalue, len(new.Upvalues))
+	for i, uv := range new.Upvalues {
+		upvalues[i] = uv
+		if i >= len(new.Proto.DbgUpvalues) {
+			continue
+		}
+		if _, ok := uv.Value().(*LFunction); ok {
+			continue
+		}
+		for j, name := range old.Proto.DbgUpvalues {
+			if name == new.Proto.DbgUpvalues[i] && j < len(old.Upvalues) {
+				upvalues[i] = old.Upvalues[j]
+				break
+			}
+		}
+		if upvalues[i] == uv && uv.Value() == LValue(newmod) {
+			upvalues[i] = &Upvalue{value: oldmod, closed: true}
+		}
+	}
+	return upvalues
+}
+
+// addCoroutine remembers the coroutine without keeping it alive. Collected and
+// dead coroutines are forgotten when the list is full.
+func (g *Global) addCoroutine(co *LState) {
+	if len(g.coroutines) == cap(g.coroutines) {
+		live := g.coroutines[:0]
+		for _, p := range g.coroutines {
+			if co := p.Value(); co != nil && !co.Dead {
+				live = append(live, p)
+			}
+		}
+		clear(g.coroutines[len(live):])
+		// the list grows if most of the coroutines are alive.
+		g.coroutines = slices.Grow(live, len(live))
+	}
+	g.coroutines = append(g.coroutines, weak.Make(co))
+}
+
+// runningFunctions returns the functions that have frames on the stacks of the
+// main thread and of the coroutines that are not dead.
+func (g *Global) runningFunctions() map[*LFunction]bool {
+	running := map[*LFunction]bool{}
+	add := func(th *LState) {
+		for i := 0; i < th.stack.Sp(); i++ {
+			if fn := th.stack.At(i).Fn; fn != nil {
+				running[fn] = true
+			}
+		}
+	}
+	if g.MainThread != nil {
+		add(g.MainThread)
+	}
+	for _, p := range g.coroutines {
+		if co := p.Value(); co != nil && !co.Dead {
+			add(co)
+		}
+	}
+	return running
+}
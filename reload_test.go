@@ -0,0 +1,134 @@
+package lua
+
+import "testing"
+
+// sourceLoader returns a module loader that runs the current value of src.
+func sourceLoader(src *string) LGFunction {
+	return func(L *LState) int {
+		fn, err := L.LoadString(*src)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		L.Push(fn)
+		L.Call(0, 1)
+		return 1
+	}
+}
+
+func TestReloadModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	src := `
+	local M = {}
+	local count = 0
+	function M.next() count = count + 1 return count end
+	M.version = 1
+	return M
+	`
+	L.PreloadModule("counter", sourceLoader(&src))
+	if err := L.DoString(`
+	counter = require("counter")
+	next = counter.next
+	assert(next() == 1 and next() == 2)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	// without Patch, the old module is replaced.
+	src = `return {version = 2}`
+	if _, err := L.ReloadModule("counter", ReloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`
+	assert(require("counter").version == 2 and counter.version == 1)
+	`); err != nil {
+		t.Error(err)
+	}
+
+	// a module that fails to load leaves package.loaded unchanged.
+	src = `error("broken")`
+	if _, err := L.ReloadModule("counter", ReloadOptions{}); err == nil {
+		t.Error("got no error, want the error of the module")
+	}
+	if err := L.DoString(`assert(require("counter").version == 2)`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReloadModulePatch(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	src := `
+	local M = {}
+	local count = 0
+	function M.next() count = count + 1 return count end
+	M.version = 1
+	M.old = true
+	return M
+	`
+	L.PreloadModule("counter", sourceLoader(&src))
+	if err := L.DoString(`
+	counter = require("counter")
+	next = counter.next
+	assert(next() == 1 and next() == 2)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	src = `
+	local M = {}
+	local count = 0
+	function M.next() count = count + 10 return count end
+	M.version = 2
+	return M
+	`
+	mod, err := L.ReloadModule("counter", ReloadOptions{Patch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod != L.GetGlobal("counter") {
+		t.Error("the table of the old module must be kept")
+	}
+	// old references run the new code, and count keeps its value.
+	if err := L.DoString(`
+	assert(counter.version == 2 and counter.old == nil)
+	assert(next == counter.next)
+	local n = next()
+	assert(n == 12, tostring(n))
+	`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReloadModuleRunning(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	src := `
+	local M = {}
+	function M.run() coroutine.yield("old") return "old" end
+	return M
+	`
+	L.PreloadModule("job", sourceLoader(&src))
+	if err := L.DoString(`
+	job = require("job")
+	co = coroutine.wrap(job.run)
+	assert(co() == "old")
+	`); err != nil {
+		t.Fatal(err)
+	}
+	src = `
+	local M = {}
+	function M.run() coroutine.yield("new") return "new" end
+	return M
+	`
+	if _, err := L.ReloadModule("job", ReloadOptions{Patch: true}); err != nil {
+		t.Fatal(err)
+	}
+	// the suspended function finishes with the old code.
+	if err := L.DoString(`
+	assert(co() == "old")
+	assert(coroutine.wrap(job.run)() == "new")
+	`); err != nil {
+		t.Error(err)
+	}
+}
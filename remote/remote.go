@@ -0,0 +1,400 @@
+// Package remote implements an opt-in server to inspect a live state. An
+// operator connects to a local socket(for example with nc or socat) and
+// evaluates expressions and inspects globals line by line.
+//
+// Requests are executed by the goroutine running the state: an instruction
+// hook polls them while the state runs Lua code, and the program calls
+// Server.Poll while the state is idle.
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// DefaultPollInterval is the number of instructions between polls.
+const DefaultPollInterval = 10000
+
+// maxFields is the maximum number of fields printed for a table by :dump.
+const maxFields = 200
+
+// Options are the options for a server.
+type Options struct {
+	// ReadOnly allows only variables and fields, like "a.b[1]", to be
+	// inspected. They are read without metamethods, so no code runs in the
+	// state.
+	ReadOnly bool
+	// PollInterval is the number of instructions between polls while the state
+	// runs. 0 means DefaultPollInterval and a negative value disables the
+	// instruction hook, the program has to call Poll then.
+	PollInterval int64
+}
+
+type job struct {
+	line string
+	done chan string
+}
+
+// Server is a remote inspection server for a state.
+type Server struct {
+	L       *lua.LState
+	options Options
+	jobs    chan *job
+	polling bool
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
+	// done is closed by Close, so connections waiting for the state stop.
+	done chan struct{}
+}
+
+// NewServer returns a server for the state. This sets an instruction hook of
+// the state unless PollInterval is negative, so this must be called by the
+// goroutine running the state. An instruction hook that is already set is
+// still called about every its interval instructions.
+func NewServer(L *lua.LState, opts Options) *Server {
+	s := &Server{L: L, options: opts, jobs: make(chan *job, 16), done: make(chan struct{})}
+	interval := opts.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	if interval <= 0 {
+		return s
+	}
+	prevInterval, prev := L.InstructionHook()
+	if prev == nil {
+		L.SetInstructionHook(interval, func(L *lua.LState) {
+			s.poll(L)
+		})
+		return s
+	}
+	// the hook is called every min(interval, prevInterval) instructions and
+	// calls the previous hook each time the count passes a multiple of its
+	// interval.
+	prevCount := L.InstructionCount() / prevInterval
+	L.SetInstructionHook(min(interval, prevInterval), func(L *lua.LState) {
+		if count := L.InstructionCount() / prevInterval; count != prevCount {
+			prevCount = count
+			prev(L)
+		}
+		s.poll(L)
+	})
+	return s
+}
+
+// Poll executes the pending requests. This must be called by the goroutine
+// running the state.
+func (s *Server) Poll() {
+	s.poll(s.L)
+}
+
+func (s *Server) poll(L *lua.LState) {
+	if s.polling {
+		return
+	}
+	s.polling = true
+	defer func() { s.polling = false }()
+	for {
+		select {
+		case j := <-s.jobs:
+			j.done <- s.execute(L, j.line)
+		default:
+			return
+		}
+	}
+}
+
+// ListenAndServe listens on the local address and serves connections. The
+// network must be "unix" or "tcp" with a loopback address.
+func (s *Server) ListenAndServe(network, address string) error {
+	switch network {
+	case "unix":
+	case "tcp", "tcp4", "tcp6":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("remote: %v is not a loopback address", address)
+		}
+	default:
+		return fmt.Errorf("remote: unsupported network: %v", network)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves connections accepted by the listener until the server is
+// closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return errors.New("remote: server closed")
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners. Connections are closed when they send the next
+// request or while they wait for the state.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	var err error
+	for _, ln := range s.listeners {
+		if e := ln.Close(); e != nil {
+			err = e
+		}
+	}
+	s.listeners = nil
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	mode := ""
+	if s.options.ReadOnly {
+		mode = " (read-only)"
+	}
+	fmt.Fprintf(w, "%v%v, type :help for help\n> ", lua.PackageName, mode)
+	w.Flush()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		line := strings.TrimSpace(scanner.Text())
+		if closed || line == ":quit" {
+			return
+		}
+		if len(line) > 0 {
+			j := &job{line: line, done: make(chan string, 1)}
+			select {
+			case s.jobs <- j:
+			case <-s.done:
+				return
+			}
+			select {
+			case out := <-j.done:
+				if len(out) > 0 {
+					w.WriteString(strings.TrimRight(out, "\n") + "\n")
+				}
+			case <-s.done:
+				return
+			}
+		}
+		w.WriteString("> ")
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+const help = `:globals     list the global variables
+:dump expr   list the fields of a table
+:quit        close the connection
+expr         evaluate the expression(or execute the statements)`
+
+// execute executes the request and returns the output.
+func (s *Server) execute(L *lua.LState, line string) string {
+	switch {
+	case line == ":help":
+		if s.options.ReadOnly {
+			return strings.Replace(help, "expr         evaluate the expression(or execute the statements)", "expr         show the variable or the field, like a.b[1]", 1)
+		}
+		return help
+	case line == ":globals":
+		return dumpTable(L.Get(lua.GlobalsIndex).(*lua.LTable), false)
+	case strings.HasPrefix(line, ":dump "):
+		values, err := s.evaluate(L, strings.TrimSpace(line[len(":dump "):]))
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		if len(values) == 0 {
+			return "error: no values"
+		}
+		tb, ok := values[0].(*lua.LTable)
+		if !ok {
+			return "error: not a table: " + format(values[0])
+		}
+		return dumpTable(tb, true)
+	case strings.HasPrefix(line, ":"):
+		return fmt.Sprintf("error: unknown command %v, type :help for help", strings.Fields(line)[0])
+	}
+	values, err := s.evaluate(L, line)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	results := make([]string, len(values))
+	for i, value := range values {
+		results[i] = format(value)
+	}
+	return strings.Join(results, "\t")
+}
+
+func (s *Server) evaluate(L *lua.LState, src string) ([]lua.LValue, error) {
+	if s.options.ReadOnly {
+		value, err := readOnlyEvaluate(L, src)
+		if err != nil {
+			return nil, err
+		}
+		return []lua.LValue{value}, nil
+	}
+	fn, err := L.LoadString("return " + src)
+	if err != nil {
+		if fn, err = L.LoadString(src); err != nil {
+			return nil, err
+		}
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.Push(fn)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return nil, err
+	}
+	values := []lua.LValue{}
+	for i := top + 1; i <= L.GetTop(); i++ {
+		values = append(values, L.Get(i))
+	}
+	return values, nil
+}
+
+var errReadOnly = errors.New("only variables and fields like a.b[1] can be inspected in read-only mode")
+
+// readOnlyEvaluate reads the variable or the field with raw accesses.
+func readOnlyEvaluate(L *lua.LState, src string) (lua.LValue, error) {
+	chunk, err := parse.Parse(strings.NewReader("return "+src), "<remote>")
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) != 1 {
+		return nil, errReadOnly
+	}
+	ret, ok := chunk[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Exprs) != 1 {
+		return nil, errReadOnly
+	}
+	var eval func(ast.Expr) (lua.LValue, error)
+	eval = func(expr ast.Expr) (lua.LValue, error) {
+		switch ex := expr.(type) {
+		case *ast.IdentExpr:
+			return L.Get(lua.GlobalsIndex).(*lua.LTable).RawGetH(lua.LString(ex.Value)), nil
+		case *ast.StringExpr:
+			return lua.LString(ex.Value), nil
+		case *ast.NumberExpr:
+			return numberValue(ex.Value)
+		case *ast.TrueExpr:
+			return lua.LTrue, nil
+		case *ast.FalseExpr:
+			return lua.LFalse, nil
+		case *ast.AttrGetExpr:
+			obj, err := eval(ex.Object)
+			if err != nil {
+				return nil, err
+			}
+			key, err := eval(ex.Key)
+			if err != nil {
+				return nil, err
+			}
+			tb, ok := obj.(*lua.LTable)
+			if !ok {
+				return nil, fmt.Errorf("attempt to index a %v value", obj.Type())
+			}
+			return tb.RawGet(key), nil
+		}
+		return nil, errReadOnly
+	}
+	return eval(ret.Exprs[0])
+}
+
+// numberValue converts the numeric literal like the compiler does, so integer
+// keys are found when Lua53Integer is enabled.
+func numberValue(literal string) (lua.LValue, error) {
+	if lua.Lua53Integer {
+		if len(literal) > 2 && literal[0] == '0' && (literal[1] == 'x' || literal[1] == 'X') {
+			if v, err := strconv.ParseUint(literal[2:], 16, 64); err == nil {
+				return lua.LInteger(v), nil
+			}
+		} else if v, err := strconv.ParseInt(literal, 10, 64); err == nil {
+			return lua.LInteger(v), nil
+		}
+	}
+	if v, err := strconv.ParseInt(literal, 0, 64); err == nil {
+		return lua.LNumber(v), nil
+	}
+	v, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, err
+	}
+	return lua.LNumber(v), nil
+}
+
+func format(lv lua.LValue) string {
+	if s, ok := lv.(lua.LString); ok {
+		return fmt.Sprintf("%q", string(s))
+	}
+	return lv.String()
+}
+
+// dumpTable lists the fields of the table sorted by their keys.
+func dumpTable(tb *lua.LTable, values bool) string {
+	type field struct {
+		key, value string
+	}
+	fields := []field{}
+	tb.ForEach(func(key, value lua.LValue) {
+		k := "[" + format(key) + "]"
+		if s, ok := key.(lua.LString); ok {
+			k = string(s)
+		}
+		v := value.Type().String()
+		if values {
+			v = format(value)
+		}
+		fields = append(fields, field{k, v})
+	})
+	sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	lines := []string{}
+	for i, f := range fields {
+		if i == maxFields {
+			lines = append(lines, fmt.Sprintf("... (%v more)", len(fields)-maxFields))
+			break
+		}
+		lines = append(lines, f.key+"\t"+f.value)
+	}
+	return strings.Join(lines, "\n")
+}
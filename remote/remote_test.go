@@ -0,0 +1,142 @@
+package remote
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+func newTestState(t *testing.T) *lua.LState {
+	L := lua.NewState()
+	err := L.DoString(`
+	config = {name = "app", ports = {80, 443}}
+	counter = 1
+	setmetatable(config, {__index = function() error("metamethod called") end})
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return L
+}
+
+func TestExecute(t *testing.T) {
+	L := newTestState(t)
+	defer L.Close()
+	s := NewServer(L, Options{PollInterval: -1})
+	for _, c := range []struct{ line, want string }{
+		{`counter + 1`, "2"},
+		{`config.name, #config.ports`, `"app"	2`},
+		{`counter = 5`, ""},
+		{`counter`, "5"},
+		{`:dump config.ports`, "[1]\t80\n[2]\t443"},
+		{`:dump counter`, "error: not a table: 5"},
+		{`:bogus`, "error: unknown command :bogus, type :help for help"},
+	} {
+		if got := s.execute(L, c.line); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.line, got, c.want)
+		}
+	}
+	if got := s.execute(L, ":globals"); !strings.Contains(got, "config\ttable") || !strings.Contains(got, "counter\tnumber") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestExecuteReadOnly(t *testing.T) {
+	L := newTestState(t)
+	defer L.Close()
+	s := NewServer(L, Options{ReadOnly: true, PollInterval: -1})
+	for _, c := range []struct{ line, want string }{
+		{`config.ports[2]`, "443"},
+		{`config["name"]`, `"app"`},
+		// fields are read without metamethods.
+		{`config.missing`, "nil"},
+		{`counter + 1`, "error: " + errReadOnly.Error()},
+		{`f()`, "error: " + errReadOnly.Error()},
+		{`counter.x`, "error: attempt to index a number value"},
+	} {
+		if got := s.execute(L, c.line); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.line, got, c.want)
+		}
+	}
+	// statements are not expressions.
+	if got := s.execute(L, `counter = 5`); !strings.HasPrefix(got, "error: ") {
+		t.Errorf("got %q, want an error", got)
+	}
+	if got := L.GetGlobal("counter"); got != lua.LNumber(1) {
+		t.Errorf("got %v, want 1", got)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	L := newTestState(t)
+	defer L.Close()
+	s := NewServer(L, Options{PollInterval: -1})
+	server, client := net.Pipe()
+	go s.serveConn(server)
+
+	outputs := make(chan []string, 1)
+	go func() {
+		defer client.Close()
+		r := bufio.NewReader(client)
+		var lines []string
+		read := func() {
+			line, _ := r.ReadString('>')
+			lines = append(lines, strings.TrimSpace(strings.TrimSuffix(line, ">")))
+			r.ReadByte() // the space after the prompt
+		}
+		read()
+		client.Write([]byte("counter * 10\n"))
+		read()
+		client.Write([]byte(":quit\n"))
+		outputs <- lines
+	}()
+
+	// the test goroutine runs the state.
+	var lines []string
+	for lines == nil {
+		s.Poll()
+		select {
+		case lines = <-outputs:
+		default:
+		}
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], "type :help for help") || lines[1] != "10" {
+		t.Errorf("got %q", lines)
+	}
+}
+
+func TestInstructionHookPoll(t *testing.T) {
+	L := newTestState(t)
+	defer L.Close()
+	s := NewServer(L, Options{PollInterval: 100})
+	j := &job{line: "counter", done: make(chan string, 1)}
+	s.jobs <- j
+	// the request is executed while the script runs.
+	if err := L.DoString(`counter = 42 for i = 1, 1000 do end`); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-j.done:
+		if out != "42" {
+			t.Errorf("got %q, want 42", out)
+		}
+	default:
+		t.Error("the request was not executed")
+	}
+}
+
+func TestListenAndServeLoopback(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	s := NewServer(L, Options{PollInterval: -1})
+	defer s.Close()
+	if err := s.ListenAndServe("tcp", "0.0.0.0:0"); err == nil || !strings.Contains(err.Error(), "not a loopback address") {
+		t.Errorf("got %v, want an error", err)
+	}
+	if err := s.ListenAndServe("udp", "127.0.0.1:0"); err == nil {
+		t.Error("udp must not be supported")
+	}
+}
@@ -5,11 +5,11 @@ TESTS=("attrib.lua" "calls.lua" "closure.lua" "constructs.lua" "events.lua"
 OLDPWD=`pwd`
 myexit() {
   cd ${OLDPWD}
-  rm -f glua.exe
+  rm -f glua
   exit $1
 }
-echo go build cmd/glua/glua.go
-go build cmd/glua/glua.go
+echo go build -o glua ./cmd/glua
+go build -o glua ./cmd/glua
 [ $? -ne 0 ] && {
    echo "compile failed."
    myexit 1
@@ -25,4 +25,12 @@ for TEST in "${TESTS[@]}"; do
   }
 done
 
+cd ${OLDPWD}
+echo "testing _glua-tests"
+go run ./_glua-tests/host _glua-tests/*.lua
+[ $? -ne 0 ] && {
+   echo "failed."
+   myexit 1
+}
+
 myexit 0
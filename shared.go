@@ -0,0 +1,310 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+const sharedTableClass = "SHAREDTABLE*"
+
+var sharedTableType = reflect.TypeOf((*SharedTable)(nil))
+
+// SharedTable is a table protected by a mutex, so it can be read and written
+// by states running in different goroutines. Keys and values are limited to
+// booleans, numbers and strings, which do not belong to any state. Integral
+// float keys are the same keys as the integers like tables.
+type SharedTable struct {
+	mu     sync.RWMutex
+	values map[LValue]LValue
+}
+
+// NewSharedTable returns a new empty SharedTable.
+func NewSharedTable() *SharedTable {
+	return &SharedTable{values: make(map[LValue]LValue)}
+}
+
+func sharedKey(key LValue) (LValue, error) {
+	switch v := key.(type) {
+	case LBool, LString:
+		return key, nil
+	case LInteger:
+		return v.tableKey(), nil
+	case LNumber:
+		if math.IsNaN(float64(v)) {
+			return nil, fmt.Errorf("shared table index is NaN")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("invalid shared table key: %v", key.Type())
+}
+
+func sharedValue(value LValue) error {
+	switch value.(type) {
+	case *LNilType, LBool, LNumber, LInteger, LString:
+		return nil
+	}
+	return fmt.Errorf("can not store a %v in a shared table", value.Type())
+}
+
+// Get returns the value for the key, or LNil if the key is not found.
+func (st *SharedTable) Get(key LValue) LValue {
+	k, err := sharedKey(key)
+	if err != nil {
+		return LNil
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if v, ok := st.values[k]; ok {
+		return v
+	}
+	return LNil
+}
+
+// Set sets the value for the key. Setting LNil deletes the key.
+func (st *SharedTable) Set(key, value LValue) error {
+	k, err := sharedKey(key)
+	if err != nil {
+		return err
+	}
+	if err := sharedValue(value); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if value == LNil {
+		delete(st.values, k)
+	} else {
+		st.values[k] = value
+	}
+	return nil
+}
+
+// Incr atomically adds delta to the number for the key and returns the new
+// number. A missing key is treated as 0.
+func (st *SharedTable) Incr(key, delta LValue) (LValue, error) {
+	k, err := sharedKey(key)
+	if err != nil {
+		return LNil, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	current, ok := st.values[k]
+	if !ok {
+		current = integerValue(0)
+	}
+	sum, ok := addNumbers(current, delta)
+	if !ok {
+		return LNil, fmt.Errorf("attempt to increment a %v with a %v", current.Type(), delta.Type())
+	}
+	st.values[k] = sum
+	return sum, nil
+}
+
+// CompareAndSwap atomically sets the value for the key to new if the current
+// value equals to old, and reports whether the value was set. LNil as old
+// matches a missing key.
+func (st *SharedTable) CompareAndSwap(key, old, new LValue) (bool, error) {
+	k, err := sharedKey(key)
+	if err != nil {
+		return false, err
+	}
+	if err := sharedValue(new); err != nil {
+		return false, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	current, ok := st.values[k]
+	if !ok {
+		current = LNil
+	}
+	if !sharedEqual(current, old) {
+		return false, nil
+	}
+	if new == LNil {
+		delete(st.values, k)
+	} else {
+		st.values[k] = new
+	}
+	return true, nil
+}
+
+// Len returns the number of the entries.
+func (st *SharedTable) Len() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return len(st.values)
+}
+
+// Keys returns a snapshot of the keys in no particular order.
+func (st *SharedTable) Keys() []LValue {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	keys := make([]LValue, 0, len(st.values))
+	for k := range st.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func addNumbers(lhs, rhs LValue) (LValue, bool) {
+	i1, ok1 := lhs.(LInteger)
+	i2, ok2 := rhs.(LInteger)
+	if ok1 && ok2 {
+		return i1 + i2, true
+	}
+	f1, ok1 := toFloatValue(lhs)
+	f2, ok2 := toFloatValue(rhs)
+	if !ok1 || !ok2 {
+		return LNil, false
+	}
+	return f1 + f2, true
+}
+
+func sharedEqual(lhs, rhs LValue) bool {
+	if c, ok := compareNumbers(lhs, rhs); ok {
+		return c == 0
+	}
+	return lhs == rhs
+}
+
+// OpenShared opens the shared module, which is not opened by OpenLibs.
+// OpenShared can be given to LState.PreloadModule as a loader.
+//
+// shared.new creates a SharedTable. Shared tables can be given to other
+// states through channels or by the host with NewSharedTableValue.
+func OpenShared(L *LState) int {
+	mod := L.RegisterModule("shared", sharedFuncs)
+	L.Push(mod)
+	return 1
+}
+
+var sharedFuncs = map[string]LGFunction{
+	"new": sharedNew,
+}
+
+// NewSharedTableValue returns userdata that exposes the SharedTable to scripts
+// with the methods get, set, incr, cas and keys. The length operator returns
+// the number of the entries, and pairs iterates over a snapshot of the
+// entries.
+func (ls *LState) NewSharedTableValue(st *SharedTable) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = st
+	ud.Metatable = ls.sharedTableMetatable()
+	return ud
+}
+
+func (ls *LState) sharedTableMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, sharedTableClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(sharedTableClass)
+	ls.SetField(mt, "__index", ls.RegisterModuleToTable(ls.NewTable(), map[string]LGFunction{
+		"get":  sharedTableGet,
+		"set":  sharedTableSet,
+		"incr": sharedTableIncr,
+		"cas":  sharedTableCas,
+		"keys": sharedTableKeys,
+	}))
+	ls.RegisterModuleToTable(mt, map[string]LGFunction{
+		"__len":      sharedTableLen,
+		"__pairs":    sharedTablePairs,
+		"__tostring": sharedTableToString,
+	})
+	ls.SetField(mt, "__metatable", LString(sharedTableClass))
+	return mt
+}
+
+func checkSharedTable(L *LState, n int) *SharedTable {
+	return CheckUserDataValue[*SharedTable](L, n)
+}
+
+func sharedNew(L *LState) int {
+	L.Push(L.NewSharedTableValue(NewSharedTable()))
+	return 1
+}
+
+func sharedTableGet(L *LState) int {
+	st := checkSharedTable(L, 1)
+	L.Push(st.Get(L.CheckAny(2)))
+	return 1
+}
+
+func sharedTableSet(L *LState) int {
+	st := checkSharedTable(L, 1)
+	if err := st.Set(L.CheckAny(2), L.Get(3)); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// sharedTableIncr adds the delta(1 by default) to the number for the key and
+// returns the new number.
+func sharedTableIncr(L *LState) int {
+	st := checkSharedTable(L, 1)
+	delta := L.Get(3)
+	if delta == LNil {
+		delta = integerValue(1)
+	}
+	v, err := st.Incr(L.CheckAny(2), delta)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(v)
+	return 1
+}
+
+func sharedTableCas(L *LState) int {
+	st := checkSharedTable(L, 1)
+	ok, err := st.CompareAndSwap(L.CheckAny(2), L.Get(3), L.Get(4))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(LBool(ok))
+	return 1
+}
+
+func sharedTableKeys(L *LState) int {
+	st := checkSharedTable(L, 1)
+	tb := L.NewTable()
+	for _, k := range st.Keys() {
+		tb.Append(k)
+	}
+	L.Push(tb)
+	return 1
+}
+
+func sharedTableLen(L *LState) int {
+	L.Push(integerValue(int64(checkSharedTable(L, 1).Len())))
+	return 1
+}
+
+func sharedTablePairs(L *LState) int {
+	st := checkSharedTable(L, 1)
+	keys := st.Keys()
+	i := 0
+	L.Push(L.NewFunction(func(L *LState) int {
+		for ; i < len(keys); i++ {
+			value := st.Get(keys[i])
+			if value == LNil {
+				continue
+			}
+			L.Push(keyValue(keys[i]))
+			L.Push(value)
+			i++
+			return 2
+		}
+		L.Push(LNil)
+		return 1
+	}))
+	L.Push(L.Get(1))
+	L.Push(LNil)
+	return 3
+}
+
+func sharedTableToString(L *LState) int {
+	L.Push(LString(fmt.Sprintf("shared table: %p", checkSharedTable(L, 1))))
+	return 1
+}
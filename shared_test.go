@@ -0,0 +1,72 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSharedTable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.PreloadModule("shared", OpenShared)
+	L.PreloadModule("channel", OpenChannel)
+	err := L.DoString(`
+	local shared = require("shared")
+	local t = shared.new()
+	t:set("name", "x")
+	t:set(1, true)
+	assert(t:get("name") == "x" and t:get(1.0) == true and t:get("missing") == nil)
+	assert(#t == 2 and #t:keys() == 2)
+	local n = 0
+	for k, v in pairs(t) do
+	  assert(t:get(k) == v)
+	  n = n + 1
+	end
+	assert(n == 2)
+	t:set("name", nil)
+	assert(#t == 1)
+
+	assert(t:incr("count") == 1 and t:incr("count", 2) == 3)
+	assert(not pcall(t.incr, t, 1), "booleans can not be incremented")
+	assert(t:cas("count", 3, 10) == true and t:get("count") == 10)
+	assert(t:cas("count", 3, 11) == false and t:get("count") == 10)
+	assert(t:cas("new", nil, "v") and t:get("new") == "v")
+
+	assert(not pcall(t.set, t, {}, 1), "tables are not keys")
+	assert(not pcall(t.set, t, "x", {}), "tables are not values")
+	assert(not pcall(t.set, t, 0/0, 1), "NaN is not a key")
+
+	-- shared tables can be sent through channels.
+	local ch = require("channel").make(1)
+	ch:send(t)
+	local _, t2 = ch:receive()
+	assert(t2:get("count") == 10)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharedTableGoroutines(t *testing.T) {
+	counters := NewSharedTable()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L := NewState()
+			defer L.Close()
+			L.SetGlobal("counters", L.NewSharedTableValue(counters))
+			if err := L.DoString(`for i = 1, 100 do counters:incr("requests") end`); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v := counters.Get(LString("requests")); v.String() != "400" {
+		t.Errorf("got %v, want 400", v)
+	}
+	if err := counters.Set(LString("x"), LNil); err != nil || counters.Len() != 1 {
+		t.Errorf("got %v, %v entries", err, counters.Len())
+	}
+}
@@ -0,0 +1,332 @@
+package lua
+
+import (
+	"math"
+)
+
+// specializedOp runs an instruction whose operands have been decoded and whose
+// constants have been looked up in advance. cf.Pc has been incremented. The
+// op returns false without changing anything if the operands are not of the
+// types it handles, and the instruction is run by the VM instead.
+type specializedOp func(L *LState, cf *callFrame) bool
+
+// specializedCode is the code of a function compiled into Go closures, one for
+// each instruction that can be specialized. Other instructions, such as calls
+// and returns, are nil and run by the VM. The closures do not depend on states,
+// so the code is shared by the states that run the function.
+type specializedCode struct {
+	ops []specializedOp
+}
+
+// Specialize compiles the function into Go closures that the VM runs instead
+// of dispatching the instructions one by one. States whose
+// Options.SpecializeThreshold is set specialize the functions they run often
+// automatically. Specialize is safe to call while the function is running.
+func (fp *FunctionProto) Specialize() {
+	if fp.specialized.Load() == nil {
+		fp.specialized.CompareAndSwap(nil, specializeProto(fp))
+	}
+}
+
+// countExecution counts an instruction run by the VM in the function, and
+// specializes the function when it has run SpecializeThreshold instructions.
+func (ls *LState) countExecution(proto *FunctionProto) {
+	if proto.executions.Add(1) == int32(ls.G.options.SpecializeThreshold) {
+		proto.Specialize()
+	}
+}
+
+// run runs the instructions from cf.Pc until an instruction that is not
+// specialized. It returns early when the state needs to see every
+// instruction, for example after a hook is set by a metamethod.
+func (sc *specializedCode) run(L *LState, cf *callFrame) {
+	for {
+		op := sc.ops[cf.Pc]
+		if op == nil {
+			return
+		}
+		cf.Pc++
+		if !op(L, cf) {
+			cf.Pc--
+			return
+		}
+		if L.contextChecked() || L.hook != nil || L.G.instrumented {
+			return
+		}
+	}
+}
+
+// rkOperand is an RK operand of an instruction: a constant or a register.
+type rkOperand struct {
+	k   LValue
+	reg int
+}
+
+func newRKOperand(proto *FunctionProto, rk int) rkOperand {
+	if opIsK(rk) {
+		return rkOperand{k: proto.Constants[opIndexK(rk)]}
+	}
+	return rkOperand{reg: rk}
+}
+
+func (o rkOperand) value(rg *registry, lbase int) LValue {
+	if o.k != nil {
+		return o.k
+	}
+	return rg.array[lbase+o.reg]
+}
+
+// skipJump returns the function that runs the instruction after a conditional
+// instruction at pc that is not skipped. The following JMP is run directly.
+func skipJump(proto *FunctionProto, pc int) func(cf *callFrame, skip bool) {
+	target := -1
+	if pc+1 < len(proto.Code) {
+		if next := proto.Code[pc+1]; opGetOpCode(next) == OP_JMP && opGetArgA(next) == 0 {
+			target = pc + 2 + opGetArgSbx(next)
+		}
+	}
+	return func(cf *callFrame, skip bool) {
+		switch {
+		case skip:
+			cf.Pc++
+		case target >= 0:
+			cf.Pc = target
+		}
+	}
+}
+
+func specializeProto(proto *FunctionProto) *specializedCode {
+	sc := &specializedCode{ops: make([]specializedOp, len(proto.Code)+1)}
+	for pc := 0; pc < len(proto.Code); pc++ {
+		inst := proto.Code[pc]
+		sc.ops[pc] = specializeInstruction(proto, pc, inst)
+		switch opGetOpCode(inst) {
+		case OP_CLOSURE:
+			// pseudo instructions follow.
+			pc += int(proto.FunctionPrototypes[opGetArgBx(inst)].NumUpvalues)
+		case OP_SETLIST:
+			if opGetArgC(inst) == 0 {
+				pc++
+			}
+		}
+	}
+	return sc
+}
+
+func specializeInstruction(proto *FunctionProto, pc int, inst uint32) specializedOp {
+	opcode := opGetOpCode(inst)
+	a := opGetArgA(inst)
+	b := opGetArgB(inst)
+	c := opGetArgC(inst)
+	switch opcode {
+	case OP_MOVE:
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, L.reg.array[cf.LocalBase+b])
+			return true
+		}
+	case OP_LOADK:
+		k := proto.Constants[opGetArgBx(inst)]
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, k)
+			return true
+		}
+	case OP_LOADBOOL:
+		value := LValue(LFalse)
+		if b != 0 {
+			value = LTrue
+		}
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, value)
+			if c != 0 {
+				cf.Pc++
+			}
+			return true
+		}
+	case OP_LOADNIL:
+		return func(L *LState, cf *callFrame) bool {
+			for i := cf.LocalBase + a; i <= cf.LocalBase+b; i++ {
+				L.reg.Set(i, LNil)
+			}
+			return true
+		}
+	case OP_GETUPVAL:
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, cf.Fn.Upvalues[b].Value())
+			return true
+		}
+	case OP_SETUPVAL:
+		return func(L *LState, cf *callFrame) bool {
+			cf.Fn.Upvalues[b].SetValue(L.reg.array[cf.LocalBase+a])
+			return true
+		}
+	case OP_GETGLOBAL:
+		k := proto.Constants[opGetArgBx(inst)]
+		instp := &proto.Code[pc]
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, L.getFieldCached(instp, cf.Fn.Env, k))
+			return true
+		}
+	case OP_SETGLOBAL:
+		k := proto.Constants[opGetArgBx(inst)]
+		return func(L *LState, cf *callFrame) bool {
+			L.setField(cf.Fn.Env, k, L.reg.array[cf.LocalBase+a])
+			return true
+		}
+	case OP_GETTABLE:
+		key := newRKOperand(proto, c)
+		if key.k == nil {
+			return func(L *LState, cf *callFrame) bool {
+				lbase := cf.LocalBase
+				L.reg.Set(lbase+a, L.getField(L.reg.array[lbase+b], key.value(L.reg, lbase)))
+				return true
+			}
+		}
+		instp := &proto.Code[pc]
+		return func(L *LState, cf *callFrame) bool {
+			L.reg.Set(cf.LocalBase+a, L.getFieldCached(instp, L.reg.array[cf.LocalBase+b], key.k))
+			return true
+		}
+	case OP_SETTABLE:
+		key, value := newRKOperand(proto, b), newRKOperand(proto, c)
+		return func(L *LState, cf *callFrame) bool {
+			lbase := cf.LocalBase
+			L.setField(L.reg.array[lbase+a], key.value(L.reg, lbase), value.value(L.reg, lbase))
+			return true
+		}
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW:
+		return specializeArith(proto, opcode, a, b, c)
+	case OP_UNM:
+		return func(L *LState, cf *callFrame) bool {
+			nm, ok := L.reg.array[cf.LocalBase+b].(LNumber)
+			if !ok {
+				return false
+			}
+			L.reg.Set(cf.LocalBase+a, -nm)
+			return true
+		}
+	case OP_NOT:
+		return func(L *LState, cf *callFrame) bool {
+			if LVIsFalse(L.reg.array[cf.LocalBase+b]) {
+				L.reg.Set(cf.LocalBase+a, LTrue)
+			} else {
+				L.reg.Set(cf.LocalBase+a, LFalse)
+			}
+			return true
+		}
+	case OP_JMP:
+		if a != 0 {
+			return nil
+		}
+		sbx := opGetArgSbx(inst)
+		return func(L *LState, cf *callFrame) bool {
+			cf.Pc += sbx
+			return true
+		}
+	case OP_EQ, OP_LT, OP_LE:
+		return specializeComparison(proto, pc, opcode, a, b, c)
+	case OP_TEST:
+		next := skipJump(proto, pc)
+		return func(L *LState, cf *callFrame) bool {
+			next(cf, LVAsBool(L.reg.array[cf.LocalBase+a]) == (c == 0))
+			return true
+		}
+	case OP_TESTSET:
+		next := skipJump(proto, pc)
+		return func(L *LState, cf *callFrame) bool {
+			value := L.reg.array[cf.LocalBase+b]
+			if LVAsBool(value) != (c == 0) {
+				L.reg.Set(cf.LocalBase+a, value)
+				next(cf, false)
+			} else {
+				next(cf, true)
+			}
+			return true
+		}
+	case OP_FORLOOP:
+		sbx := opGetArgSbx(inst)
+		return func(L *LState, cf *callFrame) bool {
+			ra := cf.LocalBase + a
+			init, ok1 := L.reg.array[ra].(LNumber)
+			limit, ok2 := L.reg.array[ra+1].(LNumber)
+			step, ok3 := L.reg.array[ra+2].(LNumber)
+			if !ok1 || !ok2 || !ok3 {
+				return false
+			}
+			init += step
+			index := LValue(init)
+			L.reg.Set(ra, index)
+			if (step > 0 && init <= limit) || (step <= 0 && init >= limit) {
+				cf.Pc += sbx
+				L.reg.Set(ra+3, index)
+			} else {
+				L.reg.SetTop(ra + 1)
+			}
+			return true
+		}
+	}
+	return nil
+}
+
+func specializeArith(proto *FunctionProto, opcode, a, b, c int) specializedOp {
+	lhs, rhs := newRKOperand(proto, b), newRKOperand(proto, c)
+	var arith func(x, y LNumber) LNumber
+	switch opcode {
+	case OP_ADD:
+		arith = func(x, y LNumber) LNumber { return x + y }
+	case OP_SUB:
+		arith = func(x, y LNumber) LNumber { return x - y }
+	case OP_MUL:
+		arith = func(x, y LNumber) LNumber { return x * y }
+	case OP_DIV:
+		arith = func(x, y LNumber) LNumber { return x / y }
+	case OP_MOD:
+		arith = luaModulo
+	case OP_POW:
+		arith = func(x, y LNumber) LNumber { return LNumber(math.Pow(float64(x), float64(y))) }
+	}
+	return func(L *LState, cf *callFrame) bool {
+		lbase := cf.LocalBase
+		lv, rv := lhs.value(L.reg, lbase), rhs.value(L.reg, lbase)
+		v1, ok1 := lv.(LNumber)
+		v2, ok2 := rv.(LNumber)
+		if ok1 && ok2 && !Lua53Integer {
+			L.reg.Set(lbase+a, arith(v1, v2))
+		} else {
+			L.reg.Set(lbase+a, objectArith(L, opcode, lv, rv))
+		}
+		return true
+	}
+}
+
+func specializeComparison(proto *FunctionProto, pc, opcode, a, b, c int) specializedOp {
+	lhs, rhs := newRKOperand(proto, b), newRKOperand(proto, c)
+	next := skipJump(proto, pc)
+	// the next instruction is skipped if the result is not the expected one.
+	want := a != 0
+	return func(L *LState, cf *callFrame) bool {
+		lbase := cf.LocalBase
+		lv, rv := lhs.value(L.reg, lbase), rhs.value(L.reg, lbase)
+		var ret bool
+		v1, ok1 := lv.(LNumber)
+		v2, ok2 := rv.(LNumber)
+		switch {
+		case ok1 && ok2:
+			switch opcode {
+			case OP_EQ:
+				ret = v1 == v2
+			case OP_LT:
+				ret = v1 < v2
+			default:
+				ret = v1 <= v2
+			}
+		case opcode == OP_EQ:
+			ret = equals(L, lv, rv, false)
+		case opcode == OP_LT:
+			ret = lessThan(L, lv, rv)
+		default:
+			ret = lessEqual(L, lv, rv)
+		}
+		next(cf, ret != want)
+		return true
+	}
+}
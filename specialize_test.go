@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+const specializeTestScript = `
+function run(n)
+  local sum, t, s = 0, {x = 1}, ""
+  for i = 1, n do
+    if i % 3 == 0 then sum = sum + i * 2 elseif i < 10 then sum = sum - 1 else sum = sum + t.x end
+    local ok = i > 5 and i <= 8 or nil
+    if ok then s = s .. i end
+    sum = sum + (-i) / 2 + i ^ 2 % 7
+  end
+  local cmp = ("a" < "b") and 1 or 0
+  local v = setmetatable({}, {__add = function() return 100 end, __lt = function() return true end})
+  return sum + cmp + (v + 1) + (v < v and 1 or 0), s
+end
+`
+
+func TestSpecialize(t *testing.T) {
+	want := func() LValue {
+		L := NewState()
+		defer L.Close()
+		if err := L.DoString(specializeTestScript + `r, s = run(1000)`); err != nil {
+			t.Fatal(err)
+		}
+		if s := L.GetGlobal("s"); s != LString("678") {
+			t.Fatalf("got %v", s)
+		}
+		return L.GetGlobal("r")
+	}()
+
+	L := NewState(Options{SpecializeThreshold: 100})
+	defer L.Close()
+	if err := L.DoString(specializeTestScript + `r, s = run(1000)`); err != nil {
+		t.Fatal(err)
+	}
+	fn := L.GetGlobal("run").(*LFunction)
+	if fn.Proto.specialized.Load() == nil {
+		t.Fatal("the function must be specialized")
+	}
+	if r, s := L.GetGlobal("r"), L.GetGlobal("s"); r != want || s != LString("678") {
+		t.Errorf("got %v, %v, want %v", r, s, want)
+	}
+
+	// the VM runs the code while hooks are set.
+	lines := 0
+	L.SetHook(func(L *LState, event HookEvent, line int) { lines++ }, HookLine, 0)
+	if err := L.DoString(`r = run(10)`); err != nil {
+		t.Fatal(err)
+	}
+	L.SetHook(nil, 0, 0)
+	if lines < 10*4 {
+		t.Errorf("got %v line events", lines)
+	}
+}
+
+func TestSpecializeShared(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(specializeTestScript); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("run").(*LFunction).Proto.Specialize()
+	var wg sync.WaitGroup
+	results := make([]LValue, 4)
+	for i := range results {
+		L2 := L.Clone()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer L2.Close()
+			if err := L2.DoString(`r = run(500)`); err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = L2.GetGlobal("r")
+		}()
+	}
+	wg.Wait()
+	for _, r := range results[1:] {
+		if r != results[0] {
+			t.Errorf("got %v, want %v", results, results[0])
+		}
+	}
+}
@@ -1,12 +1,22 @@
 package lua
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/yuin/gopher-lua/ast"
 	"github.com/yuin/gopher-lua/parse"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"maps"
 	"math"
 	"os"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -22,19 +32,58 @@ const GlobalsIndex = -10002
 type ApiError struct {
 	Type   ApiErrorType
 	Object LValue
+	// StackTrace is the Lua stack traceback at the point the error was raised.
+	StackTrace string
+	// Cause is the Go error that caused this error, if any.
+	Cause error
 }
 
 func newApiError(code ApiErrorType, message string, object LValue) *ApiError {
 	if len(message) > 0 {
 		object = LString(message)
 	}
-	return &ApiError{code, object}
+	return &ApiError{Type: code, Object: object}
+}
+
+func newApiErrorE(code ApiErrorType, message string, cause error) *ApiError {
+	return &ApiError{Type: code, Object: LString(message), Cause: cause}
+}
+
+// newApiErrorWithTraceback creates an error for the error object raised at the
+// current frame.
+func (ls *LState) newApiErrorWithTraceback(code ApiErrorType, object LValue) *ApiError {
+	return &ApiError{Type: code, Object: object, StackTrace: ls.stackTrace("", 0)}
 }
 
 func (e *ApiError) Error() string {
+	if len(e.StackTrace) > 0 {
+		return fmt.Sprintf("%v\n%v", e.Object.String(), e.StackTrace)
+	}
 	return e.Object.String()
 }
 
+// Unwrap returns the Cause, or the Go error held by the error object if the
+// object is a userdata.
+func (e *ApiError) Unwrap() error {
+	if e.Cause != nil {
+		return e.Cause
+	}
+	if ud, ok := e.Object.(*LUserData); ok {
+		if err, ok := ud.Value.(error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsIncomplete reports whether the error is a syntax error caused by the end of
+// the input, such as an unclosed block or string. Interactive shells can read
+// more lines and load the input again.
+func (e *ApiError) IsIncomplete() bool {
+	var perr *parse.Error
+	return e.Type == ApiErrorSyntax && errors.As(e.Cause, &perr) && perr.Incomplete()
+}
+
 type ApiErrorType int
 
 const (
@@ -42,8 +91,19 @@ const (
 	ApiErrorFile
 	ApiErrorRun
 	ApiErrorError
+	// ApiErrorPanic is a Go panic in a Go function called by LState.PCall.
+	ApiErrorPanic
 )
 
+var apiErrorTypeNames = [...]string{"syntax", "file", "runtime", "error handler", "panic"}
+
+func (t ApiErrorType) String() string {
+	if t < 0 || int(t) >= len(apiErrorTypeNames) {
+		return fmt.Sprintf("ApiErrorType(%d)", int(t))
+	}
+	return apiErrorTypeNames[t]
+}
+
 /* }}} */
 
 /* ResumeState {{{ */
@@ -69,6 +129,132 @@ type P struct {
 
 /* }}} */
 
+/* Hook {{{ */
+
+type HookEvent int
+
+const (
+	HookCall HookEvent = 1 << iota
+	HookReturn
+	HookLine
+	HookCount
+)
+
+func (ev HookEvent) String() string {
+	switch ev {
+	case HookCall:
+		return "call"
+	case HookReturn:
+		return "return"
+	case HookLine:
+		return "line"
+	case HookCount:
+		return "count"
+	}
+	return "unknown"
+}
+
+type HookFunc func(L *LState, event HookEvent, line int)
+
+type hookState struct {
+	fn        HookFunc
+	lfn       LValue
+	mask      HookEvent
+	count     int
+	counter   int
+	lastPc    int
+	lastFrame *callFrame
+	running   bool
+}
+
+/* }}} */
+
+/* Snapshot {{{ */
+
+// Snapshot is a frozen copy of a state. A snapshot is never modified, so
+// NewState can be called from multiple goroutines.
+type Snapshot struct {
+	ls *LState
+}
+
+func (sn *Snapshot) NewState() *LState {
+	return sn.ls.Clone()
+}
+
+/* }}} */
+
+/* Options {{{ */
+
+type Options struct {
+	// Maximum amount of memory(in bytes) that objects of the state may use. 0 means unlimited.
+	MemoryLimit int
+	// Initial size of the registry(the value stack) of each thread. 0 means RegistrySize.
+	RegistrySize int
+	// Maximum size of the registry. The registry grows up to this size. 0 means the registry can not grow.
+	RegistryMaxSize int
+	// Maximum size of the call stack of each thread. The call stack grows up to this size. 0 means CallStackSize.
+	CallStackSize int
+	// Initial size of the registry of each coroutine. 0 means RegistrySize of
+	// the options. Hosts that create many mostly idle coroutines can give them
+	// small registries that grow up to ThreadRegistryMaxSize.
+	ThreadRegistrySize int
+	// Maximum size of the registry of each coroutine. 0 means RegistryMaxSize of the options.
+	ThreadRegistryMaxSize int
+	// Maximum size of the call stack of each coroutine. 0 means CallStackSize of the options.
+	ThreadCallStackSize int
+	// SpecializeThreshold makes the state specialize functions that have run
+	// this many instructions: they are compiled into Go closures that run
+	// without dispatching the common instructions one by one(see
+	// FunctionProto.Specialize). 0 disables the specialization.
+	SpecializeThreshold int
+	// Include Go stack traces in error messages.
+	IncludeGoStackTrace bool
+	// Include columns in positions of runtime error messages(source:line:column:).
+	IncludeColumnInErrors bool
+	// Do not open the standard libraries.
+	SkipOpenLibs bool
+	// Allocator is notified of allocations of the state.
+	Allocator Allocator
+	// ModuleFS is searched by require for Lua modules instead of the OS
+	// filesystem, for example files embedded with go:embed. package.path
+	// defaults to ModuleFSPathDefault then.
+	ModuleFS fs.FS
+	// FileSystem is used by the state to access files instead of the OS
+	// filesystem, for example an in-memory filesystem or DirFileSystem for
+	// sandboxed scripts.
+	FileSystem FileSystem
+	// CommandPolicy is called with the command before os.execute and io.popen
+	// run it. The command is not run if CommandPolicy returns an error, which
+	// is returned to the script. nil allows all commands.
+	CommandPolicy func(cmd string) error
+	// Deterministic makes runs of scripts reproducible: pairs and next
+	// iterate the keys of tables in sorted order(numbers, strings, then
+	// booleans; the order of other keys is not stable), math.random
+	// is seeded with 0 unless it is seeded explicitly, and os.time, os.date and
+	// os.clock use Clock, which defaults to a clock stopped at the Unix epoch.
+	Deterministic bool
+	// OrderedTables makes the tables created by the state, including the
+	// tables created by scripts, ordered tables(see NewOrderedTable).
+	OrderedTables bool
+	// Clock returns the current time for os.time, os.date and os.clock
+	// instead of time.Now. os.clock returns the seconds elapsed since the
+	// state was created according to Clock.
+	Clock func() time.Time
+}
+
+// ThreadOptions are the sizes of the stacks of a coroutine created by
+// LState.NewThreadWithOptions. Zero fields mean the sizes given by Options.
+type ThreadOptions struct {
+	// Initial size of the registry of the coroutine.
+	RegistrySize int
+	// Maximum size of the registry of the coroutine.
+	RegistryMaxSize int
+	// Maximum size of the call stack of the coroutine.
+	CallStackSize int
+}
+
+/* }}} */
+
 /* Debug {{{ */
 
 type Debug struct {
@@ -77,9 +263,28 @@ type Debug struct {
 	What            string
 	Source          string
 	CurrentLine     int
+	CurrentColumn   int
 	NUpvalues       int
+	NParams         int
+	IsVarArg        bool
+	IsTailCall      bool
 	LineDefined     int
 	LastLineDefined int
+	// ActiveLines is the sorted list of lines that have code.
+	ActiveLines []int
+}
+
+// StackFrame is a frame of the call stack. CurrentLine and CurrentColumn are -1
+// for Go functions.
+type StackFrame struct {
+	Name          string
+	Source        string
+	CurrentLine   int
+	CurrentColumn int
+	What          string
+	IsVarArg      bool
+	// TailCall is true if the frame has been reused by tail calls.
+	TailCall bool
 }
 
 /* }}} */
@@ -99,15 +304,26 @@ type callFrame struct {
 	TailCall   int
 }
 
+// number of frames that are allocated at a time. frames are never moved after
+// they are allocated, so pointers to frames stay valid while the stack grows.
+const callFrameSegmentSize = 64
+
+// number of extra frames that error handlers can use.
+const callFrameErrorFrames = 32
+
 type callFrameStack struct {
-	array []callFrame
-	sp    int
+	segments [][]callFrame
+	sp       int
+	maxSize  int
+	// pool provides segments if it is not nil.
+	pool *threadPool
 }
 
-func newcallFrameStack(size int) *callFrameStack {
+func newcallFrameStack(maxSize int) *callFrameStack {
 	return &callFrameStack{
-		array: make([]callFrame, size),
-		sp:    0,
+		segments: make([][]callFrame, 0, 4),
+		sp:       0,
+		maxSize:  maxSize,
 	}
 }
 
@@ -117,12 +333,24 @@ func (cs *callFrameStack) Clear() {
 	cs.sp = 0
 }
 
+func (cs *callFrameStack) Cap() int {
+	return len(cs.segments) * callFrameSegmentSize
+}
+
 func (cs *callFrameStack) Push(v callFrame) error {
-	if cs.sp == CallStackSize {
+	if cs.sp >= cs.maxSize {
 		return newApiError(ApiErrorRun, "stack overflow", LNil)
 	}
-	cs.array[cs.sp] = v
-	cs.array[cs.sp].Idx = cs.sp
+	if cs.sp == cs.Cap() {
+		if cs.pool != nil {
+			cs.segments = append(cs.segments, cs.pool.segment())
+		} else {
+			cs.segments = append(cs.segments, make([]callFrame, callFrameSegmentSize))
+		}
+	}
+	frame := cs.At(cs.sp)
+	*frame = v
+	frame.Idx = cs.sp
 	cs.sp++
 	return nil
 }
@@ -133,17 +361,18 @@ func (cs *callFrameStack) Remove(sp int) {
 	var pre *callFrame
 	var next *callFrame
 	if psp > 0 {
-		pre = &cs.array[psp]
+		pre = cs.At(psp)
 	}
 	if nsp < cs.sp {
-		next = &cs.array[nsp]
+		next = cs.At(nsp)
 	}
 	if next != nil {
 		next.Parent = pre
 	}
 	for i := sp; i+1 < cs.sp; i++ {
-		cs.array[i] = cs.array[i+1]
-		cs.array[i].Idx = i
+		frame := cs.At(i)
+		*frame = *cs.At(i + 1)
+		frame.Idx = i
 		cs.sp = i
 	}
 	cs.sp++
@@ -161,29 +390,60 @@ func (cs *callFrameStack) Last() *callFrame {
 	if cs.sp == 0 {
 		return nil
 	}
-	return &cs.array[cs.sp-1]
+	return cs.At(cs.sp - 1)
 }
 
 func (cs *callFrameStack) At(sp int) *callFrame {
-	return &cs.array[sp]
+	return &cs.segments[sp/callFrameSegmentSize][sp%callFrameSegmentSize]
 }
 
 func (cs *callFrameStack) Pop() *callFrame {
 	cs.sp--
-	return &cs.array[cs.sp]
+	return cs.At(cs.sp)
 }
 
 /* }}} */
 
 /* registry {{{ */
 
+// number of slots that are kept for an error message when the registry overflows.
+const registryErrorSlots = 8
+
 type registry struct {
-	array []LValue
-	top   int
+	array   []LValue
+	top     int
+	maxSize int
+	ls      *LState
 }
 
-func newRegistry(size int) *registry {
-	return &registry{make([]LValue, size), 0}
+func newRegistry(ls *LState, size, maxSize int) *registry {
+	return &registry{make([]LValue, size), 0, intMax(size, maxSize), ls}
+}
+
+func (rg *registry) checkSize(size int) {
+	if size > len(rg.array) {
+		rg.resize(size)
+	}
+}
+
+func (rg *registry) resize(size int) {
+	if size > rg.maxSize {
+		if len(rg.array) < rg.maxSize+registryErrorSlots {
+			rg.grow(rg.maxSize + registryErrorSlots)
+		}
+		rg.ls.RaiseError("registry overflow")
+	}
+	newsize := intMin(intMax(len(rg.array)*2, size), rg.maxSize)
+	rg.grow(newsize)
+}
+
+func (rg *registry) grow(size int) {
+	array := make([]LValue, size)
+	copy(array, rg.array)
+	for i := len(rg.array); i < size; i++ {
+		array[i] = LNil
+	}
+	rg.array = array
 }
 
 func (rg *registry) RawSetTop(top int) {
@@ -191,6 +451,7 @@ func (rg *registry) RawSetTop(top int) {
 }
 
 func (rg *registry) SetTop(top int) {
+	rg.checkSize(top)
 	oldtop := rg.top
 	rg.top = top
 	for i := oldtop; i < rg.top; i++ {
@@ -206,6 +467,7 @@ func (rg *registry) Top() int {
 }
 
 func (rg *registry) Push(v LValue) {
+	rg.checkSize(rg.top + 1)
 	rg.array[rg.top] = v
 	rg.top++
 }
@@ -222,6 +484,7 @@ func (rg *registry) Get(reg int) LValue {
 }
 
 func (rg *registry) CopyRange(reg, start, limit, n int) {
+	rg.checkSize(reg + n)
 	for i := 0; i < n; i++ {
 		if tidx := start + i; tidx >= rg.top || limit > -1 && tidx >= limit || tidx < 0 {
 			rg.array[reg+i] = LNil
@@ -233,6 +496,7 @@ func (rg *registry) CopyRange(reg, start, limit, n int) {
 }
 
 func (rg *registry) FillNil(reg, n int) {
+	rg.checkSize(reg + n)
 	for i := 0; i < n; i++ {
 		rg.array[reg+i] = LNil
 	}
@@ -253,6 +517,7 @@ func (rg *registry) Insert(value LValue, reg int) {
 }
 
 func (rg *registry) Set(reg int, val LValue) {
+	rg.checkSize(reg + 1)
 	rg.array[reg] = val
 	if reg >= rg.top {
 		//rg.FillNil(rg.top, reg-rg.top)
@@ -269,6 +534,9 @@ func newGlobal() *Global {
 		Global:     newLTable(0, 64),
 		builtinMts: make(map[int]LValue),
 		tempFiles:  make([]*os.File, 0, 10),
+		gcPause:    gcDefaultPause,
+		gcStepMul:  gcDefaultStepMul,
+		startedAt:  startedAt,
 	}
 }
 
@@ -276,9 +544,19 @@ func newGlobal() *Global {
 
 /* package local methods {{{ */
 
-func newLState() *LState {
+func newLState(options Options) *LState {
+	g := newGlobal()
+	g.options = options
+	ls := newThreadState(g, ThreadOptions{options.RegistrySize, options.RegistryMaxSize, options.CallStackSize})
+	ls.Env = g.Global
+	return ls
+}
+
+// newThreadState returns a state that shares the global state g. Its registers
+// and call frames are taken from the pool of g if there are free ones.
+func newThreadState(g *Global, options ThreadOptions) *LState {
 	ls := &LState{
-		G:      newGlobal(),
+		G:      g,
 		Parent: nil,
 		Panic: func(L *LState) {
 			panic(L.Get(-1))
@@ -286,13 +564,16 @@ func newLState() *LState {
 		Dead: false,
 
 		stop:         0,
-		reg:          newRegistry(RegistrySize),
-		stack:        newcallFrameStack(CallStackSize),
+		reg:          nil,
+		stack:        g.threads.newcallFrameStack(options.CallStackSize),
 		currentFrame: nil,
 		wrapped:      false,
 		uvcache:      nil,
+		ctx:          nil,
+		hook:         nil,
+		errorObject:  LNil,
 	}
-	ls.Env = ls.G.Global
+	ls.reg = g.threads.newRegistry(ls, options.RegistrySize, options.RegistryMaxSize)
 	return ls
 }
 
@@ -339,6 +620,16 @@ func (ls *LState) closeAllUpvalues() {
 	}
 }
 
+func (ls *LState) callHook(event HookEvent, line int) {
+	h := ls.hook
+	if h == nil || h.running {
+		return
+	}
+	h.running = true
+	defer func() { h.running = false }()
+	h.fn(ls, event, line)
+}
+
 func (ls *LState) raiseError(level int, format string, args ...interface{}) {
 	ls.closeAllUpvalues()
 	message := format
@@ -347,7 +638,9 @@ func (ls *LState) raiseError(level int, format string, args ...interface{}) {
 	}
 	if level > 0 {
 		message = fmt.Sprintf("%v %v", ls.Where(level-1), message)
-		message = ls.stackTrace(message, true)
+	}
+	if ls.G.options.IncludeGoStackTrace {
+		message = fmt.Sprintf("%v\ngo stack traceback:\n%v", message, strings.TrimSpace(string(debug.Stack())))
 	}
 	ls.reg.Push(LString(message))
 	ls.Panic(ls)
@@ -374,27 +667,22 @@ func (ls *LState) findLocal(frame *callFrame, no int) string {
 	return ""
 }
 
-func (ls *LState) stackTrace(message string, include bool) string {
+func (ls *LState) stackTrace(message string, level int) string {
 	buf := []string{}
 	if len(message) > 0 {
 		buf = append(buf, message)
 	}
 	buf = append(buf, "stack traceback:")
-	if ls.currentFrame != nil {
-		i := 1
-		if include {
-			i = 0
+	for _, frame := range ls.stackFrames(level) {
+		if frame.CurrentLine < 0 {
+			buf = append(buf, fmt.Sprintf("\t%v: in %v", frame.Source, frame.Name))
+		} else if ls.G.options.IncludeColumnInErrors {
+			buf = append(buf, fmt.Sprintf("\t%v:%v:%v: in %v", frame.Source, frame.CurrentLine, frame.CurrentColumn, frame.Name))
+		} else {
+			buf = append(buf, fmt.Sprintf("\t%v:%v: in %v", frame.Source, frame.CurrentLine, frame.Name))
 		}
-		for dbg, ok := ls.GetStack(i); ok; dbg, ok = ls.GetStack(i) {
-			cf := dbg.frame
-			buf = append(buf, fmt.Sprintf("\t%v in %v", ls.Where(i), ls.frameFuncName(cf)))
-			if !cf.Fn.IsG && cf.TailCall > 0 {
-				for tc := cf.TailCall; tc > 0; tc-- {
-					buf = append(buf, "\t(tailcall): ?")
-					i++
-				}
-			}
-			i++
+		if frame.TailCall {
+			buf = append(buf, "\t(...tail calls...)")
 		}
 	}
 	buf = append(buf, fmt.Sprintf("\t%v: %v", "[G]", "?"))
@@ -405,11 +693,49 @@ func (ls *LState) stackTrace(message string, include bool) string {
 		newbuf = append(newbuf, buf[len(buf)-7:len(buf)-1]...)
 		buf = newbuf
 	}
-	ret := strings.Join(buf, "\n")
-	if len(buf) > 0 {
-		return "\n" + ret
+	return strings.Join(buf, "\n")
+}
+
+func (ls *LState) stackFrames(level int) []StackFrame {
+	frames := []StackFrame{}
+	dbg, ok := ls.GetStack(level)
+	if !ok {
+		return frames
+	}
+	for cf := dbg.frame; cf != nil; cf = cf.Parent {
+		frame := StackFrame{
+			Name:          ls.frameFuncName(cf),
+			Source:        "[G]",
+			CurrentLine:   -1,
+			CurrentColumn: -1,
+			What:          frameWhat(cf),
+		}
+		if !cf.Fn.IsG {
+			proto := cf.Fn.Proto
+			frame.Source = proto.SourceName
+			if cf.Pc > 0 {
+				frame.CurrentLine = proto.DbgSourcePositions[cf.Pc-1]
+				frame.CurrentColumn = proto.DbgSourceColumns[cf.Pc-1]
+			}
+			frame.IsVarArg = proto.IsVarArg != 0
+			frame.TailCall = cf.TailCall > 0
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func frameWhat(frame *callFrame) string {
+	switch {
+	case frame.Fn.IsG:
+		return "G"
+	// functions at the bottom of coroutines are not main chunks.
+	case frame.Parent == nil && frame.Fn.Proto.LineDefined == 0:
+		return "main"
+	case frame.TailCall > 0:
+		return "tail"
 	}
-	return ret
+	return "Lua"
 }
 
 func (ls *LState) frameFuncName(fr *callFrame) string {
@@ -444,6 +770,41 @@ func (ls *LState) kill() {
 	ls.Dead = true
 }
 
+// releaseStacks returns the registers and the call frames of the dead thread
+// to the pool of the global state.
+func (ls *LState) releaseStacks() {
+	// upvalues must not refer to the registers after they are reused.
+	ls.closeUpvalues(0)
+	ls.G.threads.put(ls.reg, ls.stack)
+	ls.currentFrame = nil
+	ls.reg = newRegistry(ls, 0, 0)
+	ls.stack = newcallFrameStack(0)
+}
+
+func (ls *LState) isActive() bool {
+	return ls == ls.G.MainThread || ls == ls.G.CurrentThread || ls.Parent != nil
+}
+
+// closeThread kills the thread and closes its pending to-be-closed variables.
+// __close metamethods are called by L.
+func (ls *LState) closeThread(L *LState) LValue {
+	ls.closeAllUpvalues()
+	ls.kill()
+	ls.releaseStacks()
+	errobj := ls.errorObject
+	ls.errorObject = LNil
+	if len(ls.tbcs) > 0 {
+		var err *ApiError
+		if errobj != LNil {
+			err = newApiError(ApiErrorRun, "", errobj)
+		}
+		if err = L.closeToBeClosedProtected(ls, 0, err); err != nil {
+			errobj = err.Object
+		}
+	}
+	return errobj
+}
+
 func (ls *LState) indexToReg(idx int) int {
 	base := ls.currentLocalBase()
 	if idx > 0 {
@@ -490,49 +851,37 @@ func (ls *LState) rkValue(idx int) LValue {
 	return ls.reg.array[ls.currentFrame.LocalBase+idx]
 }
 
+// closeUpvalues closes the open upvalues of the registers at idx and above.
+// The open upvalues are listed from the top of the registry, so only the
+// upvalues that are closed are visited.
 func (ls *LState) closeUpvalues(idx int) {
-	if ls.uvcache == nil {
-		return
-	}
-	var prev *Upvalue
-	for uv := ls.uvcache; uv != nil; uv = uv.next {
-		if uv.index >= idx {
-			if prev != nil {
-				prev.next = nil
-			} else {
-				ls.uvcache = nil
-			}
-			uv.Close()
-		}
-		prev = uv
+	for ls.uvcache != nil && ls.uvcache.index >= idx {
+		uv := ls.uvcache
+		ls.uvcache = uv.next
+		uv.next = nil
+		uv.Close()
 	}
 }
 
+// findUpvalue returns the open upvalue of the register idx, creating it if the
+// register has none. Closures usually capture the registers near the top of
+// the registry, which are found at the head of the list.
 func (ls *LState) findUpvalue(idx int) *Upvalue {
 	var prev *Upvalue
-	var next *Upvalue
-	if ls.uvcache != nil {
-		for uv := ls.uvcache; uv != nil; uv = uv.next {
-			if uv.index == idx {
-				return uv
-			}
-			if uv.index > idx {
-				next = uv
-				break
-			}
-			prev = uv
+	uv := ls.uvcache
+	for ; uv != nil && uv.index >= idx; uv = uv.next {
+		if uv.index == idx {
+			return uv
 		}
+		prev = uv
 	}
-	uv := &Upvalue{reg: ls.reg, index: idx, closed: false}
+	newuv := &Upvalue{next: uv, reg: ls.reg, index: idx, closed: false}
 	if prev != nil {
-		prev.next = uv
+		prev.next = newuv
 	} else {
-		ls.uvcache = uv
-	}
-	if next != nil {
-		uv.next = next
+		ls.uvcache = newuv
 	}
-	return uv
+	return newuv
 }
 
 func (ls *LState) metatable(lvalue LValue, rawget bool) LValue {
@@ -624,6 +973,7 @@ func (ls *LState) initCallFrame(cf *callFrame) {
 		if nvarargs < 0 {
 			nvarargs = 0
 		}
+		ls.reg.checkSize(cf.LocalBase + np)
 		for i := nargs; i < np; i++ {
 			//ls.reg.Set(cf.LocalBase+i, LNil)
 			ls.reg.array[cf.LocalBase+i] = LNil
@@ -685,6 +1035,9 @@ func (ls *LState) pushCallFrame(cf callFrame, fn LValue, meta bool) {
 	newcf := ls.stack.Last()
 	ls.initCallFrame(newcf)
 	ls.currentFrame = newcf
+	if !newcf.Fn.IsG {
+		hookLuaCall(ls)
+	}
 }
 
 func (ls *LState) callR(nargs, nret, rbase int) {
@@ -748,6 +1101,13 @@ func (ls *LState) getField(obj LValue, key LValue) LValue {
 	return nil
 }
 
+// checkFrozen raises an error if the table is frozen.
+func (ls *LState) checkFrozen(tb *LTable) {
+	if tb.frozen {
+		ls.RaiseError("attempt to modify a frozen table")
+	}
+}
+
 func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 	curobj := obj
 	for i := 0; i < MaxTableGetLoop; i++ {
@@ -757,6 +1117,7 @@ func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 				if n, ok := key.(LNumber); ok && math.IsNaN(float64(n)) {
 					ls.RaiseError("table index is NaN")
 				}
+				ls.checkFrozen(tb)
 				tb.RawSet(key, value)
 				return
 			}
@@ -769,6 +1130,10 @@ func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 			if n, ok := key.(LNumber); ok && math.IsNaN(float64(n)) {
 				ls.RaiseError("table index is NaN")
 			}
+			ls.checkFrozen(tb)
+			if value != LNil {
+				ls.allocate(LTTable, memHashSlotSize)
+			}
 			tb.RawSet(key, value)
 			return
 		}
@@ -790,14 +1155,37 @@ func (ls *LState) setField(obj LValue, key LValue, value LValue) {
 
 /* api methods {{{ */
 
-func NewState() *LState {
-	ls := newLState()
-	ls.OpenLibs()
+func NewState(opts ...Options) *LState {
+	options := Options{}
+	if len(opts) > 0 {
+		options = opts[0]
+	}
+	if options.RegistrySize < 1 {
+		options.RegistrySize = RegistrySize
+	}
+	if options.RegistryMaxSize < options.RegistrySize {
+		options.RegistryMaxSize = options.RegistrySize
+	}
+	if options.CallStackSize < 1 {
+		options.CallStackSize = CallStackSize
+	}
+	ls := newLState(options)
+	ls.G.MainThread = ls
+	ls.G.CurrentThread = ls
+	ls.G.memLimit = options.MemoryLimit
+	if options.Clock != nil || options.Deterministic {
+		ls.G.startedAt = ls.now()
+	}
+	if !options.SkipOpenLibs {
+		ls.OpenLibs()
+	}
 	return ls
 }
 
 func (ls *LState) Close() {
 	atomic.AddInt32(&ls.stop, 1)
+	ls.RemoveContext()
+	ls.closeFinalizers()
 	for _, file := range ls.G.tempFiles {
 		// ignore errors in these operations
 		file.Close()
@@ -959,21 +1347,107 @@ func (ls *LState) Remove(index int) {
 
 func (ls *LState) NewTable() *LTable {
 	// TODO change size
-	return newLTable(32, 32)
+	return ls.allocateTable(32, 32)
 }
 
 func (ls *LState) CreateTable(acap, hcap int) *LTable {
-	return newLTable(acap, hcap)
+	return ls.allocateTable(acap, hcap)
+}
+
+// NewTableFromSlice returns a new table whose elements 1 to len(values) are the
+// values. The array part of the table is allocated at once.
+func (ls *LState) NewTableFromSlice(values []LValue) *LTable {
+	tb := ls.allocateTable(len(values), 0)
+	tb.array = append(tb.array, values...)
+	return tb
+}
+
+// NewTableFromMap returns a new table with the string keys and the values of
+// the map. Entries whose values are LNil are omitted. The hash part of the
+// table is allocated at once, and the keys are set in sorted order if the table
+// is ordered.
+func (ls *LState) NewTableFromMap(m map[string]LValue) *LTable {
+	tb := ls.allocateTable(0, len(m))
+	if tb.IsOrdered() {
+		for _, key := range slices.Sorted(maps.Keys(m)) {
+			if value := m[key]; value != LNil {
+				tb.setDict(LString(key), value)
+			}
+		}
+		return tb
+	}
+	for key, value := range m {
+		if value != LNil {
+			tb.dict[LString(key)] = value
+		}
+	}
+	return tb
+}
+
+// NewOrderedTable returns a new table that preserves the insertion order of its
+// keys: pairs, next and ForEach return the elements of the array part(small
+// positive integer keys) by their keys and then the other keys in the order
+// they were first set. A key keeps its position when it is set to nil and set again, and json
+// objects are encoded in this order instead of the sorted order.
+func (ls *LState) NewOrderedTable() *LTable {
+	ls.allocateObject(LTTable, memTableSize+32*memHashSlotSize)
+	return newOrderedLTable(0, 32)
 }
 
 func (ls *LState) NewThread() *LState {
-	thread := newLState()
-	thread.G = ls.G
+	return ls.NewThreadWithOptions(ThreadOptions{})
+}
+
+// NewThreadWithOptions returns a new coroutine like NewThread whose stacks have
+// the given sizes. Zero fields of opts default to ThreadRegistrySize,
+// ThreadRegistryMaxSize and ThreadCallStackSize of the options of the state,
+// and then to RegistrySize, RegistryMaxSize and CallStackSize.
+func (ls *LState) NewThreadWithOptions(opts ThreadOptions) *LState {
+	opts = ls.G.threadOptions(opts)
+	ls.allocateObject(LTThread, memThreadSize+opts.RegistrySize*memArraySlotSize)
+	thread := newThreadState(ls.G, opts)
+	ls.G.addCoroutine(thread)
 	thread.Env = ls.Env
+	thread.ctx = ls.ctx
+	thread.ctxWatch = ls.ctxWatch
+	if ls.hook != nil {
+		hook := *ls.hook
+		hook.running = false
+		hook.lastFrame = nil
+		thread.hook = &hook
+	}
 	return thread
 }
 
+// threadOptions fills the zero fields of the sizes of a new coroutine.
+func (g *Global) threadOptions(opts ThreadOptions) ThreadOptions {
+	options := g.options
+	if opts.RegistrySize < 1 {
+		opts.RegistrySize = options.ThreadRegistrySize
+	}
+	if opts.RegistrySize < 1 {
+		opts.RegistrySize = options.RegistrySize
+	}
+	if opts.RegistryMaxSize < 1 {
+		opts.RegistryMaxSize = options.ThreadRegistryMaxSize
+	}
+	if opts.RegistryMaxSize < 1 {
+		opts.RegistryMaxSize = options.RegistryMaxSize
+	}
+	if opts.RegistryMaxSize < opts.RegistrySize {
+		opts.RegistryMaxSize = opts.RegistrySize
+	}
+	if opts.CallStackSize < 1 {
+		opts.CallStackSize = options.ThreadCallStackSize
+	}
+	if opts.CallStackSize < 1 {
+		opts.CallStackSize = options.CallStackSize
+	}
+	return opts
+}
+
 func (ls *LState) NewUserData() *LUserData {
+	ls.allocateObject(LTUserData, memUserDataSize)
 	return &LUserData{
 		Env:       ls.currentEnv(),
 		Metatable: LNil,
@@ -981,10 +1455,12 @@ func (ls *LState) NewUserData() *LUserData {
 }
 
 func (ls *LState) NewFunction(fn LGFunction) *LFunction {
+	ls.allocateObject(LTFunction, memFunctionSize)
 	return newLFunctionG(fn, ls.currentEnv(), 0)
 }
 
 func (ls *LState) NewClosure(fn LGFunction, upvalues ...LValue) *LFunction {
+	ls.allocateObject(LTFunction, memFunctionSize+len(upvalues)*memUpvalueSize)
 	cl := newLFunctionG(fn, ls.currentEnv(), len(upvalues))
 	for i, lv := range upvalues {
 		cl.Upvalues[i] = &Upvalue{}
@@ -1006,6 +1482,9 @@ func (ls *LState) ToInt(n int) int {
 	if lv, ok := ls.Get(n).(LNumber); ok {
 		return int(lv)
 	}
+	if lv, ok := ls.Get(n).(LInteger); ok {
+		return int(lv)
+	}
 	if lv, ok := ls.Get(n).(LString); ok {
 		if num, err := parseNumber(string(lv)); err == nil {
 			return int(num)
@@ -1018,6 +1497,9 @@ func (ls *LState) ToInt64(n int) int64 {
 	if lv, ok := ls.Get(n).(LNumber); ok {
 		return int64(lv)
 	}
+	if lv, ok := ls.Get(n).(LInteger); ok {
+		return int64(lv)
+	}
 	if lv, ok := ls.Get(n).(LString); ok {
 		if num, err := parseNumber(string(lv)); err == nil {
 			return int64(num)
@@ -1097,12 +1579,10 @@ func (ls *LState) GetInfo(what string, dbg *Debug, fn LValue) (LValue, error) {
 		case 'f':
 			retfn = true
 		case 'S':
-			if dbg.frame != nil && dbg.frame.Parent == nil {
-				dbg.What = "main"
+			if dbg.frame != nil {
+				dbg.What = frameWhat(dbg.frame)
 			} else if f.IsG {
 				dbg.What = "G"
-			} else if dbg.frame != nil && dbg.frame.TailCall > 0 {
-				dbg.What = "tail"
 			} else {
 				dbg.What = "Lua"
 			}
@@ -1110,15 +1590,43 @@ func (ls *LState) GetInfo(what string, dbg *Debug, fn LValue) (LValue, error) {
 				dbg.Source = f.Proto.SourceName
 				dbg.LineDefined = f.Proto.LineDefined
 				dbg.LastLineDefined = f.Proto.LastLineDefined
+			} else {
+				dbg.Source = "[G]"
+				dbg.LineDefined = -1
+				dbg.LastLineDefined = -1
 			}
 		case 'l':
+			dbg.CurrentLine = -1
+			dbg.CurrentColumn = -1
 			if !f.IsG && dbg.frame != nil {
 				if dbg.frame.Pc > 0 {
 					dbg.CurrentLine = f.Proto.DbgSourcePositions[dbg.frame.Pc-1]
+					dbg.CurrentColumn = f.Proto.DbgSourceColumns[dbg.frame.Pc-1]
 				}
 			}
 		case 'u':
 			dbg.NUpvalues = len(f.Upvalues)
+			if f.IsG {
+				dbg.NParams = 0
+				dbg.IsVarArg = true
+			} else {
+				dbg.NParams = int(f.Proto.NumParameters)
+				dbg.IsVarArg = f.Proto.IsVarArg != 0
+			}
+		case 't':
+			dbg.IsTailCall = dbg.frame != nil && !dbg.frame.Fn.IsG && dbg.frame.TailCall > 0
+		case 'L':
+			dbg.ActiveLines = nil
+			if !f.IsG {
+				seen := map[int]bool{}
+				for _, line := range f.Proto.DbgSourcePositions {
+					if !seen[line] {
+						seen[line] = true
+						dbg.ActiveLines = append(dbg.ActiveLines, line)
+					}
+				}
+				sort.Ints(dbg.ActiveLines)
+			}
 		case 'n':
 			if dbg.frame != nil {
 				dbg.Name = ls.frameFuncName(dbg.frame)
@@ -1135,19 +1643,26 @@ func (ls *LState) GetInfo(what string, dbg *Debug, fn LValue) (LValue, error) {
 
 }
 
+// Traceback returns the stack traceback that starts at the given level.
+func (ls *LState) Traceback(level int) string {
+	return ls.stackTrace("", level)
+}
+
+// StackFrames returns the frames of the call stack from the current function
+// to the main chunk.
+func (ls *LState) StackFrames() []StackFrame {
+	return ls.stackFrames(0)
+}
+
 func (ls *LState) GetStack(level int) (*Debug, bool) {
 	frame := ls.currentFrame
+	// frames reused by tail calls are not counted as levels, like Lua 5.2.
 	for ; level > 0 && frame != nil; frame = frame.Parent {
 		level--
-		if !frame.Fn.IsG {
-			level -= frame.TailCall
-		}
 	}
 
 	if level == 0 && frame != nil {
 		return &Debug{frame: frame}, true
-	} else if level < 0 && ls.stack.Sp() > 0 {
-		return &Debug{frame: ls.stack.At(0)}, true
 	}
 	return &Debug{}, false
 }
@@ -1249,6 +1764,17 @@ func (ls *LState) RawGetInt(obj LValue, key int) LValue {
 	return tb.RawGetInt(key)
 }
 
+// GetTable returns obj[key], calling the __index metamethod like the VM.
+func (ls *LState) GetTable(obj LValue, key LValue) LValue {
+	return ls.getField(obj, key)
+}
+
+// SetTable sets obj[key] to value, calling the __newindex metamethod like the
+// VM.
+func (ls *LState) SetTable(obj LValue, key LValue, value LValue) {
+	ls.setField(obj, key, value)
+}
+
 func (ls *LState) GetField(obj LValue, skey string) LValue {
 	return ls.getField(obj, LString(skey))
 }
@@ -1257,6 +1783,10 @@ func (ls *LState) RawSet(obj LValue, key LValue, value LValue) {
 	if tb, ok := obj.(*LTable); !ok {
 		ls.TypeError(1, LTTable)
 	} else {
+		ls.checkFrozen(tb)
+		if value != LNil && tb.RawGet(key) == LNil {
+			ls.allocate(LTTable, memHashSlotSize)
+		}
 		tb.RawSet(key, value)
 	}
 }
@@ -1265,6 +1795,10 @@ func (ls *LState) RawSetInt(obj LValue, key int, value LValue) {
 	if tb, ok := obj.(*LTable); !ok {
 		ls.TypeError(1, LTTable)
 	} else {
+		ls.checkFrozen(tb)
+		if value != LNil && tb.RawGetInt(key) == LNil {
+			ls.allocate(LTTable, memArraySlotSize)
+		}
 		tb.RawSetInt(key, value)
 	}
 }
@@ -1295,7 +1829,13 @@ func (ls *LState) Next(obj LValue, key LValue) (LValue, LValue) {
 		ls.TypeError(1, LTTable)
 		return nil, nil
 	}
-	return tb.Next(key)
+	return ls.tableNext(tb, key)
+}
+
+// tableNext returns the entry of the table after the key like LTable.Next. The
+// keys are sorted in deterministic mode.
+func (ls *LState) tableNext(tb *LTable, key LValue) (LValue, LValue) {
+	return tb.nextKey(key, ls.G.options.Deterministic)
 }
 
 /* }}} */
@@ -1312,19 +1852,59 @@ func (ls *LState) ObjLen(v1 LValue) int {
 		ls.Push(v1)
 		ls.Call(1, 1)
 		ret := ls.reg.Pop()
-		if ret.Type() == LTNumber {
-			return int(ret.(LNumber))
+		if ret.Type() != LTNumber {
+			ls.RaiseError("object length is not a number")
 		}
+		return int(LVAsNumber(ret))
 	} else if v1.Type() == LTTable {
 		return v1.(*LTable).Len()
 	}
 	return 0
 }
 
+// Len returns #v like the VM, calling the __len metamethod.
+func (ls *LState) Len(v LValue) LValue {
+	return objectLength(ls, v)
+}
+
 /* }}} */
 
 /* binary operations {{{ */
 
+// Arith returns the result of the arithmetic operation like the VM, calling
+// metamethods if the operands are not numbers. opcode is one of OP_ADD,
+// OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR,
+// OP_SHL, OP_SHR, OP_UNM, OP_BNOT and OP_CONCAT. rhs is ignored by OP_UNM and
+// OP_BNOT.
+func (ls *LState) Arith(opcode int, lhs, rhs LValue) LValue {
+	switch opcode {
+	case OP_UNM:
+		if nm, ok := lhs.(LNumber); ok {
+			return -nm
+		}
+		return objectUnaryMinus(ls, lhs)
+	case OP_CONCAT:
+		top := ls.reg.Top()
+		ls.reg.Push(lhs)
+		ls.reg.Push(rhs)
+		ret := stringConcat(ls, 2, ls.reg.Top()-1)
+		ls.reg.SetTop(top)
+		return ret
+	case OP_BNOT:
+		rhs = lhs
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+	default:
+		ls.RaiseError("invalid arithmetic operation: %v", opcode)
+		return LNil
+	}
+	v1, ok1 := lhs.(LNumber)
+	v2, ok2 := rhs.(LNumber)
+	if ok1 && ok2 && !Lua53Integer {
+		return numberArith(ls, opcode, v1, v2)
+	}
+	return objectArith(ls, opcode, lhs, rhs)
+}
+
 func (ls *LState) Concat(values ...LValue) string {
 	top := ls.reg.Top()
 	for _, value := range values {
@@ -1339,6 +1919,12 @@ func (ls *LState) LessThan(lhs, rhs LValue) bool {
 	return lessThan(ls, lhs, rhs)
 }
 
+// LessEqual returns lhs <= rhs like the VM, calling the __le or __lt
+// metamethods.
+func (ls *LState) LessEqual(lhs, rhs LValue) bool {
+	return lessEqual(ls, lhs, rhs)
+}
+
 func (ls *LState) Equal(lhs, rhs LValue) bool {
 	return equals(ls, lhs, rhs, false)
 }
@@ -1360,15 +1946,53 @@ func (ls *LState) Register(name string, fn LGFunction) {
 /* load and function call operations {{{ */
 
 func (ls *LState) Load(reader io.Reader, name string) (*LFunction, *ApiError) {
+	var header [1]byte
+	n, _ := io.ReadFull(reader, header[:])
+	if n == 1 && header[0] == dumpSignature[0] {
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, newApiErrorE(ApiErrorFile, err.Error(), err)
+		}
+		proto, err := undumpProto(append(header[:], data...))
+		if err != nil {
+			return nil, newApiErrorE(ApiErrorSyntax, fmt.Sprintf("%v: %v", name, err.Error()), err)
+		}
+		return newChunkFunction(proto, ls.currentEnv()), nil
+	}
+	reader = io.MultiReader(bytes.NewReader(header[:n]), reader)
 	chunk, err := parse.Parse(reader, name)
 	if err != nil {
-		return nil, newApiError(ApiErrorSyntax, err.Error(), LNil)
+		return nil, newApiErrorE(ApiErrorSyntax, err.Error(), err)
 	}
+	return ls.LoadAST(chunk, name)
+}
+
+// LoadAST compiles the chunk parsed by parse.Parse and returns it as a
+// function. The chunk is not modified, so it can be compiled again.
+func (ls *LState) LoadAST(chunk []ast.Stmt, name string) (*LFunction, *ApiError) {
 	proto, err := Compile(chunk, name)
 	if err != nil {
-		return nil, newApiError(ApiErrorSyntax, err.Error(), LNil)
+		return nil, newApiErrorE(ApiErrorSyntax, err.Error(), err)
+	}
+	return newChunkFunction(proto, ls.currentEnv()), nil
+}
+
+// newChunkFunction creates a function of the loaded chunk. Chunks compiled
+// with Lua52Env hold the environment in their first upvalue named _ENV.
+func newChunkFunction(proto *FunctionProto, env *LTable) *LFunction {
+	fn := newLFunctionL(proto, env, int(proto.NumUpvalues))
+	for i := range fn.Upvalues {
+		fn.Upvalues[i] = &Upvalue{value: LNil, closed: true}
+	}
+	setChunkEnv(fn, env)
+	return fn
+}
+
+func setChunkEnv(fn *LFunction, env *LTable) {
+	fn.Env = env
+	if len(fn.Upvalues) > 0 && len(fn.Proto.DbgUpvalues) > 0 && fn.Proto.DbgUpvalues[0] == envName {
+		fn.Upvalues[0].value = env
 	}
-	return newLFunctionL(proto, ls.currentEnv(), 0), nil
 }
 
 func (ls *LState) Call(nargs, nret int) {
@@ -1381,37 +2005,31 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err *ApiError) {
 	base := ls.reg.Top() - nargs - 1
 	oldpanic := ls.Panic
 	ls.Panic = func(L *LState) {
-		panic(newApiError(ApiErrorRun, "", L.Get(-1)))
+		panic(L.newApiErrorWithTraceback(ApiErrorRun, L.Get(-1)))
 	}
 	defer func() {
 		ls.Panic = oldpanic
 		rcv := recover()
 		if rcv != nil {
-			if _, ok := rcv.(*ApiError); !ok {
-				panic(rcv)
-			}
-			err = rcv.(*ApiError)
-			if errfunc != nil {
-				ls.Push(errfunc)
-				ls.Push(err.Object)
-				ls.Panic = func(L *LState) {
-					panic(newApiError(ApiErrorError, "", L.Get(-1)))
+			if apierr, ok := rcv.(*ApiError); ok {
+				err = apierr
+				if errfunc != nil {
+					err = ls.callErrorHandler(errfunc, err)
 				}
-				defer func() {
-					ls.Panic = oldpanic
-					rcv := recover()
-					if rcv != nil {
-						if _, ok := rcv.(*ApiError); !ok {
-							panic(ok)
-						}
-						err = rcv.(*ApiError)
-					}
-				}()
-				ls.Call(1, 1)
+			} else {
+				ls.closeAllUpvalues()
+				err = ls.newPanicError(rcv)
 			}
 			ls.reg.SetTop(base)
+			if n := len(ls.tbcs); n > 0 && ls.tbcs[n-1].index >= base {
+				ls.stack.SetSp(sp)
+				ls.currentFrame = ls.stack.Last()
+				err = ls.closeToBeClosedProtected(ls, base, err)
+				ls.reg.SetTop(base)
+			}
 		}
 		ls.stack.SetSp(sp)
+		ls.currentFrame = ls.stack.Last()
 	}()
 
 	ls.Call(nargs, nret)
@@ -1419,6 +2037,46 @@ func (ls *LState) PCall(nargs, nret int, errfunc *LFunction) (err *ApiError) {
 	return
 }
 
+// newPanicError converts a recovered Go panic to an error. Error handlers are
+// not called for Go panics.
+func (ls *LState) newPanicError(rcv interface{}) *ApiError {
+	cause, ok := rcv.(error)
+	if !ok {
+		cause = fmt.Errorf("%v", rcv)
+	}
+	err := ls.newApiErrorWithTraceback(ApiErrorPanic, LString(cause.Error()))
+	err.Cause = cause
+	if ls.G.options.IncludeGoStackTrace {
+		err.StackTrace = fmt.Sprintf("%v\ngo stack traceback:\n%v", err.StackTrace, strings.TrimSpace(string(debug.Stack())))
+	}
+	return err
+}
+
+func (ls *LState) callErrorHandler(errfunc *LFunction, err *ApiError) (herr *ApiError) {
+	herr = err
+	// the call stack may be full, the error handler can use extra frames.
+	ls.stack.maxSize += callFrameErrorFrames
+	oldpanic := ls.Panic
+	ls.Panic = func(L *LState) {
+		panic(L.newApiErrorWithTraceback(ApiErrorError, L.Get(-1)))
+	}
+	defer func() {
+		ls.stack.maxSize -= callFrameErrorFrames
+		ls.Panic = oldpanic
+		if rcv := recover(); rcv != nil {
+			if _, ok := rcv.(*ApiError); !ok {
+				panic(rcv)
+			}
+			herr = rcv.(*ApiError)
+		}
+	}()
+	ls.Push(errfunc)
+	ls.Push(err.Object)
+	ls.Call(1, 1)
+	herr = &ApiError{Type: err.Type, Object: ls.reg.Pop(), StackTrace: err.StackTrace}
+	return
+}
+
 func (ls *LState) GPCall(fn LGFunction, data LValue) *ApiError {
 	ls.Push(newLFunctionG(fn, ls.currentEnv(), 0))
 	ls.Push(data)
@@ -1456,8 +2114,11 @@ func (ls *LState) SetMetatable(obj LValue, mt LValue) {
 	switch v := obj.(type) {
 	case *LTable:
 		v.Metatable = mt
+		v.setWeakMode(weakMode(mt))
+		ls.markForFinalization(v, mt)
 	case *LUserData:
 		v.Metatable = mt
+		ls.markForFinalization(v, mt)
 	default:
 		ls.G.builtinMts[int(obj.Type())] = mt
 	}
@@ -1480,6 +2141,12 @@ func (ls *LState) Status(th *LState) string {
 }
 
 func (ls *LState) Resume(th *LState, fn *LFunction, args ...LValue) (ResumeState, *ApiError, []LValue) {
+	if ls.G.CurrentThread == th {
+		return ResumeError, newApiError(ApiErrorRun, "can not resume a running thread", LNil), nil
+	}
+	if th.Dead {
+		return ResumeError, newApiError(ApiErrorRun, "can not resume a dead thread", LNil), nil
+	}
 	isstarted := th.isStarted()
 	if !isstarted {
 		base := 0
@@ -1499,12 +2166,6 @@ func (ls *LState) Resume(th *LState, fn *LFunction, args ...LValue) (ResumeState
 		}
 	}
 
-	if ls.G.CurrentThread == th {
-		return ResumeError, newApiError(ApiErrorRun, "can not resume a running thread", LNil), nil
-	}
-	if th.Dead {
-		return ResumeError, newApiError(ApiErrorRun, "can not resume a dead thread", LNil), nil
-	}
 	th.Parent = ls
 	ls.G.CurrentThread = th
 	if !isstarted {
@@ -1534,13 +2195,23 @@ func (ls *LState) Resume(th *LState, fn *LFunction, args ...LValue) (ResumeState
 	ls.SetTop(top)
 
 	if haserror {
-		return ResumeError, newApiError(ApiErrorRun, fmt.Sprint(ret[0]), LNil), nil
+		return ResumeError, newApiError(ApiErrorRun, "", ret[0]), nil
 	} else if th.stack.IsEmpty() {
 		return ResumeOK, nil, ret
 	}
 	return ResumeYield, nil, ret
 }
 
+func (ls *LState) CloseThread(th *LState) error {
+	if th.isActive() {
+		return newApiError(ApiErrorRun, "can not close a running thread", LNil)
+	}
+	if errobj := th.closeThread(ls); errobj != LNil {
+		return newApiError(ApiErrorRun, "", errobj)
+	}
+	return nil
+}
+
 func (ls *LState) Yield(values ...LValue) int {
 	ls.SetTop(0)
 	for _, lv := range values {
@@ -1575,7 +2246,7 @@ func (ls *LState) SetMx(mx int) {
 		for ls.stop == 0 {
 			runtime.ReadMemStats(&s)
 			if s.Alloc >= limit {
-				fmt.Println("out of memory")
+				fmt.Fprintln(ls.G.stderrWriter(), "out of memory")
 				os.Exit(3)
 			}
 			time.Sleep(100 * time.Millisecond)
@@ -1583,6 +2254,166 @@ func (ls *LState) SetMx(mx int) {
 	}()
 }
 
+// contextWatch tells the VM when it has to check the context of a state, so
+// the VM does not check the context before every instruction.
+type contextWatch struct {
+	// check is set when the context is done, or when the state stops watching
+	// the context. Coroutines that still have the context check it before
+	// every instruction then.
+	check atomic.Bool
+	stop  func() bool
+}
+
+func watchContext(ctx context.Context) *contextWatch {
+	if ctx.Done() == nil {
+		return nil
+	}
+	w := &contextWatch{}
+	w.stop = context.AfterFunc(ctx, func() {
+		w.check.Store(true)
+	})
+	// the function above runs on another goroutine.
+	if ctx.Err() != nil {
+		w.check.Store(true)
+	}
+	return w
+}
+
+// contextChecked reports whether the VM has to check the context.
+func (ls *LState) contextChecked() bool {
+	return ls.ctxWatch != nil && ls.ctxWatch.check.Load()
+}
+
+func (ls *LState) SetContext(ctx context.Context) {
+	ls.RemoveContext()
+	ls.ctx = ctx
+	if ctx != nil {
+		ls.ctxWatch = watchContext(ctx)
+	}
+}
+
+func (ls *LState) Context() context.Context {
+	return ls.ctx
+}
+
+func (ls *LState) RemoveContext() context.Context {
+	oldctx := ls.ctx
+	if w := ls.ctxWatch; w != nil {
+		w.stop()
+		w.check.Store(true)
+	}
+	ls.ctx = nil
+	ls.ctxWatch = nil
+	return oldctx
+}
+
+func (ls *LState) SetInstructionLimit(n int64) {
+	ls.G.instCount = 0
+	ls.G.instLimit = n
+	ls.G.updateInstrumented()
+}
+
+func (ls *LState) SetInstructionHook(interval int64, hook func(*LState)) {
+	if interval <= 0 || hook == nil {
+		ls.G.instHook = nil
+		ls.G.instHookInterval = 0
+	} else {
+		ls.G.instHook = hook
+		ls.G.instHookInterval = interval
+	}
+	ls.G.updateInstrumented()
+}
+
+// InstructionHook returns the interval and the function set by
+// SetInstructionHook, or 0 and nil if no hook is set.
+func (ls *LState) InstructionHook() (int64, func(*LState)) {
+	return ls.G.instHookInterval, ls.G.instHook
+}
+
+func (ls *LState) AllocStats() AllocStats {
+	return ls.G.allocStats
+}
+
+func (ls *LState) InstructionCount() int64 {
+	return ls.G.instCount
+}
+
+func (ls *LState) DumpFunction(fn *LFunction, w io.Writer) error {
+	if fn.IsG {
+		return errors.New("unable to dump given function")
+	}
+	return dumpProto(fn.Proto, w)
+}
+
+func (ls *LState) Clone() *LState {
+	L, _ := ls.clone()
+	return L
+}
+
+// clone returns a copy of the state and the copier that made it, so values of
+// the state can be copied into the new state consistently.
+func (ls *LState) clone() (*LState, *valueCopier) {
+	L := newLState(ls.G.options)
+	L.G.MainThread = L
+	L.G.CurrentThread = L
+	L.G.memLimit = ls.G.memLimit
+	L.G.instLimit = ls.G.instLimit
+	L.G.instHook = ls.G.instHook
+	L.G.instHookInterval = ls.G.instHookInterval
+	L.G.updateInstrumented()
+	for typ, conv := range ls.G.transferConverters {
+		L.RegisterTransferConverter(typ, conv)
+	}
+	L.G.stdin, L.G.stdout, L.G.stderr = ls.G.stdin, ls.G.stdout, ls.G.stderr
+	L.G.startedAt = ls.G.startedAt
+
+	vc := newValueCopier(L)
+	vc.copies[ls.G.MainThread] = L
+	L.G.Registry = vc.copyTable(ls.G.Registry)
+	L.G.Global = vc.copyTable(ls.G.Global)
+	L.Env = vc.copyTable(ls.G.MainThread.Env)
+	for typ, mt := range ls.G.builtinMts {
+		L.G.builtinMts[typ] = vc.copy(mt)
+	}
+	return L, vc
+}
+
+func (ls *LState) Snapshot() *Snapshot {
+	return &Snapshot{ls.Clone()}
+}
+
+func (ls *LState) SetHook(hook HookFunc, mask HookEvent, count int) {
+	ls.setHook(hook, LNil, mask, count)
+}
+
+func (ls *LState) GetHook() (HookFunc, HookEvent, int) {
+	if ls.hook == nil {
+		return nil, 0, 0
+	}
+	return ls.hook.fn, ls.hook.mask, ls.hook.count
+}
+
+func (ls *LState) setHook(hook HookFunc, lfn LValue, mask HookEvent, count int) {
+	if count > 0 {
+		mask |= HookCount
+	} else {
+		mask &^= HookCount
+		count = 0
+	}
+	if hook == nil || mask == 0 {
+		ls.hook = nil
+		return
+	}
+	ls.hook = &hookState{
+		fn:      hook,
+		lfn:     lfn,
+		mask:    mask,
+		count:   count,
+		counter: count,
+		lastPc:  -1,
+	}
+}
+
 /* }}} */
 
 /* }}} */
@@ -0,0 +1,253 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetContextTimeout(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.DoString(`while true do end`)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+}
+
+func TestSetContextCanceled(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	L.SetContext(ctx)
+	if err := L.DoString(`local x = 1`); err == nil {
+		t.Error("a canceled context must stop the script")
+	}
+	L.RemoveContext()
+	if err := L.DoString(`local x = 1`); err != nil {
+		t.Errorf("the script must run after RemoveContext: %v", err)
+	}
+}
+
+func TestSetContextCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.DoString(`
+	local co = coroutine.wrap(function() while true do end end)
+	co()
+	`)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+}
+
+func TestContextRestored(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	ctx := context.Background()
+	L.SetContext(ctx)
+	if L.Context() != ctx {
+		t.Error("Context must return the context set by SetContext")
+	}
+	if old := L.RemoveContext(); old != ctx {
+		t.Error("RemoveContext must return the previous context")
+	}
+	if L.Context() != nil {
+		t.Error("Context must return nil after RemoveContext")
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetInstructionLimit(10000)
+	err := L.DoString(`while true do end`)
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Errorf("got %v, want a limit error", err)
+	}
+	// SetInstructionLimit resets the count.
+	L.SetInstructionLimit(10000)
+	if err := L.DoString(`for i = 1, 100 do end`); err != nil {
+		t.Error(err)
+	}
+	if n := L.InstructionCount(); n <= 0 || n > 10000 {
+		t.Errorf("got %v instructions", n)
+	}
+}
+
+func TestInstructionHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	calls := 0
+	L.SetInstructionHook(100, func(L *LState) { calls++ })
+	if err := L.DoString(`for i = 1, 1000 do end`); err != nil {
+		t.Fatal(err)
+	}
+	if calls == 0 {
+		t.Error("the hook was not called")
+	}
+	if interval, hook := L.InstructionHook(); interval != 100 || hook == nil {
+		t.Errorf("got the interval %v, want 100", interval)
+	}
+	L.SetInstructionHook(0, nil)
+	calls = 0
+	if err := L.DoString(`for i = 1, 1000 do end`); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 0 {
+		t.Error("the hook was called after it was removed")
+	}
+}
+
+func TestInstructionHookError(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetInstructionHook(10, func(L *LState) { L.RaiseError("stopped") })
+	if err := L.DoString(`while true do end`); err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Errorf("got %v, want the error of the hook", err)
+	}
+}
+
+func TestApiErrorUnwrap(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	err := L.DoFile(filepath.Join(t.TempDir(), "missing.lua"))
+	if err == nil || err.Type != ApiErrorFile || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want a file error", err)
+	}
+
+	err = L.DoString(`x = = 1`)
+	if err == nil || err.Type != ApiErrorSyntax || errors.Unwrap(err) == nil {
+		t.Errorf("got %v, want a syntax error", err)
+	}
+
+	sentinel := errors.New("sentinel")
+	L.SetGlobal("fail", L.NewFunction(func(L *LState) int {
+		ud := L.NewUserData()
+		ud.Value = sentinel
+		L.Error(ud, 0)
+		return 0
+	}))
+	L.SetGlobal("crash", L.NewFunction(func(L *LState) int {
+		panic(sentinel)
+	}))
+	if err := L.DoString(`fail()`); !errors.Is(err, sentinel) {
+		t.Errorf("got %v, want the error of the userdata", err)
+	}
+	err = L.DoString(`crash()`)
+	if err == nil || err.Type != ApiErrorPanic || !errors.Is(err, sentinel) {
+		t.Errorf("got %v, want a panic error", err)
+	}
+	if s := ApiErrorPanic.String(); s != "panic" {
+		t.Errorf("got %v, want panic", s)
+	}
+}
+
+func TestStackFrames(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var frames []StackFrame
+	var traceback string
+	L.SetGlobal("capture", L.NewFunction(func(L *LState) int {
+		frames = L.StackFrames()
+		traceback = L.Traceback(1)
+		return 0
+	}))
+	err := L.DoString(`
+	function handler()
+	  capture()
+	end
+	handler()
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %v frames, want 3", len(frames))
+	}
+	if f := frames[0]; f.What != "G" || f.CurrentLine != -1 {
+		t.Errorf("got %+v, want the Go function", f)
+	}
+	if f := frames[1]; f.Name != "handler" || f.Source != "<string>" || f.CurrentLine != 3 || f.What != "Lua" {
+		t.Errorf("got %+v, want handler", f)
+	}
+	if f := frames[2]; f.What != "main" || f.CurrentLine != 5 {
+		t.Errorf("got %+v, want the main chunk", f)
+	}
+	// the traceback starts at handler.
+	if !strings.HasPrefix(traceback, "stack traceback:\n\t<string>:3: in handler\n") {
+		t.Errorf("got %q", traceback)
+	}
+}
+
+func TestApiErrorIsIncomplete(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	for _, src := range []string{"if x then", "function f()", "x = {", `x = "abc`, "x = [[abc", "return 1 +"} {
+		if _, err := L.LoadString(src); err == nil || !err.IsIncomplete() {
+			t.Errorf("%q: got %v, want an incomplete input error", src, err)
+		}
+	}
+	for _, src := range []string{"x = = 1", "end", "return )"} {
+		if _, err := L.LoadString(src); err == nil || err.IsIncomplete() {
+			t.Errorf("%q: got %v, want a syntax error", src, err)
+		}
+	}
+	if err := L.DoString(`error("x")`); err == nil || err.IsIncomplete() {
+		t.Errorf("got %v, want a runtime error", err)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	run := func() string {
+		L := NewState(Options{Deterministic: true})
+		defer L.Close()
+		err := L.DoString(`
+		local t = {b = 1, a = 2, [true] = 3, [-1] = 4, [2.5] = 5, [false] = 6, c = 7}
+		local keys = {}
+		for k in pairs(t) do keys[#keys + 1] = tostring(k) end
+		local k, n = next(t), 0
+		while k ~= nil do n = n + 1 k = next(t, k) end
+		assert(n == 7, tostring(n))
+		result = table.concat(keys, " ") .. " " .. math.random(1000000) .. " " .. os.time() .. " " .. os.clock()
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return L.GetGlobal("result").String()
+	}
+	got := run()
+	if !strings.HasPrefix(got, "-1 2.5 a b c false true ") || !strings.HasSuffix(got, " 0 0") {
+		t.Errorf("got %q", got)
+	}
+	if again := run(); again != got {
+		t.Errorf("got %q, then %q", got, again)
+	}
+}
+
+func TestClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	L := NewState(Options{Clock: func() time.Time { return now }})
+	defer L.Close()
+	now = now.Add(1500 * time.Millisecond)
+	err := L.DoString(`
+	assert(os.time() == 1577934246, tostring(os.time()))
+	assert(os.date("!%Y-%m-%d %H:%M:%S") == "2020-01-02 03:04:06", os.date("!%Y-%m-%d %H:%M:%S"))
+	assert(os.clock() == 1.5, tostring(os.clock()))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
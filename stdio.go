@@ -0,0 +1,120 @@
+package lua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SetStdin sets the standard input of the state and its threads. io.read,
+// io.lines, io.stdin, loadfile and LoadFile read it instead of os.Stdin, and
+// commands run by os.execute and io.popen inherit it if it is an *os.File. nil
+// restores os.Stdin.
+func (ls *LState) SetStdin(r io.Reader) {
+	ls.G.stdin = r
+}
+
+// SetStdout sets the standard output of the state and its threads. print,
+// io.write and io.stdout write to it instead of os.Stdout, and so do commands
+// run by os.execute and io.popen. nil restores os.Stdout.
+func (ls *LState) SetStdout(w io.Writer) {
+	ls.G.stdout = w
+}
+
+// SetStderr sets the standard error of the state and its threads. io.stderr,
+// commands run by os.execute and io.popen and the error reported when the
+// memory limit set by SetMx is exceeded write to it instead of os.Stderr. nil
+// restores os.Stderr.
+func (ls *LState) SetStderr(w io.Writer) {
+	ls.G.stderr = w
+}
+
+func (g *Global) stdinReader() io.Reader {
+	if g.stdin != nil {
+		return g.stdin
+	}
+	return os.Stdin
+}
+
+func (g *Global) stdoutWriter() io.Writer {
+	if g.stdout != nil {
+		return g.stdout
+	}
+	return os.Stdout
+}
+
+func (g *Global) stderrWriter() io.Writer {
+	if g.stderr != nil {
+		return g.stderr
+	}
+	return os.Stderr
+}
+
+// stdinFile returns the standard input as a file that child processes can
+// inherit, or nil if it is not a file.
+func (g *Global) stdinFile() *os.File {
+	f, _ := g.stdinReader().(*os.File)
+	return f
+}
+
+// stdioFile is the File of io.stdin, io.stdout and io.stderr. It reads from and
+// writes to the standard streams that the state has when it is used, and
+// closing it does nothing.
+type stdioFile struct {
+	g    *Global
+	name string
+}
+
+func (f *stdioFile) stream() interface{} {
+	switch f.name {
+	case "stdin":
+		return f.g.stdinReader()
+	case "stdout":
+		return f.g.stdoutWriter()
+	}
+	return f.g.stderrWriter()
+}
+
+func (f *stdioFile) Read(p []byte) (int, error) {
+	if r, ok := f.stream().(io.Reader); ok {
+		return r.Read(p)
+	}
+	return 0, fmt.Errorf("can not read %v", f.name)
+}
+
+func (f *stdioFile) Write(p []byte) (int, error) {
+	if w, ok := f.stream().(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, fmt.Errorf("can not write %v", f.name)
+}
+
+func (f *stdioFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.stream().(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, fmt.Errorf("can not seek %v", f.name)
+}
+
+func (f *stdioFile) Close() error {
+	return nil
+}
+
+func (f *stdioFile) Name() string {
+	return f.name
+}
+
+// newStdioLFile returns a copy of the standard file that uses the streams of
+// the global state g. The buffers of the file are not copied.
+func newStdioLFile(g *Global, name string, file *lFile) *lFile {
+	fp := &stdioFile{g, name}
+	cp := &lFile{fp: fp, closed: file.closed}
+	if file.rawWriter != nil {
+		cp.writer, cp.rawWriter = fp, fp
+	}
+	if file.reader != nil {
+		cp.reader = bufio.NewReaderSize(fp, fileDefaultReadBuffer)
+	}
+	return cp
+}
@@ -0,0 +1,57 @@
+package lua
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSetStdio(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var stdout, stderr bytes.Buffer
+	L.SetStdout(&stdout)
+	L.SetStderr(&stderr)
+	L.SetStdin(strings.NewReader("first line\n42\nlast"))
+	err := L.DoString(`
+	print("hello", 1)
+	io.write("a", 2, "\n")
+	io.stdout:write("b\n")
+	io.stderr:write("oops")
+	assert(io.read() == "first line" and io.read("n") == 42)
+	for l in io.lines() do assert(l == "" or l == "last", l) end
+	coroutine.wrap(function() print("from a coroutine") end)()
+
+	-- the standard streams are not closed.
+	local ok, err = io.stdout:close()
+	assert(ok == nil and type(err) == "string")
+	io.write("still open\n")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "hello\t1\na2\nb\nfrom a coroutine\nstill open\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := stderr.String(); got != "oops" {
+		t.Errorf("got %q, want oops", got)
+	}
+}
+
+func TestSetStdoutCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands need a POSIX shell")
+	}
+	L := NewState()
+	defer L.Close()
+	var stdout, stderr bytes.Buffer
+	L.SetStdout(&stdout)
+	L.SetStderr(&stderr)
+	if err := L.DoString(`os.execute("echo out; echo err >&2")`); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("got %q and %q", stdout.String(), stderr.String())
+	}
+}
@@ -1,11 +1,66 @@
 package lua
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// patternKey identifies a compiled pattern. The same text compiles
+// differently depending on LuaRegex.
+type patternKey struct {
+	pattern  string
+	luaRegex bool
+}
+
+// patternCache holds compiled patterns shared by all states, which is safe
+// because compiled regexps can be used concurrently. The cache is emptied when
+// it has PatternCacheSize patterns.
+var patternCache = struct {
+	sync.Mutex
+	patterns map[patternKey]*regexp.Regexp
+}{patterns: make(map[patternKey]*regexp.Regexp)}
+
+// compileLuaRegex compiles the pattern, reusing the cached result if the
+// pattern has been compiled before.
+func compileLuaRegex(pattern string) (*regexp.Regexp, error) {
+	return compileCachedRegex(pattern, LuaRegex)
+}
+
+// compileCachedRegex compiles the pattern as a Lua pattern if luaRegex is true
+// and as a Go regexp otherwise, reusing the cached result.
+func compileCachedRegex(pattern string, luaRegex bool) (*regexp.Regexp, error) {
+	compile := regexp.Compile
+	if luaRegex {
+		compile = translateLuaRegex
+	}
+	if PatternCacheSize <= 0 {
+		return compile(pattern)
+	}
+	key := patternKey{pattern, luaRegex}
+	patternCache.Lock()
+	re, ok := patternCache.patterns[key]
+	patternCache.Unlock()
+	if ok {
+		return re, nil
+	}
+	re, err := compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Lock()
+	if len(patternCache.patterns) >= PatternCacheSize {
+		clear(patternCache.patterns)
+	}
+	patternCache.patterns[key] = re
+	patternCache.Unlock()
+	return re, nil
+}
+
 func stringOpen(L *LState) {
 	_, ok := L.G.builtinMts[int(LTString)]
 	if !ok {
@@ -19,19 +74,22 @@ func stringOpen(L *LState) {
 }
 
 var strFuncs = map[string]LGFunction{
-	"byte":    strByte,
-	"char":    strChar,
-	"dump":    strDump,
-	"find":    strFind,
-	"format":  strFormat,
-	"gsub":    strGsub,
-	"len":     strLen,
-	"lower":   strLower,
-	"match":   strMatch,
-	"rep":     strRep,
-	"reverse": strReverse,
-	"sub":     strSub,
-	"upper":   strUpper,
+	"byte":     strByte,
+	"char":     strChar,
+	"dump":     strDump,
+	"find":     strFind,
+	"format":   strFormat,
+	"gsub":     strGsub,
+	"len":      strLen,
+	"lower":    strLower,
+	"match":    strMatch,
+	"pack":     strPack,
+	"packsize": strPackSize,
+	"rep":      strRep,
+	"reverse":  strReverse,
+	"sub":      strSub,
+	"unpack":   strUnpack,
+	"upper":    strUpper,
 }
 
 func strByte(L *LState) int {
@@ -50,7 +108,7 @@ func strByte(L *LState) int {
 		if start < 0 || start >= l {
 			return 0
 		}
-		L.Push(LNumber(str[start]))
+		L.Push(integerValue(int64(str[start])))
 		return 1
 	}
 
@@ -61,7 +119,7 @@ func strByte(L *LState) int {
 	}
 
 	for i := start; i < end; i++ {
-		L.Push(LNumber(str[i]))
+		L.Push(integerValue(int64(str[i])))
 	}
 	return end - start
 }
@@ -77,16 +135,21 @@ func strChar(L *LState) int {
 }
 
 func strDump(L *LState) int {
-	L.RaiseError("GopherLua does not support the string.dump")
-	return 0
+	fn := L.CheckFunction(1)
+	var buf bytes.Buffer
+	if err := L.DumpFunction(fn, &buf); err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(LString(buf.String()))
+	return 1
 }
 
 func strFind(L *LState) int {
 	str := L.CheckString(1)
 	pattern := L.CheckString(2)
 	if len(str) == 0 && len(pattern) == 0 {
-		L.Push(LNumber(1))
-		L.Push(LNumber(0))
+		L.Push(integerValue(1))
+		L.Push(integerValue(0))
 		return 2
 	}
 	init := luaIndex2StringIndex(str, L.OptInt(3, 1), true)
@@ -95,7 +158,7 @@ func strFind(L *LState) int {
 		plain = LVAsBool(L.Get(4))
 	}
 	if len(str) == 0 && len(pattern) == 0 {
-		L.Push(LNumber(1))
+		L.Push(integerValue(1))
 		return 1
 	}
 
@@ -105,8 +168,8 @@ func strFind(L *LState) int {
 			L.Push(LNil)
 			return 1
 		}
-		L.Push(LNumber(init+pos) + 1)
-		L.Push(LNumber(init + pos + len(pattern)))
+		L.Push(integerValue(int64(init + pos + 1)))
+		L.Push(integerValue(int64(init + pos + len(pattern))))
 		return 2
 	}
 
@@ -121,8 +184,8 @@ func strFind(L *LState) int {
 		return 1
 	}
 	npos := len(positions)
-	L.Push(LNumber(init+positions[0]) + 1)
-	L.Push(LNumber(init + positions[npos-1]))
+	L.Push(integerValue(int64(init + positions[0] + 1)))
+	L.Push(integerValue(int64(init + positions[npos-1])))
 	for i := 2; i < npos; i += 2 {
 		L.Push(LString(stroffset[positions[i]:positions[i+1]]))
 	}
@@ -130,15 +193,274 @@ func strFind(L *LState) int {
 }
 
 func strFormat(L *LState) int {
-	str := L.CheckString(1)
-	args := make([]interface{}, L.GetTop()-1)
+	L.Push(L.allocateString(strFormatAux(L, 1)))
+	return 1
+}
+
+// strFormatAux formats the arguments after the stack index idx with the format
+// at idx like string.format. The conversions follow the C printf of Lua,
+// except that %q quotes strings so that the Lua lexer reads them back.
+func strFormatAux(L *LState, idx int) string {
+	format := L.CheckString(idx)
 	top := L.GetTop()
-	for i := 2; i <= top; i++ {
-		args[i-2] = L.Get(i)
+	arg := idx
+	buf := make([]byte, 0, len(format))
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			buf = append(buf, format[i])
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			buf = append(buf, '%')
+			continue
+		}
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		if i-start >= 6 {
+			L.RaiseError("invalid format (repeated flags)")
+		}
+		flags := format[start:i]
+		var width int
+		width, i = strFormatDigits(L, format, i)
+		precision := -1
+		if i < len(format) && format[i] == '.' {
+			precision, i = strFormatDigits(L, format, i+1)
+		}
+		if i >= len(format) {
+			L.RaiseError("invalid option '%%%v' to 'format'", format[start:])
+		}
+		conv := format[i]
+		if strings.IndexByte("diouxXceEfFgGaAqs", conv) < 0 {
+			L.RaiseError("invalid option '%%%v' to 'format'", format[start:i+1])
+		}
+		spec := "%" + format[start:i]
+		arg++
+		if arg > top {
+			L.ArgError(arg, "no value")
+		}
+		switch conv {
+		case 'd', 'i':
+			buf = fmt.Appendf(buf, spec+"d", strFormatInteger(L, arg))
+		case 'o', 'u', 'x', 'X':
+			if conv == 'u' {
+				conv = 'd'
+			}
+			buf = fmt.Appendf(buf, spec+string(conv), uint64(strFormatInteger(L, arg)))
+		case 'c':
+			c := string([]byte{byte(strFormatInteger(L, arg))})
+			buf = appendPadded(buf, "", c, flags, width, false)
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			f := float64(strFormatFloat(L, arg))
+			if math.IsInf(f, 0) || math.IsNaN(f) {
+				buf = appendNonFinite(buf, f, flags, width, conv < 'a')
+				break
+			}
+			if precision < 0 {
+				spec += ".6"
+			}
+			buf = fmt.Appendf(buf, spec+string(conv), f)
+		case 'a', 'A':
+			buf = appendHexFloat(buf, float64(strFormatFloat(L, arg)), flags, width, precision, conv == 'A')
+		case 'q':
+			if len(spec) > 1 {
+				L.RaiseError("specifier '%v' cannot have modifiers", "%q")
+			}
+			buf = appendQuoted(L, buf, arg)
+		case 's':
+			s := strFormatString(L, L.Get(arg))
+			if precision >= 0 && precision < len(s) {
+				s = s[:precision]
+			}
+			buf = appendPadded(buf, "", s, flags, width, false)
+		}
 	}
-	npat := strings.Count(str, "%") - strings.Count(str, "%%")
-	L.Push(LString(fmt.Sprintf(str, args[:intMin(npat, len(args))]...)))
-	return 1
+	return string(buf)
+}
+
+// strFormatDigits reads the width or the precision of a conversion, which has
+// at most 2 digits, from format[i:].
+func strFormatDigits(L *LState, format string, i int) (int, int) {
+	n, start := 0, i
+	for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+		n = n*10 + int(format[i]-'0')
+		i++
+	}
+	if i-start > 2 {
+		L.RaiseError("invalid format (width or precision too long)")
+	}
+	return n, i
+}
+
+// strFormatFloat returns the number argument at the stack index n. Strings
+// are converted to numbers.
+func strFormatFloat(L *LState, n int) LNumber {
+	lv := L.Get(n)
+	if s, ok := lv.(LString); ok {
+		if v, err := parseNumberValue(string(s)); err == nil {
+			lv = v
+		}
+	}
+	if f, ok := toFloatValue(lv); ok {
+		return f
+	}
+	L.ArgError(n, "number expected, got "+lv.Type().String())
+	return 0
+}
+
+// strFormatInteger returns the integer argument at the stack index n. Floats
+// are truncated, and raise an error if Lua53Integer is enabled and they have
+// no integer representation.
+func strFormatInteger(L *LState, n int) int64 {
+	if i, ok := L.Get(n).(LInteger); ok {
+		return int64(i)
+	}
+	f := strFormatFloat(L, n)
+	if i, ok := lnumberToInt64(f); ok {
+		return i
+	}
+	if Lua53Integer {
+		L.ArgError(n, "number has no integer representation")
+	}
+	return int64(f)
+}
+
+// strFormatString converts the value to a string like tostring.
+func strFormatString(L *LState, lv LValue) string {
+	if fn := L.metaOp1(lv, "__tostring"); fn.Type() == LTFunction {
+		L.Push(fn)
+		L.Push(lv)
+		L.Call(1, 1)
+		s, ok := L.reg.Pop().(LString)
+		if !ok {
+			L.RaiseError("'__tostring' must return a string")
+		}
+		return string(s)
+	}
+	return lv.String()
+}
+
+// appendPadded appends prefix and body padded to width with spaces, or with
+// zeros between prefix and body if zero is true and flags has '0'. The padding
+// follows body if flags has '-'.
+func appendPadded(buf []byte, prefix, body string, flags string, width int, zero bool) []byte {
+	pad := width - len(prefix) - len(body)
+	switch {
+	case pad <= 0:
+		buf = append(buf, prefix...)
+		buf = append(buf, body...)
+	case strings.IndexByte(flags, '-') >= 0:
+		buf = append(buf, prefix...)
+		buf = append(buf, body...)
+		buf = append(buf, strings.Repeat(" ", pad)...)
+	case zero && strings.IndexByte(flags, '0') >= 0:
+		buf = append(buf, prefix...)
+		buf = append(buf, strings.Repeat("0", pad)...)
+		buf = append(buf, body...)
+	default:
+		buf = append(buf, strings.Repeat(" ", pad)...)
+		buf = append(buf, prefix...)
+		buf = append(buf, body...)
+	}
+	return buf
+}
+
+// numberSign returns the sign that printf writes before a number.
+func numberSign(f float64, flags string) string {
+	switch {
+	case math.Signbit(f) && !math.IsNaN(f):
+		return "-"
+	case strings.IndexByte(flags, '+') >= 0:
+		return "+"
+	case strings.IndexByte(flags, ' ') >= 0:
+		return " "
+	}
+	return ""
+}
+
+// appendNonFinite appends inf or nan like printf.
+func appendNonFinite(buf []byte, f float64, flags string, width int, upper bool) []byte {
+	body := "inf"
+	if math.IsNaN(f) {
+		body = "nan"
+	}
+	if upper {
+		body = strings.ToUpper(body)
+	}
+	return appendPadded(buf, "", numberSign(f, flags)+body, flags, width, false)
+}
+
+// appendHexFloat appends the number in the hexadecimal notation of %a, like
+// 0x1.8p+1. precision is the number of hexadecimal digits after the point, or
+// -1 for as many digits as needed.
+func appendHexFloat(buf []byte, f float64, flags string, width, precision int, upper bool) []byte {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return appendNonFinite(buf, f, flags, width, upper)
+	}
+	body := strconv.FormatFloat(math.Abs(f), 'x', precision, 64)
+	// strconv writes at least 2 digits in the exponent, printf does not.
+	p := strings.IndexByte(body, 'p') + 2
+	exp := strings.TrimLeft(body[p:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	body = body[2:p] + exp
+	prefix := numberSign(f, flags) + "0x"
+	if upper {
+		prefix, body = strings.ToUpper(prefix), strings.ToUpper(body)
+	}
+	return appendPadded(buf, prefix, body, flags, width, true)
+}
+
+// appendQuoted appends the argument at the stack index n as a Lua literal.
+// Strings are quoted escaping '"', '\\', newlines and control characters like
+// Lua 5.3, numbers are written so that they are read back exactly, and nil
+// and booleans are written as they are.
+func appendQuoted(L *LState, buf []byte, n int) []byte {
+	switch v := L.Get(n).(type) {
+	case LString:
+		buf = append(buf, '"')
+		for i := 0; i < len(v); i++ {
+			c := v[i]
+			switch {
+			case c == '"' || c == '\\' || c == '\n':
+				buf = append(buf, '\\', c)
+			case c < 0x20 || c == 0x7f:
+				if i+1 < len(v) && v[i+1] >= '0' && v[i+1] <= '9' {
+					buf = fmt.Appendf(buf, "\\%03d", c)
+				} else {
+					buf = fmt.Appendf(buf, "\\%d", c)
+				}
+			default:
+				buf = append(buf, c)
+			}
+		}
+		return append(buf, '"')
+	case LInteger:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case LNumber:
+		f := float64(v)
+		switch {
+		case math.IsInf(f, 1):
+			return append(buf, "1e9999"...)
+		case math.IsInf(f, -1):
+			return append(buf, "-1e9999"...)
+		case math.IsNaN(f):
+			return append(buf, "(0/0)"...)
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		if Lua53Integer && !strings.ContainsAny(s, ".e") {
+			// keep the float subtype.
+			s += ".0"
+		}
+		return append(buf, s...)
+	case *LNilType, LBool:
+		return append(buf, v.String()...)
+	}
+	L.ArgError(n, "value has no literal form")
+	return buf
 }
 
 func strGsub(L *LState) int {
@@ -155,18 +477,18 @@ func strGsub(L *LState) int {
 	matches := re.FindAllStringSubmatchIndex(str, limit)
 	if matches == nil || len(matches) == 0 {
 		L.SetTop(1)
-		L.Push(LNumber(0))
+		L.Push(integerValue(0))
 		return 2
 	}
 	switch lv := repl.(type) {
 	case LString:
-		L.Push(LString(strGsubStr(str, re, string(lv), matches)))
+		L.Push(L.allocateString(strGsubStr(str, re, string(lv), matches)))
 	case *LTable:
-		L.Push(LString(strGsubTable(L, str, lv, matches)))
+		L.Push(L.allocateString(strGsubTable(L, str, lv, matches)))
 	case *LFunction:
-		L.Push(LString(strGsubFunc(L, str, lv, matches)))
+		L.Push(L.allocateString(strGsubFunc(L, str, lv, matches)))
 	}
-	L.Push(LNumber(len(matches)))
+	L.Push(integerValue(int64(len(matches))))
 	return 2
 }
 
@@ -301,13 +623,13 @@ func strGmatch(L *LState) int {
 
 func strLen(L *LState) int {
 	str := L.CheckString(1)
-	L.Push(LNumber(len(str)))
+	L.Push(integerValue(int64(len(str))))
 	return 1
 }
 
 func strLower(L *LState) int {
 	str := L.CheckString(1)
-	L.Push(LString(strings.ToLower(str)))
+	L.Push(L.allocateString(strings.ToLower(str)))
 	return 1
 }
 
@@ -349,6 +671,14 @@ func strMatch(L *LState) int {
 func strRep(L *LState) int {
 	str := L.CheckString(1)
 	n := L.CheckInt(2)
+	if n <= 0 {
+		L.Push(LString(""))
+		return 1
+	}
+	if len(str) > 0 && n > (math.MaxInt-memStringSize)/len(str) {
+		L.RaiseError("resulting string too large")
+	}
+	L.allocateObject(LTString, memStringSize+len(str)*n)
 	L.Push(LString(strings.Repeat(str, n)))
 	return 1
 }
@@ -360,7 +690,7 @@ func strReverse(L *LState) int {
 	for i, j := 0, len(bts)-1; j >= 0; i, j = i+1, j-1 {
 		out[i] = bts[j]
 	}
-	L.Push(LString(string(out)))
+	L.Push(L.allocateString(string(out)))
 	return 1
 }
 
@@ -379,7 +709,7 @@ func strSub(L *LState) int {
 
 func strUpper(L *LState) int {
 	str := L.CheckString(1)
-	L.Push(LString(strings.ToUpper(str)))
+	L.Push(L.allocateString(strings.ToUpper(str)))
 	return 1
 }
 
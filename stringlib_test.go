@@ -0,0 +1,86 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPatternCache(t *testing.T) {
+	defer func(old int) { PatternCacheSize = old }(PatternCacheSize)
+	PatternCacheSize = 2
+	re1, err := compileLuaRegex("%d+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re2, _ := compileLuaRegex("%d+"); re2 != re1 {
+		t.Error("the compiled pattern must be reused")
+	}
+	// Lua patterns and Go regexps with the same text are different.
+	if re, _ := compileCachedRegex("%d+", false); re == re1 {
+		t.Error("got the Lua pattern for a Go regexp")
+	}
+	if _, err := compileLuaRegex("[a"); err == nil {
+		t.Error("got no error for an invalid pattern")
+	}
+	// the cache is emptied when it is full.
+	compileLuaRegex("%a+")
+	if n := len(patternCache.patterns); n > PatternCacheSize {
+		t.Errorf("got %v cached patterns, want at most %v", n, PatternCacheSize)
+	}
+
+	PatternCacheSize = 0
+	re3, _ := compileLuaRegex("%s+")
+	if re4, _ := compileLuaRegex("%s+"); re4 == re3 {
+		t.Error("patterns must not be cached when the cache is disabled")
+	}
+}
+
+func TestPatternCacheConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			L := NewState()
+			defer L.Close()
+			err := L.DoString(`
+			for i = 1, 100 do
+			  assert(string.match("key" .. i .. "=value", "^(%w+)=(%w+)$") == "key" .. i)
+			  assert(select(2, string.gsub("a b c", "%s", "")) == 2)
+			end
+			`)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStringFormat(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function check(want, ...)
+	  local got = string.format(...)
+	  assert(got == want, string.format("%q", got))
+	end
+	check("  42|42   |+42|0042|2a|2A|52", "%4d|%-5d|%+d|%04d|%x|%X|%o", 42, 42, 42, 42, 42, 42, 42)
+	check("3.14|3.1416e+00|  3.1|3.14159", "%.2f|%.4e|%5.1f|%g", 3.14159, 3.14159, 3.14159, 3.14159)
+	check("abc|  abc|ab|%", "%s|%5s|%.2s|%%", "abc", "abc", "abc")
+	check("A", "%c", 65)
+	check('"a\\\nb\\0\\1\\"\\\\"', "%q", 'a\nb\0\1"\\')
+	check("nil true 1e+100", "%q %q %q", nil, true, 1e100)
+	check("0x1p+0 0X1.8P+1", "%a %A", 1, 3)
+
+	assert(load("return " .. string.format("%q", 0.1))() == 0.1)
+	assert(load("return " .. string.format("%q", 1/0))() == 1/0)
+	assert(load("return " .. string.format("%q", -1/0))() == -1/0)
+	assert(not pcall(string.format, "%d"), "missing argument")
+	assert(not pcall(string.format, "%y", 1), "invalid conversion")
+	assert(not pcall(string.format, "%100d", 1), "invalid format")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
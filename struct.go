@@ -0,0 +1,214 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// goType holds the metatable and the members of a Go type exposed by
+// NewStructProxy.
+type goType struct {
+	mt      *LTable
+	fields  map[string][]int
+	methods map[string]*LFunction
+}
+
+// NewStructProxy returns userdata that exposes the Go struct(or the pointer to
+// the struct) to scripts. Indexing the userdata reads the exported fields and
+// returns the methods, which are called with the colon syntax like
+// obj:Method(args). Assignments write the fields if v is a pointer. The name
+// of a field in Lua can be set with the `lua:"name"` tag, and fields tagged
+// with `lua:"-"` are hidden. Arguments and results are converted between Lua
+// and Go values, and a non-nil error returned as the last result of a method
+// is raised as a Lua error. Struct fields of a pointer proxy are exposed as
+// pointer proxies, so they can be modified in place.
+func (ls *LState) NewStructProxy(v interface{}) *LUserData {
+	rv := reflect.ValueOf(v)
+	if !isStructValue(rv) {
+		ls.RaiseError("NewStructProxy: struct or non-nil pointer to struct expected, got %T", v)
+	}
+	return ls.newStructProxy(rv)
+}
+
+func isStructValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return true
+	case reflect.Ptr:
+		return !rv.IsNil() && rv.Elem().Kind() == reflect.Struct
+	}
+	return false
+}
+
+func (ls *LState) newStructProxy(rv reflect.Value) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = rv.Interface()
+	ud.Metatable = ls.goType(rv.Type()).mt
+	return ud
+}
+
+// goType returns the cached members of the type.
+func (ls *LState) goType(typ reflect.Type) *goType {
+	if gt, ok := ls.G.goTypes[typ]; ok {
+		return gt
+	}
+	if ls.G.goTypes == nil {
+		ls.G.goTypes = make(map[reflect.Type]*goType)
+	}
+	gt := &goType{
+		mt:      ls.NewTable(),
+		methods: make(map[string]*LFunction),
+	}
+	st := typ
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	gt.fields = structFields(st)
+	for i := 0; i < typ.NumMethod(); i++ {
+		m := typ.Method(i)
+		if m.IsExported() {
+			gt.methods[m.Name] = ls.NewFunction(structMethod(m.Name))
+		}
+	}
+	ls.RegisterModuleToTable(gt.mt, map[string]LGFunction{
+		"__index":    structProxyIndex,
+		"__newindex": structProxyNewIndex,
+		"__tostring": structProxyToString,
+		"__eq":       structProxyEq,
+	})
+	gt.mt.RawSetH(LString("__metatable"), LString(typ.String()))
+	ls.G.goTypes[typ] = gt
+	return gt
+}
+
+// structFields returns the indices of the exported fields of the struct type
+// by the names in Lua. The name of a field can be set with the `lua:"name"`
+// tag, and fields tagged with `lua:"-"` are omitted.
+func structFields(st reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for _, f := range reflect.VisibleFields(st) {
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("lua"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = strings.Split(tag, ",")[0]
+		}
+		fields[name] = f.Index
+	}
+	return fields
+}
+
+// structMethod returns the function that calls the method of the receiver
+// given as the first argument.
+func structMethod(name string) LGFunction {
+	return func(L *LState) int {
+		ud, ok := L.Get(1).(*LUserData)
+		if !ok || ud.Value == nil {
+			L.RaiseError("calling method %v without a receiver, use obj:%v(...)", name, name)
+		}
+		method := reflect.ValueOf(ud.Value).MethodByName(name)
+		if !method.IsValid() {
+			L.ArgError(1, fmt.Sprintf("%T has no method %v", ud.Value, name))
+		}
+		return L.callGoFunc(method, 2)
+	}
+}
+
+func checkStructProxy(L *LState) (reflect.Value, *goType) {
+	ud := L.CheckUserData(1)
+	rv := reflect.ValueOf(ud.Value)
+	if !isStructValue(rv) {
+		L.ArgError(1, "struct proxy expected")
+	}
+	return rv, L.goType(rv.Type())
+}
+
+// structField returns the field of the struct. ok is false if the field is
+// not found or is in a nil embedded pointer.
+func structField(rv reflect.Value, index []int) (field reflect.Value, ok bool) {
+	rv = reflect.Indirect(rv)
+	for i, x := range index {
+		if i > 0 {
+			if rv.Kind() == reflect.Ptr {
+				if rv.IsNil() {
+					return reflect.Value{}, false
+				}
+				rv = rv.Elem()
+			}
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+func structProxyIndex(L *LState) int {
+	rv, gt := checkStructProxy(L)
+	name, ok := L.Get(2).(LString)
+	if !ok {
+		L.Push(LNil)
+		return 1
+	}
+	if index, ok := gt.fields[string(name)]; ok {
+		field, ok := structField(rv, index)
+		if !ok {
+			L.Push(LNil)
+			return 1
+		}
+		if field.Kind() == reflect.Struct && field.CanAddr() {
+			L.Push(L.newStructProxy(field.Addr()))
+		} else {
+			L.Push(L.fromGoValue(field))
+		}
+		return 1
+	}
+	if fn, ok := gt.methods[string(name)]; ok {
+		L.Push(fn)
+		return 1
+	}
+	L.Push(LNil)
+	return 1
+}
+
+func structProxyNewIndex(L *LState) int {
+	rv, gt := checkStructProxy(L)
+	name := L.CheckString(2)
+	index, ok := gt.fields[name]
+	if !ok {
+		L.ArgError(2, fmt.Sprintf("%v has no field %v", rv.Type(), name))
+	}
+	field, ok := structField(rv, index)
+	if !ok || !field.CanSet() {
+		L.ArgError(2, fmt.Sprintf("field %v of %v can not be set", name, rv.Type()))
+	}
+	value, err := toGoValue(L.CheckAny(3), field.Type())
+	if err != nil {
+		L.ArgError(3, err.Error())
+	}
+	field.Set(value)
+	return 0
+}
+
+func structProxyToString(L *LState) int {
+	ud := L.CheckUserData(1)
+	if s, ok := ud.Value.(fmt.Stringer); ok {
+		L.Push(LString(s.String()))
+	} else {
+		L.Push(LString(fmt.Sprintf("%T: %p", ud.Value, ud)))
+	}
+	return 1
+}
+
+func structProxyEq(L *LState) int {
+	lhs, rhs := L.CheckUserData(1).Value, L.CheckUserData(2).Value
+	if reflect.TypeOf(lhs) != reflect.TypeOf(rhs) || !reflect.TypeOf(lhs).Comparable() {
+		L.Push(LFalse)
+		return 1
+	}
+	L.Push(LBool(lhs == rhs))
+	return 1
+}
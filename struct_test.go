@@ -0,0 +1,82 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testPoint struct {
+	X, Y int
+}
+
+type testPerson struct {
+	Name   string
+	Age    int    `lua:"age"`
+	Secret string `lua:"-"`
+	Pos    testPoint
+	Tags   []string
+	*testPoint
+}
+
+func (p testPerson) String() string { return "person " + p.Name }
+
+func (p *testPerson) Greet(greeting string) string { return greeting + ", " + p.Name }
+
+func (p *testPerson) Birthday() (int, error) {
+	if p.Age < 0 {
+		return 0, errors.New("not born yet")
+	}
+	p.Age++
+	return p.Age, nil
+}
+
+func TestStructProxy(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	p := &testPerson{Name: "Bob", Age: 30, Secret: "s", Tags: []string{"a", "b"}}
+	L.SetGlobal("person", L.NewStructProxy(p))
+	L.SetGlobal("value", L.NewStructProxy(testPerson{Name: "Alice"}))
+	err := L.DoString(`
+	assert(person.Name == "Bob" and person.age == 30 and person.Age == nil)
+	assert(person.Secret == nil and person.unexported == nil)
+	assert(person:Greet("Hello") == "Hello, Bob")
+	assert(person:Birthday() == 31)
+	assert(tostring(person) == "person Bob")
+	assert(person == person)
+
+	person.Name = "Carol"
+	person.Pos.X = 5
+	person.Tags[1] = "c"
+	assert(#person.Tags == 2)
+	-- fields of a nil embedded pointer read nil.
+	assert(person.X == nil)
+
+	local ok, err = pcall(function() person.missing = 1 end)
+	assert(not ok and err:find("has no field missing"), tostring(err))
+	ok, err = pcall(function() person.age = "old" end)
+	assert(not ok, "values of other types can not be assigned")
+	ok, err = pcall(person.Greet, 1, "x")
+	assert(not ok and err:find("without a receiver"), tostring(err))
+
+	-- structs held by value can not be modified.
+	assert(value.Name == "Alice" and tostring(value) == "person Alice")
+	ok, err = pcall(function() value.Name = "Dave" end)
+	assert(not ok and err:find("can not be set"), tostring(err))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Carol" || p.Age != 31 || p.Pos.X != 5 || p.Tags[0] != "c" {
+		t.Errorf("got %+v", p)
+	}
+
+	p.Age = -1
+	if err := L.DoString(`person:Birthday()`); err == nil || !strings.Contains(err.Error(), "not born yet") {
+		t.Errorf("got %v, want the error of the method", err)
+	}
+	p.testPoint = &testPoint{X: 7}
+	if err := L.DoString(`assert(person.X == 7)`); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,5 +1,11 @@
 package lua
 
+import (
+	"iter"
+	"slices"
+	"sort"
+)
+
 type lValueArraySorter struct {
 	L      *LState
 	Fn     *LFunction
@@ -42,10 +48,68 @@ func newLTable(acap int, hcap int) *LTable {
 	return tb
 }
 
+// newOrderedLTable returns a table that iterates the keys of its hash part in
+// the order they were first set.
+func newOrderedLTable(acap int, hcap int) *LTable {
+	tb := newLTable(acap, hcap)
+	tb.order = make([]LValue, 0, intMax(hcap, 0))
+	tb.orderIndex = make(map[LValue]int, intMax(hcap, 0))
+	return tb
+}
+
+// IsOrdered reports whether the table preserves the insertion order of its
+// keys(see LState.NewOrderedTable).
+func (tb *LTable) IsOrdered() bool {
+	return tb.orderIndex != nil
+}
+
+// setDict sets the value of the key in the hash part, recording the key if it
+// is new to the ordered table.
+func (tb *LTable) setDict(key LValue, value LValue) {
+	if tb.orderIndex != nil {
+		if _, ok := tb.dict[key]; !ok {
+			tb.orderIndex[key] = len(tb.order)
+			tb.order = append(tb.order, key)
+		}
+	}
+	tb.dict[key] = value
+	tb.version++
+}
+
+// rangeDict calls fn with the raw entries of the hash part, in insertion order
+// if the table is ordered.
+func (tb *LTable) rangeDict(fn func(key, value LValue)) {
+	if tb.orderIndex != nil {
+		for _, k := range tb.order {
+			fn(k, tb.dict[k])
+		}
+		return
+	}
+	for k, v := range tb.dict {
+		fn(k, v)
+	}
+}
+
+// Freeze makes the table read-only for scripts: assignments, rawset,
+// setmetatable and the functions of the table library raise errors when they
+// modify the table. Methods of LTable called from Go still modify the table.
+// A frozen table can not be unfrozen.
+func (tb *LTable) Freeze() {
+	tb.frozen = true
+}
+
+// IsFrozen reports whether the table is frozen.
+func (tb *LTable) IsFrozen() bool {
+	return tb.frozen
+}
+
 func (tb *LTable) Len() int {
 	var prev LValue = LNil
 	for i := len(tb.array) - 1; i >= 0; i-- {
 		v := tb.array[i]
+		if tb.weak != 0 {
+			v = strongValue(v)
+		}
 		if prev == LNil && v != LNil {
 			return i + 1
 		}
@@ -55,7 +119,16 @@ func (tb *LTable) Len() int {
 }
 
 func (tb *LTable) Append(value LValue) {
-	tb.array = append(tb.array, value)
+	tb.array = append(tb.array, tb.weakValue(value))
+}
+
+// AppendMany appends the values to the array part of the table like Append,
+// growing the array part once.
+func (tb *LTable) AppendMany(values ...LValue) {
+	tb.array = slices.Grow(tb.array, len(values))
+	for _, value := range values {
+		tb.array = append(tb.array, tb.weakValue(value))
+	}
 }
 
 func (tb *LTable) Insert(i int, value LValue) {
@@ -70,12 +143,12 @@ func (tb *LTable) Insert(i int, value LValue) {
 	i -= 1
 	tb.array = append(tb.array, LNil)
 	copy(tb.array[i+1:], tb.array[i:])
-	tb.array[i] = value
+	tb.array[i] = tb.weakValue(value)
 }
 
 func (tb *LTable) MaxN() int {
 	for i := len(tb.array) - 1; i >= 0; i-- {
-		if tb.array[i] != LNil {
+		if strongValue(tb.array[i]) != LNil {
 			return i
 		}
 	}
@@ -98,6 +171,13 @@ func (tb *LTable) Remove(pos int) {
 }
 
 func (tb *LTable) RawSet(key LValue, value LValue) {
+	if tb.weak != 0 {
+		value = tb.weakValue(value)
+		tb.weakSet()
+	}
+	if iv, ok := key.(LInteger); ok {
+		key = iv.tableKey()
+	}
 	switch v := key.(type) {
 	case LNumber:
 		if isArrayKey(v) {
@@ -117,12 +197,16 @@ func (tb *LTable) RawSet(key LValue, value LValue) {
 			return
 		}
 	}
-	tb.dict[key] = value
+	tb.setDict(tb.weakKey(key), value)
 }
 
 func (tb *LTable) RawSetInt(key int, value LValue) {
+	if tb.weak != 0 {
+		value = tb.weakValue(value)
+		tb.weakSet()
+	}
 	if key < 1 || key >= MaxArrayIndex {
-		tb.dict[LNumber(key)] = value
+		tb.setDict(LNumber(key), value)
 		return
 	}
 	index := key - 1
@@ -141,10 +225,21 @@ func (tb *LTable) RawSetInt(key int, value LValue) {
 }
 
 func (tb *LTable) RawSetH(key LValue, value LValue) {
-	tb.dict[key] = value
+	if tb.weak != 0 {
+		tb.setDict(tb.weakKey(key), tb.weakValue(value))
+		tb.weakSet()
+		return
+	}
+	tb.setDict(key, value)
 }
 
 func (tb *LTable) RawGet(key LValue) LValue {
+	if iv, ok := key.(LInteger); ok {
+		key = iv.tableKey()
+	}
+	if tb.weak != 0 {
+		return tb.rawGetWeak(key)
+	}
 	switch v := key.(type) {
 	case LNumber:
 		if isArrayKey(v) {
@@ -166,10 +261,19 @@ func (tb *LTable) RawGetInt(key int) LValue {
 	if index >= len(tb.array) {
 		return LNil
 	}
+	if tb.weak != 0 {
+		return strongValue(tb.array[index])
+	}
 	return tb.array[index]
 }
 
 func (tb *LTable) RawGetH(key LValue) LValue {
+	if tb.weak != 0 {
+		if v, ok := tb.dict[tb.weakKey(key)]; ok {
+			return strongValue(v)
+		}
+		return LNil
+	}
 	if v, ok := tb.dict[key]; ok {
 		return v
 	}
@@ -177,19 +281,111 @@ func (tb *LTable) RawGetH(key LValue) LValue {
 }
 
 func (tb *LTable) ForEach(cb func(LValue, LValue)) {
+	if tb.weak != 0 {
+		tb.forEachWeak(cb)
+		return
+	}
 	for i, v := range tb.array {
 		if v != LNil {
-			cb(LNumber(i+1), v)
+			cb(keyValue(LNumber(i+1)), v)
 		}
 	}
+	if tb.orderIndex != nil {
+		tb.rangeDict(func(k, v LValue) {
+			if v != LNil {
+				cb(keyValue(k), v)
+			}
+		})
+		return
+	}
 	for k, v := range tb.dict {
 		if v != LNil {
-			cb(k, v)
+			cb(keyValue(k), v)
+		}
+	}
+}
+
+// All returns an iterator over the keys and the values of the table like
+// ForEach. Setting existing keys of the table during the iteration is allowed,
+// but keys added during the iteration may or may not be visited.
+func (tb *LTable) All() iter.Seq2[LValue, LValue] {
+	return func(yield func(LValue, LValue) bool) {
+		for i, v := range tb.array {
+			if v = strongValue(v); v != LNil && !yield(keyValue(LNumber(i+1)), v) {
+				return
+			}
+		}
+		if tb.orderIndex != nil {
+			for i := 0; i < len(tb.order); i++ {
+				k, v := strongValue(tb.order[i]), strongValue(tb.dict[tb.order[i]])
+				if k != LNil && v != LNil && !yield(keyValue(k), v) {
+					return
+				}
+			}
+			return
+		}
+		for k, v := range tb.dict {
+			if k, v = strongValue(k), strongValue(v); k != LNil && v != LNil && !yield(keyValue(k), v) {
+				return
+			}
+		}
+	}
+}
+
+// Array returns an iterator over the indices and the values of the elements 1
+// to Len() of the table, where Len() is taken when the iteration starts.
+// Values of missing elements are LNil.
+func (tb *LTable) Array() iter.Seq2[int, LValue] {
+	return func(yield func(int, LValue) bool) {
+		n := tb.Len()
+		for i := 1; i <= n; i++ {
+			if !yield(i, tb.RawGetInt(i)) {
+				return
+			}
+		}
+	}
+}
+
+// ArrayView returns the array part of the table up to Len() without copying
+// it: the element i+1 of the table is view[i], and missing elements are LNil.
+// The view must not be modified. It reflects later assignments to existing
+// elements, but becomes stale once the array part of the table grows or
+// shrinks, for example by assignments to new integer keys, table.insert or
+// table.remove, so it should be taken again after the table is modified. Weak
+// tables return a copy of the array part.
+func (tb *LTable) ArrayView() []LValue {
+	view := tb.array[:tb.Len()]
+	if tb.weak != 0 {
+		cp := make([]LValue, len(view))
+		for i, v := range view {
+			cp[i] = strongValue(v)
 		}
+		return cp
 	}
+	return slices.Clip(view)
 }
 
 func (tb *LTable) Next(key LValue) (LValue, LValue) {
+	return tb.nextKey(key, false)
+}
+
+// nextKey is like Next, but iterates the keys in the hash part in the order of
+// lessKey if sorted is true. Ordered tables are iterated in insertion order
+// regardless of sorted.
+func (tb *LTable) nextKey(key LValue, sorted bool) (LValue, LValue) {
+	if iv, ok := key.(LInteger); ok {
+		key = iv.tableKey()
+	}
+	var value LValue
+	if tb.weak != 0 {
+		key, value = tb.nextWeak(key, sorted)
+	} else {
+		key, value = tb.next(key, sorted)
+	}
+	return keyValue(key), value
+}
+
+func (tb *LTable) next(key LValue, sorted bool) (LValue, LValue) {
 	// TODO: inefficient way
 	if key == LNil {
 		tb.keys = nil
@@ -197,15 +393,24 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 		key = LNumber(0)
 	}
 
+	if tb.keys == nil && tb.orderIndex != nil {
+		tb.keys = tb.order
+		tb.k2i = tb.orderIndex
+	}
 	if tb.keys == nil {
 		tb.keys = make([]LValue, len(tb.dict))
 		tb.k2i = make(map[LValue]int)
 		i := 0
 		for k, _ := range tb.dict {
 			tb.keys[i] = k
-			tb.k2i[k] = i
 			i++
 		}
+		if sorted {
+			sort.Slice(tb.keys, func(i, j int) bool { return lessKey(tb.keys[i], tb.keys[j]) })
+		}
+		for i, k := range tb.keys {
+			tb.k2i[k] = i
+		}
 	}
 
 	if kv, ok := key.(LNumber); ok && isInteger(kv) && int(kv) >= 0 {
@@ -216,7 +421,7 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 			}
 		}
 		if index == len(tb.array) {
-			if len(tb.dict) == 0 {
+			if len(tb.keys) == 0 {
 				tb.keys = nil
 				tb.k2i = nil
 				return LNil, LNil
@@ -227,7 +432,7 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 			}
 		}
 	}
-	for i := tb.k2i[key] + 1; i < len(tb.dict); i++ {
+	for i := tb.k2i[key] + 1; i < len(tb.keys); i++ {
 		key = tb.keys[i]
 		if v := tb.dict[key]; v != LNil {
 			return key, v
@@ -237,3 +442,34 @@ func (tb *LTable) Next(key LValue) (LValue, LValue) {
 	tb.k2i = nil
 	return LNil, LNil
 }
+
+// lessKey orders the keys of tables for deterministic iteration: numbers in
+// ascending order, then strings in byte order, then false and true. Other keys
+// come last and are ordered only by their types.
+func lessKey(a, b LValue) bool {
+	ra, rb := keyRank(a), keyRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch x := a.(type) {
+	case LNumber:
+		return x < b.(LNumber)
+	case LString:
+		return x < b.(LString)
+	case LBool:
+		return !bool(x) && bool(b.(LBool))
+	}
+	return a.Type() < b.Type()
+}
+
+func keyRank(lv LValue) int {
+	switch lv.(type) {
+	case LNumber:
+		return 0
+	case LString:
+		return 1
+	case LBool:
+		return 2
+	}
+	return 3
+}
@@ -0,0 +1,181 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderedTable(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	tb := L.NewOrderedTable()
+	if !tb.IsOrdered() || L.NewTable().IsOrdered() {
+		t.Fatal("only NewOrderedTable must return ordered tables")
+	}
+	for _, k := range []string{"z", "b", "y", "a"} {
+		tb.RawSetH(LString(k), LString(k))
+	}
+	tb.RawSetInt(1, LTrue)
+	L.SetGlobal("t", tb)
+	err := L.DoString(`
+	local keys = {}
+	for k in pairs(t) do keys[#keys + 1] = tostring(k) end
+	assert(table.concat(keys, " ") == "1 z b y a", table.concat(keys, " "))
+
+	-- a key keeps its position when it is set again.
+	t.b = nil
+	t.b = "b"
+	t.c = "c"
+	keys = {}
+	for k in pairs(t) do keys[#keys + 1] = tostring(k) end
+	assert(table.concat(keys, " ") == "1 z b y a c", table.concat(keys, " "))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	tb.ForEach(func(k, v LValue) { keys = append(keys, k.String()) })
+	if got := strings.Join(keys, " "); got != "1 z b y a c" {
+		t.Errorf("got %q", got)
+	}
+	L2 := L.Clone()
+	defer L2.Close()
+	if cp, ok := L2.GetGlobal("t").(*LTable); !ok || !cp.IsOrdered() {
+		t.Error("copies of ordered tables must be ordered")
+	}
+}
+
+func TestOrderedTablesOption(t *testing.T) {
+	L := NewState(Options{OrderedTables: true})
+	defer L.Close()
+	L.PreloadModule("json", OpenJSON)
+	err := L.DoString(`
+	local json = require("json")
+	local t = {z = 1, y = 2, x = 3}
+	t.a = 4
+	assert(json.encode(t) == '{"z":1,"y":2,"x":3,"a":4}', json.encode(t))
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !L.NewTable().IsOrdered() {
+		t.Error("NewTable must return ordered tables")
+	}
+}
+
+func TestTableAll(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`t = {10, 20, 30, a = 1, b = 2}`); err != nil {
+		t.Fatal(err)
+	}
+	tb := L.GetGlobal("t").(*LTable)
+	sum := LNumber(0)
+	n := 0
+	for k, v := range tb.All() {
+		n++
+		sum += v.(LNumber)
+		if _, ok := k.(LString); !ok && k.(LNumber)*10 != v.(LNumber) {
+			t.Errorf("got %v for %v", v, k)
+		}
+	}
+	if n != 5 || sum != 63 {
+		t.Errorf("got %v entries and the sum %v", n, sum)
+	}
+	n = 0
+	for range tb.All() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("got %v entries after break, want 1", n)
+	}
+}
+
+func TestTableArray(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	tb := L.NewTable()
+	for i := 1; i <= 3; i++ {
+		tb.Append(LNumber(i * 10))
+	}
+	tb.RawSetH(LString("a"), LTrue)
+	var indices []int
+	for i, v := range tb.Array() {
+		indices = append(indices, i)
+		if v != LNumber(i*10) {
+			t.Errorf("got %v at %v", v, i)
+		}
+	}
+	if len(indices) != 3 || indices[0] != 1 || indices[2] != 3 {
+		t.Errorf("got %v", indices)
+	}
+	for i := range tb.Array() {
+		if i == 2 {
+			break
+		}
+		if i > 2 {
+			t.Error("the iteration must stop at break")
+		}
+	}
+}
+
+func TestNewTableFromSliceAndMap(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.SetGlobal("s", L.NewTableFromSlice([]LValue{LString("a"), LString("b")}))
+	L.SetGlobal("m", L.NewTableFromMap(map[string]LValue{"x": LNumber(1), "y": LNil}))
+	tb := L.NewTable()
+	tb.Append(LNumber(1))
+	tb.AppendMany(LNumber(2), LNumber(3))
+	L.SetGlobal("t", tb)
+	err := L.DoString(`
+	assert(#s == 2 and s[1] == "a" and s[2] == "b")
+	assert(m.x == 1 and next(m, "x") == nil and next(m) == "x")
+	assert(#t == 3 and t[3] == 3)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L2 := NewState(Options{OrderedTables: true})
+	defer L2.Close()
+	var keys []string
+	L2.NewTableFromMap(map[string]LValue{"b": LTrue, "c": LTrue, "a": LTrue}).ForEach(func(k, v LValue) {
+		keys = append(keys, k.String())
+	})
+	if got := strings.Join(keys, " "); got != "a b c" {
+		t.Errorf("got %q, want the sorted keys", got)
+	}
+}
+
+func TestTableArrayView(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`t = {1, 2, 3}`); err != nil {
+		t.Fatal(err)
+	}
+	tb := L.GetGlobal("t").(*LTable)
+	view := tb.ArrayView()
+	if len(view) != 3 || view[2] != LNumber(3) {
+		t.Fatalf("got %v", view)
+	}
+	if err := L.DoString(`t[1] = "x"`); err != nil {
+		t.Fatal(err)
+	}
+	if view[0] != LString("x") {
+		t.Errorf("got %v, want the view to reflect the assignment", view[0])
+	}
+	// appending to the view does not modify the table.
+	_ = append(view, LNumber(4))
+	if tb.RawGetInt(4) != LNil {
+		t.Error("appending to the view modified the table")
+	}
+
+	if err := L.DoString(`w = setmetatable({"a", 2}, {__mode = "v"})`); err != nil {
+		t.Fatal(err)
+	}
+	if view := L.GetGlobal("w").(*LTable).ArrayView(); len(view) != 2 || view[1] != LNumber(2) {
+		t.Errorf("got %v for a weak table", view)
+	}
+}
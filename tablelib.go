@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"math"
 	"sort"
 )
 
@@ -9,26 +10,44 @@ func tableOpen(L *LState) {
 }
 
 var tableFuncs = map[string]LGFunction{
-	"getn":   tableGetN,
-	"concat": tableConcat,
-	"insert": tableInsert,
-	"maxn":   tableMaxN,
-	"remove": tableRemove,
-	"sort":   tableSort,
+	"getn":     tableGetN,
+	"concat":   tableConcat,
+	"freeze":   tableFreeze,
+	"insert":   tableInsert,
+	"isfrozen": tableIsFrozen,
+	"maxn":     tableMaxN,
+	"move":     tableMove,
+	"pack":     tablePack,
+	"remove":   tableRemove,
+	"sort":     tableSort,
+	"unpack":   baseUnpack,
 }
 
 func tableSort(L *LState) int {
 	tbl := L.CheckTable(1)
-	sorter := lValueArraySorter{L, nil, tbl.array}
+	L.checkFrozen(tbl)
+	values := tbl.array
+	if tbl.weak != 0 {
+		values = make([]LValue, len(tbl.array))
+		for i, v := range tbl.array {
+			values[i] = strongValue(v)
+		}
+	}
+	sorter := lValueArraySorter{L, nil, values}
 	if L.GetTop() != 1 {
 		sorter.Fn = L.CheckFunction(2)
 	}
 	sort.Sort(sorter)
+	if tbl.weak != 0 {
+		for i, v := range values {
+			tbl.array[i] = tbl.weakValue(v)
+		}
+	}
 	return 0
 }
 
 func tableGetN(L *LState) int {
-	L.Push(LNumber(L.CheckTable(1).Len()))
+	L.Push(integerValue(int64(L.ObjLen(L.CheckTable(1)))))
 	return 1
 }
 
@@ -37,13 +56,62 @@ func tableMaxN(L *LState) int {
 	return 1
 }
 
+func tableMove(L *LState) int {
+	a1 := L.CheckTable(1)
+	f := L.CheckInt64(2)
+	e := L.CheckInt64(3)
+	t := L.CheckInt64(4)
+	a2 := a1
+	if L.GetTop() >= 5 && L.Get(5) != LNil {
+		a2 = L.CheckTable(5)
+	}
+	if e >= f {
+		if f <= 0 && e >= math.MaxInt64+f {
+			L.ArgError(3, "too many elements to move")
+		}
+		n := e - f
+		if t > math.MaxInt64-n {
+			L.ArgError(4, "destination wrap around")
+		}
+		// copy backward if the ranges overlap and the destination is after
+		// the source.
+		if t > e || t <= f || a1 != a2 {
+			for i := int64(0); i <= n; i++ {
+				L.setField(a2, integerValue(t+i), L.getField(a1, integerValue(f+i)))
+			}
+		} else {
+			for i := n; i >= 0; i-- {
+				L.setField(a2, integerValue(t+i), L.getField(a1, integerValue(f+i)))
+			}
+		}
+	}
+	L.Push(a2)
+	return 1
+}
+
+func tablePack(L *LState) int {
+	n := L.GetTop()
+	tbl := L.CreateTable(n, 1)
+	for i := 1; i <= n; i++ {
+		tbl.RawSetInt(i, L.Get(i))
+	}
+	tbl.RawSetH(LString("n"), integerValue(int64(n)))
+	L.Push(tbl)
+	return 1
+}
+
 func tableRemove(L *LState) int {
 	tbl := L.CheckTable(1)
-	if L.GetTop() == 1 {
-		tbl.Remove(-1)
-	} else {
-		tbl.Remove(L.CheckInt(2))
+	L.checkFrozen(tbl)
+	n := L.ObjLen(tbl)
+	pos := L.OptInt(2, n)
+	if n == 0 || pos < 1 || pos > n {
+		return 0
+	}
+	for ; pos < n; pos++ {
+		tbl.RawSetInt(pos, tbl.RawGetInt(pos+1))
 	}
+	tbl.RawSetInt(n, LNil)
 	return 0
 }
 
@@ -51,15 +119,16 @@ func tableConcat(L *LState) int {
 	tbl := L.CheckTable(1)
 	sep := LString(L.OptString(2, ""))
 	i := L.OptInt(3, 1)
-	j := L.OptInt(4, tbl.Len())
+	length := L.ObjLen(tbl)
+	j := L.OptInt(4, length)
 	if L.GetTop() == 3 {
-		if i > tbl.Len() || i < 1 {
+		if i > length || i < 1 {
 			L.Push(LString(""))
 			return 1
 		}
 	}
-	i = intMax(intMin(i, tbl.Len()), 1)
-	j = intMin(intMin(j, tbl.Len()), tbl.Len())
+	i = intMax(intMin(i, length), 1)
+	j = intMin(intMin(j, length), length)
 	if i > j {
 		L.Push(LString(""))
 		return 1
@@ -78,17 +147,40 @@ func tableConcat(L *LState) int {
 
 func tableInsert(L *LState) int {
 	tbl := L.CheckTable(1)
+	L.checkFrozen(tbl)
 	nargs := L.GetTop()
 	if nargs == 1 {
 		L.RaiseError("wrong number of arguments")
 	}
 
+	n := L.ObjLen(tbl)
 	if L.GetTop() == 2 {
-		tbl.Append(L.Get(2))
+		tbl.RawSetInt(n+1, L.Get(2))
 		return 0
 	}
-	tbl.Insert(int(L.CheckInt(2)), L.CheckAny(3))
+	pos := L.CheckInt(2)
+	value := L.CheckAny(3)
+	e := n + 1
+	if pos > e {
+		e = pos
+	}
+	for i := e; i > pos; i-- {
+		tbl.RawSetInt(i, tbl.RawGet(LNumber(i-1)))
+	}
+	tbl.RawSetInt(pos, value)
 	return 0
 }
 
+func tableFreeze(L *LState) int {
+	tbl := L.CheckTable(1)
+	tbl.Freeze()
+	L.Push(tbl)
+	return 1
+}
+
+func tableIsFrozen(L *LState) int {
+	L.Push(LBool(L.CheckTable(1).IsFrozen()))
+	return 1
+}
+
 //
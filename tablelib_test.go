@@ -0,0 +1,112 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableInsertRemove(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local t = {1, 2, 3}
+	table.insert(t, 4)
+	table.insert(t, 1, 0)
+	assert(table.concat(t, ",") == "0,1,2,3,4")
+	table.remove(t, 1)
+	table.remove(t)
+	assert(table.concat(t, ",") == "1,2,3")
+	table.remove(t, 10)
+	assert(#t == 3)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableInsertRemoveLen(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local t = setmetatable({}, {__len = function() return 3 end})
+	table.insert(t, "x")
+	assert(t[1] == nil and t[4] == "x")
+	table.insert(t, 2, "y")
+	assert(t[2] == "y" and t[3] == nil and t[4] == nil)
+
+	local u = setmetatable({"a", "b", "c", "d"}, {__len = function() return 2 end})
+	table.remove(u)
+	assert(u[1] == "a" and u[2] == nil and u[3] == "c")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjLenNonNumber(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`table.insert(setmetatable({}, {__len = function() return "x" end}), 1)`)
+	if err == nil || !strings.Contains(err.Error(), "object length is not a number") {
+		t.Errorf("got %v, want an error", err)
+	}
+}
+
+func TestTableMovePackUnpack(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local t = table.pack(1, nil, 3)
+	assert(t.n == 3 and t[1] == 1 and t[2] == nil and t[3] == 3)
+	assert(table.pack().n == 0)
+
+	local a, b, c = table.unpack({1, 2, 3})
+	assert(a == 1 and b == 2 and c == 3)
+	a, b = table.unpack({1, 2, 3}, 2)
+	assert(a == 2 and b == 3)
+	assert(select("#", table.unpack({}, 1, 3)) == 3)
+
+	local src = {1, 2, 3, 4, 5}
+	table.move(src, 2, 4, 1)
+	assert(table.concat(src, ",") == "2,3,4,4,5")
+	src = {1, 2, 3, 4, 5}
+	table.move(src, 1, 3, 3)
+	assert(table.concat(src, ",") == "1,2,1,2,3")
+	local dst = table.move({1, 2}, 1, 2, 3, {"a", "b"})
+	assert(table.concat(dst, ",") == "a,b,1,2")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableFreeze(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local t = table.freeze({1, 2, x = 1})
+	assert(table.isfrozen(t) and not table.isfrozen({}))
+	local function fails(f, ...)
+	  local ok, err = pcall(f, ...)
+	  assert(not ok and err:find("attempt to modify a frozen table"), tostring(err))
+	end
+	fails(function() t.x = 2 end)
+	fails(function() t.y = 2 end)
+	fails(rawset, t, "x", 2)
+	fails(setmetatable, t, {})
+	fails(table.insert, t, 3)
+	fails(table.remove, t)
+	fails(table.sort, t)
+	assert(t.x == 1 and #t == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Go can still modify frozen tables.
+	tb := L.NewTable()
+	tb.Freeze()
+	tb.RawSetInt(1, LNumber(1))
+	if !tb.IsFrozen() || tb.RawGetInt(1) != LNumber(1) {
+		t.Error("LTable methods must modify frozen tables")
+	}
+}
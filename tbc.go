@@ -0,0 +1,86 @@
+package lua
+
+// tbcVariable is a to-be-closed variable. The value is kept with the register
+// index, because the registers may be discarded before the variable is closed,
+// e.g. when a coroutine dies with an error.
+type tbcVariable struct {
+	index int
+	value LValue
+}
+
+func (ls *LState) markToBeClosed(idx int) {
+	lv := ls.reg.Get(idx)
+	if lv == LNil || lv == LFalse {
+		return
+	}
+	if ls.metaOp1(lv, "__close") == LNil {
+		ls.RaiseError("variable '%v' got a non-closable value", tbcVariableName(ls.currentFrame, idx))
+	}
+	ls.tbcs = append(ls.tbcs, tbcVariable{idx, lv})
+}
+
+// tbcVariableName returns the name of the variable marked by the current
+// OP_TBC instruction.
+func tbcVariableName(cf *callFrame, idx int) string {
+	if cf == nil || cf.Fn.IsG {
+		return "?"
+	}
+	pc := cf.Pc - 1
+	regno := idx - cf.LocalBase
+	for _, local := range cf.Fn.Proto.DbgLocals {
+		if local.StartPc <= pc && pc <= local.EndPc {
+			if regno == 0 {
+				return local.Name
+			}
+			regno--
+		}
+	}
+	return "?"
+}
+
+func (ls *LState) callCloseMethod(lv, errobj LValue) {
+	ls.Push(ls.metaOp1(lv, "__close"))
+	ls.Push(lv)
+	ls.Push(errobj)
+}
+
+// closeToBeClosed calls __close metamethods of the to-be-closed variables at
+// or above idx in reverse order.
+func (ls *LState) closeToBeClosed(idx int, errobj LValue) {
+	if ls.reg.Top() < idx {
+		ls.reg.SetTop(idx)
+	}
+	for n := len(ls.tbcs); n > 0 && ls.tbcs[n-1].index >= idx; n = len(ls.tbcs) {
+		tbc := ls.tbcs[n-1]
+		ls.tbcs = ls.tbcs[:n-1]
+		ls.callCloseMethod(tbc.value, errobj)
+		ls.Call(2, 0)
+	}
+}
+
+// closeToBeClosedProtected closes the to-be-closed variables of th while
+// unwinding err. Every variable gets the error object. An error raised by a
+// __close metamethod replaces err, and the remaining variables are still
+// closed.
+func (ls *LState) closeToBeClosedProtected(th *LState, idx int, err *ApiError) *ApiError {
+	// the variables are removed first, so that the metamethods, whose frames
+	// may be below the registers of the variables, do not close them again.
+	n := len(th.tbcs)
+	for n > 0 && th.tbcs[n-1].index >= idx {
+		n--
+	}
+	pending := th.tbcs[n:]
+	th.tbcs = th.tbcs[:n:n]
+	for i := len(pending) - 1; i >= 0; i-- {
+		tbc := pending[i]
+		var errobj LValue = LNil
+		if err != nil {
+			errobj = err.Object
+		}
+		ls.callCloseMethod(tbc.value, errobj)
+		if cerr := ls.PCall(2, 0, nil); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
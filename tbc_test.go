@@ -0,0 +1,83 @@
+package lua
+
+import (
+	"testing"
+)
+
+const genericForClosingPrelude = `
+local log = {}
+local function closer(name)
+  return setmetatable({}, {__close = function(_, err) log[#log + 1] = name .. ":" .. tostring(err) end})
+end
+local function count(n, name)
+  local function next(_, i)
+    if i < n then return i + 1 end
+  end
+  return next, nil, 0, closer(name)
+end
+`
+
+func TestGenericForClosingValue(t *testing.T) {
+	cases := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"exit", `
+		local sum = 0
+		for i in count(3, "exit") do sum = sum + i end
+		assert(sum == 6)
+		`, "exit:nil"},
+		{"break", `
+		for i in count(3, "break") do
+		  if i == 2 then break end
+		end
+		`, "break:nil"},
+		{"goto", `
+		for i in count(3, "goto") do
+		  if i == 2 then goto out end
+		end
+		::out::
+		`, "goto:nil"},
+		{"return", `
+		local function first()
+		  for i in count(3, "return") do return i end
+		end
+		assert(first() == 1)
+		`, "return:nil"},
+		{"error", `
+		local ok, err = pcall(function()
+		  for i in count(3, "error") do error("boom", 0) end
+		end)
+		assert(not ok and err == "boom")
+		`, "error:boom"},
+		{"nested", `
+		for i in count(1, "outer") do
+		  for j in count(1, "inner") do end
+		end
+		`, "inner:nil outer:nil"},
+	}
+	for _, c := range cases {
+		L := NewState()
+		if err := L.DoString(genericForClosingPrelude + c.code + `
+		assert(#log > 0, "not closed")
+		got = table.concat(log, " ")
+		`); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got := L.GetGlobal("got").String(); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		L.Close()
+	}
+}
+
+func TestGenericForNonClosableValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if err := L.DoString(`for i in next, {}, nil, 42 do end`); err == nil {
+		t.Error("a non-closable closing value must raise an error")
+	}
+	if err := L.DoString(`for k, v in pairs({a = 1}) do assert(k == "a" and v == 1) end`); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,231 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const timeClass = "TIME*"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// timeLayouts are the layouts of strings accepted as times. Times without time
+// zones are in UTC.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// secondsToDuration converts the seconds to a duration, rounding to the
+// nearest nanosecond. ok is false if the duration overflows.
+func secondsToDuration(sec float64) (time.Duration, bool) {
+	ns := math.Round(sec * float64(time.Second))
+	if math.IsNaN(ns) || ns >= math.MaxInt64 || ns < math.MinInt64 {
+		return 0, false
+	}
+	return time.Duration(ns), true
+}
+
+// toTime converts the value to a time. Numbers are seconds since the Unix
+// epoch, strings are in one of timeLayouts, and userdata holding time.Time are
+// the times.
+func toTime(lv LValue) (time.Time, bool) {
+	switch v := lv.(type) {
+	case LNumber, LInteger:
+		f, _ := toFloatValue(v)
+		sec, frac := math.Modf(float64(f))
+		if math.IsNaN(sec) || math.IsInf(sec, 0) {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(sec), int64(math.Round(frac*float64(time.Second)))), true
+	case LString:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, string(v)); err == nil {
+				return t, true
+			}
+		}
+	case *LUserData:
+		t, ok := v.Value.(time.Time)
+		return t, ok
+	}
+	return time.Time{}, false
+}
+
+// toDuration converts the value to a duration. Numbers are seconds, strings
+// are parsed by time.ParseDuration, and userdata holding time.Duration are the
+// durations.
+func toDuration(lv LValue) (time.Duration, bool) {
+	switch v := lv.(type) {
+	case LNumber, LInteger:
+		f, _ := toFloatValue(v)
+		return secondsToDuration(float64(f))
+	case LString:
+		d, err := time.ParseDuration(strings.TrimSpace(string(v)))
+		return d, err == nil
+	case *LUserData:
+		d, ok := v.Value.(time.Duration)
+		return d, ok
+	}
+	return 0, false
+}
+
+// CheckTime checks whether the given argument is a time and returns it. A time
+// can be a number of seconds since the Unix epoch, a string in RFC 3339 or
+// "2006-01-02 15:04:05" format(in UTC if no time zone is given), or a value
+// created by NewTime.
+func (ls *LState) CheckTime(n int) time.Time {
+	t, ok := toTime(ls.Get(n))
+	if !ok {
+		ls.ArgError(n, fmt.Sprintf("time expected, got %v", ls.Get(n).Type()))
+	}
+	return t
+}
+
+// OptTime is like CheckTime, but returns d if the argument is nil or none.
+func (ls *LState) OptTime(n int, d time.Time) time.Time {
+	if ls.Get(n) == LNil {
+		return d
+	}
+	return ls.CheckTime(n)
+}
+
+// CheckDuration checks whether the given argument is a duration and returns
+// it. A duration can be a number of seconds, a string like "1h30m" or userdata
+// holding a time.Duration.
+func (ls *LState) CheckDuration(n int) time.Duration {
+	d, ok := toDuration(ls.Get(n))
+	if !ok {
+		ls.ArgError(n, fmt.Sprintf("duration expected, got %v", ls.Get(n).Type()))
+	}
+	return d
+}
+
+// OptDuration is like CheckDuration, but returns d if the argument is nil or
+// none.
+func (ls *LState) OptDuration(n int, d time.Duration) time.Duration {
+	if ls.Get(n) == LNil {
+		return d
+	}
+	return ls.CheckDuration(n)
+}
+
+// DurationValue returns the duration in seconds.
+func DurationValue(d time.Duration) LNumber {
+	return LNumber(d.Seconds())
+}
+
+// NewTime returns userdata holding the time. Adding seconds(or durations) to
+// the time and subtracting them from the time return new times, subtracting a
+// time from another returns the difference in seconds, and times can be
+// compared. The userdata has the methods unix, format(a Go layout, RFC 3339 by
+// default), year, month, day, hour, minute, second, nanosecond, weekday(1 is
+// Sunday), yearday, utc and localtime.
+func (ls *LState) NewTime(t time.Time) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = t
+	ud.Metatable = ls.timeMetatable()
+	return ud
+}
+
+func (ls *LState) timeMetatable() *LTable {
+	regtable := ls.Get(RegistryIndex)
+	if mt, ok := ls.GetField(regtable, timeClass).(*LTable); ok {
+		return mt
+	}
+	mt := ls.NewTypeMetatable(timeClass)
+	ls.SetField(mt, "__index", ls.RegisterModuleToTable(ls.NewTable(), map[string]LGFunction{
+		"unix": func(L *LState) int {
+			t := checkTimeValue(L, 1)
+			L.Push(LNumber(float64(t.UnixNano()) / float64(time.Second)))
+			return 1
+		},
+		"format": func(L *LState) int {
+			t := checkTimeValue(L, 1)
+			L.Push(LString(t.Format(L.OptString(2, time.RFC3339))))
+			return 1
+		},
+		"year":       timeField(func(t time.Time) int { return t.Year() }),
+		"month":      timeField(func(t time.Time) int { return int(t.Month()) }),
+		"day":        timeField(func(t time.Time) int { return t.Day() }),
+		"hour":       timeField(func(t time.Time) int { return t.Hour() }),
+		"minute":     timeField(func(t time.Time) int { return t.Minute() }),
+		"second":     timeField(func(t time.Time) int { return t.Second() }),
+		"nanosecond": timeField(func(t time.Time) int { return t.Nanosecond() }),
+		"weekday":    timeField(func(t time.Time) int { return int(t.Weekday()) + 1 }),
+		"yearday":    timeField(func(t time.Time) int { return t.YearDay() }),
+		"utc": func(L *LState) int {
+			L.Push(L.NewTime(checkTimeValue(L, 1).UTC()))
+			return 1
+		},
+		"localtime": func(L *LState) int {
+			L.Push(L.NewTime(checkTimeValue(L, 1).Local()))
+			return 1
+		},
+	}))
+	ls.RegisterModuleToTable(mt, map[string]LGFunction{
+		"__add":      timeAdd,
+		"__sub":      timeSub,
+		"__eq":       timeEq,
+		"__lt":       timeLt,
+		"__le":       timeLe,
+		"__tostring": timeToString,
+	})
+	ls.SetField(mt, "__metatable", LString(timeClass))
+	return mt
+}
+
+func timeField(field func(time.Time) int) LGFunction {
+	return func(L *LState) int {
+		L.Push(integerValue(int64(field(checkTimeValue(L, 1)))))
+		return 1
+	}
+}
+
+func checkTimeValue(L *LState, n int) time.Time {
+	return CheckUserDataValue[time.Time](L, n)
+}
+
+func timeAdd(L *LState) int {
+	t, ok := ToUserDataValue[time.Time](L.Get(1))
+	n := 2
+	if !ok {
+		t, n = checkTimeValue(L, 2), 1
+	}
+	L.Push(L.NewTime(t.Add(L.CheckDuration(n))))
+	return 1
+}
+
+func timeSub(L *LState) int {
+	t := checkTimeValue(L, 1)
+	if u, ok := ToUserDataValue[time.Time](L.Get(2)); ok {
+		L.Push(DurationValue(t.Sub(u)))
+		return 1
+	}
+	L.Push(L.NewTime(t.Add(-L.CheckDuration(2))))
+	return 1
+}
+
+func timeEq(L *LState) int {
+	L.Push(LBool(checkTimeValue(L, 1).Equal(checkTimeValue(L, 2))))
+	return 1
+}
+
+func timeLt(L *LState) int {
+	L.Push(LBool(checkTimeValue(L, 1).Before(checkTimeValue(L, 2))))
+	return 1
+}
+
+func timeLe(L *LState) int {
+	L.Push(LBool(!checkTimeValue(L, 1).After(checkTimeValue(L, 2))))
+	return 1
+}
+
+func timeToString(L *LState) int {
+	L.Push(LString(checkTimeValue(L, 1).Format(time.RFC3339Nano)))
+	return 1
+}
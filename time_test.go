@@ -0,0 +1,77 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckTime(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	var times []time.Time
+	var durations []time.Duration
+	L.SetGlobal("check", L.NewFunction(func(L *LState) int {
+		times = append(times, L.OptTime(1, time.Time{}))
+		durations = append(durations, L.OptDuration(2, time.Hour))
+		return 0
+	}))
+	err := L.DoString(`
+	check(0, 1.5)
+	check("2024-01-02T15:04:05Z", "1m30s")
+	check("2024-01-02 15:04:05")
+	check(nil, nil)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if !times[0].Equal(time.Unix(0, 0)) || !times[1].Equal(want) || !times[2].Equal(want) || !times[3].IsZero() {
+		t.Errorf("got %v", times)
+	}
+	if durations[0] != 1500*time.Millisecond || durations[1] != 90*time.Second || durations[2] != time.Hour {
+		t.Errorf("got %v", durations)
+	}
+	if err := L.DoString(`check("yesterday")`); err == nil {
+		t.Error("got no error for an invalid time")
+	}
+	if err := L.DoString(`check(0, "long")`); err == nil {
+		t.Error("got no error for an invalid duration")
+	}
+	if err := L.DoString(`check(0, 1e300)`); err == nil {
+		t.Error("got no error for a duration that overflows")
+	}
+}
+
+func TestTimeValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	L.SetGlobal("start", L.NewTime(start))
+	L.SetGlobal("now", L.NewFunctionFromGo(func() time.Time { return start.Add(time.Minute) }))
+	err := L.DoString(`
+	assert(start:year() == 2024 and start:month() == 1 and start:day() == 2)
+	assert(start:hour() == 15 and start:minute() == 4 and start:second() == 5)
+	assert(start:weekday() == 3 and start:yearday() == 2)
+	assert(start:unix() == 1704207845)
+	assert(start:format() == "2024-01-02T15:04:05Z")
+	assert(start:format("2006/01/02") == "2024/01/02")
+	assert(tostring(start) == "2024-01-02T15:04:05Z")
+
+	local later = now()
+	assert(later - start == 60)
+	assert(start + 60 == later and 60 + start == later)
+	assert(later - "1m" == start)
+	assert(start < later and start <= start and not (later < start))
+	assert(start:utc() == start)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoString(`local f = start.year f(1)`); err == nil || !strings.Contains(err.Error(), "time.Time expected") {
+		t.Errorf("got %v, want an argument error", err)
+	}
+	if v := DurationValue(1500 * time.Millisecond); v != 1.5 {
+		t.Errorf("got %v, want 1.5", v)
+	}
+}
@@ -0,0 +1,100 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TransferConverter converts a value held by userdata into a Lua value of the
+// state L. It is used by TransferValue to re-wrap userdata for the destination
+// state, typically with NewUserData and a metatable of L.
+type TransferConverter func(L *LState, value interface{}) (LValue, error)
+
+// RegisterTransferConverter registers the converter used by TransferValue for
+// userdata transferred into the state whose value has the given type.
+func (ls *LState) RegisterTransferConverter(typ reflect.Type, conv TransferConverter) {
+	if ls.G.transferConverters == nil {
+		ls.G.transferConverters = make(map[reflect.Type]TransferConverter)
+	}
+	ls.G.transferConverters[typ] = conv
+}
+
+// TransferValue deep-copies the value into the state dst, which may be
+// independent from the state that owns the value. Nil, booleans, numbers and
+// strings are returned as is, and tables are copied with their keys and values
+// preserving shared references and cycles. Metatables are not copied.
+//
+// Userdata is re-wrapped by the converter registered to dst for the type of its
+// value(see RegisterTransferConverter). Shared tables and channels are wrapped
+// by NewSharedTableValue and NewChannel without converters. TransferValue
+// returns an error for functions, threads and userdata without converters.
+//
+// The source state must not be running while the value is transferred.
+func TransferValue(dst *LState, v LValue) (LValue, error) {
+	t := &valueTransferer{dst: dst, copies: make(map[LValue]LValue)}
+	return t.transfer(v)
+}
+
+type valueTransferer struct {
+	dst    *LState
+	copies map[LValue]LValue
+}
+
+func (t *valueTransferer) transfer(lv LValue) (LValue, error) {
+	switch v := lv.(type) {
+	case *LNilType, LBool, LNumber, LInteger, LString:
+		return lv, nil
+	case *LTable:
+		if cp, ok := t.copies[v]; ok {
+			return cp, nil
+		}
+		tb := t.dst.CreateTable(len(v.array), len(v.dict))
+		t.copies[v] = tb
+		var err error
+		v.ForEach(func(key, value LValue) {
+			if err != nil {
+				return
+			}
+			var k, val LValue
+			if k, err = t.transfer(key); err != nil {
+				return
+			}
+			if val, err = t.transfer(value); err != nil {
+				return
+			}
+			tb.RawSet(k, val)
+		})
+		if err != nil {
+			return LNil, err
+		}
+		tb.frozen = v.frozen
+		return tb, nil
+	case *LUserData:
+		if cp, ok := t.copies[v]; ok {
+			return cp, nil
+		}
+		cp, err := t.transferUserData(v)
+		if err != nil {
+			return LNil, err
+		}
+		t.copies[v] = cp
+		return cp, nil
+	}
+	return LNil, fmt.Errorf("can not transfer a %v to another state", lv.Type())
+}
+
+func (t *valueTransferer) transferUserData(ud *LUserData) (LValue, error) {
+	rv := reflect.ValueOf(ud.Value)
+	if rv.IsValid() {
+		if conv, ok := t.dst.G.transferConverters[rv.Type()]; ok {
+			return conv(t.dst, ud.Value)
+		}
+		switch {
+		case rv.Type() == sharedTableType && !rv.IsNil():
+			return t.dst.NewSharedTableValue(ud.Value.(*SharedTable)), nil
+		case rv.Kind() == reflect.Chan && !rv.IsNil():
+			return t.dst.newChannel(rv), nil
+		}
+	}
+	return LNil, fmt.Errorf("can not transfer userdata holding %T to another state", ud.Value)
+}
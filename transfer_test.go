@@ -0,0 +1,80 @@
+package lua
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransferValue(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	err := src.DoString(`
+	local shared = {1, 2}
+	result = {name = "x", a = shared, b = shared, nested = {flag = true}}
+	result.self = result
+	setmetatable(result, {})
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, terr := TransferValue(dst, src.GetGlobal("result"))
+	if terr != nil {
+		t.Fatal(terr)
+	}
+	dst.SetGlobal("result", v)
+	err = dst.DoString(`
+	assert(result.name == "x" and result.nested.flag == true)
+	assert(result.a == result.b and result.a[2] == 2)
+	assert(result.self == result)
+	assert(getmetatable(result) == nil)
+	`)
+	if err != nil {
+		t.Error(err)
+	}
+	if v == src.GetGlobal("result") {
+		t.Error("the table must be copied")
+	}
+
+	for _, lv := range []LValue{src.GetGlobal("print"), src.NewThread(), src.NewUserData()} {
+		if _, err := TransferValue(dst, lv); err == nil || !strings.Contains(err.Error(), "can not transfer") {
+			t.Errorf("%v: got %v, want an error", lv.Type(), err)
+		}
+	}
+}
+
+func TestTransferConverter(t *testing.T) {
+	src := NewState()
+	defer src.Close()
+	dst := NewState()
+	defer dst.Close()
+	dst.RegisterTransferConverter(reflect.TypeOf(&testPoint{}), func(L *LState, v interface{}) (LValue, error) {
+		return L.NewStructProxy(v), nil
+	})
+	p := &testPoint{X: 1}
+	ud := src.NewUserData()
+	ud.Value = p
+	st := NewSharedTable()
+	tb := src.NewTable()
+	tb.RawSetInt(1, ud)
+	tb.RawSetInt(2, ud)
+	tb.RawSetInt(3, src.NewSharedTableValue(st))
+	tb.RawSetInt(4, src.NewChannel(make(chan int)))
+	v, err := TransferValue(dst, tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.SetGlobal("t", v)
+	if err := dst.DoString(`
+	assert(t[1].X == 1 and t[1] == t[2])
+	t[3]:set("x", 1)
+	assert(t[4]:len() == 0)
+	`); err != nil {
+		t.Error(err)
+	}
+	if st.Get(LString("x")) == LNil {
+		t.Error("the shared table must not be copied")
+	}
+}
@@ -0,0 +1,124 @@
+package transpile
+
+import (
+	"github.com/yuin/gopher-lua"
+)
+
+// The functions below are called by the generated code.
+
+// Call calls fn with the arguments and returns all the results.
+func Call(L *lua.LState, fn lua.LValue, args ...lua.LValue) []lua.LValue {
+	top := L.GetTop()
+	push(L, fn, args)
+	L.Call(len(args), lua.MultRet)
+	results := make([]lua.LValue, L.GetTop()-top)
+	for i := range results {
+		results[i] = L.Get(top + i + 1)
+	}
+	L.SetTop(top)
+	return results
+}
+
+// Call0 calls fn with the arguments and discards the results.
+func Call0(L *lua.LState, fn lua.LValue, args ...lua.LValue) {
+	push(L, fn, args)
+	L.Call(len(args), 0)
+}
+
+// Call1 calls fn with the arguments and returns the first result.
+func Call1(L *lua.LState, fn lua.LValue, args ...lua.LValue) lua.LValue {
+	push(L, fn, args)
+	L.Call(len(args), 1)
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret
+}
+
+// CallTo calls fn with the arguments and stores the first len(results) results
+// into results, which are padded with nil.
+func CallTo(L *lua.LState, results []lua.LValue, fn lua.LValue, args ...lua.LValue) {
+	push(L, fn, args)
+	L.Call(len(args), len(results))
+	for i := range results {
+		results[i] = L.Get(i - len(results))
+	}
+	L.Pop(len(results))
+}
+
+func push(L *lua.LState, fn lua.LValue, args []lua.LValue) {
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+}
+
+// Return pushes the values returned by the function and returns the number of
+// them.
+func Return(L *lua.LState, values ...lua.LValue) int {
+	for _, value := range values {
+		L.Push(value)
+	}
+	return len(values)
+}
+
+// Varargs returns the arguments of the function after its nparams
+// parameters.
+func Varargs(L *lua.LState, nparams int) []lua.LValue {
+	n := L.GetTop() - nparams
+	if n <= 0 {
+		return nil
+	}
+	values := make([]lua.LValue, n)
+	for i := range values {
+		values[i] = L.Get(nparams + i + 1)
+	}
+	return values
+}
+
+// Nth returns values[i], or nil if there are not enough values.
+func Nth(values []lua.LValue, i int) lua.LValue {
+	if i < len(values) {
+		return values[i]
+	}
+	return lua.LNil
+}
+
+// SetList sets the elements of the table from the index start to the values.
+func SetList(L *lua.LState, tb *lua.LTable, start int, values []lua.LValue) {
+	for i, value := range values {
+		L.RawSetInt(tb, start+i, value)
+	}
+}
+
+// ForPrep checks the control values of a numeric for statement and returns
+// them as floats. The returned index is init-step, which is incremented before
+// each iteration like the VM does.
+func ForPrep(L *lua.LState, init, limit, step lua.LValue) (index, flimit, fstep lua.LNumber) {
+	ok := false
+	if index, ok = forNumber(init); !ok {
+		L.RaiseError("for statement init must be a number")
+	}
+	if fstep, ok = forNumber(step); !ok {
+		L.RaiseError("for statement step must be a number")
+	}
+	if flimit, ok = forNumber(limit); !ok {
+		L.RaiseError("for statement limit must be a number")
+	}
+	return index - fstep, flimit, fstep
+}
+
+func forNumber(lv lua.LValue) (lua.LNumber, bool) {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		return v, true
+	case lua.LInteger:
+		return lua.LNumber(v), true
+	}
+	return 0, false
+}
+
+// ForCond reports whether a numeric for statement runs the iteration of the
+// index.
+func ForCond(index, limit, step lua.LNumber) bool {
+	return (step > 0 && index <= limit) || (step <= 0 && index >= limit)
+}
@@ -0,0 +1,678 @@
+// Package transpile translates Lua scripts into Go source code that runs them
+// with the API of gopher-lua, so that performance-critical scripts can be built
+// into programs instead of being compiled and interpreted at runtime.
+//
+// A script is translated into a function of the type lua.LGFunction that runs
+// the main chunk of the script. Lua functions become Go closures created by
+// LState.NewFunction, and Lua local variables become Go variables captured by
+// the closures. Operations call LState methods such as GetTable, Arith and
+// LessThan, so metamethods and errors work as they do in the VM.
+//
+// A subset of Lua is supported. goto statements, labels and to-be-closed
+// variables are rejected. Numbers are floats even if lua.Lua53Integer is set,
+// calls in return statements are not tail calls, and globals are the fields of
+// the global table of the state rather than of the environments of the
+// functions. Coroutines can not yield in the generated functions, which are Go
+// functions, and errors raised by them do not have line numbers.
+package transpile
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Options are the options of the generated Go source.
+type Options struct {
+	// Package is the name of the package of the generated source.
+	Package string
+	// Func is the name of the generated function.
+	Func string
+}
+
+// Error is an error of a Lua construct that can not be translated.
+type Error struct {
+	Source  string
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Source, e.Line, e.Message)
+}
+
+// Source translates the Lua source code into Go source code.
+func Source(src []byte, name string, opts Options) ([]byte, error) {
+	chunk, err := parse.Parse(bytes.NewReader(src), name)
+	if err != nil {
+		return nil, err
+	}
+	return Chunk(chunk, name, opts)
+}
+
+// Chunk translates the chunk into Go source code. name is the name of the
+// chunk used in errors and in the header of the source.
+func Chunk(chunk []ast.Stmt, name string, opts Options) (src []byte, err error) {
+	g := &generator{source: name, out: &strings.Builder{}}
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			if e, ok := rcv.(*Error); ok {
+				err = e
+				return
+			}
+			panic(rcv)
+		}
+	}()
+	g.printf("// Code generated from %s by gopher-lua/transpile. DO NOT EDIT.\n\n", name)
+	g.printf("package %s\n\n", opts.Package)
+	g.printf("import (\n\tlua %q\n\t%q\n)\n\n", "github.com/yuin/gopher-lua", "github.com/yuin/gopher-lua/transpile")
+	g.printf("// %s runs %s. The arguments are the varargs of the chunk.\n", opts.Func, name)
+	g.printf("func %s(L *lua.LState) int {\n", opts.Func)
+	g.body(nil, true, chunk)
+	g.printf("}\n")
+	formatted, ferr := format.Source([]byte(g.out.String()))
+	if ferr != nil {
+		return nil, fmt.Errorf("%s: invalid generated source: %v", name, ferr)
+	}
+	return formatted, nil
+}
+
+// value is a Go expression of a Lua value.
+type value struct {
+	expr string
+	// variable is true if the expression reads a local variable, whose value
+	// may be changed by the code that runs after the expression is compiled.
+	variable bool
+}
+
+type scope struct {
+	parent *scope
+	names  map[string]string
+}
+
+type generator struct {
+	source string
+	out    *strings.Builder
+	scope  *scope
+	// varargs is true in vararg functions.
+	varargs bool
+	temps   int
+	locals  int
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(g.out, format, args...)
+}
+
+func (g *generator) fail(node ast.PositionHolder, format string, args ...any) {
+	panic(&Error{Source: g.source, Line: node.Line(), Message: fmt.Sprintf(format, args...)})
+}
+
+func (g *generator) openScope() {
+	g.scope = &scope{parent: g.scope, names: map[string]string{}}
+}
+
+func (g *generator) closeScope() {
+	g.scope = g.scope.parent
+}
+
+// local declares the Lua local variable, initialized to the Go expression.
+func (g *generator) local(name, init string) string {
+	g.locals++
+	goname := fmt.Sprintf("%s_%d", name, g.locals)
+	g.scope.names[name] = goname
+	g.printf("var %s lua.LValue = %s\n_ = %s\n", goname, init, goname)
+	return goname
+}
+
+// lookup returns the Go variable of the Lua local variable, or "" if name is
+// a global.
+func (g *generator) lookup(name string) string {
+	for s := g.scope; s != nil; s = s.parent {
+		if goname, ok := s.names[name]; ok {
+			return goname
+		}
+	}
+	return ""
+}
+
+// temp stores the Go expression into a new variable.
+func (g *generator) temp(expr string) value {
+	g.temps++
+	name := fmt.Sprintf("t%d", g.temps)
+	g.printf("%s := %s\n", name, expr)
+	return value{expr: name}
+}
+
+// variable is like temp, but the variable can be assigned values of other
+// types later.
+func (g *generator) variable(expr string) value {
+	g.temps++
+	name := fmt.Sprintf("t%d", g.temps)
+	g.printf("var %s lua.LValue = %s\n", name, expr)
+	return value{expr: name}
+}
+
+// body compiles the body of a function, whose parameters are the first Lua
+// local variables.
+func (g *generator) body(params []string, varargs bool, stmts []ast.Stmt) {
+	saved := g.varargs
+	g.varargs = varargs
+	g.openScope()
+	for i, name := range params {
+		g.local(name, fmt.Sprintf("L.Get(%d)", i+1))
+	}
+	if varargs {
+		g.printf("varargs := transpile.Varargs(L, %d)\n_ = varargs\n", len(params))
+	}
+	g.stmts(stmts)
+	if len(stmts) == 0 {
+		g.printf("return 0\n")
+	} else if _, ok := stmts[len(stmts)-1].(*ast.ReturnStmt); !ok {
+		g.printf("return 0\n")
+	}
+	g.closeScope()
+	g.varargs = saved
+}
+
+func (g *generator) block(stmts []ast.Stmt) {
+	g.openScope()
+	g.stmts(stmts)
+	g.closeScope()
+}
+
+func (g *generator) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		g.stmt(stmt)
+	}
+}
+
+func (g *generator) stmt(stmt ast.Stmt) {
+	switch st := stmt.(type) {
+	case *ast.LocalAssignStmt:
+		g.localAssign(st)
+	case *ast.AssignStmt:
+		g.assign(st.Lhs, st.Rhs)
+	case *ast.FuncCallStmt:
+		fn, args := g.call(st.Expr.(*ast.FuncCallExpr))
+		g.printf("transpile.Call0(L, %s%s)\n", fn, args)
+	case *ast.DoBlockStmt:
+		g.printf("{\n")
+		g.block(st.Stmts)
+		g.printf("}\n")
+	case *ast.WhileStmt:
+		g.printf("for {\n")
+		g.printf("if !(%s) {\nbreak\n}\n", g.cond(st.Condition))
+		g.block(st.Stmts)
+		g.printf("}\n")
+	case *ast.RepeatStmt:
+		// the condition can refer to the local variables of the body.
+		g.printf("for {\n")
+		g.openScope()
+		g.stmts(st.Stmts)
+		g.printf("if %s {\nbreak\n}\n", g.cond(st.Condition))
+		g.closeScope()
+		g.printf("}\n")
+	case *ast.IfStmt:
+		g.printf("if %s {\n", g.cond(st.Condition))
+		g.block(st.Then)
+		if len(st.Else) > 0 {
+			g.printf("} else {\n")
+			g.block(st.Else)
+		}
+		g.printf("}\n")
+	case *ast.NumberForStmt:
+		g.numberFor(st)
+	case *ast.GenericForStmt:
+		g.genericFor(st)
+	case *ast.FuncDefStmt:
+		if st.Name.Func != nil {
+			g.assign([]ast.Expr{st.Name.Func}, []ast.Expr{st.Func})
+			return
+		}
+		vals := g.operands(st.Name.Receiver)
+		fn := g.function(st.Func, true)
+		g.printf("L.SetTable(%s, lua.LString(%q), %s)\n", vals[0].expr, st.Name.Method, fn.expr)
+	case *ast.ReturnStmt:
+		vals, rest := g.exprs(st.Exprs, true)
+		if len(vals) == 0 && rest == "" {
+			g.printf("return 0\n")
+		} else {
+			g.printf("return transpile.Return(L, %s)\n", argList(vals, rest))
+		}
+	case *ast.BreakStmt:
+		g.printf("break\n")
+	case *ast.GotoStmt:
+		g.fail(st, "goto statements are not supported")
+	case *ast.LabelStmt:
+		g.fail(st, "labels are not supported")
+	default:
+		g.fail(stmt, "unknown statement %T", stmt)
+	}
+}
+
+func (g *generator) localAssign(st *ast.LocalAssignStmt) {
+	for _, attrib := range st.Attribs {
+		if attrib == "close" {
+			g.fail(st, "to-be-closed variables are not supported")
+		}
+	}
+	if len(st.Names) == 1 && len(st.Exprs) == 1 {
+		if fn, ok := st.Exprs[0].(*ast.FunctionExpr); ok {
+			// the function can call itself.
+			goname := g.local(st.Names[0], "lua.LNil")
+			g.printf("%s = %s\n", goname, g.function(fn, false).expr)
+			return
+		}
+	}
+	vals, rest := g.exprs(st.Exprs, true)
+	inits := g.adjust(vals, rest, len(st.Names))
+	for i, name := range st.Names {
+		g.local(name, inits[i])
+	}
+}
+
+// assign assigns the values to the variables. The tables and keys of the
+// variables and then the values are evaluated before any of them is assigned.
+func (g *generator) assign(lhs, rhs []ast.Expr) {
+	var exprs []ast.Expr
+	for _, ex := range lhs {
+		switch v := ex.(type) {
+		case *ast.IdentExpr:
+		case *ast.AttrGetExpr:
+			exprs = append(exprs, v.Object, v.Key)
+		default:
+			g.fail(ex, "cannot assign to %T", ex)
+		}
+	}
+	targets := g.operands(exprs...)
+	if len(lhs) > 1 {
+		// a variable may be assigned before it is used as a table or a key.
+		for i, v := range targets {
+			if v.variable {
+				targets[i] = g.temp(v.expr)
+			}
+		}
+	}
+	vals, rest := g.exprs(rhs, true)
+	if len(lhs) > 1 {
+		// a variable may be assigned before it is read as a value.
+		for i, v := range vals {
+			if v.variable {
+				vals[i] = g.temp(v.expr)
+			}
+		}
+	}
+	values := g.adjust(vals, rest, len(lhs))
+	for i, ex := range lhs {
+		switch v := ex.(type) {
+		case *ast.IdentExpr:
+			if goname := g.lookup(v.Value); goname != "" {
+				g.printf("%s = %s\n", goname, values[i])
+			} else {
+				g.printf("L.SetGlobal(%q, %s)\n", v.Value, values[i])
+			}
+		case *ast.AttrGetExpr:
+			g.printf("L.SetTable(%s, %s, %s)\n", targets[0].expr, targets[1].expr, values[i])
+			targets = targets[2:]
+		}
+	}
+}
+
+func (g *generator) numberFor(st *ast.NumberForStmt) {
+	step := st.Step
+	if step == nil {
+		step = &ast.NumberExpr{Value: "1"}
+	}
+	g.printf("{\n")
+	vals, _ := g.exprs([]ast.Expr{st.Init, st.Limit, step}, false)
+	g.temps += 3
+	index, limit, fstep := fmt.Sprintf("t%d", g.temps-2), fmt.Sprintf("t%d", g.temps-1), fmt.Sprintf("t%d", g.temps)
+	g.printf("%s, %s, %s := transpile.ForPrep(L, %s, %s, %s)\n", index, limit, fstep, vals[0].expr, vals[1].expr, vals[2].expr)
+	g.printf("for {\n%s += %s\n", index, fstep)
+	g.printf("if !transpile.ForCond(%s, %s, %s) {\nbreak\n}\n", index, limit, fstep)
+	g.openScope()
+	g.local(st.Name, index)
+	g.stmts(st.Stmts)
+	g.closeScope()
+	g.printf("}\n}\n")
+}
+
+func (g *generator) genericFor(st *ast.GenericForStmt) {
+	g.printf("{\n")
+	vals, rest := g.exprs(st.Exprs, true)
+	inits := g.adjust(vals, rest, 3)
+	fn, state, control := g.temp(inits[0]), g.temp(inits[1]), g.variable(inits[2])
+	results := g.temp(fmt.Sprintf("make([]lua.LValue, %d)", len(st.Names)))
+	g.printf("for {\ntranspile.CallTo(L, %s, %s, %s, %s)\n", results.expr, fn.expr, state.expr, control.expr)
+	g.printf("if %s[0] == lua.LNil {\nbreak\n}\n%s = %s[0]\n", results.expr, control.expr, results.expr)
+	g.openScope()
+	for i, name := range st.Names {
+		g.local(name, fmt.Sprintf("%s[%d]", results.expr, i))
+	}
+	g.stmts(st.Stmts)
+	g.closeScope()
+	g.printf("}\n}\n")
+}
+
+// adjust returns n Go expressions of the values, which are padded with the
+// values of rest or nil. The values that are not used are discarded, so that
+// Go does not reject the variables that hold them.
+func (g *generator) adjust(vals []value, rest string, n int) []string {
+	for i := n; i < len(vals); i++ {
+		g.printf("_ = %s\n", vals[i].expr)
+	}
+	if rest != "" && n <= len(vals) {
+		g.printf("_ = %s\n", rest)
+	}
+	exprs := make([]string, n)
+	for i := range exprs {
+		switch {
+		case i < len(vals):
+			exprs[i] = vals[i].expr
+		case rest != "":
+			exprs[i] = fmt.Sprintf("transpile.Nth(%s, %d)", rest, i-len(vals))
+		default:
+			exprs[i] = "lua.LNil"
+		}
+	}
+	return exprs
+}
+
+// operands compiles the operands of an operation. Local variables are read
+// when the operation runs, after the other operands are evaluated, like the VM
+// reads registers.
+func (g *generator) operands(exprs ...ast.Expr) []value {
+	vals := make([]value, len(exprs))
+	for i, ex := range exprs {
+		vals[i] = g.expr(ex)
+	}
+	return vals
+}
+
+// exprs compiles the list of expressions, which are evaluated from left to
+// right like the VM copies them into registers. If multi is true and the last
+// expression is a call or '...', all of its values are the slice rest.
+func (g *generator) exprs(exprs []ast.Expr, multi bool) (vals []value, rest string) {
+	out := g.out
+	for i, ex := range exprs {
+		prev := len(vals)
+		g.out = &strings.Builder{}
+		if multi && i == len(exprs)-1 && isMultiValue(ex) {
+			rest = g.multiValue(ex)
+		} else {
+			vals = append(vals, g.expr(ex))
+		}
+		code := g.out.String()
+		g.out = out
+		if code != "" {
+			// the code may change the variables read before it.
+			for j, v := range vals[:prev] {
+				if v.variable {
+					vals[j] = g.temp(v.expr)
+				}
+			}
+		}
+		g.out.WriteString(code)
+	}
+	return vals, rest
+}
+
+func isMultiValue(ex ast.Expr) bool {
+	switch v := ex.(type) {
+	case *ast.FuncCallExpr:
+		return !v.AdjustRet
+	case *ast.Comma3Expr:
+		return true
+	}
+	return false
+}
+
+// multiValue compiles the call or '...' into a slice of all its values.
+func (g *generator) multiValue(ex ast.Expr) string {
+	if call, ok := ex.(*ast.FuncCallExpr); ok {
+		fn, args := g.call(call)
+		return g.temp(fmt.Sprintf("transpile.Call(L, %s%s)", fn, args)).expr
+	}
+	g.checkVarargs(ex)
+	return "varargs"
+}
+
+func (g *generator) checkVarargs(ex ast.Expr) {
+	if !g.varargs {
+		g.fail(ex, "cannot use '...' outside a vararg function")
+	}
+}
+
+// call compiles the function and the arguments of the call. args is empty or
+// starts with a comma.
+func (g *generator) call(ex *ast.FuncCallExpr) (fn string, args string) {
+	var vals []value
+	var rest string
+	if ex.Func != nil {
+		// the function is a single value even if it is the last expression.
+		vals, rest = g.exprs(append([]ast.Expr{ex.Func}, ex.Args...), len(ex.Args) > 0)
+	} else {
+		recv := g.operands(ex.Receiver)
+		self := recv[0]
+		if self.variable {
+			self = g.temp(self.expr)
+		}
+		method := g.temp(fmt.Sprintf("L.GetTable(%s, lua.LString(%q))", self.expr, ex.Method))
+		vals, rest = g.exprs(ex.Args, true)
+		vals = append([]value{method, self}, vals...)
+	}
+	if len(vals) == 1 && rest == "" {
+		return vals[0].expr, ""
+	}
+	return vals[0].expr, ", " + argList(vals[1:], rest)
+}
+
+// argList returns the Go arguments of a variadic function of the values.
+func argList(vals []value, rest string) string {
+	exprs := make([]string, len(vals))
+	for i, v := range vals {
+		exprs[i] = v.expr
+	}
+	list := strings.Join(exprs, ", ")
+	switch {
+	case rest == "":
+		return list
+	case len(vals) == 0:
+		return rest + "..."
+	}
+	return fmt.Sprintf("append([]lua.LValue{%s}, %s...)...", list, rest)
+}
+
+// cond compiles the expression into a Go boolean expression.
+func (g *generator) cond(ex ast.Expr) string {
+	switch v := ex.(type) {
+	case *ast.RelationalOpExpr:
+		vals := g.operands(v.Lhs, v.Rhs)
+		lhs, rhs := vals[0].expr, vals[1].expr
+		switch v.Operator {
+		case "==":
+			return fmt.Sprintf("L.Equal(%s, %s)", lhs, rhs)
+		case "~=":
+			return fmt.Sprintf("!L.Equal(%s, %s)", lhs, rhs)
+		case "<":
+			return fmt.Sprintf("L.LessThan(%s, %s)", lhs, rhs)
+		case ">":
+			return fmt.Sprintf("L.LessThan(%s, %s)", rhs, lhs)
+		case "<=":
+			return fmt.Sprintf("L.LessEqual(%s, %s)", lhs, rhs)
+		case ">=":
+			return fmt.Sprintf("L.LessEqual(%s, %s)", rhs, lhs)
+		}
+		g.fail(ex, "unknown operator %v", v.Operator)
+	case *ast.UnaryNotOpExpr:
+		return fmt.Sprintf("!(%s)", g.cond(v.Expr))
+	case *ast.TrueExpr:
+		return "true"
+	}
+	vals := g.operands(ex)
+	return fmt.Sprintf("lua.LVAsBool(%s)", vals[0].expr)
+}
+
+var arithOps = map[string]string{
+	"+":  "lua.OP_ADD",
+	"-":  "lua.OP_SUB",
+	"*":  "lua.OP_MUL",
+	"/":  "lua.OP_DIV",
+	"%":  "lua.OP_MOD",
+	"^":  "lua.OP_POW",
+	"//": "lua.OP_IDIV",
+	"&":  "lua.OP_BAND",
+	"|":  "lua.OP_BOR",
+	"~":  "lua.OP_BXOR",
+	"<<": "lua.OP_SHL",
+	">>": "lua.OP_SHR",
+}
+
+// expr compiles the expression into a single value.
+func (g *generator) expr(ex ast.Expr) value {
+	switch v := ex.(type) {
+	case *ast.NilExpr:
+		return value{expr: "lua.LNil"}
+	case *ast.TrueExpr:
+		return value{expr: "lua.LTrue"}
+	case *ast.FalseExpr:
+		return value{expr: "lua.LFalse"}
+	case *ast.NumberExpr:
+		return value{expr: g.number(v, float64(lua.LVAsNumber(lua.LString(v.Value))))}
+	case *ast.StringExpr:
+		return value{expr: fmt.Sprintf("lua.LString(%s)", strconv.Quote(v.Value))}
+	case *ast.Comma3Expr:
+		g.checkVarargs(ex)
+		return value{expr: "transpile.Nth(varargs, 0)"}
+	case *ast.IdentExpr:
+		if goname := g.lookup(v.Value); goname != "" {
+			return value{expr: goname, variable: true}
+		}
+		return g.temp(fmt.Sprintf("L.GetGlobal(%q)", v.Value))
+	case *ast.AttrGetExpr:
+		vals := g.operands(v.Object, v.Key)
+		return g.temp(fmt.Sprintf("L.GetTable(%s, %s)", vals[0].expr, vals[1].expr))
+	case *ast.TableExpr:
+		return g.table(v)
+	case *ast.FuncCallExpr:
+		fn, args := g.call(v)
+		return g.temp(fmt.Sprintf("transpile.Call1(L, %s%s)", fn, args))
+	case *ast.LogicalOpExpr:
+		lhs := g.operands(v.Lhs)
+		ret := g.variable(lhs[0].expr)
+		if v.Operator == "and" {
+			g.printf("if lua.LVAsBool(%s) {\n", ret.expr)
+		} else {
+			g.printf("if !lua.LVAsBool(%s) {\n", ret.expr)
+		}
+		rhs := g.operands(v.Rhs)
+		g.printf("%s = %s\n}\n", ret.expr, rhs[0].expr)
+		return ret
+	case *ast.RelationalOpExpr, *ast.UnaryNotOpExpr:
+		return g.temp(fmt.Sprintf("lua.LBool(%s)", g.cond(ex)))
+	case *ast.StringConcatOpExpr:
+		return g.arith(ex, "lua.OP_CONCAT", v.Lhs, v.Rhs)
+	case *ast.ArithmeticOpExpr:
+		op, ok := arithOps[v.Operator]
+		if !ok {
+			g.fail(ex, "unknown operator %v", v.Operator)
+		}
+		return g.arith(ex, op, v.Lhs, v.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		if num, ok := v.Expr.(*ast.NumberExpr); ok {
+			return value{expr: g.number(num, -float64(lua.LVAsNumber(lua.LString(num.Value))))}
+		}
+		return g.arith(ex, "lua.OP_UNM", v.Expr, nil)
+	case *ast.UnaryBNotOpExpr:
+		return g.arith(ex, "lua.OP_BNOT", v.Expr, nil)
+	case *ast.UnaryLenOpExpr:
+		vals := g.operands(v.Expr)
+		return g.temp(fmt.Sprintf("L.Len(%s)", vals[0].expr))
+	case *ast.FunctionExpr:
+		return g.function(v, false)
+	}
+	g.fail(ex, "unknown expression %T", ex)
+	return value{}
+}
+
+func (g *generator) number(ex ast.Expr, f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		g.fail(ex, "number %v is not finite", f)
+	}
+	return fmt.Sprintf("lua.LNumber(%s)", strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// arith compiles the operation. rhs is nil for unary operations.
+func (g *generator) arith(ex ast.Expr, op string, lhs, rhs ast.Expr) value {
+	if rhs == nil {
+		vals := g.operands(lhs)
+		return g.temp(fmt.Sprintf("L.Arith(%s, %s, lua.LNil)", op, vals[0].expr))
+	}
+	var vals []value
+	if op == "lua.OP_CONCAT" {
+		// the VM concatenates copies of the values like a call.
+		vals, _ = g.exprs([]ast.Expr{lhs, rhs}, false)
+	} else {
+		vals = g.operands(lhs, rhs)
+	}
+	return g.temp(fmt.Sprintf("L.Arith(%s, %s, %s)", op, vals[0].expr, vals[1].expr))
+}
+
+// table compiles the table constructor. The positional fields are stored after
+// the other fields like the VM does.
+func (g *generator) table(ex *ast.TableExpr) value {
+	var exprs []ast.Expr
+	npositional := 0
+	for _, field := range ex.Fields {
+		if field.Key != nil {
+			exprs = append(exprs, field.Key)
+		} else {
+			npositional++
+		}
+		exprs = append(exprs, field.Value)
+	}
+	multi := len(ex.Fields) > 0 && ex.Fields[len(ex.Fields)-1].Key == nil
+	vals, rest := g.exprs(exprs, multi)
+	tb := g.temp(fmt.Sprintf("L.CreateTable(%d, %d)", npositional, len(ex.Fields)-npositional))
+	var positional []value
+	for _, field := range ex.Fields {
+		if field.Key != nil {
+			g.printf("L.RawSet(%s, %s, %s)\n", tb.expr, vals[0].expr, vals[1].expr)
+			vals = vals[2:]
+		} else if len(vals) > 0 {
+			positional = append(positional, vals[0])
+			vals = vals[1:]
+		}
+	}
+	for i, v := range positional {
+		g.printf("L.RawSetInt(%s, %d, %s)\n", tb.expr, i+1, v.expr)
+	}
+	index := len(positional) + 1
+	if rest != "" {
+		g.printf("transpile.SetList(L, %s, %d, %s)\n", tb.expr, index, rest)
+	}
+	return tb
+}
+
+// function compiles the function into a closure. self is true for methods,
+// whose first parameter is self.
+func (g *generator) function(ex *ast.FunctionExpr, self bool) value {
+	params := ex.ParList.Names
+	if self {
+		params = append([]string{"self"}, params...)
+	}
+	g.temps++
+	name := fmt.Sprintf("t%d", g.temps)
+	g.printf("%s := L.NewFunction(func(L *lua.LState) int {\n", name)
+	g.body(params, ex.ParList.HasVargs, ex.Stmts)
+	g.printf("})\n")
+	return value{expr: name}
+}
@@ -0,0 +1,156 @@
+package transpile
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const testScript = `
+local n = ...
+local function fib(k) if k < 2 then return k end return fib(k - 1) + fib(k - 2) end
+local t = {}
+for i = 1, n do t[#t + 1] = fib(i) end
+local keys = {}
+for k, v in pairs({a = 1, b = 2}) do keys[#keys + 1] = k .. "=" .. v end
+table.sort(keys)
+local sum = 0
+for _, v in ipairs(t) do sum = sum + v end
+local i = 0
+while true do
+  i = i + 1
+  if i >= 3 then break end
+end
+repeat i = i - 1 until i == 0
+local function counter()
+  local c = 0
+  return function() c = c + 1 return c end
+end
+local next_id = counter()
+next_id()
+local function pack(...) return select("#", ...), ... end
+local count, first = pack("x", nil, 3)
+local v = setmetatable({}, {__add = function(a, b) return 100 end, __index = function(_, k) return k .. "!" end})
+local obj = {name = "o"}
+function obj:greet(s) return s .. ", " .. self.name end
+return sum, table.concat(t, " "), table.concat(keys, " "), next_id(), count, first,
+  v + 1, v.key, obj:greet("hi"), (nil or "d"), (1 < 2 and "lt" or "ge"), -n % 3, ("abc"):upper()
+`
+
+func TestSource(t *testing.T) {
+	out, err := Source([]byte(testScript), "script.lua", Options{Package: "scripts", Func: "Script"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"// Code generated from script.lua by gopher-lua/transpile. DO NOT EDIT.",
+		"package scripts",
+		"func Script(L *lua.LState) int {",
+	} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("the source does not contain %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"goto done", "<string>:1: goto statements are not supported"},
+		{"\n::done::", "<string>:2: labels are not supported"},
+		{"local x <close> = nil", "to-be-closed variables are not supported"},
+		{"local function f() return ... end", "cannot use '...' outside a vararg function"},
+		{"local x = = 1", "<string>"},
+	}
+	for _, c := range cases {
+		_, err := Source([]byte(c.src), "<string>", Options{Package: "p", Func: "F"})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want %q", c.src, err, c.want)
+		}
+	}
+}
+
+// TestRun builds the Go source of the script and compares its results with the
+// results of the script run by the VM.
+func TestRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building the generated source takes time")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go is not found")
+	}
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	fn, lerr := L.LoadString(testScript)
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	L.Push(fn)
+	L.Push(lua.LNumber(10))
+	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for i := 1; i <= L.GetTop(); i++ {
+		want.WriteString(L.Get(i).String() + "\n")
+	}
+
+	out, err := Source([]byte(testScript), "script.lua", Options{Package: "main", Func: "Script"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"script.go": string(out),
+		"main.go": `package main
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func main() {
+	L := lua.NewState()
+	defer L.Close()
+	L.Push(L.NewFunction(Script))
+	L.Push(lua.LNumber(10))
+	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i := 1; i <= L.GetTop(); i++ {
+		fmt.Println(L.Get(i).String())
+	}
+}
+`,
+		"go.mod": "module transpiled\n\ngo 1.24\n\nrequire github.com/yuin/gopher-lua v0.0.0\n\nreplace github.com/yuin/gopher-lua => " + root + "\n",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(gobin, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+	got, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, got)
+	}
+	if string(got) != want.String() {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want.String())
+	}
+}
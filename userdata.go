@@ -0,0 +1,52 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// NewTypedUserData returns userdata holding v with the metatable. mt may be
+// nil.
+func NewTypedUserData[T any](ls *LState, v T, mt *LTable) *LUserData {
+	ud := ls.NewUserData()
+	ud.Value = v
+	if mt != nil {
+		ud.Metatable = mt
+	}
+	return ud
+}
+
+// ToUserDataValue returns the value of type T held by the userdata. ok is false
+// if lv is not userdata or holds a value of another type.
+func ToUserDataValue[T any](lv LValue) (v T, ok bool) {
+	if ud, isud := lv.(*LUserData); isud {
+		v, ok = ud.Value.(T)
+	}
+	return v, ok
+}
+
+// CheckUserDataValue returns the value of type T held by the userdata at the
+// given stack index, and raises an argument error if the argument is not
+// userdata holding a value of type T.
+func CheckUserDataValue[T any](ls *LState, n int) T {
+	lv := ls.Get(n)
+	v, ok := ToUserDataValue[T](lv)
+	if !ok {
+		typ := reflect.TypeOf((*T)(nil)).Elem()
+		got := lv.Type().String()
+		if ud, isud := lv.(*LUserData); isud {
+			got = fmt.Sprintf("%T", ud.Value)
+		}
+		ls.ArgError(n, fmt.Sprintf("%v expected, got %v", typ, got))
+	}
+	return v
+}
+
+// OptUserDataValue is like CheckUserDataValue, but returns d if the argument
+// is nil or none.
+func OptUserDataValue[T any](ls *LState, n int, d T) T {
+	if ls.Get(n) == LNil {
+		return d
+	}
+	return CheckUserDataValue[T](ls, n)
+}
@@ -0,0 +1,53 @@
+package lua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTypedUserData(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	mt := L.NewTypeMetatable("point")
+	L.SetField(mt, "__index", L.RegisterModuleToTable(L.NewTable(), map[string]LGFunction{
+		"x": func(L *LState) int {
+			p := CheckUserDataValue[*testPoint](L, 1)
+			L.Push(LNumber(p.X))
+			return 1
+		},
+		"moved": func(L *LState) int {
+			p := OptUserDataValue(L, 2, &testPoint{})
+			L.Push(LNumber(p.X))
+			return 1
+		},
+	}))
+	p := &testPoint{X: 1, Y: 2}
+	L.SetGlobal("p", NewTypedUserData(L, p, mt))
+	L.SetGlobal("other", NewTypedUserData(L, "other", nil))
+	err := L.DoString(`
+	assert(p:x() == 1)
+	assert(p:moved() == 0 and p:moved(p) == 1)
+	assert(getmetatable(other) == nil)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = L.DoString(`p.x(other)`)
+	if err == nil || !strings.Contains(err.Error(), "*lua.testPoint expected, got string") {
+		t.Errorf("got %v, want an argument error", err)
+	}
+	err = L.DoString(`p.x(1)`)
+	if err == nil || !strings.Contains(err.Error(), "*lua.testPoint expected, got number") {
+		t.Errorf("got %v, want an argument error", err)
+	}
+
+	if v, ok := ToUserDataValue[*testPoint](L.GetGlobal("p")); !ok || v != p {
+		t.Errorf("got %v, %v, want the point", v, ok)
+	}
+	if _, ok := ToUserDataValue[*testPoint](L.GetGlobal("other")); ok {
+		t.Error("got true for a value of another type")
+	}
+	if _, ok := ToUserDataValue[*testPoint](LNumber(1)); ok {
+		t.Error("got true for a number")
+	}
+}
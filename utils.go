@@ -102,35 +102,134 @@ func (fs *flagScanner) Next() (byte, bool) {
 	return c, false
 }
 
-var cDateFlagToGo = map[byte]string{
-	'a': "mon", 'A': "Monday", 'b': "Jan", 'B': "January", 'c': "02 Jan 06 15:04 MST", 'd': "02",
-	'F': "2006-01-02", 'H': "15", 'I': "03", 'm': "01", 'M': "04", 'p': "PM", 'P': "pm", 'S': "05",
-	'y': "06", 'Y': "2006", 'z': "-0700", 'Z': "MST"}
+var (
+	strftimeWeekdays = [...]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+	strftimeMonths   = [...]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+)
 
-func strftime(t time.Time, cfmt string) string {
-	sc := newFlagScanner('%', "", "", cfmt)
-	for c, eos := sc.Next(); !eos; c, eos = sc.Next() {
-		if !sc.ChangeFlag {
-			if sc.HasFlag {
-				if v, ok := cDateFlagToGo[c]; ok {
-					sc.AppendString(t.Format(v))
-				} else {
-					switch c {
-					case 'w':
-						sc.AppendString(fmt.Sprint(int(t.Weekday())))
-					default:
-						sc.AppendChar('%')
-						sc.AppendChar(c)
-					}
-				}
-				sc.HasFlag = false
-			} else {
-				sc.AppendChar(c)
+// strftimeModified are the conversions that accept the E and O modifiers. The
+// modifiers do not change the results in the C locale.
+var strftimeModified = map[byte]string{
+	'E': "cCxXyY",
+	'O': "deHImMSuUVwWy",
+}
+
+// strftime formats the time like strftime of C in the C locale. It returns an
+// error for invalid conversion specifiers.
+func strftime(t time.Time, cfmt string) (string, error) {
+	buf := make([]byte, 0, len(cfmt)*2)
+	for i := 0; i < len(cfmt); i++ {
+		c := cfmt[i]
+		if c != '%' {
+			buf = append(buf, c)
+			continue
+		}
+		start := i
+		i++
+		if i < len(cfmt) && (cfmt[i] == 'E' || cfmt[i] == 'O') {
+			if i+1 >= len(cfmt) || !strings.ContainsRune(strftimeModified[cfmt[i]], rune(cfmt[i+1])) {
+				return "", fmt.Errorf("invalid conversion specifier '%v'", cfmt[start:intMin(i+2, len(cfmt))])
 			}
+			i++
+		}
+		if i >= len(cfmt) {
+			return "", fmt.Errorf("invalid conversion specifier '%v'", cfmt[start:])
+		}
+		var ok bool
+		if buf, ok = appendStrftime(buf, t, cfmt[i]); !ok {
+			return "", fmt.Errorf("invalid conversion specifier '%v'", cfmt[start:i+1])
 		}
 	}
+	return string(buf), nil
+}
 
-	return sc.String()
+func appendStrftime(buf []byte, t time.Time, c byte) ([]byte, bool) {
+	hour12 := t.Hour() % 12
+	if hour12 == 0 {
+		hour12 = 12
+	}
+	yday := t.YearDay() - 1
+	wday := int(t.Weekday())
+	switch c {
+	case 'a':
+		buf = append(buf, strftimeWeekdays[wday][:3]...)
+	case 'A':
+		buf = append(buf, strftimeWeekdays[wday]...)
+	case 'b', 'h':
+		buf = append(buf, strftimeMonths[t.Month()-1][:3]...)
+	case 'B':
+		buf = append(buf, strftimeMonths[t.Month()-1]...)
+	case 'c':
+		buf = fmt.Appendf(buf, "%s %s %2d %02d:%02d:%02d %d", strftimeWeekdays[wday][:3], strftimeMonths[t.Month()-1][:3], t.Day(), t.Hour(), t.Minute(), t.Second(), t.Year())
+	case 'C':
+		buf = fmt.Appendf(buf, "%02d", t.Year()/100)
+	case 'd':
+		buf = fmt.Appendf(buf, "%02d", t.Day())
+	case 'D', 'x':
+		buf = fmt.Appendf(buf, "%02d/%02d/%02d", int(t.Month()), t.Day(), t.Year()%100)
+	case 'e':
+		buf = fmt.Appendf(buf, "%2d", t.Day())
+	case 'F':
+		buf = fmt.Appendf(buf, "%d-%02d-%02d", t.Year(), int(t.Month()), t.Day())
+	case 'g':
+		year, _ := t.ISOWeek()
+		buf = fmt.Appendf(buf, "%02d", year%100)
+	case 'G':
+		year, _ := t.ISOWeek()
+		buf = fmt.Appendf(buf, "%d", year)
+	case 'H':
+		buf = fmt.Appendf(buf, "%02d", t.Hour())
+	case 'I':
+		buf = fmt.Appendf(buf, "%02d", hour12)
+	case 'j':
+		buf = fmt.Appendf(buf, "%03d", yday+1)
+	case 'm':
+		buf = fmt.Appendf(buf, "%02d", int(t.Month()))
+	case 'M':
+		buf = fmt.Appendf(buf, "%02d", t.Minute())
+	case 'n':
+		buf = append(buf, '\n')
+	case 'p':
+		if t.Hour() < 12 {
+			buf = append(buf, "AM"...)
+		} else {
+			buf = append(buf, "PM"...)
+		}
+	case 'r':
+		buf, _ = appendStrftime(fmt.Appendf(buf, "%02d:%02d:%02d ", hour12, t.Minute(), t.Second()), t, 'p')
+	case 'R':
+		buf = fmt.Appendf(buf, "%02d:%02d", t.Hour(), t.Minute())
+	case 'S':
+		buf = fmt.Appendf(buf, "%02d", t.Second())
+	case 't':
+		buf = append(buf, '\t')
+	case 'T', 'X':
+		buf = fmt.Appendf(buf, "%02d:%02d:%02d", t.Hour(), t.Minute(), t.Second())
+	case 'u':
+		buf = fmt.Appendf(buf, "%d", (wday+6)%7+1)
+	case 'U':
+		buf = fmt.Appendf(buf, "%02d", (yday+7-wday)/7)
+	case 'V':
+		_, week := t.ISOWeek()
+		buf = fmt.Appendf(buf, "%02d", week)
+	case 'w':
+		buf = fmt.Appendf(buf, "%d", wday)
+	case 'W':
+		buf = fmt.Appendf(buf, "%02d", (yday+7-(wday+6)%7)/7)
+	case 'y':
+		buf = fmt.Appendf(buf, "%02d", t.Year()%100)
+	case 'Y':
+		buf = fmt.Appendf(buf, "%d", t.Year())
+	case 'z':
+		buf = append(buf, t.Format("-0700")...)
+	case 'Z':
+		buf = append(buf, t.Format("MST")...)
+	case '%':
+		buf = append(buf, '%')
+	default:
+		return buf, false
+	}
+	return buf, true
 }
 
 func compileLuaTemplate(repl string) string {
@@ -161,11 +260,8 @@ func rRange(start, end byte, isnot bool) string {
 	return fmt.Sprintf(`\x%02x-\x%02x`, start, end)
 }
 
-func compileLuaRegex(pattern string) (*regexp.Regexp, error) {
-	if !LuaRegex {
-		return regexp.Compile(pattern)
-	}
-
+// translateLuaRegex translates the Lua pattern to a Go regexp and compiles it.
+func translateLuaRegex(pattern string) (*regexp.Regexp, error) {
 	b := make([]byte, 1)
 	sc := newFlagScanner('%', "", "", pattern)
 	inset := false
@@ -281,7 +377,8 @@ func parseNumber(number string) (LNumber, error) {
 	var value LNumber
 	number = strings.Trim(number, " \t\n")
 	if v, err := strconv.ParseInt(number, 0, LNumberBit); err != nil {
-		if v2, err2 := strconv.ParseFloat(number, LNumberBit); err2 != nil {
+		// numbers out of the range are infinities or zeros like strtod.
+		if v2, err2 := strconv.ParseFloat(number, LNumberBit); err2 != nil && !errors.Is(err2, strconv.ErrRange) {
 			return LNumber(0), err2
 		} else {
 			value = LNumber(v2)
@@ -314,17 +411,12 @@ func readBufioSize(reader *bufio.Reader, size int64) ([]byte, error, bool) {
 	return result, e, len(result) == 0 && err == io.EOF
 }
 
-func readBufioLine(reader *bufio.Reader) ([]byte, error, bool) {
-	result := []byte{}
-	var buf []byte
-	var err error
-	var isprefix bool = true
-	for isprefix {
-		buf, isprefix, err = reader.ReadLine()
-		if err != nil {
-			break
-		}
-		result = append(result, buf...)
+// readBufioLine reads a line. The newline is kept in the line unless chop is
+// true.
+func readBufioLine(reader *bufio.Reader, chop bool) ([]byte, error, bool) {
+	result, err := reader.ReadBytes('\n')
+	if chop && len(result) > 0 && result[len(result)-1] == '\n' {
+		result = result[:len(result)-1]
 	}
 	e := err
 	if e != nil && e == io.EOF {
@@ -334,6 +426,66 @@ func readBufioLine(reader *bufio.Reader) ([]byte, error, bool) {
 	return result, e, len(result) == 0 && err == io.EOF
 }
 
+// readBufioNumber reads the longest prefix of a numeral after skipping
+// whitespace, like Lua 5.3 does. The prefix may not be a valid number.
+func readBufioNumber(reader *bufio.Reader) (string, error) {
+	var err error
+	for {
+		var c byte
+		if c, err = reader.ReadByte(); err != nil {
+			break
+		}
+		if !strings.ContainsRune(" \t\n\v\f\r", rune(c)) {
+			reader.UnreadByte()
+			break
+		}
+	}
+	buf := []byte{}
+	accept := func(chars string) bool {
+		if err != nil {
+			return false
+		}
+		var c byte
+		if c, err = reader.ReadByte(); err != nil {
+			return false
+		}
+		if strings.IndexByte(chars, c) < 0 {
+			reader.UnreadByte()
+			return false
+		}
+		buf = append(buf, c)
+		return true
+	}
+	const decimal = "0123456789"
+	digits, exponent := decimal, "eE"
+	count := 0
+	accept("+-")
+	if accept("0") {
+		if accept("xX") {
+			digits, exponent = "0123456789abcdefABCDEF", "pP"
+		} else {
+			count++
+		}
+	}
+	for accept(digits) {
+		count++
+	}
+	if accept(".") {
+		for accept(digits) {
+			count++
+		}
+	}
+	if count > 0 && accept(exponent) {
+		accept("+-")
+		for accept(decimal) {
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return string(buf), err
+}
+
 func int2Fb(val int) int {
 	e := 0
 	x := val
@@ -1,8 +1,17 @@
 package lua
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"weak"
 )
 
 type LValueType int
@@ -33,7 +42,7 @@ func LVIsFalse(v LValue) bool { return v == LNil || v == LFalse }
 func LVAsBool(v LValue) bool  { return v != LNil && v != LFalse }
 func LVAsString(v LValue) string {
 	switch sn := v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return sn.String()
 	default:
 		return ""
@@ -42,7 +51,7 @@ func LVAsString(v LValue) string {
 
 func LVCanConvToString(v LValue) bool {
 	switch v.(type) {
-	case LString, LNumber:
+	case LString, LNumber, LInteger:
 		return true
 	default:
 		return false
@@ -53,6 +62,8 @@ func LVAsNumber(v LValue) LNumber {
 	switch lv := v.(type) {
 	case LNumber:
 		return lv
+	case LInteger:
+		return LNumber(lv)
 	case LString:
 		if num, err := parseNumber(string(lv)); err == nil {
 			return num
@@ -100,11 +111,33 @@ func (st LString) Format(f fmt.State, c rune) {
 	}
 }
 
+// String formats the number like "%.14g" of Lua 5.1, so integral numbers look
+// like integers and results of float arithmetic are rounded to 14 significant
+// digits. If Lua53Integer is enabled, ".0" is appended to numbers that look
+// like integers like Lua 5.3, so they are told from LInteger.
 func (nm LNumber) String() string {
-	if isInteger(nm) {
-		return fmt.Sprint(int64(nm))
+	f := float64(nm)
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		if math.Signbit(f) {
+			return "-nan"
+		}
+		return "nan"
+	case math.Abs(f) < 1e14 && isInteger(nm) && (f != 0 || !math.Signbit(f)):
+		if Lua53Integer {
+			return strconv.FormatInt(int64(f), 10) + ".0"
+		}
+		return strconv.FormatInt(int64(f), 10)
 	}
-	return fmt.Sprint(float64(nm))
+	s := strconv.FormatFloat(f, 'g', 14, 64)
+	if Lua53Integer && !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
 }
 
 func (nm LNumber) Type() LValueType { return LTNumber }
@@ -136,6 +169,18 @@ type LTable struct {
 	dict  map[LValue]LValue
 	keys  []LValue
 	k2i   map[LValue]int
+	// order and orderIndex hold the keys of the hash part in insertion order
+	// if the table is ordered. orderIndex is nil otherwise.
+	order      []LValue
+	orderIndex map[LValue]int
+
+	weak     uint8
+	weakSets int
+	gcMarked bool
+	frozen   bool
+	// version is incremented when the hash part is modified, invalidating the
+	// inline caches of the values of the table.
+	version uint32
 }
 
 func (tb *LTable) String() string   { return fmt.Sprintf("table: %p", tb) }
@@ -162,6 +207,49 @@ type Global struct {
 	builtinMts map[int]LValue
 	tempFiles  []*os.File
 	gccount    int32
+	gcStopped  bool
+	gcPause    int
+	gcStepMul  int
+
+	finalizers          finalizerQueue
+	gcRunningFinalizers bool
+
+	options     Options
+	memLimit    int
+	memEstimate int
+	// memMeasured is memEstimate just after the last measurement of the
+	// reachable objects(see LState.allocate).
+	memMeasured int
+	allocStats  AllocStats
+
+	instCount        int64
+	instLimit        int64
+	instHook         func(*LState)
+	instHookInterval int64
+	// instrumented is true if any of instLimit, instHook, profiler, coverage
+	// and debugger is set(see updateInstrumented).
+	instrumented bool
+
+	profiler *profiler
+	coverage *coverageRecorder
+	debugger *debugger
+
+	goTypes            map[reflect.Type]*goType
+	transferConverters map[reflect.Type]TransferConverter
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	rand      *rand.Rand
+	startedAt time.Time
+
+	strings    stringInterner
+	fieldCache *fieldCache
+	threads    threadPool
+	// coroutines are the coroutines created by the states, whose call stacks
+	// are checked by ReloadModule. They are not kept alive by the list.
+	coroutines []weak.Pointer[LState]
 }
 
 type LState struct {
@@ -177,6 +265,11 @@ type LState struct {
 	currentFrame *callFrame
 	wrapped      bool
 	uvcache      *Upvalue
+	ctx          context.Context
+	ctxWatch     *contextWatch
+	hook         *hookState
+	errorObject  LValue
+	tbcs         []tbcVariable
 }
 
 func (ls *LState) String() string   { return fmt.Sprintf("thread: %p", ls) }
@@ -186,6 +279,8 @@ type LUserData struct {
 	Value     interface{}
 	Env       *LTable
 	Metatable LValue
+
+	gcMarked bool
 }
 
 func (ud *LUserData) String() string   { return fmt.Sprintf("userdata: %p", ud) }
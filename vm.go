@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"strings"
+	"sync/atomic"
 )
 
 func copyReturnValues(L *LState, reg, start, n, b int) {
@@ -35,12 +36,23 @@ func switchToParentThread(L *LState, nargs int, haserror bool, kill bool) {
 	L.reg.SetTop(L.reg.Top() - offset) // remove 'yield' function(including tailcalled functions)
 	if kill {
 		L.kill()
+		if !haserror {
+			// the stacks of threads that died with errors are kept for
+			// debug.traceback.
+			L.releaseStacks()
+		}
 	}
 }
 
 func callGFunction(L *LState, tailcall bool) bool {
 	frame := L.currentFrame
+	if L.hook != nil && L.hook.mask&HookCall != 0 {
+		L.callHook(HookCall, -1)
+	}
 	gfnret := frame.Fn.GFunction(L)
+	if gfnret >= 0 && L.hook != nil && L.hook.mask&HookReturn != 0 {
+		L.callHook(HookReturn, -1)
+	}
 	if tailcall {
 		L.stack.Remove(L.stack.Sp() - 2) // remove caller lua function frame
 		L.currentFrame = L.stack.Last()
@@ -67,6 +79,104 @@ func callGFunction(L *LState, tailcall bool) bool {
 	return false
 }
 
+func countInstruction(L *LState) {
+	g := L.G
+	g.instCount++
+	if g.instLimit > 0 && g.instCount > g.instLimit {
+		L.RaiseError("instruction limit exceeded")
+	}
+	if g.instHook != nil && g.instCount%g.instHookInterval == 0 {
+		g.instHook(L)
+	}
+}
+
+// updateInstrumented records whether the VM has to count, sample or check the
+// instructions it runs.
+func (g *Global) updateInstrumented() {
+	g.instrumented = g.instLimit > 0 || g.instHook != nil || g.profiler != nil || g.coverage != nil || g.debugger != nil
+}
+
+// instrumentInstruction is called before the instruction at cf.Pc-1 runs if the
+// context of the state may be done, the state has a hook, or the instructions
+// are instrumented.
+func instrumentInstruction(L *LState, cf *callFrame) {
+	if L.contextChecked() {
+		select {
+		case <-L.ctx.Done():
+			L.RaiseError("%v", L.ctx.Err())
+		default:
+		}
+	}
+	g := L.G
+	if g.instLimit > 0 || g.instHook != nil {
+		countInstruction(L)
+	}
+	if g.profiler != nil && atomic.LoadInt32(&g.profiler.ticks) > 0 {
+		g.profiler.sample(L)
+	}
+	if g.coverage != nil {
+		g.coverage.hit(cf)
+	}
+	if g.debugger != nil && g.debugger.active {
+		g.debugger.check(L, cf)
+	}
+	if L.hook != nil {
+		traceExec(L, cf)
+	}
+}
+
+// fuseJump runs the JMP that follows a comparison or a test that did not skip
+// it, without dispatching it separately. The JMP is dispatched as usual if it
+// closes upvalues or instructions are instrumented, so hooks see it.
+func fuseJump(L *LState, cf *callFrame) {
+	if L.hook != nil || L.G.instrumented {
+		return
+	}
+	inst := cf.Fn.Proto.Code[cf.Pc]
+	if int(inst>>26) != OP_JMP || int(inst>>18)&0xff != 0 {
+		return
+	}
+	cf.Pc += 1 + int(inst&0x3ffff) - opMaxArgSbx
+}
+
+// hookLuaCall calls the call hook when a Lua function starts. Calls of Go
+// functions are hooked by callGFunction.
+func hookLuaCall(L *LState) {
+	if L.hook != nil && L.hook.mask&HookCall != 0 {
+		L.callHook(HookCall, -1)
+	}
+}
+
+func traceExec(L *LState, cf *callFrame) {
+	h := L.hook
+	if h.running {
+		return
+	}
+	pc := cf.Pc - 1
+	if h.mask&HookCount != 0 {
+		h.counter--
+		if h.counter <= 0 {
+			h.counter = h.count
+			L.callHook(HookCount, -1)
+			if h = L.hook; h == nil {
+				return
+			}
+		}
+	}
+	if h.mask&HookLine != 0 {
+		oldpc := h.lastPc
+		if cf != h.lastFrame {
+			oldpc = pc - 1
+		}
+		h.lastPc = pc
+		h.lastFrame = cf
+		positions := cf.Fn.Proto.DbgSourcePositions
+		if pc == 0 || pc <= oldpc || positions[pc] != positions[oldpc] {
+			L.callHook(HookLine, positions[pc])
+		}
+	}
+}
+
 func threadRun(L *LState) {
 	if L.stack.IsEmpty() {
 		return
@@ -86,6 +196,7 @@ func threadRun(L *LState) {
 					L.Push(lv)
 					parent.Panic(L)
 				} else {
+					L.errorObject = lv
 					L.SetTop(0)
 					L.Push(lv)
 					switchToParentThread(L, 1, true, true)
@@ -95,6 +206,10 @@ func threadRun(L *LState) {
 			}
 		}
 	}()
+	if cf := L.currentFrame; cf != nil && !cf.Fn.IsG && cf.Pc == 0 {
+		// the thread starts, resumed threads are in the middle of calls.
+		hookLuaCall(L)
+	}
 	mainLoop(L, nil)
 }
 
@@ -116,8 +231,18 @@ func mainLoop(L *LState, startframe *callFrame) {
 	reg := L.reg
 	for {
 		cf = L.currentFrame
+		if spec := cf.Fn.Proto.specialized.Load(); spec != nil {
+			if !L.contextChecked() && L.hook == nil && !L.G.instrumented {
+				spec.run(L, cf)
+			}
+		} else if L.G.options.SpecializeThreshold > 0 {
+			L.countExecution(cf.Fn.Proto)
+		}
 		inst = cf.Fn.Proto.Code[cf.Pc]
 		cf.Pc++
+		if L.contextChecked() || L.hook != nil || L.G.instrumented {
+			instrumentInstruction(L, cf)
+		}
 		lbase = cf.LocalBase
 		opcode := int(inst >> 26) //GETOPCODE
 		A = int(inst>>18) & 0xff  //GETA
@@ -151,17 +276,33 @@ func mainLoop(L *LState, startframe *callFrame) {
 			reg.Set(RA, cf.Fn.Upvalues[B].Value())
 		case OP_GETGLOBAL:
 			Bx = int(inst & 0x3ffff) //GETBX
-			reg.Set(RA, L.getField(cf.Fn.Env, cf.Fn.Proto.Constants[Bx]))
+			reg.Set(RA, L.getFieldCached(&cf.Fn.Proto.Code[cf.Pc-1], cf.Fn.Env, cf.Fn.Proto.Constants[Bx]))
 		case OP_GETTABLE:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
-			reg.Set(RA, L.getField(reg.Get(lbase+B), L.rkValue(C)))
+			if opIsK(C) {
+				reg.Set(RA, L.getFieldCached(&cf.Fn.Proto.Code[cf.Pc-1], reg.Get(lbase+B), L.rkValue(C)))
+			} else {
+				reg.Set(RA, L.getField(reg.Get(lbase+B), L.rkValue(C)))
+			}
 		case OP_SETGLOBAL:
 			Bx = int(inst & 0x3ffff) //GETBX
 			L.setField(cf.Fn.Env, cf.Fn.Proto.Constants[Bx], reg.Get(RA))
 		case OP_SETUPVAL:
 			B = int(inst & 0x1ff) //GETB
 			cf.Fn.Upvalues[B].SetValue(reg.Get(RA))
+		case OP_GETTABUP:
+			B = int(inst & 0x1ff)    //GETB
+			C = int(inst>>9) & 0x1ff //GETC
+			if opIsK(C) {
+				reg.Set(RA, L.getFieldCached(&cf.Fn.Proto.Code[cf.Pc-1], cf.Fn.Upvalues[B].Value(), L.rkValue(C)))
+			} else {
+				reg.Set(RA, L.getField(cf.Fn.Upvalues[B].Value(), L.rkValue(C)))
+			}
+		case OP_SETTABUP:
+			B = int(inst & 0x1ff)    //GETB
+			C = int(inst>>9) & 0x1ff //GETC
+			L.setField(cf.Fn.Upvalues[A].Value(), L.rkValue(B), L.rkValue(C))
 		case OP_SETTABLE:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
@@ -169,14 +310,39 @@ func mainLoop(L *LState, startframe *callFrame) {
 		case OP_NEWTABLE:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
-			reg.Set(RA, newLTable(B, C))
+			reg.Set(RA, L.allocateTable(B, C))
 		case OP_SELF:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
 			selfobj := reg.Get(lbase + B)
-			reg.Set(RA, L.getField(selfobj, L.rkValue(C)))
+			if opIsK(C) {
+				reg.Set(RA, L.getFieldCached(&cf.Fn.Proto.Code[cf.Pc-1], selfobj, L.rkValue(C)))
+			} else {
+				reg.Set(RA, L.getField(selfobj, L.rkValue(C)))
+			}
 			reg.Set(RA+1, selfobj)
-		case OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW:
+		case OP_ADD, OP_SUB, OP_MUL:
+			B = int(inst & 0x1ff)    //GETB
+			C = int(inst>>9) & 0x1ff //GETC
+			lhs := L.rkValue(B)
+			rhs := L.rkValue(C)
+			v1, ok1 := lhs.(LNumber)
+			v2, ok2 := rhs.(LNumber)
+			if ok1 && ok2 && !Lua53Integer {
+				// the most common operations are run without calling numberArith.
+				switch opcode {
+				case OP_ADD:
+					reg.Set(RA, v1+v2)
+				case OP_SUB:
+					reg.Set(RA, v1-v2)
+				default:
+					reg.Set(RA, v1*v2)
+				}
+			} else {
+				reg.Set(RA, objectArith(L, opcode, lhs, rhs))
+			}
+		case OP_DIV, OP_MOD, OP_POW,
+			OP_IDIV, OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
 			lhs := L.rkValue(B)
@@ -184,7 +350,7 @@ func mainLoop(L *LState, startframe *callFrame) {
 			var ret LValue
 			v1, ok1 := lhs.(LNumber)
 			v2, ok2 := rhs.(LNumber)
-			if ok1 && ok2 {
+			if ok1 && ok2 && !Lua53Integer {
 				ret = numberArith(L, opcode, v1, v2)
 			} else {
 				ret = objectArith(L, opcode, lhs, rhs)
@@ -196,21 +362,15 @@ func mainLoop(L *LState, startframe *callFrame) {
 			if nm, ok := unaryv.(LNumber); ok {
 				reg.Set(RA, LNumber(-nm))
 			} else {
-				op := L.metaOp1(unaryv, "__unm")
-				if op.Type() == LTFunction {
-					reg.Push(op)
-					reg.Push(unaryv)
-					L.Call(1, 1)
-					reg.Set(RA, reg.Pop())
-				} else if str, ok1 := unaryv.(LString); ok1 {
-					if num, err := parseNumber(string(str)); err == nil {
-						reg.Set(RA, -num)
-					} else {
-						L.RaiseError("__unm undefined")
-					}
-				} else {
-					L.RaiseError("__unm undefined")
-				}
+				reg.Set(RA, objectUnaryMinus(L, unaryv))
+			}
+		case OP_BNOT:
+			B = int(inst & 0x1ff) //GETB
+			unaryv := reg.Get(lbase + B)
+			if nm, ok := unaryv.(LNumber); ok && !Lua53Integer {
+				reg.Set(RA, numberArith(L, opcode, nm, nm))
+			} else {
+				reg.Set(RA, objectArith(L, opcode, unaryv, unaryv))
 			}
 		case OP_NOT:
 			B = int(inst & 0x1ff) //GETB
@@ -221,22 +381,7 @@ func mainLoop(L *LState, startframe *callFrame) {
 			}
 		case OP_LEN:
 			B = int(inst & 0x1ff) //GETB
-			switch lv := L.rkValue(B).(type) {
-			case LString:
-				reg.Set(RA, LNumber(len(lv)))
-			case *LTable:
-				reg.Set(RA, LNumber(lv.Len()))
-			default:
-				op := L.metaOp1(lv, "__len")
-				if op.Type() == LTFunction {
-					reg.Push(op)
-					reg.Push(lv)
-					L.Call(1, 1)
-					reg.Set(RA, reg.Pop())
-				} else {
-					L.RaiseError("__len undefined")
-				}
-			}
+			reg.Set(RA, objectLength(L, L.rkValue(B)))
 		case OP_CONCAT:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
@@ -244,6 +389,12 @@ func mainLoop(L *LState, startframe *callFrame) {
 			RB := lbase + B
 			reg.Set(RA, stringConcat(L, RC-RB+1, RC))
 		case OP_JMP:
+			if A != 0 {
+				L.closeUpvalues(RA - 1)
+				if len(L.tbcs) > 0 {
+					L.closeToBeClosed(RA-1, LNil)
+				}
+			}
 			Sbx = int(inst&0x3ffff) - opMaxArgSbx //GETSBX
 			cf.Pc += Sbx
 		case OP_EQ:
@@ -256,6 +407,8 @@ func mainLoop(L *LState, startframe *callFrame) {
 			}
 			if v == A {
 				cf.Pc++
+			} else {
+				fuseJump(L, cf)
 			}
 		case OP_LT:
 			B = int(inst & 0x1ff)    //GETB
@@ -267,50 +420,28 @@ func mainLoop(L *LState, startframe *callFrame) {
 			}
 			if v == A {
 				cf.Pc++
+			} else {
+				fuseJump(L, cf)
 			}
 		case OP_LE:
 			B = int(inst & 0x1ff)    //GETB
 			C = int(inst>>9) & 0x1ff //GETC
-			lhs := L.rkValue(B)
-			rhs := L.rkValue(C)
-			ret := false
-
-			if v1, ok1 := lhs.(LNumber); ok1 {
-				if v2, ok2 := rhs.(LNumber); ok2 {
-					ret = v1 <= v2
-				} else {
-					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
-				}
-			} else {
-				if lhs.Type() != rhs.Type() {
-					L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
-				}
-				switch lhs.Type() {
-				case LTString:
-					ret = strCmp(string(lhs.(LString)), string(rhs.(LString))) <= 0
-				default:
-					switch objectRational(L, lhs, rhs, "__le") {
-					case 1:
-						ret = true
-					case 0:
-						ret = false
-					default:
-						ret = !objectRationalWithError(L, rhs, lhs, "__lt")
-					}
-				}
-			}
-
+			ret := lessEqual(L, L.rkValue(B), L.rkValue(C))
 			v := 1
 			if ret {
 				v = 0
 			}
 			if v == A {
 				cf.Pc++
+			} else {
+				fuseJump(L, cf)
 			}
 		case OP_TEST:
 			C = int(inst>>9) & 0x1ff //GETC
 			if LVAsBool(reg.Get(RA)) == (C == 0) {
 				cf.Pc++
+			} else {
+				fuseJump(L, cf)
 			}
 		case OP_TESTSET:
 			B = int(inst & 0x1ff)    //GETB
@@ -355,6 +486,9 @@ func mainLoop(L *LState, startframe *callFrame) {
 			}
 			fn := reg.Get(RA)
 			callable, meta := L.metaCall(fn)
+			if callable == nil {
+				L.RaiseError("attempt to call a non-function object")
+			}
 			L.closeUpvalues(lbase)
 			if callable.IsG {
 				luaframe := cf
@@ -394,20 +528,30 @@ func mainLoop(L *LState, startframe *callFrame) {
 				L.reg.CopyRange(base, RA, -1, reg.Top()-RA-1)
 				cf.Base = base
 				cf.LocalBase = base + (cf.LocalBase - lbase + 1)
+				hookLuaCall(L)
 			}
 		case OP_RETURN:
 			B = int(inst & 0x1ff) //GETB
+			if L.hook != nil && L.hook.mask&HookReturn != 0 {
+				L.callHook(HookReturn, -1)
+			}
 			L.closeUpvalues(lbase)
 			nret := B - 1
 			if B == 0 {
 				nret = reg.Top() - RA
 			}
+			if ntbc := len(L.tbcs); ntbc > 0 && L.tbcs[ntbc-1].index >= lbase {
+				// __close metamethods must not overwrite the return values
+				reg.SetTop(RA + nret)
+				L.closeToBeClosed(lbase, LNil)
+				reg.SetTop(RA + nret)
+			}
 			n := cf.NRet
 			if cf.NRet == MultRet {
 				n = nret
 			}
 
-			if L.Parent != nil && (startframe == cf || L.stack.Sp() == 1) {
+			if L.Parent != nil && L.stack.Sp() == 1 {
 				copyReturnValues(L, reg.Top(), RA, n, B)
 				switchToParentThread(L, n, false, true)
 				return
@@ -420,6 +564,27 @@ func mainLoop(L *LState, startframe *callFrame) {
 			}
 		case OP_FORPREP:
 			Sbx = int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+			if Lua53Integer {
+				init, ok1 := reg.Get(RA).(LInteger)
+				step, ok2 := reg.Get(RA + 2).(LInteger)
+				if ok1 && ok2 {
+					if count, ok := forPrepInteger(L, init, step, reg.Get(RA+1)); ok {
+						// enter the loop body without FORLOOP
+						reg.Set(RA, init)
+						reg.Set(RA+1, count)
+						reg.Set(RA+3, init)
+					} else {
+						reg.SetTop(RA + 1)
+						cf.Pc += Sbx + 1
+					}
+					break
+				}
+				for i := RA; i < RA+3; i++ {
+					if v, ok := reg.Get(i).(LInteger); ok {
+						reg.Set(i, LNumber(v))
+					}
+				}
+			}
 			if init, ok1 := reg.Get(RA).(LNumber); ok1 {
 				if step, ok2 := reg.Get(RA + 2).(LNumber); ok2 {
 					reg.Set(RA, LNumber(init-step))
@@ -435,11 +600,13 @@ func mainLoop(L *LState, startframe *callFrame) {
 				if limit, ok2 := reg.Get(RA + 1).(LNumber); ok2 {
 					if step, ok3 := reg.Get(RA + 2).(LNumber); ok3 {
 						init += step
-						reg.Set(RA, LNumber(init))
+						// the index is boxed once for both registers.
+						index := LValue(init)
+						reg.Set(RA, index)
 						if (step > 0 && init <= limit) || (step <= 0 && init >= limit) {
 							Sbx = int(inst&0x3ffff) - opMaxArgSbx //GETSBX
 							cf.Pc += Sbx
-							reg.Set(RA+3, LNumber(init))
+							reg.Set(RA+3, index)
 						} else {
 							reg.SetTop(RA + 1)
 						}
@@ -449,6 +616,18 @@ func mainLoop(L *LState, startframe *callFrame) {
 				} else {
 					L.RaiseError("for statement limit must be a number")
 				}
+			} else if init, ok := reg.Get(RA).(LInteger); ok {
+				if count := reg.Get(RA + 1).(LInteger); count > 0 {
+					init += reg.Get(RA + 2).(LInteger)
+					index := LValue(init)
+					reg.Set(RA, index)
+					reg.Set(RA+1, count-1)
+					Sbx = int(inst&0x3ffff) - opMaxArgSbx //GETSBX
+					cf.Pc += Sbx
+					reg.Set(RA+3, index)
+				} else {
+					reg.SetTop(RA + 1)
+				}
 			} else {
 				L.RaiseError("for statement init must be a number")
 			}
@@ -471,19 +650,27 @@ func mainLoop(L *LState, startframe *callFrame) {
 				cf.Pc++
 			}
 			offset := (C - 1) * FieldsPerFlush
-			table := reg.Get(RA).(*LTable)
+			table, ok := reg.Get(RA).(*LTable)
+			if !ok {
+				L.RaiseError("SETLIST to a non-table object")
+			}
 			nelem := B
 			if B == 0 {
 				nelem = reg.Top() - RA - 1
 			}
+			L.allocate(LTTable, nelem*memArraySlotSize)
 			for i := 1; i <= nelem; i++ {
 				table.RawSetInt(offset+i, reg.Get(RA+i))
 			}
 		case OP_CLOSE:
 			L.closeUpvalues(RA)
+			if len(L.tbcs) > 0 {
+				L.closeToBeClosed(RA, LNil)
+			}
 		case OP_CLOSURE:
 			Bx = int(inst & 0x3ffff) //GETBX
 			proto := cf.Fn.Proto.FunctionPrototypes[Bx]
+			L.allocateObject(LTFunction, memFunctionSize+int(proto.NumUpvalues)*memUpvalueSize)
 			closure := newLFunctionL(proto, cf.Fn.Env, int(proto.NumUpvalues))
 			reg.Set(RA, closure)
 			for i := 0; i < int(proto.NumUpvalues); i++ {
@@ -509,6 +696,8 @@ func mainLoop(L *LState, startframe *callFrame) {
 				nwant = nvarargs
 			}
 			reg.CopyRange(RA, cf.Base+nparams+1, cf.LocalBase, nwant)
+		case OP_TBC:
+			L.markToBeClosed(RA)
 		case OP_NOP:
 			/* nothing to do */
 		default:
@@ -527,8 +716,57 @@ func luaModulo(lhs, rhs LNumber) LNumber {
 	return LNumber(v)
 }
 
+func luaFloorDiv(lhs, rhs LNumber) LNumber {
+	return LNumber(math.Floor(float64(lhs) / float64(rhs)))
+}
+
+func lnumberToInt64(v LNumber) (int64, bool) {
+	f := float64(v)
+	if math.Floor(f) != f || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func luaShiftLeft(x, n int64) int64 {
+	switch {
+	case n <= -64 || n >= 64:
+		return 0
+	case n < 0:
+		return int64(uint64(x) >> uint(-n))
+	}
+	return int64(uint64(x) << uint(n))
+}
+
+func luaBitwise(opcode int, lhs, rhs int64) int64 {
+	switch opcode {
+	case OP_BAND:
+		return lhs & rhs
+	case OP_BOR:
+		return lhs | rhs
+	case OP_BXOR:
+		return lhs ^ rhs
+	case OP_SHL:
+		return luaShiftLeft(lhs, rhs)
+	case OP_SHR:
+		return luaShiftLeft(lhs, -rhs)
+	case OP_BNOT:
+		return ^lhs
+	}
+	panic("should not reach here")
+}
+
 func numberArith(L *LState, opcode int, lhs, rhs LNumber) LNumber {
 	switch opcode {
+	case OP_IDIV:
+		return luaFloorDiv(lhs, rhs)
+	case OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_BNOT:
+		ilhs, ok1 := lnumberToInt64(lhs)
+		irhs, ok2 := lnumberToInt64(rhs)
+		if !ok1 || !ok2 {
+			L.RaiseError("number has no integer representation")
+		}
+		return LNumber(luaBitwise(opcode, ilhs, irhs))
 	case OP_ADD:
 		return lhs + rhs
 	case OP_SUB:
@@ -563,6 +801,25 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		event = "__mod"
 	case OP_POW:
 		event = "__pow"
+	case OP_IDIV:
+		event = "__idiv"
+	case OP_BAND:
+		event = "__band"
+	case OP_BOR:
+		event = "__bor"
+	case OP_BXOR:
+		event = "__bxor"
+	case OP_SHL:
+		event = "__shl"
+	case OP_SHR:
+		event = "__shr"
+	case OP_BNOT:
+		event = "__bnot"
+	}
+	if Lua53Integer {
+		if ret, ok := arith53(L, opcode, lhs, rhs); ok {
+			return ret
+		}
 	}
 	op := L.metaOp2(lhs, rhs, event)
 	if op.Type() == LTFunction {
@@ -573,16 +830,20 @@ func objectArith(L *LState, opcode int, lhs, rhs LValue) LValue {
 		return L.reg.Pop()
 	}
 	if str, ok := lhs.(LString); ok {
-		if lnum, err := parseNumber(string(str)); err == nil {
+		if lnum, err := parseNumberValue(string(str)); err == nil {
 			lhs = lnum
 		}
 	}
 	if str, ok := rhs.(LString); ok {
-		if rnum, err := parseNumber(string(str)); err == nil {
+		if rnum, err := parseNumberValue(string(str)); err == nil {
 			rhs = rnum
 		}
 	}
-	if lhs.Type() == LTNumber && rhs.Type() == LTNumber {
+	if Lua53Integer {
+		if ret, ok := arith53(L, opcode, lhs, rhs); ok {
+			return ret
+		}
+	} else if lhs.Type() == LTNumber && rhs.Type() == LTNumber {
 		return numberArith(L, opcode, lhs.(LNumber), rhs.(LNumber))
 	}
 	L.RaiseError(fmt.Sprintf("cannot performs %v operation between %v and %v",
@@ -613,16 +874,19 @@ func stringConcat(L *LState, total, last int) LValue {
 		} else {
 			buf := make([]string, total+1)
 			buf[total] = LVAsString(rhs)
+			length := len(buf[total])
 			for total > 0 {
 				lhs = L.reg.Get(i)
 				if !LVCanConvToString(lhs) {
 					break
 				}
 				buf[total-1] = LVAsString(lhs)
+				length += len(buf[total-1])
 				i--
 				total--
 			}
-			rhs = LString(strings.Join(buf, ""))
+			L.allocateObject(LTString, memStringSize+length)
+			rhs = L.G.strings.concat(buf, length)
 		}
 	}
 	return rhs
@@ -634,7 +898,9 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 		if v2, ok2 := rhs.(LNumber); ok2 {
 			return v1 < v2
 		}
-		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
+	}
+	if c, ok := compareNumbers(lhs, rhs); ok {
+		return c == -1
 	}
 	if lhs.Type() != rhs.Type() {
 		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
@@ -650,6 +916,74 @@ func lessThan(L *LState, lhs, rhs LValue) bool {
 	return ret
 }
 
+func lessEqual(L *LState, lhs, rhs LValue) bool {
+	// optimization for numbers
+	if v1, ok1 := lhs.(LNumber); ok1 {
+		if v2, ok2 := rhs.(LNumber); ok2 {
+			return v1 <= v2
+		}
+	}
+	if c, ok := compareNumbers(lhs, rhs); ok {
+		return c == -1 || c == 0
+	}
+	if lhs.Type() != rhs.Type() {
+		L.RaiseError("attempt to compare %v with %v", lhs.Type().String(), rhs.Type().String())
+		return false
+	}
+	switch lhs.Type() {
+	case LTString:
+		return strCmp(string(lhs.(LString)), string(rhs.(LString))) <= 0
+	default:
+		switch objectRational(L, lhs, rhs, "__le") {
+		case 1:
+			return true
+		case 0:
+			return false
+		default:
+			return !objectRationalWithError(L, rhs, lhs, "__lt")
+		}
+	}
+}
+
+// objectUnaryMinus returns -v for values other than floats, calling the __unm
+// metamethod or converting strings to numbers.
+func objectUnaryMinus(L *LState, v LValue) LValue {
+	if iv, ok := v.(LInteger); ok {
+		return -iv
+	}
+	if op := L.metaOp1(v, "__unm"); op.Type() == LTFunction {
+		L.reg.Push(op)
+		L.reg.Push(v)
+		L.Call(1, 1)
+		return L.reg.Pop()
+	}
+	if str, ok := v.(LString); ok {
+		if num, err := parseNumberValue(string(str)); err == nil {
+			return unaryMinus(num)
+		}
+	}
+	L.RaiseError("__unm undefined")
+	return LNil
+}
+
+// objectLength returns #v, calling the __len metamethod.
+func objectLength(L *LState, v LValue) LValue {
+	if lv, ok := v.(LString); ok {
+		return integerValue(int64(len(lv)))
+	}
+	if op := L.metaOp1(v, "__len"); op.Type() == LTFunction {
+		L.reg.Push(op)
+		L.reg.Push(v)
+		L.Call(1, 1)
+		return L.reg.Pop()
+	}
+	if tb, ok := v.(*LTable); ok {
+		return integerValue(int64(tb.Len()))
+	}
+	L.RaiseError("__len undefined")
+	return LNil
+}
+
 func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	if lhs.Type() != rhs.Type() {
 		return false
@@ -660,7 +994,13 @@ func equals(L *LState, lhs, rhs LValue, raw bool) bool {
 	case LTNil:
 		ret = true
 	case LTNumber:
-		ret = float64(lhs.(LNumber)) == float64(rhs.(LNumber))
+		if v1, ok := lhs.(LNumber); ok {
+			if v2, ok := rhs.(LNumber); ok {
+				return float64(v1) == float64(v2)
+			}
+		}
+		c, _ := compareNumbers(lhs, rhs)
+		ret = c == 0
 	case LTBool:
 		ret = bool(lhs.(LBool)) == bool(rhs.(LBool))
 	case LTString:
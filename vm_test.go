@@ -0,0 +1,110 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestLenMetamethod(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local t = setmetatable({1, 2, 3, 4}, {__len = function(self) return 2 end})
+	assert(#t == 2)
+	assert(table.getn(t) == 2)
+	assert(table.concat(t, ",") == "1,2")
+	assert(select("#", unpack(t)) == 2)
+	assert(#setmetatable({1, 2}, {}) == 2)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailCall(t *testing.T) {
+	L := NewState(Options{CallStackSize: 100})
+	defer L.Close()
+	err := L.DoString(`
+	local function loop(n) if n == 0 then return "done" end return loop(n - 1) end
+	assert(loop(100000) == "done")
+
+	local function inner() return debug.traceback("tb") end
+	local function outer() return inner() end
+	local tb = outer()
+	assert(tb:find("%(%.%.%.tail calls%.%.%.%)"), tb)
+
+	-- the tail-called function is at level 1, its caller is not counted.
+	local function where() return debug.getinfo(2, "S").what end
+	local function tail() return where() end
+	assert(tail() == "main")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVMFusedJumps(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function classify(a, b)
+	  local r = {}
+	  if a == b then r[#r + 1] = "eq" end
+	  if a < b then r[#r + 1] = "lt" end
+	  if a <= b then r[#r + 1] = "le" end
+	  if a then r[#r + 1] = "t" end
+	  local c = a and b
+	  r[#r + 1] = tostring(c)
+	  return table.concat(r, " ")
+	end
+	assert(classify(1, 2) == "lt le t 2", classify(1, 2))
+	assert(classify(2, 2) == "eq le t 2")
+	assert(classify(3, 2) == "t 2")
+	assert(classify("a", "b") == "lt le t b")
+
+	local n = 0
+	for i = 1, 100 do
+	  if i % 2 == 0 then n = n + i * 2 - 1 end
+	end
+	assert(n == 5050, tostring(n))
+	-- operands with metamethods are not run inline.
+	local v = setmetatable({}, {__add = function(a, b) return "add" end, __sub = function() return "sub" end})
+	assert(v + 1 == "add" and 1 - v == "sub")
+	assert("10" + 1 == 11 and "3" * "4" == 12)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVMInstrumented(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	if L.G.instrumented {
+		t.Fatal("a new state must not be instrumented")
+	}
+	L.SetInstructionLimit(1000)
+	if !L.G.instrumented {
+		t.Error("SetInstructionLimit must instrument the state")
+	}
+	L.SetInstructionLimit(0)
+	L.SetInstructionHook(10, func(L *LState) {})
+	if !L.G.instrumented {
+		t.Error("SetInstructionHook must instrument the state")
+	}
+	L.SetInstructionHook(0, nil)
+	if L.G.instrumented {
+		t.Error("the state must not be instrumented after the limit and the hook are removed")
+	}
+
+	// the jumps after comparisons are not fused while a hook is set, so the
+	// hook sees their lines.
+	lines := 0
+	L.SetHook(func(L *LState, event HookEvent, line int) { lines++ }, HookLine, 0)
+	if err := L.DoString("local x = 1\nif x < 2 then\nx = 2\nend\nif x < 2 then\nx = 3\nend"); err != nil {
+		t.Fatal(err)
+	}
+	L.SetHook(nil, 0, 0)
+	if lines != 5 {
+		t.Errorf("got %v line events, want 5", lines)
+	}
+}
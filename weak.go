@@ -0,0 +1,196 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+	"weak"
+)
+
+const (
+	weakKeys uint8 = 1 << iota
+	weakValues
+)
+
+// lWeakRef is a weak reference to a collectable value. Weak tables hold their
+// keys and values as lWeakRefs, so the Go garbage collector can collect them.
+type lWeakRef struct {
+	tb weak.Pointer[LTable]
+	fn weak.Pointer[LFunction]
+	ud weak.Pointer[LUserData]
+	th weak.Pointer[LState]
+}
+
+func (wr lWeakRef) String() string   { return fmt.Sprint(wr.value()) }
+func (wr lWeakRef) Type() LValueType { return wr.value().Type() }
+
+func (wr lWeakRef) value() LValue {
+	if v := wr.tb.Value(); v != nil {
+		return v
+	}
+	if v := wr.fn.Value(); v != nil {
+		return v
+	}
+	if v := wr.ud.Value(); v != nil {
+		return v
+	}
+	if v := wr.th.Value(); v != nil {
+		return v
+	}
+	return LNil
+}
+
+func makeWeakRef(lv LValue) LValue {
+	switch v := lv.(type) {
+	case *LTable:
+		return lWeakRef{tb: weak.Make(v)}
+	case *LFunction:
+		return lWeakRef{fn: weak.Make(v)}
+	case *LUserData:
+		return lWeakRef{ud: weak.Make(v)}
+	case *LState:
+		return lWeakRef{th: weak.Make(v)}
+	}
+	return lv
+}
+
+func strongValue(lv LValue) LValue {
+	if wr, ok := lv.(lWeakRef); ok {
+		return wr.value()
+	}
+	return lv
+}
+
+func weakMode(mt LValue) uint8 {
+	tb, ok := mt.(*LTable)
+	if !ok {
+		return 0
+	}
+	str, ok := tb.RawGetH(LString("__mode")).(LString)
+	if !ok {
+		return 0
+	}
+	var mode uint8
+	if strings.ContainsRune(string(str), 'k') {
+		mode |= weakKeys
+	}
+	if strings.ContainsRune(string(str), 'v') {
+		mode |= weakValues
+	}
+	return mode
+}
+
+func (tb *LTable) weakKey(key LValue) LValue {
+	if tb.weak&weakKeys != 0 {
+		return makeWeakRef(key)
+	}
+	return key
+}
+
+func (tb *LTable) weakValue(value LValue) LValue {
+	if tb.weak&weakValues != 0 {
+		return makeWeakRef(value)
+	}
+	return value
+}
+
+func (tb *LTable) setWeakMode(mode uint8) {
+	if tb.weak == mode {
+		return
+	}
+	old := *tb
+	tb.weak = mode
+	tb.array = make([]LValue, 0, len(old.array))
+	tb.dict = make(map[LValue]LValue, len(old.dict))
+	tb.keys = nil
+	tb.k2i = nil
+	if old.orderIndex != nil {
+		tb.order = make([]LValue, 0, len(old.order))
+		tb.orderIndex = make(map[LValue]int, len(old.order))
+	}
+	for _, value := range old.array {
+		tb.array = append(tb.array, tb.weakValue(strongValue(value)))
+	}
+	old.rangeDict(func(key, value LValue) {
+		key, value = strongValue(key), strongValue(value)
+		if key != LNil && value != LNil {
+			tb.setDict(tb.weakKey(key), tb.weakValue(value))
+		}
+	})
+}
+
+// weakSet is called when a value is set to a weak table. Entries whose keys or
+// values have been collected are removed from time to time.
+func (tb *LTable) weakSet() {
+	tb.weakSets++
+	if tb.weakSets > len(tb.dict)+len(tb.array) && tb.keys == nil {
+		tb.sweep()
+	}
+}
+
+func (tb *LTable) sweep() {
+	tb.weakSets = 0
+	for i, value := range tb.array {
+		if strongValue(value) == LNil {
+			tb.array[i] = LNil
+		}
+	}
+	for key, value := range tb.dict {
+		if strongValue(key) == LNil || strongValue(value) == LNil {
+			delete(tb.dict, key)
+			tb.version++
+		}
+	}
+	if tb.orderIndex != nil {
+		order := tb.order[:0]
+		clear(tb.orderIndex)
+		for _, key := range tb.order {
+			if _, ok := tb.dict[key]; ok {
+				tb.orderIndex[key] = len(order)
+				order = append(order, key)
+			}
+		}
+		clear(tb.order[len(order):])
+		tb.order = order
+	}
+}
+
+func (tb *LTable) rawGetWeak(key LValue) LValue {
+	if v, ok := key.(LNumber); ok && isArrayKey(v) {
+		index := int(v) - 1
+		if index >= len(tb.array) {
+			return LNil
+		}
+		return strongValue(tb.array[index])
+	}
+	if v, ok := tb.dict[tb.weakKey(key)]; ok {
+		return strongValue(v)
+	}
+	return LNil
+}
+
+func (tb *LTable) forEachWeak(cb func(LValue, LValue)) {
+	for i, v := range tb.array {
+		if v = strongValue(v); v != LNil {
+			cb(keyValue(LNumber(i+1)), v)
+		}
+	}
+	tb.rangeDict(func(k, v LValue) {
+		if k, v = strongValue(k), strongValue(v); k != LNil && v != LNil {
+			cb(keyValue(k), v)
+		}
+	})
+}
+
+func (tb *LTable) nextWeak(key LValue, sorted bool) (LValue, LValue) {
+	key = tb.weakKey(key)
+	for {
+		k, v := tb.next(key, sorted)
+		if k == LNil {
+			return LNil, LNil
+		}
+		if sk, sv := strongValue(k), strongValue(v); sk != LNil && sv != LNil {
+			return sk, sv
+		}
+		key = k
+	}
+}
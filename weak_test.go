@@ -0,0 +1,45 @@
+package lua
+
+import (
+	"testing"
+)
+
+func TestWeakTables(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	err := L.DoString(`
+	local function count(t)
+	  local n = 0
+	  for _ in pairs(t) do n = n + 1 end
+	  return n
+	end
+
+	local keep = {}
+	local weakk = setmetatable({}, {__mode = "k"})
+	local weakv = setmetatable({}, {__mode = "v"})
+	local function fill()
+	  for i = 1, 10 do
+	    weakk[{}] = i
+	    weakv[i] = {}
+	  end
+	  weakk[keep] = "kept"
+	  weakv.kept = keep
+	  -- strings and numbers are not collected.
+	  weakv.s = "string"
+	end
+	fill()
+	assert(count(weakk) == 11 and count(weakv) == 12)
+	collectgarbage()
+	collectgarbage()
+	assert(count(weakk) == 1 and weakk[keep] == "kept", count(weakk) .. " keys")
+	assert(count(weakv) == 2 and weakv.kept == keep and weakv.s == "string", count(weakv) .. " values")
+
+	-- values of weak tables are the original objects.
+	local v = {}
+	weakv.x = v
+	assert(rawequal(weakv.x, v) and type(weakv.x) == "table")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}